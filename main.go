@@ -2,14 +2,33 @@ package main
 
 import (
 	"encoding/gob"
+	"html/template"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"todoweb/packages/config"
 	"todoweb/packages/handlers"
+	"todoweb/packages/handlers/admin"
+	"todoweb/packages/handlers/api"
 	"todoweb/packages/handlers/authentication"
+	"todoweb/packages/handlers/invite"
 	"todoweb/packages/handlers/middleware"
+	"todoweb/packages/handlers/oauth"
+	"todoweb/packages/handlers/offline"
+	"todoweb/packages/handlers/socket"
+	"todoweb/packages/handlers/stream"
 	"todoweb/packages/handlers/task"
+	"todoweb/packages/handlers/passkey"
+	"todoweb/packages/handlers/password"
+	"todoweb/packages/handlers/settings"
+	"todoweb/packages/handlers/sso"
+	"todoweb/packages/handlers/twofactor"
+	"todoweb/packages/hub"
+	"todoweb/packages/mailer"
 	"todoweb/packages/utils"
 
 	"github.com/gin-gonic/gin"
@@ -21,6 +40,7 @@ var (
 	router   *gin.Engine
 	database *utils.DataBaseProps
 	store *sessions.CookieStore
+	mail mailer.Mailer
 	host string
 	port string
 )
@@ -28,23 +48,44 @@ var (
 func init() {
 	router = gin.Default()
 	router.Static("/static", "./static")
+	router.SetFuncMap(template.FuncMap{
+		"csrfField": handlers.CSRFField, // {{ csrfField .CSRFToken }} inside every POST form
+		"ssoName": handlers.SSOName, // Name of the single sign-on provider, "" if it is off
+		"rememberMe": handlers.RememberMe, // Whether the login page shows "Remember me"
+	})
 	router.LoadHTMLGlob("templates/*.html")
 
 	store = sessions.NewCookieStore(utils.GenerateRandomKey(32))
 	store.Options = &sessions.Options{
-		Path: "/user",
-		MaxAge: 300,
+		Path: "/", // Cookie is needed both under /user and /api.
+		MaxAge: config.SessionTimeDefault, // Sliding, set to SESSION_IDLE_TIMEOUT below. A longer login is kept by the remember me cookie.
 		HttpOnly: true,
 		Secure: (os.Getenv("ENV") == "production"),
 		SameSite: http.SameSiteLaxMode,
 	}
-	gob.Register(&utils.User{})
+	gob.Register(&utils.Principal{})
+	gob.Register(&utils.User{}) // Only to read cookies of the old format, see handlers.GetUserFromSession.
+	gob.Register(&utils.PendingLogin{})
 
-	err := godotenv.Load("database.env", "host.env")
+	err := godotenv.Load("database.env", "host.env", "app.env")
     if err != nil {
         log.Fatal("Error loading database.env file")
     }
 
+	loadSettings()
+
+	// The cookie and its signed timestamp expire after the idle timeout, middleware.Auth renews both on every request
+	store.MaxAge(handlers.RoutesPointer.Authentication.SessionTime)
+
+	mail = mailer.NewMailer(
+		os.Getenv("MAIL_DRIVER"),
+		os.Getenv("SMTP_HOST"),
+		os.Getenv("SMTP_PORT"),
+		os.Getenv("SMTP_USER"),
+		os.Getenv("SMTP_PASSWORD"),
+		os.Getenv("MAIL_FROM"),
+	)
+
 	dbHost := os.Getenv("DB_HOST")
     dbPort := os.Getenv("DB_PORT")
     dbUser := os.Getenv("DB_USER")
@@ -58,28 +99,334 @@ func init() {
 	if err != nil || database == nil {
 		log.Fatalf("Error connecting to database: %v", err)
 	}
+
+	if err = database.EnsureSchema(); err != nil {
+		log.Fatalf("Error preparing database schema: %v", err)
+	}
+
+	// The first admin can not be made in the console, ADMIN_USERS names them
+	if len(config.Options.AdminUsers) > 0 {
+		promoted, err := database.GrantAdminRole(config.Options.AdminUsers)
+		if err != nil {
+			log.Fatalf("Error granting admin role: %v", err)
+		}
+		if promoted > 0 {
+			log.Printf("Granted admin role to %d users from ADMIN_USERS\n", promoted)
+		}
+	}
+}
+
+// loadSettings overrides config.Options with values from app.env, invalid values keep the defaults
+func loadSettings() {
+	durations := map[string]*time.Duration{
+		"IDEMPOTENCY_WINDOW": &config.Options.IdempotencyWindow,
+		"PASSWORD_RESET_TTL": &config.Options.PasswordResetTTL,
+		"EMAIL_VERIFICATION_TTL": &config.Options.EmailVerificationTTL,
+		"LOGIN_LOCKOUT_BASE": &config.Options.LoginLockoutBase,
+		"LOGIN_LOCKOUT_MAX": &config.Options.LoginLockoutMax,
+		"ACCOUNT_DELETION_GRACE": &config.Options.AccountDeletionGrace,
+		"OAUTH_ACCESS_TOKEN_TTL": &config.Options.OAuthAccessTokenTTL,
+		"OAUTH_REFRESH_TOKEN_TTL": &config.Options.OAuthRefreshTokenTTL,
+		"INVITE_MAX_TTL": &config.Options.InviteMaxTTL,
+		"REMEMBER_ME_TTL": &config.Options.RememberMeTTL,
+		"SESSION_IDLE_TIMEOUT": &config.Options.SessionIdleTimeout,
+		"SESSION_MAX_LIFETIME": &config.Options.SessionMaxLifetime,
+		"SUDO_MODE_TTL": &config.Options.SudoModeTTL,
+		"SECURITY_EVENT_RETENTION": &config.Options.SecurityEventRetention,
+	}
+	for key, target := range durations {
+		if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+			*target = value
+		} else if os.Getenv(key) != "" {
+			log.Printf("Invalid %s, using default %s\n", key, *target)
+		}
+	}
+
+	// 0 turns the maximum lifetime off, the idle timeout and sudo mode need a positive duration
+	if config.Options.SessionIdleTimeout < time.Second {
+		log.Printf("Invalid SESSION_IDLE_TIMEOUT, using default %s\n", config.SessionTimeDefault*time.Second)
+		config.Options.SessionIdleTimeout = config.SessionTimeDefault * time.Second
+	}
+	if config.Options.SudoModeTTL <= 0 {
+		log.Printf("Invalid SUDO_MODE_TTL, using default %s\n", 10*time.Minute)
+		config.Options.SudoModeTTL = 10 * time.Minute
+	}
+	config.Routes.Authentication.SessionTime = int(config.Options.SessionIdleTimeout.Seconds())
+
+	if baseURL := os.Getenv("BASE_URL"); baseURL != "" {
+		config.Options.BaseURL = baseURL
+	}
+
+	bools := map[string]*bool{
+		"REQUIRE_EMAIL_VERIFICATION": &config.Options.RequireEmailVerification,
+		"PASSWORD_REQUIRE_LETTER": &config.Options.PasswordRequireLetter,
+		"PASSWORD_REQUIRE_UPPER": &config.Options.PasswordRequireUpper,
+		"PASSWORD_REQUIRE_LOWER": &config.Options.PasswordRequireLower,
+		"PASSWORD_REQUIRE_DIGIT": &config.Options.PasswordRequireDigit,
+		"PASSWORD_REQUIRE_SYMBOL": &config.Options.PasswordRequireSymbol,
+		"PASSWORD_ALLOW_SPACES": &config.Options.PasswordAllowSpaces,
+		"OIDC_AUTO_PROVISION": &config.Options.OIDCAutoProvision,
+		"USER_INVITES": &config.Options.UserInvites,
+	}
+	for key, target := range bools {
+		if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+			*target = value
+		} else if os.Getenv(key) != "" {
+			log.Printf("Invalid %s, using default %t\n", key, *target)
+		}
+	}
+
+	numbers := map[string]*int{
+		"LOGIN_MAX_FAILURES": &config.Options.LoginMaxFailures,
+		"LOGIN_IP_MAX_FAILURES": &config.Options.LoginIPMaxFailures,
+		"ARGON2_MEMORY": &config.Options.Argon2Memory,
+		"ARGON2_ITERATIONS": &config.Options.Argon2Iterations,
+		"ARGON2_PARALLELISM": &config.Options.Argon2Parallelism,
+		"PASSWORD_MIN_LENGTH": &config.Options.PasswordMinLength,
+		"PASSWORD_MAX_LENGTH": &config.Options.PasswordMaxLength,
+		"INVITE_MAX_USES": &config.Options.InviteMaxUses,
+	}
+	for key, target := range numbers {
+		if value, err := strconv.Atoi(os.Getenv(key)); err == nil && value > 0 {
+			*target = value
+		} else if os.Getenv(key) != "" {
+			log.Printf("Invalid %s, using default %d\n", key, *target)
+		}
+	}
+
+	if config.Options.Argon2Parallelism > 255 {
+		log.Printf("Invalid ARGON2_PARALLELISM, using default %d\n", utils.DefaultArgon2Params.Parallelism)
+		config.Options.Argon2Parallelism = int(utils.DefaultArgon2Params.Parallelism)
+	}
+
+	// 0 is a valid strength, so it is not part of the numbers above
+	if strength, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_STRENGTH")); err == nil && strength >= 0 && strength <= 4 {
+		config.Options.PasswordMinStrength = strength
+	} else if os.Getenv("PASSWORD_MIN_STRENGTH") != "" {
+		log.Printf("Invalid PASSWORD_MIN_STRENGTH, using default %d\n", config.Options.PasswordMinStrength)
+	}
+
+	config.Options.BreachedPasswordsFile = os.Getenv("BREACHED_PASSWORDS_FILE")
+
+	texts := map[string]*string{
+		"OIDC_ISSUER": &config.Options.OIDCIssuer,
+		"OIDC_CLIENT_ID": &config.Options.OIDCClientID,
+		"OIDC_CLIENT_SECRET": &config.Options.OIDCClientSecret,
+		"OIDC_REDIRECT_URL": &config.Options.OIDCRedirectURL,
+		"OIDC_PROVIDER_NAME": &config.Options.OIDCProviderName,
+		"REGISTRATION_MODE": &config.Options.RegistrationMode,
+	}
+	for key, target := range texts {
+		if value := os.Getenv(key); value != "" {
+			*target = value
+		}
+	}
+	if config.Options.OIDCIssuer != "" && config.Options.OIDCClientID == "" {
+		log.Fatal("OIDC_ISSUER is set without OIDC_CLIENT_ID")
+	}
+
+	for _, username := range strings.Split(os.Getenv("ADMIN_USERS"), ",") {
+		if username = strings.TrimSpace(username); username != "" {
+			config.Options.AdminUsers = append(config.Options.AdminUsers, username)
+		}
+	}
+
+	if domains := os.Getenv("ALLOWED_EMAIL_DOMAINS"); domains != "" {
+		config.Options.AllowedEmailDomains = strings.Split(domains, ",")
+	}
+	err := utils.SetRegistrationPolicy(utils.RegistrationPolicy{
+		Mode: config.Options.RegistrationMode,
+		AllowedDomains: config.Options.AllowedEmailDomains,
+	})
+	if err != nil {
+		log.Fatalf("Invalid REGISTRATION_MODE: %v", err)
+	}
+
+	policy := utils.PasswordPolicy{
+		MinLength: config.Options.PasswordMinLength,
+		MaxLength: config.Options.PasswordMaxLength,
+		RequireLetter: config.Options.PasswordRequireLetter,
+		RequireUpper: config.Options.PasswordRequireUpper,
+		RequireLower: config.Options.PasswordRequireLower,
+		RequireDigit: config.Options.PasswordRequireDigit,
+		RequireSymbol: config.Options.PasswordRequireSymbol,
+		AllowSpaces: config.Options.PasswordAllowSpaces,
+		MinStrength: config.Options.PasswordMinStrength,
+	}
+	if config.Options.BreachedPasswordsFile != "" {
+		list, err := utils.OpenBreachedPasswordList(config.Options.BreachedPasswordsFile)
+		if err != nil {
+			log.Fatalf("Error opening BREACHED_PASSWORDS_FILE: %v", err)
+		}
+		policy.Breached = list
+	}
+	utils.SetPasswordPolicy(policy)
+
+	// New password hashes use these parameters, older hashes are replaced at the next login
+	utils.SetPasswordHasher(utils.NewArgon2idHasher(utils.Argon2Params{
+		Memory: uint32(config.Options.Argon2Memory),
+		Iterations: uint32(config.Options.Argon2Iterations),
+		Parallelism: uint8(config.Options.Argon2Parallelism),
+	}))
+}
+
+// How often accounts past their deletion grace period are removed
+const purgeInterval = time.Hour
+
+// Recorded sessions unused for this long are removed, their cookies expired long before
+const userSessionRetention = 24 * time.Hour
+
+// purgeDeletedAccounts removes accounts whose deletion grace period ended, once at start and then every purgeInterval.
+// Old rows of user_sessions, expired remember me tokens and security events past their retention are removed in the same run.
+func purgeDeletedAccounts() {
+	for {
+		if deleted, err := database.PurgeDeletedAccounts(time.Now()); err != nil {
+			log.Printf("Account purge error: %v\n", err)
+		} else if deleted > 0 {
+			log.Printf("Deleted %d accounts\n", deleted)
+		}
+
+		if _, err := database.PurgeUserSessions(time.Now().Add(-userSessionRetention)); err != nil {
+			log.Printf("User session purge error: %v\n", err)
+		}
+
+		if _, err := database.PurgeRememberTokens(time.Now()); err != nil {
+			log.Printf("Remember token purge error: %v\n", err)
+		}
+
+		if config.Options.SecurityEventRetention > 0 {
+			if _, err := database.PurgeSecurityEvents(time.Now().Add(-config.Options.SecurityEventRetention)); err != nil {
+				log.Printf("Security event purge error: %v\n", err)
+			}
+		}
+
+		time.Sleep(purgeInterval)
+	}
 }
 
 func main() {
-	AuthenticationHandlers := authentication.NewAuthenticationHandler(database, store)
-	TaskHandlers := task.NewTaskHandler(database, store)
-	MiddlewareHandlers := middleware.NewMiddlewareHandler(store)
+	AuthenticationHandlers := authentication.NewAuthenticationHandler(database, store, mail)
+	EventHub := hub.NewHub()
+	TaskHandlers := task.NewTaskHandler(database, store, EventHub)
+	StreamHandlers := stream.NewStreamHandler(database, store, EventHub)
+	SocketHandlers := socket.NewSocketHandler(database, store, EventHub)
+	SyncHandlers := offline.NewSyncHandler(database, store, EventHub)
+	TaskAPIHandlers := api.NewTaskAPIHandler(database, store, EventHub)
+	MiddlewareHandlers := middleware.NewMiddlewareHandler(store, database)
+	router.Use(MiddlewareHandlers.CSRF) // Before any route, so every POST is checked.
+	PasswordHandlers := password.NewPasswordHandler(database, mail)
+	TwoFactorHandlers := twofactor.NewTwoFactorHandler(database, store)
+	SettingsHandlers := settings.NewSettingsHandler(database, store)
+	OAuthHandlers := oauth.NewOAuthHandler(database, store)
+	AdminHandlers := admin.NewAdminHandler(database, store, mail)
+	InviteHandlers := invite.NewInviteHandler(database, store)
+
+	webAuthn, err := passkey.NewWebAuthn(config.Options.BaseURL)
+	if err != nil {
+		log.Fatalf("Error configuring passkeys: %v", err)
+	}
+	PasskeyHandlers := passkey.NewPasskeyHandler(database, store, webAuthn)
+
+	// Single sign-on routes exist only if an issuer is configured
+	if provider := sso.NewProvider(config.Options); provider != nil {
+		SSOHandlers := sso.NewSSOHandler(database, store, provider, config.Options.OIDCAutoProvision)
+		router.GET(handlers.RoutesPointer.SSO.Path, SSOHandlers.GetStart)
+		router.GET(handlers.RoutesPointer.SSO.RedirectPath, SSOHandlers.GetCallback)
+	}
 
 	router.GET(handlers.RoutesPointer.MainLoginConfig.EmptyPathString, AuthenticationHandlers.GetEmptyPath)
 	router.GET("/login", AuthenticationHandlers.GetLogin)
 	router.POST("/login", AuthenticationHandlers.PostLogin)
+	router.GET("/login/2fa", TwoFactorHandlers.GetLoginCode)
+	router.POST("/login/2fa", TwoFactorHandlers.PostLoginCode)
+	router.POST("/login/2fa/passkey/begin", PasskeyHandlers.PostSecondStepBegin)
+	router.POST("/login/2fa/passkey/finish", PasskeyHandlers.PostSecondStepFinish)
+	router.POST("/login/passkey/begin", PasskeyHandlers.PostLoginBegin)
+	router.POST("/login/passkey/finish", PasskeyHandlers.PostLoginFinish)
 	router.GET("/register", AuthenticationHandlers.GetRegister)
 	router.POST("/register", AuthenticationHandlers.PostRegister)
+	router.GET("/verify", AuthenticationHandlers.GetVerifyEmail)
+	router.POST("/verify/resend", AuthenticationHandlers.PostResendVerification)
+	router.GET("/forgot", PasswordHandlers.GetForgot)
+	router.POST("/forgot", PasswordHandlers.PostForgot)
+	router.GET("/reset", PasswordHandlers.GetReset)
+	router.POST("/reset", PasswordHandlers.PostReset)
+	router.GET(handlers.RoutesPointer.OAuth.Authorize, OAuthHandlers.GetAuthorize)
+	router.POST(handlers.RoutesPointer.OAuth.Authorize, OAuthHandlers.PostAuthorize)
+	router.POST(handlers.RoutesPointer.OAuth.Token, OAuthHandlers.PostToken)
+	router.POST(handlers.RoutesPointer.OAuth.Introspect, OAuthHandlers.PostIntrospect)
+	router.POST(handlers.RoutesPointer.OAuth.Revoke, OAuthHandlers.PostRevoke)
+	router.StaticFile("/sw.js", "./static/sw.js") // Served from the root so the worker controls every page.
+
+	// Sensitive changes need the password entered again recently, besides a valid session (sudo mode)
+	sudo := MiddlewareHandlers.RequireRecentAuth
 
 	userRoutes := router.Group("/user", MiddlewareHandlers.Auth)
 	{
 		userRoutes.GET("/tasks", TaskHandlers.GetTasks)
 		userRoutes.POST("/addTask", TaskHandlers.CreateTask)
 		userRoutes.POST("/deleteTask", TaskHandlers.DeleteTask)
+		userRoutes.POST("/updateTask", TaskHandlers.UpdateTask)
+		userRoutes.POST("/completeTask", TaskHandlers.CompleteTask)
+		userRoutes.GET("/task/:id", TaskHandlers.GetTask)
+		userRoutes.GET("/activity", TaskHandlers.GetActivity)
+		userRoutes.GET("/events", StreamHandlers.GetEvents)
+		userRoutes.GET("/ws", SocketHandlers.Connect)
+		userRoutes.POST("/bulkTasks", TaskHandlers.BulkTasks)
+		userRoutes.GET("/2fa", TwoFactorHandlers.GetSettings)
+		userRoutes.POST("/2fa/setup", sudo, TwoFactorHandlers.PostSetup)
+		userRoutes.POST("/2fa/confirm", sudo, TwoFactorHandlers.PostConfirm)
+		userRoutes.POST("/2fa/disable", sudo, TwoFactorHandlers.PostDisable)
+		userRoutes.GET("/passkeys", PasskeyHandlers.GetPasskeys)
+		userRoutes.POST("/passkeys/register/begin", sudo, PasskeyHandlers.PostRegisterBegin)
+		userRoutes.POST("/passkeys/register/finish", sudo, PasskeyHandlers.PostRegisterFinish)
+		userRoutes.POST("/passkeys/delete", sudo, PasskeyHandlers.PostDelete)
+		userRoutes.POST("/passkeys/2fa", sudo, PasskeyHandlers.PostSecondFactor)
+		userRoutes.GET("/settings", SettingsHandlers.GetSettings)
+		userRoutes.POST("/settings/password", sudo, SettingsHandlers.PostPassword)
+		userRoutes.POST("/settings/username", sudo, SettingsHandlers.PostUsername)
+		userRoutes.POST("/settings/delete", sudo, SettingsHandlers.PostDelete)
+		userRoutes.POST("/settings/delete/cancel", SettingsHandlers.PostCancelDelete)
+		userRoutes.GET("/settings/export", sudo, SettingsHandlers.GetExport)
+		userRoutes.GET("/apps", OAuthHandlers.GetApps)
+		userRoutes.POST("/apps/register", OAuthHandlers.PostRegisterApp)
+		userRoutes.POST("/apps/delete", OAuthHandlers.PostDeleteApp)
+		userRoutes.POST("/apps/revoke", OAuthHandlers.PostRevokeApp)
+		userRoutes.GET("/invites", InviteHandlers.GetInvites)
+		userRoutes.POST("/invites/create", InviteHandlers.PostCreate)
+		userRoutes.POST("/invites/revoke", InviteHandlers.PostRevoke)
+		userRoutes.GET("/reauth", SettingsHandlers.GetReauth)
+		userRoutes.POST("/reauth", SettingsHandlers.PostReauth)
+		userRoutes.GET("/security", SettingsHandlers.GetSecurity)
 		userRoutes.POST("/logout", MiddlewareHandlers.Logout)
 	}
 
-	err := router.Run(host + ":" + port)
+	adminRoutes := router.Group(handlers.RoutesPointer.Admin.Route, MiddlewareHandlers.Auth, MiddlewareHandlers.RequireRole(utils.RoleAdmin))
+	{
+		adminRoutes.GET("", AdminHandlers.GetConsole)
+		adminRoutes.GET(handlers.RoutesPointer.AdminEvents.Route, AdminHandlers.GetEvents)
+		adminRoutes.POST("/users/disable", sudo, AdminHandlers.PostDisable)
+		adminRoutes.POST("/users/enable", sudo, AdminHandlers.PostEnable)
+		adminRoutes.POST("/users/logout", sudo, AdminHandlers.PostLogout)
+		adminRoutes.POST("/users/reset", sudo, AdminHandlers.PostPasswordReset)
+		adminRoutes.POST("/users/role", sudo, AdminHandlers.PostRole)
+	}
+
+	apiRoutes := router.Group(handlers.RoutesPointer.API.Route, MiddlewareHandlers.APIAuth)
+	{
+		apiRoutes.GET("/sync", SyncHandlers.Pull)
+		apiRoutes.POST("/sync", SyncHandlers.Push)
+		apiRoutes.GET("/tasks", TaskAPIHandlers.ListTasks)
+		apiRoutes.POST("/tasks", TaskAPIHandlers.CreateTask)
+		apiRoutes.GET("/tasks/:id", TaskAPIHandlers.GetTask)
+		apiRoutes.PATCH("/tasks/:id", TaskAPIHandlers.UpdateTask)
+		apiRoutes.DELETE("/tasks/:id", TaskAPIHandlers.DeleteTask)
+		apiRoutes.POST("/tasks/bulk", TaskAPIHandlers.BulkTasks)
+	}
+
+	go purgeDeletedAccounts()
+
+	err = router.Run(host + ":" + port)
 	if err != nil {
 		log.Printf("Server running on %s:%s\n Error : %v", host, port, err)
 	}
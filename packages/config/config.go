@@ -1,5 +1,7 @@
 package config
 
+import "time"
+
 const (
 	SessionTimeDefault = 300
 	SessionTimeExpireTime = -1
@@ -16,12 +18,30 @@ type ParseKeys struct {
 	UsernameParseKey string
 	PasswordParseKey string
 	RePasswordParseKey string
+	EmailParseKey string
+	CodeParseKey string
+	CurrentPasswordParseKey string
+	InviteParseKey string
+	RememberParseKey string
 }
 
 type UserRouteConfig struct {
 	GetTask TasksConfig
 	DeleteTask TasksConfig
 	CreateTask TasksConfig
+	UpdateTask TasksConfig
+	CompleteTask TasksConfig
+	TaskDetail TasksConfig
+	Activity TasksConfig
+	Events TasksConfig
+	Socket TasksConfig
+	BulkTasks TasksConfig
+	TwoFactor TasksConfig
+	Passkeys TasksConfig
+	Settings TasksConfig
+	Invites TasksConfig
+	Reauth TasksConfig // Asks for the password again before sensitive settings (sudo mode).
+	Security TasksConfig // Recent security events of the user.
 	Route string
 }
 
@@ -31,17 +51,19 @@ type AuthPageConfig struct {
 	RedirectPath   string
 	EmptyPathString string
 	ParseKeys
-	SessionTime int // 300 default
+	SessionTime int // 300 default, set from Settings.SessionIdleTimeout at start
 	SessionTimeOut int
 }
 
 type Cookie struct {
 	Naming string
 	UserInfoKey string
+	PendingLoginKey string // Holds utils.PendingLogin between password and code steps
+	RememberNaming string // Separate long-lived cookie with the remember me token, see handlers.RememberUserSession
 }
 
-func NewCookie (name string, key string) Cookie {
-	return Cookie{name, key};
+func NewCookie (name string, key string, pendingKey string, rememberName string) Cookie {
+	return Cookie{name, key, pendingKey, rememberName};
 }
 
 func NewParseKeys () ParseKeys {
@@ -49,15 +71,55 @@ func NewParseKeys () ParseKeys {
 		UsernameParseKey: "uname",
 		PasswordParseKey: "pword",
 		RePasswordParseKey: "re-pword",
+		EmailParseKey: "email",
+		CodeParseKey: "code",
+		CurrentPasswordParseKey: "current-pword",
+		InviteParseKey: "invite",
+		RememberParseKey: "remember",
 	}
 }
 
+// CSRFConfig names the places the CSRF token is kept and read from
+type CSRFConfig struct {
+	SessionKey string // Key of the token in the session.
+	FormField string // Hidden input of HTML forms.
+	Header string // Header used by fetch requests.
+	TemplateKey string // Template data key, used as {{ csrfField .CSRFToken }}.
+	ExemptPaths []string // Endpoints called by other servers with client credentials instead of the session cookie.
+}
+
+type APIRouteConfig struct {
+	Route string
+	Sync string
+	Tasks string
+}
+
+// OAuthRouteConfig holds the endpoints of the OAuth authorization server
+type OAuthRouteConfig struct {
+	Authorize string
+	Token string
+	Introspect string
+	Revoke string
+	ConsentPageName string
+	Apps TasksConfig // Page listing registered clients and authorized applications.
+}
+
 type RouteConfig struct {
 	UserConfig UserRouteConfig
 	MainLoginConfig AuthPageConfig
 	MainRegisterConfig AuthPageConfig
 	MainLogoutConfig AuthPageConfig
+	ForgotPasswordConfig AuthPageConfig
+	ResetPasswordConfig AuthPageConfig
+	VerifyEmailConfig AuthPageConfig
+	TwoFactorLoginConfig AuthPageConfig
+	SSO AuthPageConfig // Path starts single sign-on, RedirectPath is the callback registered at the provider.
+	OAuth OAuthRouteConfig
+	Admin TasksConfig // Admin console, only for users with the admin role.
+	AdminEvents TasksConfig // Security event log of the admin console, Route is below Admin.Route.
 	Authentication AuthPageConfig
+	API APIRouteConfig
+	CSRF CSRFConfig
 	Cookie
 }
 
@@ -79,6 +141,75 @@ var Routes *RouteConfig = &RouteConfig{
 			RedirectPath: "/user/tasks",
 		},
 
+		UpdateTask: TasksConfig{
+			Route: "/user/updateTask",
+			RedirectPath: "/user/task/",
+		},
+
+		CompleteTask: TasksConfig{
+			Route: "/user/completeTask",
+			RedirectPath: "/user/tasks",
+		},
+
+		TaskDetail: TasksConfig{
+			Route: "/user/task/:id",
+			HTMLPageName: "taskDetail.html",
+			RedirectPath: "/user/tasks",
+		},
+
+		Activity: TasksConfig{
+			Route: "/user/activity",
+		},
+
+		Events: TasksConfig{
+			Route: "/user/events",
+		},
+
+		Socket: TasksConfig{
+			Route: "/user/ws",
+		},
+
+		BulkTasks: TasksConfig{
+			Route: "/user/bulkTasks",
+			RedirectPath: "/user/tasks",
+		},
+
+		TwoFactor: TasksConfig{
+			Route: "/user/2fa",
+			HTMLPageName: "twoFactor.html",
+			RedirectPath: "/user/2fa",
+		},
+
+		Passkeys: TasksConfig{
+			Route: "/user/passkeys",
+			HTMLPageName: "passkeys.html",
+			RedirectPath: "/user/passkeys",
+		},
+
+		Settings: TasksConfig{
+			Route: "/user/settings",
+			HTMLPageName: "settings.html",
+			RedirectPath: "/user/settings",
+		},
+
+		Invites: TasksConfig{
+			Route: "/user/invites",
+			HTMLPageName: "invites.html",
+			RedirectPath: "/user/invites",
+		},
+
+		Reauth: TasksConfig{
+			Route: "/user/reauth",
+			HTMLPageName: "reauth.html",
+			RedirectPath: "/user/reauth",
+		},
+
+		Security: TasksConfig{
+			Route: "/user/security",
+			HTMLPageName: "security.html",
+			RedirectPath: "/user/security",
+		},
+
 		Route: "/user",
 	},
 
@@ -100,6 +231,62 @@ var Routes *RouteConfig = &RouteConfig{
 		RedirectPath: "/login",
 	},
 
+	ForgotPasswordConfig: AuthPageConfig{
+		PageName: "forgotPassword.html",
+		Path: "/forgot",
+		ParseKeys: NewParseKeys(),
+	},
+
+	ResetPasswordConfig: AuthPageConfig{
+		PageName: "resetPassword.html",
+		Path: "/reset",
+		RedirectPath: "/login",
+		ParseKeys: NewParseKeys(),
+	},
+
+	VerifyEmailConfig: AuthPageConfig{
+		PageName: "verifyEmail.html",
+		Path: "/verify",
+		ParseKeys: NewParseKeys(),
+	},
+
+	TwoFactorLoginConfig: AuthPageConfig{
+		PageName: "loginCode.html",
+		Path: "/login/2fa",
+		RedirectPath: "/login",
+		ParseKeys: NewParseKeys(),
+	},
+
+	SSO: AuthPageConfig{
+		Path: "/login/oidc",
+		RedirectPath: "/login/oidc/callback",
+	},
+
+	OAuth: OAuthRouteConfig{
+		Authorize: "/oauth/authorize",
+		Token: "/oauth/token",
+		Introspect: "/oauth/introspect",
+		Revoke: "/oauth/revoke",
+		ConsentPageName: "consent.html",
+		Apps: TasksConfig{
+			Route: "/user/apps",
+			HTMLPageName: "apps.html",
+			RedirectPath: "/user/apps",
+		},
+	},
+
+	Admin: TasksConfig{
+		Route: "/admin",
+		HTMLPageName: "admin.html",
+		RedirectPath: "/admin",
+	},
+
+	AdminEvents: TasksConfig{
+		Route: "/events",
+		HTMLPageName: "adminEvents.html",
+		RedirectPath: "/admin/events",
+	},
+
 	Authentication: AuthPageConfig{
 		RedirectPath: "/logout",
 		SessionTime: SessionTimeDefault,
@@ -107,7 +294,100 @@ var Routes *RouteConfig = &RouteConfig{
 		ParseKeys: NewParseKeys(),
 	},
 
-	Cookie: NewCookie("loginSession", "user"),
+	API: APIRouteConfig{
+		Route: "/api/v1",
+		Sync: "/api/v1/sync",
+		Tasks: "/api/v1/tasks",
+	},
+
+	CSRF: CSRFConfig{
+		SessionKey: "csrfToken",
+		FormField: "csrf_token",
+		Header: "X-CSRF-Token",
+		TemplateKey: "CSRFToken",
+		ExemptPaths: []string{"/oauth/token", "/oauth/introspect", "/oauth/revoke"},
+	},
+
+	Cookie: NewCookie("loginSession", "user", "pendingLogin", "rememberMe"),
 }
 
-// hard coded part should be improved by more readible coding
\ No newline at end of file
+// hard coded part should be improved by more readible coding
+
+// Settings holds options that can be changed through app.env, see main.init
+type Settings struct {
+	IdempotencyWindow time.Duration // How long idempotency keys of task creation are remembered.
+	PasswordResetTTL time.Duration // How long a password reset link is valid.
+	BaseURL string // Scheme and host used in links sent by email.
+	EmailVerificationTTL time.Duration // How long an email verification link is valid.
+	RequireEmailVerification bool // If true, users with unverified email can not log in.
+	LoginMaxFailures int // Failed logins of one username before it is locked.
+	LoginIPMaxFailures int // Failed logins from one address before it is locked.
+	LoginLockoutBase time.Duration // First lock, doubled with every further failure.
+	LoginLockoutMax time.Duration // Longest lock.
+	AccountDeletionGrace time.Duration // Time between a deletion request and the removal of the account.
+	Argon2Memory int // Memory of new password hashes in KiB.
+	Argon2Iterations int // Passes over the memory.
+	Argon2Parallelism int // Lanes, at most 255.
+	PasswordMinLength int
+	PasswordMaxLength int
+	PasswordRequireLetter bool // Latin letter.
+	PasswordRequireUpper bool
+	PasswordRequireLower bool
+	PasswordRequireDigit bool
+	PasswordRequireSymbol bool
+	PasswordAllowSpaces bool
+	PasswordMinStrength int // zxcvbn score 0-4, 0 turns the check off.
+	BreachedPasswordsFile string // Sorted "SHA1:COUNT" list, empty turns the check off.
+	OIDCIssuer string // OpenID Connect issuer URL, empty turns single sign-on off.
+	OIDCClientID string
+	OIDCClientSecret string
+	OIDCRedirectURL string // Callback registered at the provider, BaseURL + "/login/oidc/callback" if empty.
+	OIDCProviderName string // Shown on the login button.
+	OIDCAutoProvision bool // If true, unknown provider users get a new account at their first login.
+	OAuthAccessTokenTTL time.Duration // Lifetime of access tokens issued to OAuth clients.
+	OAuthRefreshTokenTTL time.Duration // Lifetime of refresh tokens, each refresh issues a new one.
+	AdminUsers []string // Usernames given the admin role at start.
+	RegistrationMode string // utils.Registration* mode: open, invite, domains or closed.
+	AllowedEmailDomains []string // Domains that register without an invite in the domains mode.
+	UserInvites bool // If true, every user can create invites, otherwise only admins.
+	InviteMaxUses int // Most accounts one invite of a user can create, admins are not limited.
+	InviteMaxTTL time.Duration // Longest validity of an invite.
+	RememberMeTTL time.Duration // How long an unused remember me token restores the login, 0 hides the checkbox.
+	SessionIdleTimeout time.Duration // Session ends after this long without a request.
+	SessionMaxLifetime time.Duration // Session ends this long after it started however active it is, 0 turns the limit off.
+	SudoModeTTL time.Duration // How long entering the password again allows sensitive settings changes.
+	SecurityEventRetention time.Duration // Security events older than this are removed, 0 keeps them.
+}
+
+// Options are the current settings, fields keep their defaults unless overridden in app.env
+var Options *Settings = &Settings{
+	IdempotencyWindow: 24 * time.Hour,
+	PasswordResetTTL: time.Hour,
+	BaseURL: "http://localhost:8080",
+	EmailVerificationTTL: 48 * time.Hour,
+	RequireEmailVerification: true,
+	LoginMaxFailures: 5,
+	LoginIPMaxFailures: 50,
+	LoginLockoutBase: time.Minute,
+	LoginLockoutMax: time.Hour,
+	AccountDeletionGrace: 7 * 24 * time.Hour,
+	Argon2Memory: 64 * 1024,
+	Argon2Iterations: 3,
+	Argon2Parallelism: 2,
+	PasswordMinLength: 8,
+	PasswordMaxLength: 64,
+	PasswordRequireLetter: true,
+	PasswordRequireDigit: true,
+	OIDCProviderName: "SSO",
+	OIDCAutoProvision: true,
+	OAuthAccessTokenTTL: time.Hour,
+	OAuthRefreshTokenTTL: 30 * 24 * time.Hour,
+	RegistrationMode: "open",
+	InviteMaxUses: 5,
+	InviteMaxTTL: 30 * 24 * time.Hour,
+	RememberMeTTL: 30 * 24 * time.Hour,
+	SessionIdleTimeout: SessionTimeDefault * time.Second,
+	SessionMaxLifetime: 24 * time.Hour,
+	SudoModeTTL: 10 * time.Minute,
+	SecurityEventRetention: 365 * 24 * time.Hour,
+}
@@ -0,0 +1,295 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"todoweb/packages/handlers"
+	"todoweb/packages/handlers/password"
+	"todoweb/packages/mailer"
+	"todoweb/packages/utils"
+)
+
+// Users shown on one page of the console
+const pageSize = 25
+
+// Events shown on one page of the event log
+const eventPageSize = 50
+
+// Form of the from and to dates of the event log, to includes the whole day
+const eventDateLayout = "2006-01-02"
+
+// AdminHandlers defines the interface for the admin console.
+// The routes are behind Auth and RequireRole(utils.RoleAdmin), see main.
+type AdminHandlers interface {
+	GetConsole(c *gin.Context)        // Renders stats and the user list, "q" searches and "page" pages.
+	GetEvents(c *gin.Context)         // Renders the security event log filtered by user, event, ip, from and to.
+	PostDisable(c *gin.Context)       // Disables an account and logs it out.
+	PostEnable(c *gin.Context)        // Enables a disabled account.
+	PostLogout(c *gin.Context)        // Logs out every session and OAuth token of a user.
+	PostPasswordReset(c *gin.Context) // Refuses the current password and emails a reset link.
+	PostRole(c *gin.Context)          // Changes the role of a user.
+}
+
+// adminHandlerProps holds dependencies for admin handlers.
+type adminHandlerProps struct {
+	Database *utils.DataBaseProps  // Database connection properties.
+	Store    *sessions.CookieStore // Cookie store for session management.
+	Mailer   mailer.Mailer         // Sends reset links.
+}
+
+// renderConsole renders the console with the page of users matching search, data may hold a message or an error.
+// Action forms send "q" and "page" back, so the admin stays on the same list.
+func (prop *adminHandlerProps) renderConsole(c *gin.Context, status int, admin *utils.Principal, search string, page int, data gin.H) {
+	if page < 1 {
+		page = 1
+	}
+
+	users, total, err := prop.Database.ListUsers(search, pageSize, (page-1)*pageSize)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// A session counts as active while its cookie can still be alive, the row is written at most once per touch interval
+	activeSince := time.Now().Add(-time.Duration(handlers.RoutesPointer.Authentication.SessionTime)*time.Second - utils.UserSessionTouchInterval)
+	stats, err := prop.Database.GetAdminStats(activeSince)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	data["Username"] = admin.Username
+	data["AdminID"] = admin.ID
+	data["Stats"] = stats
+	data["Users"] = users
+	data["Roles"] = utils.Roles
+	data["Search"] = search
+	data["Page"] = page
+	data["Total"] = total
+	if page > 1 {
+		data["PreviousPage"] = page - 1
+	}
+	if page*pageSize < total {
+		data["NextPage"] = page + 1
+	}
+
+	handlers.RenderHTML(c, status, handlers.RoutesPointer.Admin.HTMLPageName, data)
+}
+
+// GetConsole renders the admin console.
+func (prop *adminHandlerProps) GetConsole(c *gin.Context) {
+	admin, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	prop.renderConsole(c, http.StatusOK, admin, utils.TrimSpace(c.Query("q")), utils.StrToInt(c.Query("page")), gin.H{})
+}
+
+// GetEvents renders the security event log with the entries matching the query, newest first.
+// The filter stays in the form and the page links, so "Next" keeps it.
+func (prop *adminHandlerProps) GetEvents(c *gin.Context) {
+	admin, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	query := url.Values{}
+	for _, key := range []string{"user", "event", "ip", "from", "to"} {
+		if value := utils.TrimSpace(c.Query(key)); value != "" {
+			query.Set(key, value)
+		}
+	}
+
+	filter := utils.SecurityEventFilter{
+		Username: query.Get("user"),
+		Event:    query.Get("event"),
+		IP:       query.Get("ip"),
+	}
+
+	data := gin.H{
+		"Username": admin.Username,
+		"Filter":   query,
+		"Events":   utils.AuditEvents,
+	}
+
+	var err error
+	if from := query.Get("from"); from != "" {
+		filter.Since, err = time.ParseInLocation(eventDateLayout, from, time.Local)
+	}
+	if to := query.Get("to"); to != "" && err == nil {
+		filter.Until, err = time.ParseInLocation(eventDateLayout, to, time.Local)
+		filter.Until = filter.Until.AddDate(0, 0, 1)
+	}
+	if err != nil {
+		data[utils.ErrorAdminHTML] = utils.AdminEventDateInvalid
+		handlers.RenderHTML(c, http.StatusBadRequest, handlers.RoutesPointer.AdminEvents.HTMLPageName, data)
+		return
+	}
+
+	page := utils.StrToInt(c.Query("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	entries, total, err := prop.Database.ListSecurityEvents(filter, eventPageSize, (page-1)*eventPageSize)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// Page links keep the filter
+	link := func(page int) string {
+		query.Set("page", strconv.Itoa(page))
+		return handlers.RoutesPointer.AdminEvents.RedirectPath + "?" + query.Encode()
+	}
+
+	data["Entries"] = entries
+	data["Total"] = total
+	if page > 1 {
+		data["PreviousPage"] = link(page - 1)
+	}
+	if page*eventPageSize < total {
+		data["NextPage"] = link(page + 1)
+	}
+
+	handlers.RenderHTML(c, http.StatusOK, handlers.RoutesPointer.AdminEvents.HTMLPageName, data)
+}
+
+// target returns the admin and the user an action form is about.
+// An error page is rendered and false returned if the user is unknown or is the admin, who uses the settings page instead.
+func (prop *adminHandlerProps) target(c *gin.Context) (*utils.Principal, utils.User, bool) {
+	admin, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return nil, utils.User{}, false
+	}
+
+	userID := c.PostForm("user_id")
+	if userID == admin.ID {
+		prop.renderResult(c, http.StatusBadRequest, admin, utils.ErrorAdminHTML, utils.AdminSelfAction)
+		return nil, utils.User{}, false
+	}
+
+	notFound := fmt.Sprintf(utils.UserNotFound, userID)
+	if utils.StrToInt(userID) < 1 {
+		prop.renderResult(c, http.StatusNotFound, admin, utils.ErrorAdminHTML, notFound)
+		return nil, utils.User{}, false
+	}
+
+	user, err := prop.Database.FetchUserByID(userID)
+	if err != nil {
+		if err.Error() == notFound {
+			prop.renderResult(c, http.StatusNotFound, admin, utils.ErrorAdminHTML, notFound)
+			return nil, utils.User{}, false
+		}
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return nil, utils.User{}, false
+	}
+
+	return admin, user, true
+}
+
+// renderResult renders the list the action form came from with message under key (utils.MessageHTML or utils.ErrorAdminHTML)
+func (prop *adminHandlerProps) renderResult(c *gin.Context, status int, admin *utils.Principal, key string, message string) {
+	prop.renderConsole(c, status, admin, utils.TrimSpace(c.PostForm("q")), utils.StrToInt(c.PostForm("page")), gin.H{key: message})
+}
+
+// done renders the result of an action that returned err, UserNotFound is shown, other errors are internal
+func (prop *adminHandlerProps) done(c *gin.Context, admin *utils.Principal, user utils.User, err error, message string) {
+	if err != nil {
+		if err.Error() == fmt.Sprintf(utils.UserNotFound, user.ID) || err.Error() == utils.AdminRoleInvalid {
+			prop.renderResult(c, http.StatusBadRequest, admin, utils.ErrorAdminHTML, err.Error())
+			return
+		}
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	prop.renderResult(c, http.StatusOK, admin, utils.MessageHTML, message)
+}
+
+// PostDisable disables the account in user_id.
+func (prop *adminHandlerProps) PostDisable(c *gin.Context) {
+	admin, user, ok := prop.target(c)
+	if !ok {
+		return
+	}
+
+	err := prop.Database.SetUserDisabled(user.ID, true, admin.Username, c.ClientIP())
+	prop.done(c, admin, user, err, fmt.Sprintf(utils.AdminUserDisabled, user.Username))
+}
+
+// PostEnable enables the account in user_id.
+func (prop *adminHandlerProps) PostEnable(c *gin.Context) {
+	admin, user, ok := prop.target(c)
+	if !ok {
+		return
+	}
+
+	err := prop.Database.SetUserDisabled(user.ID, false, admin.Username, c.ClientIP())
+	prop.done(c, admin, user, err, fmt.Sprintf(utils.AdminUserEnabled, user.Username))
+}
+
+// PostLogout logs out every session of the user in user_id.
+func (prop *adminHandlerProps) PostLogout(c *gin.Context) {
+	admin, user, ok := prop.target(c)
+	if !ok {
+		return
+	}
+
+	err := prop.Database.ForceLogout(user.ID, admin.Username, c.ClientIP())
+	prop.done(c, admin, user, err, fmt.Sprintf(utils.AdminUserLoggedOut, user.Username))
+}
+
+// PostPasswordReset makes the user in user_id choose a new password through an emailed reset link.
+// Users without email could not finish the reset, so it is refused for them.
+func (prop *adminHandlerProps) PostPasswordReset(c *gin.Context) {
+	admin, user, ok := prop.target(c)
+	if !ok {
+		return
+	}
+
+	if user.Email == "" {
+		prop.renderResult(c, http.StatusBadRequest, admin, utils.ErrorAdminHTML, fmt.Sprintf(utils.AdminPasswordResetNoEmail, user.Username))
+		return
+	}
+
+	if err := prop.Database.RequirePasswordReset(user.ID, admin.Username, c.ClientIP()); err != nil {
+		prop.done(c, admin, user, err, "")
+		return
+	}
+
+	err := password.SendResetLink(prop.Database, prop.Mailer, user, password.ResetReasonAdmin)
+	prop.done(c, admin, user, err, fmt.Sprintf(utils.AdminPasswordResetSent, user.Username))
+}
+
+// PostRole gives the user in user_id the role in "role".
+func (prop *adminHandlerProps) PostRole(c *gin.Context) {
+	admin, user, ok := prop.target(c)
+	if !ok {
+		return
+	}
+
+	role := c.PostForm("role")
+	err := prop.Database.SetUserRole(user.ID, role, admin.Username, c.ClientIP())
+	prop.done(c, admin, user, err, fmt.Sprintf(utils.AdminRoleChanged, user.Username, role))
+}
+
+// NewAdminHandler creates a new instance of AdminHandlers.
+func NewAdminHandler(db *utils.DataBaseProps, store *sessions.CookieStore, mail mailer.Mailer) AdminHandlers {
+	return &adminHandlerProps{
+		Database: db,
+		Store:    store,
+		Mailer:   mail,
+	}
+}
@@ -0,0 +1,283 @@
+package api
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"todoweb/packages/config"
+	"todoweb/packages/handlers"
+	"todoweb/packages/hub"
+	"todoweb/packages/utils"
+)
+
+// bulkInput is body of bulk requests
+type bulkInput struct {
+	Action  string `json:"action"` // complete, reopen or delete
+	TaskIDs []int  `json:"taskIds"`
+}
+
+// taskInput is body of create and update requests, missing fields are left unchanged on update
+type taskInput struct {
+	Description *string `json:"description"`
+	IsCompleted *bool   `json:"isCompleted"`
+}
+
+// TaskAPIHandlers defines the interface for the JSON task API.
+// Every task response carries an ETag, update and delete require a matching If-Match header.
+type TaskAPIHandlers interface {
+	ListTasks(c *gin.Context)  // GET    /api/v1/tasks
+	CreateTask(c *gin.Context) // POST   /api/v1/tasks
+	GetTask(c *gin.Context)    // GET    /api/v1/tasks/:id
+	UpdateTask(c *gin.Context) // PATCH  /api/v1/tasks/:id
+	DeleteTask(c *gin.Context) // DELETE /api/v1/tasks/:id
+	BulkTasks(c *gin.Context)  // POST   /api/v1/tasks/bulk
+}
+
+// taskAPIProps holds dependencies for the task API handlers.
+type taskAPIProps struct {
+	Database *utils.DataBaseProps  // Database connection properties.
+	Store    *sessions.CookieStore // Cookie store for session management.
+	Hub      *hub.Hub              // Hub notified after every successful change.
+}
+
+// ListTasks returns all tasks of the user.
+func (prop *taskAPIProps) ListTasks(c *gin.Context) {
+	userInterface, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	tasks, err := prop.Database.GetTasksFromDatabase(userInterface.ID)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tasks": tasks})
+}
+
+// CreateTask creates task from {"description": "..."} and returns it with 201.
+// With Idempotency-Key header a repeated request returns the first result instead of creating another task.
+func (prop *taskAPIProps) CreateTask(c *gin.Context) {
+	userInterface, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var input taskInput
+	if err := c.ShouldBindJSON(&input); err != nil || input.Description == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "description is required"})
+		return
+	}
+
+	key := strings.TrimSpace(c.GetHeader("Idempotency-Key")) // Optional, makes retries safe.
+
+	created, replayed, err := prop.Database.AddTaskIdempotent(userInterface.ID, key, utils.TrimSpace(*input.Description), config.Options.IdempotencyWindow)
+	if err != nil {
+		if err.Error() == utils.IdempotencyKeyReused || err.Error() == fmt.Sprintf(utils.IdempotencyKeyTooLong, utils.IdempotencyKeyMaxLength) {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+			return
+		}
+		internalError(c, err)
+		return
+	}
+
+	if replayed {
+		c.Header("Idempotent-Replayed", "true") // Same response as the first request, nothing was inserted.
+	} else {
+		prop.Hub.TaskChanged(userInterface.ID, utils.TaskEventCreate, utils.StrToInt(created.TaskID), &created)
+	}
+
+	c.Header("Location", handlers.RoutesPointer.API.Tasks+"/"+created.TaskID)
+	writeTask(c, http.StatusCreated, created)
+}
+
+// GetTask returns single task, If-None-Match with the current ETag gives 304.
+func (prop *taskAPIProps) GetTask(c *gin.Context) {
+	userInterface, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	taskID := utils.StrToInt(c.Param("id"))
+
+	task, err := prop.Database.GetTaskByID(userInterface.ID, taskID)
+	if err != nil {
+		storeError(c, taskID, err)
+		return
+	}
+
+	if c.GetHeader("If-None-Match") == utils.TaskETag(task) {
+		c.Header("ETag", utils.TaskETag(task))
+		c.Status(http.StatusNotModified)
+		return
+	}
+
+	writeTask(c, http.StatusOK, task)
+}
+
+// UpdateTask changes description and/or completion of task whose ETag matches If-Match.
+func (prop *taskAPIProps) UpdateTask(c *gin.Context) {
+	userInterface, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	taskID := utils.StrToInt(c.Param("id"))
+
+	expected, ok := ifMatchVersion(c, taskID)
+	if !ok {
+		return // Response is already written.
+	}
+
+	var input taskInput
+	if err := c.ShouldBindJSON(&input); err != nil || (input.Description == nil && input.IsCompleted == nil) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "description or isCompleted is required"})
+		return
+	}
+
+	// Both fields change in one transaction with one If-Match check, a 412 changes nothing
+	if input.Description != nil {
+		description := utils.TrimSpace(*input.Description)
+		input.Description = &description
+	}
+
+	updated, err := prop.Database.UpdateTaskFields(userInterface.ID, taskID, expected, input.Description, input.IsCompleted)
+	if err != nil {
+		storeError(c, taskID, err)
+		return
+	}
+
+	if input.Description != nil {
+		prop.Hub.TaskChanged(userInterface.ID, utils.TaskEventUpdate, taskID, &updated)
+	}
+	if input.IsCompleted != nil {
+		prop.Hub.TaskChanged(userInterface.ID, utils.TaskEventComplete, taskID, &updated)
+	}
+
+	writeTask(c, http.StatusOK, updated)
+}
+
+// DeleteTask deletes task whose ETag matches If-Match and returns 204.
+func (prop *taskAPIProps) DeleteTask(c *gin.Context) {
+	userInterface, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	taskID := utils.StrToInt(c.Param("id"))
+
+	expected, ok := ifMatchVersion(c, taskID)
+	if !ok {
+		return // Response is already written.
+	}
+
+	if err := prop.Database.DeleteTask(userInterface.ID, taskID, expected); err != nil {
+		storeError(c, taskID, err)
+		return
+	}
+
+	prop.Hub.TaskChanged(userInterface.ID, utils.TaskEventDelete, taskID, nil)
+
+	c.Status(http.StatusNoContent)
+}
+
+// BulkTasks applies one action to a set of task ids in a single transaction and returns a result per id.
+func (prop *taskAPIProps) BulkTasks(c *gin.Context) {
+	userInterface, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var input bulkInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	if !utils.IsBulkAction(input.Action) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf(utils.BulkUnknownAction, input.Action)})
+		return
+	}
+
+	if len(input.TaskIDs) > utils.BulkMaxTasks {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf(utils.BulkTooManyTasks, utils.BulkMaxTasks)})
+		return
+	}
+
+	results, err := prop.Database.BulkUpdateTasks(userInterface.ID, input.Action, input.TaskIDs)
+	if err != nil {
+		internalError(c, err)
+		return
+	}
+
+	prop.Hub.BulkChanged(userInterface.ID, input.Action, results)
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// ifMatchVersion reads task version from If-Match header.
+// "*" matches any version (0 is returned), missing header gives 428 and a tag of another task gives 412.
+func ifMatchVersion(c *gin.Context, taskID int) (int, bool) {
+	header := strings.TrimSpace(c.GetHeader("If-Match"))
+	if header == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "If-Match header is required"})
+		return 0, false
+	}
+
+	if header == "*" {
+		return 0, true
+	}
+
+	var id, version int
+	if _, err := fmt.Sscanf(header, `"%d-%d"`, &id, &version); err != nil || id != taskID || version <= 0 {
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": "If-Match does not match the task"})
+		return 0, false
+	}
+
+	return version, true
+}
+
+// writeTask writes task as JSON together with its ETag
+func writeTask(c *gin.Context, status int, task utils.Task) {
+	c.Header("ETag", utils.TaskETag(task))
+	c.JSON(status, task)
+}
+
+// storeError maps error of a store method to a response
+func storeError(c *gin.Context, taskID int, err error) {
+	switch err.Error() {
+	case fmt.Sprintf(utils.TaskNotFound, taskID):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case fmt.Sprintf(utils.TaskVersionMismatch, taskID):
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+	default:
+		internalError(c, err)
+	}
+}
+
+// internalError logs err and hides it from the client
+func internalError(c *gin.Context, err error) {
+	log.Printf("task api error: %v\n", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+}
+
+// NewTaskAPIHandler creates a new instance of TaskAPIHandlers.
+func NewTaskAPIHandler(db *utils.DataBaseProps, store *sessions.CookieStore, eventHub *hub.Hub) TaskAPIHandlers {
+	return &taskAPIProps{
+		Database: db,       // Set the database property.
+		Store:    store,    // Set the session store property.
+		Hub:      eventHub, // Set the hub property.
+	}
+}
@@ -2,13 +2,19 @@ package authentication
 
 import (
 	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin" // Gin framework for HTTP handling
 	"github.com/gorilla/sessions" // Package for session management
 
 	"net/http"
 
+	"todoweb/packages/config" // Application settings
 	"todoweb/packages/handlers" // Handlers for routing
+	"todoweb/packages/mailer" // Sending verification emails
 	"todoweb/packages/utils" // Utility functions and types
 )
 
@@ -19,17 +25,20 @@ type AuthenticationHandlers interface {
 	GetRegister(c *gin.Context) // Handler for GET registration requests
 	PostRegister(c *gin.Context) // Handler for POST registration requests
 	GetEmptyPath(c *gin.Context) // Handler for empty path redirects
+	GetVerifyEmail(c *gin.Context) // Handler for email verification links
+	PostResendVerification(c *gin.Context) // Handler for sending a new verification link
 }
 
 // authenticationHandlerProps holds the properties needed for authentication handlers.
 type authenticationHandlerProps struct {
 	Database *utils.DataBaseProps  // Database connection properties.
 	Store    *sessions.CookieStore  // Cookie store for session management.
+	Mailer   mailer.Mailer          // Sends verification emails.
 }
 
 // GetLogin renders the login page.
 func (prop *authenticationHandlerProps) GetLogin(c *gin.Context) {
-	c.HTML(http.StatusOK, handlers.RoutesPointer.MainLoginConfig.PageName, nil)
+	handlers.RenderHTML(c, http.StatusOK, handlers.RoutesPointer.MainLoginConfig.PageName, nil)
 }
 
 // GetEmptyPath redirects to the main login page.
@@ -48,46 +57,183 @@ func (prop *authenticationHandlerProps) PostLogin(c *gin.Context) {
 	// Retrieve and trim the username and password from the form
 	username := utils.TrimSpace(c.PostForm(handlers.RoutesPointer.Authentication.ParseKeys.UsernameParseKey))
 	password := utils.TrimSpace(c.PostForm(handlers.RoutesPointer.Authentication.ParseKeys.PasswordParseKey))
+	remember := c.PostForm(handlers.RoutesPointer.MainLoginConfig.ParseKeys.RememberParseKey) != ""
 
-	// Fetch the user from the database using the username
-	authResult, err := prop.Database.FetchUserByUsername(username)
+	var (
+		ip = c.ClientIP()
+		userKey = utils.UserLoginKey(username)
+		ipKey = utils.IPLoginKey(ip)
+	)
+
+	// Locked usernames and addresses are refused before the password is checked
+	lockedUntil, err := prop.Database.LoginLockedUntil(userKey, ipKey)
 	if err != nil {
-		var errorMessage string = fmt.Sprintf(utils.UserNotFound, username)
-		// Check if the error is due to the user not being found
-		if err.Error() == errorMessage {
-			data := gin.H{
-				utils.ErrorLoginHTML: errorMessage, // Display the user not found error
-				"Username":           username, // Pass the username back to the view
-			}
-			c.HTML(http.StatusOK, handlers.RoutesPointer.MainLoginConfig.PageName, data)
-			return
-		}
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if !lockedUntil.IsZero() {
+		c.Header("Retry-After", strconv.Itoa(int(time.Until(lockedUntil).Seconds())+1))
+		handlers.RenderHTML(c, http.StatusTooManyRequests, handlers.RoutesPointer.MainLoginConfig.PageName, gin.H{
+			utils.ErrorLoginHTML: utils.LoginLocked,
+			"Username":           username, // Pass the username back to the view
+		})
+		return
+	}
 
+	// Fetch the user from the database using the username
+	authResult, err := prop.Database.FetchUserByUsername(username)
+	userFound := err == nil
+	if err != nil && err.Error() != fmt.Sprintf(utils.UserNotFound, username) {
 		// Handle other errors by returning an internal server error
 		c.String(http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
 
+	// Unknown users are compared against a dummy hash, so both failures take the same time
+	passwordHash := authResult.PasswordHash
+	if !userFound {
+		passwordHash = utils.DummyPasswordHash()
+	}
+
 	// Check if the provided password matches the hashed password in the database
-	if !utils.ComparePassword(password, authResult.PasswordHash) {
+	if !utils.ComparePassword(password, passwordHash) || !userFound {
+		if err := prop.registerLoginFailure(userKey, ipKey, authResult.ID, ip); err != nil {
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+
+		// The typed username is not logged for unknown users, it is often a password entered in the wrong field
+		detail := utils.AuthMethodPassword
+		if !userFound {
+			detail += ", unknown username"
+		}
+		handlers.RecordSecurityEvent(c, prop.Database, authResult.ID, utils.AuditEventLoginFailed, detail)
+
+		// Same message for unknown user and wrong password
 		data := gin.H{
 			utils.ErrorLoginHTML: utils.LoginError, // Display login error
 			"Username":           username, // Pass the username back to the view
+			"Remember":           remember, // Keep the checkbox ticked
 		}
-		c.HTML(http.StatusOK, handlers.RoutesPointer.MainLoginConfig.PageName, data)
+		handlers.RenderHTML(c, http.StatusOK, handlers.RoutesPointer.MainLoginConfig.PageName, data)
+		return
+	}
+
+	if err := prop.Database.ClearLoginFailures(userKey); err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
 		return
 	}
 
-	// Set the user session upon successful login
-	handlers.SetSession(c, prop.Store, handlers.RoutesPointer.Cookie.UserInfoKey, authResult)
+	// Accounts blocked by an admin are told so only after the right password, so the message does not reveal them
+	var blocked string
+	switch {
+	case authResult.Disabled:
+		blocked = utils.AccountDisabled
+	case authResult.PasswordResetRequired:
+		blocked = utils.PasswordResetRequired
+	}
+	if blocked != "" {
+		handlers.RenderHTML(c, http.StatusForbidden, handlers.RoutesPointer.MainLoginConfig.PageName, gin.H{
+			utils.ErrorLoginHTML: blocked,
+			"Username":           username, // Pass the username back to the view
+		})
+		return
+	}
+
+	// bcrypt hashes and Argon2id hashes with old parameters are replaced while the plain password is known.
+	// A failed rehash does not stop the login, it is tried again next time.
+	if utils.PasswordNeedsRehash(authResult.PasswordHash) {
+		if err := prop.Database.RehashPassword(authResult.ID, authResult.PasswordHash, password); err != nil {
+			log.Printf("password rehash error: %v\n", err)
+		}
+	}
+
+	// Unverified users only see the "please verify" page unless the settings allow them in
+	if authResult.NeedsEmailVerification() && config.Options.RequireEmailVerification {
+		handlers.RenderHTML(c, http.StatusForbidden, handlers.RoutesPointer.VerifyEmailConfig.PageName, gin.H{
+			"Email": authResult.Email, // Address the link was sent to.
+		})
+		return
+	}
+
+	// With 2FA the password only starts a pending login, the session gets the user after the code step
+	if authResult.TwoFactorEnabled {
+		session, ok := handlers.GetSession(c, prop.Store)
+		if !ok {
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+
+		delete(session.Values, handlers.RoutesPointer.Cookie.UserInfoKey)
+		session.Values[handlers.RoutesPointer.Cookie.PendingLoginKey] = utils.NewPendingLogin(authResult.ID, remember)
+		if err := sessions.Save(c.Request, c.Writer); err != nil {
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.TwoFactorLoginConfig.Path)
+		return
+	}
+
+	// Set the user session upon successful login, the cookie gets only the principal
+	if err := handlers.StartUserSession(c, prop.Store, prop.Database, &authResult, utils.AuthMethodPassword); err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// The login works without the remember me cookie, so a failure is only logged
+	if remember {
+		if err := handlers.RememberUserSession(c, prop.Store, prop.Database); err != nil {
+			log.Printf("remember me error: %v\n", err)
+		}
+	}
+
+	// Redirect to the page the user came for, usually the tasks page
+	c.Redirect(http.StatusFound, handlers.LoginRedirectPath(c, prop.Store))
+}
+
+// registerLoginFailure counts the failure for the username and the address, locks are written to the audit log
+func (prop *authenticationHandlerProps) registerLoginFailure(userKey, ipKey, userID, ip string) error {
+	userLimits := utils.LoginLimits{
+		MaxFailures: config.Options.LoginMaxFailures,
+		LockoutBase: config.Options.LoginLockoutBase,
+		LockoutMax:  config.Options.LoginLockoutMax,
+	}
+	if _, err := prop.Database.RegisterLoginFailure(userKey, userLimits, userID, ip); err != nil {
+		return err
+	}
 
-	// Redirect to the user's tasks page
-	c.Redirect(http.StatusFound, handlers.RoutesPointer.UserConfig.GetTask.Route)
+	ipLimits := userLimits
+	ipLimits.MaxFailures = config.Options.LoginIPMaxFailures
+	if _, err := prop.Database.RegisterLoginFailure(ipKey, ipLimits, "", ip); err != nil {
+		return err
+	}
+
+	return nil
 }
 
 // GetRegister renders the registration page.
 func (prop *authenticationHandlerProps) GetRegister(c *gin.Context) {
-	c.HTML(http.StatusOK, handlers.RoutesPointer.MainRegisterConfig.PageName, nil)
+	// Invite links carry the code, so it is filled in for the user
+	form := utils.RegisterForm{InviteCode: c.Query(handlers.RoutesPointer.MainRegisterConfig.ParseKeys.InviteParseKey)}
+
+	handlers.RenderHTML(c, http.StatusOK, handlers.RoutesPointer.MainRegisterConfig.PageName, registerPageData(gin.H{
+		utils.Form: form,
+	}))
+}
+
+// registerPageData adds what the register page shows besides errors: password rules and the registration mode
+func registerPageData(data gin.H) gin.H {
+	policy := utils.CurrentRegistrationPolicy()
+
+	data["PasswordRules"] = utils.PasswordRules()
+	data["RegistrationClosed"] = policy.Closed()
+	data["AskInvite"] = policy.UsesInvites()
+	if policy.Mode == utils.RegistrationDomains {
+		data["AllowedDomains"] = policy.AllowedDomains
+	}
+
+	return data
 }
 
 // PostRegister handles user registration attempts.
@@ -101,8 +247,10 @@ func (prop *authenticationHandlerProps) PostRegister(c *gin.Context) {
 	// Create a new register form with trimmed inputs
 	registerForm := utils.NewRegisterForm(
 		utils.TrimSpace(c.PostForm("uname")), 
+		utils.TrimSpace(c.PostForm("email")), 
 		utils.TrimSpace(c.PostForm("pword")), 
 		utils.TrimSpace(c.PostForm("re-pword")), 
+		utils.TrimSpace(c.PostForm(handlers.RoutesPointer.MainRegisterConfig.ParseKeys.InviteParseKey)),
 	)
 
 	var (
@@ -112,23 +260,115 @@ func (prop *authenticationHandlerProps) PostRegister(c *gin.Context) {
 
 	// Validate the registration form
 	if err := prop.Database.IsValidRegister(*registerForm, data); err != nil {
-		c.HTML(status, handlers.RoutesPointer.MainRegisterConfig.PageName, data) // Render errors if validation fails
+		handlers.RenderHTML(c, status, handlers.RoutesPointer.MainRegisterConfig.PageName, registerPageData(data)) // Render errors if validation fails
 		return
 	}
 
-	// Create a new user in the database
-	if err := prop.Database.CreateNewUser(registerForm.Username, registerForm.Password); err != nil {
+	// Create a new user in the database, using up the invite if the registration mode needs one
+	var (
+		userID string
+		err error
+	)
+	if utils.CurrentRegistrationPolicy().NeedsInvite(registerForm.Email) {
+		userID, err = prop.Database.CreateNewUserWithInvite(registerForm.Username, registerForm.Password, registerForm.Email, registerForm.InviteCode, c.ClientIP())
+	} else {
+		userID, err = prop.Database.CreateNewUser(registerForm.Username, registerForm.Password, registerForm.Email)
+	}
+	if err != nil {
+		// The last use of the invite was taken by another form since the check
+		if err.Error() == utils.InviteInvalid {
+			data[utils.ErrorRegistrationHTML] = utils.InviteInvalid
+			data[utils.Form] = *registerForm
+			handlers.RenderHTML(c, http.StatusConflict, handlers.RoutesPointer.MainRegisterConfig.PageName, registerPageData(data))
+			return
+		}
 		c.String(http.StatusInternalServerError, "Internal Server Error") // Handle errors during user creation
+		return
 	}
 
-	// Redirect to the login page after successful registration
-	c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.MainLoginConfig.Path)
+	// Send the verification link and tell the user to check the inbox
+	if err := prop.sendVerification(userID, registerForm.Username, registerForm.Email); err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.RenderHTML(c, http.StatusOK, handlers.RoutesPointer.VerifyEmailConfig.PageName, gin.H{
+		"Email": registerForm.Email, // Address the link was sent to.
+		"Registered": true, // Show "account created" instead of "please verify".
+	})
+}
+
+// sendVerification issues a verification token for the user and emails the link in the background
+func (prop *authenticationHandlerProps) sendVerification(userID, username, email string) error {
+	token, err := prop.Database.CreateEmailVerificationToken(userID, config.Options.EmailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	link := config.Options.BaseURL + handlers.RoutesPointer.VerifyEmailConfig.Path + "?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf(
+		"Hello %s,\n\nplease confirm your email address for TodoWebApp by opening the link below, it is valid for %s:\n\n%s\n\nIf you did not create an account, ignore this email.\n",
+		username, config.Options.EmailVerificationTTL, link,
+	)
+
+	go func() {
+		if err := prop.Mailer.Send(email, "Confirm your email", body); err != nil {
+			log.Printf("verification mail error: %v\n", err)
+		}
+	}()
+
+	return nil
+}
+
+// GetVerifyEmail marks the email of the link owner as verified.
+func (prop *authenticationHandlerProps) GetVerifyEmail(c *gin.Context) {
+	if err := prop.Database.VerifyEmailWithToken(c.Query("token")); err != nil {
+		if err.Error() == utils.VerificationTokenInvalid {
+			handlers.RenderHTML(c, http.StatusOK, handlers.RoutesPointer.VerifyEmailConfig.PageName, gin.H{
+				utils.ErrorResetHTML: err.Error(), // Offer to send a new link.
+			})
+			return
+		}
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.RenderHTML(c, http.StatusOK, handlers.RoutesPointer.VerifyEmailConfig.PageName, gin.H{
+		"Verified": true, // Show link to the login page.
+	})
+}
+
+// PostResendVerification sends a new verification link if the address belongs to an unverified user.
+// The answer does not depend on the address, so the page does not tell which addresses are registered.
+func (prop *authenticationHandlerProps) PostResendVerification(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.MainLoginConfig.Path)
+		return
+	}
+
+	email := utils.TrimSpace(c.PostForm(handlers.RoutesPointer.VerifyEmailConfig.ParseKeys.EmailParseKey))
+	data := gin.H{utils.MessageHTML: utils.VerificationLinkSent}
+
+	user, err := prop.Database.FetchUserByEmail(email)
+	if err == nil && user.NeedsEmailVerification() {
+		if err := prop.sendVerification(user.ID, user.Username, user.Email); err != nil {
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+	} else if err != nil && err.Error() != fmt.Sprintf(utils.UserNotFound, email) {
+		log.Printf("resend verification lookup error: %v\n", err)
+	}
+
+	handlers.RenderHTML(c, http.StatusOK, handlers.RoutesPointer.VerifyEmailConfig.PageName, data)
 }
 
 // NewAuthenticationHandler creates a new instance of AuthenticationHandlers.
-func NewAuthenticationHandler(db *utils.DataBaseProps, store *sessions.CookieStore) AuthenticationHandlers {
+func NewAuthenticationHandler(db *utils.DataBaseProps, store *sessions.CookieStore, mail mailer.Mailer) AuthenticationHandlers {
+	utils.DummyPasswordHash() // Hash it now, so the first unknown username is not slower than the rest.
+
 	return &authenticationHandlerProps{
 		Database: db,  // Set the database property.
 		Store:    store, // Set the session store property.
+		Mailer:   mail, // Set the mailer property.
 	}
 }
\ No newline at end of file
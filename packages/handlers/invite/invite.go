@@ -0,0 +1,170 @@
+package invite
+
+import (
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"todoweb/packages/config"
+	"todoweb/packages/handlers"
+	"todoweb/packages/utils"
+)
+
+// Most accounts one invite of an admin can create
+const adminInviteMaxUses = 1000
+
+// InviteHandlers defines the interface for the invites page.
+// Admins see and revoke every invite, other users only their own and only if USER_INVITES is on.
+type InviteHandlers interface {
+	GetInvites(c *gin.Context) // Renders the invites page.
+	PostCreate(c *gin.Context) // Creates an invite from "uses" and "days".
+	PostRevoke(c *gin.Context) // Revokes the invite in "invite_id".
+}
+
+// inviteHandlerProps holds dependencies for invite handlers.
+type inviteHandlerProps struct {
+	Database *utils.DataBaseProps  // Database connection properties.
+	Store    *sessions.CookieStore // Cookie store for session management.
+}
+
+// access returns whether user is an admin and whether user may use the page at all.
+// A 403 page is rendered when the page is not allowed, the caller only returns then.
+func (prop *inviteHandlerProps) access(c *gin.Context, user *utils.Principal) (bool, bool) {
+	role, err := prop.Database.UserRole(user.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return false, false
+	}
+
+	admin := role == utils.RoleAdmin
+	if !admin && !config.Options.UserInvites {
+		c.String(http.StatusForbidden, utils.InvitesForbidden)
+		return false, false
+	}
+
+	return admin, true
+}
+
+// renderInvites renders the invites the user can see, data may hold a message, an error or a new code
+func (prop *inviteHandlerProps) renderInvites(c *gin.Context, status int, user *utils.Principal, admin bool, data gin.H) {
+	owner := user.ID
+	if admin {
+		owner = ""
+	}
+
+	invites, err := prop.Database.ListInvites(owner)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	maxUses := config.Options.InviteMaxUses
+	if admin {
+		maxUses = adminInviteMaxUses
+	}
+
+	data["Username"] = user.Username
+	data["Invites"] = invites
+	data["IsAdmin"] = admin
+	data["MaxUses"] = maxUses
+	data["MaxDays"] = int(config.Options.InviteMaxTTL.Hours() / 24)
+	data["RegistrationMode"] = utils.CurrentRegistrationPolicy().Mode
+
+	handlers.RenderHTML(c, status, handlers.RoutesPointer.UserConfig.Invites.HTMLPageName, data)
+}
+
+// GetInvites renders the invites page.
+func (prop *inviteHandlerProps) GetInvites(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	admin, allowed := prop.access(c, user)
+	if !allowed {
+		return
+	}
+
+	prop.renderInvites(c, http.StatusOK, user, admin, gin.H{})
+}
+
+// PostCreate creates an invite and shows its code and link once.
+func (prop *inviteHandlerProps) PostCreate(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	admin, allowed := prop.access(c, user)
+	if !allowed {
+		return
+	}
+
+	maxUses := config.Options.InviteMaxUses
+	if admin {
+		maxUses = adminInviteMaxUses
+	}
+
+	uses := utils.StrToInt(c.PostForm("uses"))
+	ttl := time.Duration(utils.StrToInt(c.PostForm("days"))) * 24 * time.Hour
+
+	invite, code, err := prop.Database.CreateInvite(user.ID, uses, maxUses, ttl, config.Options.InviteMaxTTL, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		if inviteError, ok := err.(*utils.InviteError); ok {
+			prop.renderInvites(c, http.StatusBadRequest, user, admin, gin.H{utils.ErrorInviteHTML: inviteError.Message})
+			return
+		}
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	link := config.Options.BaseURL + handlers.RoutesPointer.MainRegisterConfig.Path + "?" +
+		handlers.RoutesPointer.MainRegisterConfig.ParseKeys.InviteParseKey + "=" + url.QueryEscape(code)
+
+	// The code exists only in this response
+	c.Header("Cache-Control", "no-store")
+	prop.renderInvites(c, http.StatusOK, user, admin, gin.H{"NewInvite": invite, "NewCode": code, "NewLink": link})
+}
+
+// PostRevoke revokes an invite of the user, admins can revoke any invite.
+func (prop *inviteHandlerProps) PostRevoke(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	admin, allowed := prop.access(c, user)
+	if !allowed {
+		return
+	}
+
+	owner := user.ID
+	if admin {
+		owner = ""
+	}
+
+	if err := prop.Database.RevokeInvite(c.PostForm("invite_id"), owner, user.ID, c.ClientIP()); err != nil {
+		if err.Error() == utils.InviteNotFound {
+			prop.renderInvites(c, http.StatusNotFound, user, admin, gin.H{utils.ErrorInviteHTML: utils.InviteNotFound})
+			return
+		}
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	prop.renderInvites(c, http.StatusOK, user, admin, gin.H{utils.MessageHTML: utils.InviteRevoked})
+}
+
+// NewInviteHandler creates a new instance of InviteHandlers.
+func NewInviteHandler(db *utils.DataBaseProps, store *sessions.CookieStore) InviteHandlers {
+	return &inviteHandlerProps{
+		Database: db,
+		Store:    store,
+	}
+}
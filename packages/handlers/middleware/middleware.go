@@ -4,39 +4,119 @@ import (
 	"github.com/gin-gonic/gin" 
 	"github.com/gorilla/sessions"
 
+	"crypto/subtle"
 	"net/http"
+	"net/url"
 	"fmt"
+	"strings"
+	"time"
+	"todoweb/packages/config"
 	"todoweb/packages/handlers"
+	"todoweb/packages/utils"
 )
 
+// Size of the CSRF token in random bytes
+const csrfTokenSize = 32
+
 // MiddlewareHandlers defines the interface for authentication-related middleware.
 // Auth: Ensures that users are authenticated.
+// RequireRole: Returns a middleware that lets only users with the role through, used after Auth.
+// RequireRecentAuth: Lets only users who entered their password recently through (sudo mode), used after Auth.
 // Logout: Logs out the user by terminating their session.
 type MiddlewareHandlers interface {
 	Auth(c *gin.Context)
+	APIAuth(c *gin.Context)
+	RequireRole(role string) gin.HandlerFunc
+	RequireRecentAuth(c *gin.Context)
+	CSRF(c *gin.Context)
 	Logout(c *gin.Context)
 }
 
 // authHandler contains a CookieStore for session management.
 type authHandler struct {
 	Store *sessions.CookieStore
+	Database *utils.DataBaseProps // Used to find sessions outdated by a password change.
+}
+
+// isOutdated reports whether user logged in before the last password change of the account.
+// The user is removed from such a session, so handlers behind the middleware see no user either.
+func (BrowserAuth *authHandler) isOutdated(c *gin.Context, session *sessions.Session, user *utils.Principal) (bool, error) {
+	version, err := BrowserAuth.Database.SessionVersion(user.ID)
+	if err != nil {
+		if err.Error() != fmt.Sprintf(utils.UserNotFound, user.ID) {
+			return false, err
+		}
+		version = -1 // Deleted account, no session matches
+	}
+
+	if version == user.SessionVersion {
+		return false, nil
+	}
+
+	delete(session.Values, handlers.RoutesPointer.Cookie.UserInfoKey)
+	return true, sessions.Save(c.Request, c.Writer)
+}
+
+// touchSession records the use of the session in user_sessions, at most once per utils.UserSessionTouchInterval.
+// The time is kept in the principal, the caller saves the session. A failed write does not stop the request.
+func (BrowserAuth *authHandler) touchSession(c *gin.Context, user *utils.Principal) {
+	if time.Since(user.LastSeen) < utils.UserSessionTouchInterval {
+		return
+	}
+
+	if err := BrowserAuth.Database.TouchUserSession(user.SessionID, user.ID, c.ClientIP(), c.Request.UserAgent()); err != nil {
+		fmt.Printf("user session error: %v\n", err)
+		return
+	}
+	user.LastSeen = time.Now()
 }
 
-// Auth checks if the user is authenticated.
+// currentSession returns the session and principal of the request and records the request in the principal.
+// Sessions past the idle timeout or their maximum lifetime have no user (see handlers.GetSessionAndUser),
+// without a user a remembered login starts a new session.
+func (BrowserAuth *authHandler) currentSession(c *gin.Context) (*sessions.Session, *utils.Principal, bool) {
+	session, user, ok := handlers.GetSessionAndUser(c, BrowserAuth.Store)
+	if !ok {
+		session, user, ok = handlers.RestoreUserSession(c, BrowserAuth.Store, BrowserAuth.Database)
+	}
+	if ok {
+		user.Touch()
+	}
+
+	return session, user, ok
+}
+
+// Auth checks if the user is authenticated, an expired session is restored from the remember me cookie.
 // If the user session is valid, it refreshes the session expiry time and proceeds to the next handler.
 // If not authenticated, the user is redirected to the login page.
 func (BrowserAuth *authHandler) Auth(c *gin.Context) {
 	// Retrieve session and user information from the session store.
-	session, _, ok := handlers.GetSessionAndUser(c, BrowserAuth.Store)
+	session, user, ok := BrowserAuth.currentSession(c)
 	if !ok {
 		// If session or user info is missing, redirect to the login page.
 		c.Redirect(http.StatusUnauthorized, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
 		return
 	}
 
+	// Password was changed in another session, this one has to log in again.
+	outdated, err := BrowserAuth.isOutdated(c, session, user)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		c.Abort()
+		fmt.Printf("session version error: %v\n", err)
+		return
+	}
+	if outdated {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.MainLogoutConfig.RedirectPath)
+		c.Abort()
+		return
+	}
+
+	BrowserAuth.touchSession(c, user)
+
 	// Refresh the session expiration time.
 	session.Options.MaxAge = handlers.RoutesPointer.Authentication.SessionTime
-	err := sessions.Save(c.Request, c.Writer)
+	err = sessions.Save(c.Request, c.Writer)
 	if err != nil {
 		// Handle session saving error.
 		c.String(http.StatusInternalServerError, err.Error())
@@ -48,17 +128,233 @@ func (BrowserAuth *authHandler) Auth(c *gin.Context) {
 	c.Next()
 }
 
-// Logout terminates the user session by setting its MaxAge to -1 (expire immediately).
+// bearerAuth authenticates the request with an OAuth access token from the Authorization header.
+// Reading needs the tasks:read scope, every other method tasks:write.
+func (BrowserAuth *authHandler) bearerAuth(c *gin.Context, token string) {
+	// Token errors follow RFC 6750, so clients know whether to refresh or to ask for more scope
+	info, active, err := BrowserAuth.Database.IntrospectOAuthToken(token)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		fmt.Printf("oauth token error: %v\n", err)
+		return
+	}
+	if !active || !info.IsAccessToken() {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid_token"})
+		return
+	}
+
+	scope := utils.ScopeTasksWrite
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead:
+		scope = utils.ScopeTasksRead
+	}
+	if !info.HasScope(scope) {
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "insufficient_scope"})
+		return
+	}
+
+	handlers.SetRequestPrincipal(c, utils.PrincipalFromOAuthToken(info))
+	c.Next()
+}
+
+// APIAuth is Auth for JSON endpoints.
+// Instead of redirecting, unauthenticated requests are aborted with 401 and a JSON error.
+// Requests with an OAuth bearer token are authenticated by the token instead of the session.
+func (BrowserAuth *authHandler) APIAuth(c *gin.Context) {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		BrowserAuth.bearerAuth(c, strings.TrimSpace(token))
+		return
+	}
+
+	// Retrieve session and user information from the session store.
+	session, user, ok := BrowserAuth.currentSession(c)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	outdated, err := BrowserAuth.isOutdated(c, session, user)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		fmt.Printf("session version error: %v\n", err)
+		return
+	}
+	if outdated {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	BrowserAuth.touchSession(c, user)
+
+	// Refresh the session expiration time.
+	session.Options.MaxAge = handlers.RoutesPointer.Authentication.SessionTime
+	if err := sessions.Save(c.Request, c.Writer); err != nil {
+		// Handle session saving error.
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		fmt.Printf("session save error: %v\n", err)
+		return
+	}
+
+	// Call the next handler in the chain (if the user is authenticated).
+	c.Next()
+}
+
+// RequireRole lets only users whose current role is role through, others get 403.
+// The role is read from the database on every request, so taking it away works without a new login.
+func (BrowserAuth *authHandler) RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := handlers.GetUserFromSession(c, BrowserAuth.Store)
+		if !ok {
+			c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.MainLoginConfig.Path)
+			c.Abort()
+			return
+		}
+
+		current, err := BrowserAuth.Database.UserRole(user.ID)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+			c.Abort()
+			fmt.Printf("role error: %v\n", err)
+			return
+		}
+
+		if current != role {
+			c.String(http.StatusForbidden, utils.AdminForbidden)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// RequireRecentAuth lets the request through if the user entered credentials in this session within
+// config.Settings.SudoModeTTL, so a session left open or restored by remember me can not change sensitive settings.
+// Other requests are sent to the confirmation page, which returns to the page the request came from.
+// Forms are not sent again after the confirmation, the user sends them once more.
+func (BrowserAuth *authHandler) RequireRecentAuth(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, BrowserAuth.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.MainLoginConfig.Path)
+		c.Abort()
+		return
+	}
+
+	if user.RecentlyVerified(config.Options.SudoModeTTL) {
+		c.Next()
+		return
+	}
+
+	returnPath := c.Request.URL.RequestURI()
+	if c.Request.Method != http.MethodGet {
+		returnPath = handlers.RoutesPointer.UserConfig.Settings.Route
+		if referer, err := url.Parse(c.Request.Referer()); err == nil && referer.Host == c.Request.Host {
+			returnPath = referer.RequestURI()
+		}
+	}
+	if err := handlers.SaveReturnPath(c, BrowserAuth.Store, returnPath); err != nil {
+		fmt.Printf("return path error: %v\n", err)
+	}
+
+	// passkeys.js follows the redirect of JSON errors
+	if c.ContentType() == "application/json" {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": utils.ReauthRequired, "redirect": handlers.RoutesPointer.UserConfig.Reauth.Route})
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.Reauth.Route)
+	c.Abort()
+}
+
+// isAPIPath reports whether path belongs to the API route group, which is behind APIAuth
+func isAPIPath(path string) bool {
+	return path == handlers.RoutesPointer.API.Route || strings.HasPrefix(path, handlers.RoutesPointer.API.Route+"/")
+}
+
+// CSRF issues a per-session token and checks it on every state-changing request.
+// Forms send it in a hidden field (see handlers.CSRFField), fetch requests in the X-CSRF-Token header.
+// API requests with a bearer token do not use the session cookie, APIAuth checks the token instead, so they are not checked.
+// Other routes ignore the Authorization header, there a bearer token must not skip the check.
+func (BrowserAuth *authHandler) CSRF(c *gin.Context) {
+	// OAuth endpoints authenticate clients themselves and never read the cookie
+	for _, path := range handlers.RoutesPointer.CSRF.ExemptPaths {
+		if c.Request.URL.Path == path {
+			c.Next()
+			return
+		}
+	}
+
+	session, ok := handlers.GetSession(c, BrowserAuth.Store)
+	if !ok {
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// The token lives as long as the session, a new one is made for new sessions
+	token, _ := session.Values[handlers.RoutesPointer.CSRF.SessionKey].(string)
+	if token == "" {
+		token = utils.GenerateToken(csrfTokenSize)
+		session.Values[handlers.RoutesPointer.CSRF.SessionKey] = token
+		if err := sessions.Save(c.Request, c.Writer); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+			fmt.Printf("session save error: %v\n", err)
+			return
+		}
+	}
+	c.Set(handlers.RoutesPointer.CSRF.SessionKey, token)
+
+	switch c.Request.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		c.Next()
+		return
+	}
+
+	if isAPIPath(c.Request.URL.Path) && strings.HasPrefix(c.GetHeader("Authorization"), "Bearer ") {
+		c.Next()
+		return
+	}
+
+	sent := c.GetHeader(handlers.RoutesPointer.CSRF.Header)
+	if sent == "" {
+		sent = c.PostForm(handlers.RoutesPointer.CSRF.FormField)
+	}
+
+	if subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+		if isAPIPath(c.Request.URL.Path) || c.ContentType() == "application/json" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": utils.CSRFTokenInvalid})
+			return
+		}
+		c.String(http.StatusForbidden, utils.CSRFTokenInvalid)
+		c.Abort()
+		return
+	}
+
+	c.Next()
+}
+
+// Logout terminates the user session by setting its MaxAge to -1 (expire immediately), a remembered login is revoked.
 // After successfully logging out, the user is redirected to the login page.
 func (BrowserAuth *authHandler) Logout(c *gin.Context) {
+	// Logging out also forgets the browser, even if its session expired already
+	if err := handlers.ForgetUserSession(c, BrowserAuth.Store, BrowserAuth.Database); err != nil {
+		fmt.Printf("remember me error: %v\n", err)
+	}
+
 	// Retrieve session and user information from the session store.
-	session, _, ok := handlers.GetSessionAndUser(c, BrowserAuth.Store)
+	session, user, ok := handlers.GetSessionAndUser(c, BrowserAuth.Store)
 	if !ok {
 		// If session or user info is missing, redirect to the login page.
 		c.Redirect(http.StatusUnauthorized, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
 		return
 	}
 
+	// The session is no longer counted as active, the cookie is what logs out, so an error is only logged
+	if err := BrowserAuth.Database.EndUserSession(user.SessionID); err != nil {
+		fmt.Printf("user session error: %v\n", err)
+	}
+
 	// Invalidate the session by setting MaxAge to -1.
 	session.Options.MaxAge = handlers.RoutesPointer.MainLoginConfig.SessionTimeOut
 	err := sessions.Save(c.Request, c.Writer)
@@ -68,14 +364,17 @@ func (BrowserAuth *authHandler) Logout(c *gin.Context) {
 		return
 	}
 
+	handlers.RecordSecurityEvent(c, BrowserAuth.Database, user.ID, utils.AuditEventLogout, "")
+
 	// Redirect the user to the login page after logging out.
 	c.Redirect(http.StatusFound, handlers.RoutesPointer.MainLoginConfig.Path) // Consider making this path configurable.
 }
 
 // NewMiddlewareHandler creates a new authHandler instance that implements the MiddlewareHandlers interface.
-// It takes a CookieStore for session management.
-func NewMiddlewareHandler(store *sessions.CookieStore) MiddlewareHandlers {
+// It takes a CookieStore for session management and the database to check session versions.
+func NewMiddlewareHandler(store *sessions.CookieStore, db *utils.DataBaseProps) MiddlewareHandlers {
 	return &authHandler{
 		Store: store,
+		Database: db,
 	}
 }
@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"todoweb/packages/handlers"
+	"todoweb/packages/utils"
+)
+
+// newCSRFRouter serves paths behind the CSRF middleware only, reached handlers answer 200
+func newCSRFRouter(paths ...string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	auth := &authHandler{Store: sessions.NewCookieStore(utils.GenerateRandomKey(32))}
+	router := gin.New()
+	router.Use(auth.CSRF)
+	for _, path := range paths {
+		router.GET(path, func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+		router.POST(path, func(c *gin.Context) { c.String(http.StatusOK, "ok") })
+	}
+	return router
+}
+
+func serve(router *gin.Engine, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	router.ServeHTTP(recorder, request)
+	return recorder
+}
+
+// sessionCookie returns the session cookie set by response, nil if none was set
+func sessionCookie(response *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range response.Result().Cookies() {
+		if cookie.Name == handlers.RoutesPointer.Cookie.Naming {
+			return cookie
+		}
+	}
+	return nil
+}
+
+func TestCSRFUndecodableCookie(t *testing.T) {
+	router := newCSRFRouter("/login")
+
+	// A cookie of an earlier start, the key of this store can not decode it
+	stale := &http.Cookie{Name: handlers.RoutesPointer.Cookie.Naming, Value: "MTcwMDAwMDAwMHxzdGFsZXw="}
+
+	request := httptest.NewRequest(http.MethodGet, "/login", nil)
+	request.AddCookie(stale)
+	response := serve(router, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("GET status = %d, want %d", response.Code, http.StatusOK)
+	}
+	fresh := sessionCookie(response)
+	if fresh == nil {
+		t.Fatal("GET did not replace the undecodable cookie")
+	}
+
+	// The login form still fails without token, but with 403 instead of 500
+	request = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(url.Values{"username": {"alice"}}.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.AddCookie(stale)
+	if response := serve(router, request); response.Code != http.StatusForbidden {
+		t.Errorf("POST without token status = %d, want %d", response.Code, http.StatusForbidden)
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	router := newCSRFRouter("/login")
+
+	var token string
+	router.GET("/token", func(c *gin.Context) { token = c.GetString(handlers.RoutesPointer.CSRF.SessionKey) })
+	response := serve(router, httptest.NewRequest(http.MethodGet, "/token", nil))
+	cookie := sessionCookie(response)
+	if token == "" || cookie == nil {
+		t.Fatalf("no token issued, token %q cookie %v", token, cookie)
+	}
+
+	for name, sent := range map[string]string{"valid": token, "wrong": token + "x", "missing": ""} {
+		form := url.Values{}
+		if sent != "" {
+			form.Set(handlers.RoutesPointer.CSRF.FormField, sent)
+		}
+		request := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.AddCookie(cookie)
+
+		want := http.StatusForbidden
+		if name == "valid" {
+			want = http.StatusOK
+		}
+		if response := serve(router, request); response.Code != want {
+			t.Errorf("%s token status = %d, want %d", name, response.Code, want)
+		}
+	}
+}
+
+func TestCSRFBearerOnlyExemptForAPI(t *testing.T) {
+	router := newCSRFRouter(handlers.RoutesPointer.API.Tasks, handlers.RoutesPointer.UserConfig.GetTask.Route, handlers.RoutesPointer.API.Route+"x")
+
+	cases := map[string]int{
+		handlers.RoutesPointer.API.Tasks:                http.StatusOK,        // APIAuth checks the token.
+		handlers.RoutesPointer.UserConfig.GetTask.Route: http.StatusForbidden, // Auth reads the cookie, the header is ignored.
+		handlers.RoutesPointer.API.Route + "x":          http.StatusForbidden, // Only a prefix of the name, not in the group.
+	}
+	for path, want := range cases {
+		request := httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}"))
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("Authorization", "Bearer anything")
+		if response := serve(router, request); response.Code != want {
+			t.Errorf("POST %s with bearer token status = %d, want %d", path, response.Code, want)
+		}
+	}
+}
@@ -0,0 +1,516 @@
+package oauth
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"todoweb/packages/config"
+	"todoweb/packages/handlers"
+	"todoweb/packages/utils"
+)
+
+const (
+	// Session key holding the authorization request between the consent page and the decision
+	authorizeSessionKey = "oauthAuthorize"
+
+	// How long the consent page can be answered
+	authorizeRequestTTL = 10 * time.Minute
+
+	// PKCE verifiers have 43 to 128 characters, so S256 challenges always have 43
+	pkceChallengeLength = 43
+
+	// Error codes of the authorization endpoint (RFC 6749 section 4.1.2.1) besides the utils.OAuth* ones
+	unsupportedResponseType = "unsupported_response_type"
+	unsupportedGrantType    = "unsupported_grant_type"
+	accessDenied            = "access_denied"
+)
+
+// OAuthHandlers defines the interface of the OAuth 2.0 authorization server and the page managing it.
+// Only the authorization code grant with PKCE (S256) and refresh tokens are supported.
+type OAuthHandlers interface {
+	GetAuthorize(c *gin.Context)    // Shows the consent page, logged out users log in first.
+	PostAuthorize(c *gin.Context)   // Redirects to the client with a code or access_denied.
+	PostToken(c *gin.Context)       // Exchanges codes and refresh tokens.
+	PostIntrospect(c *gin.Context)  // Describes a token to a confidential client (RFC 7662).
+	PostRevoke(c *gin.Context)      // Revokes a token and its grant (RFC 7009).
+	GetApps(c *gin.Context)         // Lists registered clients and authorized applications.
+	PostRegisterApp(c *gin.Context) // Registers a client, the secret is shown once.
+	PostDeleteApp(c *gin.Context)   // Removes a client of the user.
+	PostRevokeApp(c *gin.Context)   // Revokes the access the user gave to a client.
+}
+
+// oauthHandlerProps holds dependencies for OAuth handlers.
+type oauthHandlerProps struct {
+	Database *utils.DataBaseProps  // Database connection properties.
+	Store    *sessions.CookieStore // Cookie store for session management.
+}
+
+// authorizeRequest is an authorization request waiting for the decision of the user
+type authorizeRequest struct {
+	ClientID    string    `json:"clientId"`
+	RedirectURI string    `json:"redirectUri"`
+	Scope       string    `json:"scope"`
+	State       string    `json:"state"`
+	Challenge   string    `json:"challenge"`
+	UserID      string    `json:"userId"` // User who saw the consent page.
+	Expires     time.Time `json:"expires"`
+}
+
+// currentUser returns the logged-in user, sessions outdated by a password change do not count.
+// The authorize endpoint is outside /user, so the check of middleware.Auth is repeated here.
+func (prop *oauthHandlerProps) currentUser(c *gin.Context) (*utils.Principal, bool, error) {
+	principal, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		return nil, false, nil
+	}
+
+	version, err := prop.Database.SessionVersion(principal.ID)
+	if err != nil {
+		if err.Error() == fmt.Sprintf(utils.UserNotFound, principal.ID) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	return principal, version == principal.SessionVersion, nil
+}
+
+// redirectToClient sends the browser back to redirectURI with params added to its query
+func redirectToClient(c *gin.Context, redirectURI string, params map[string]string) {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	query := target.Query()
+	for key, value := range params {
+		if value != "" {
+			query.Set(key, value)
+		}
+	}
+	target.RawQuery = query.Encode()
+
+	c.Redirect(http.StatusSeeOther, target.String())
+}
+
+// renderConsent shows the consent page, an error replaces the question.
+// The page must not be framed, otherwise another site could trick the user into clicking "Allow".
+func renderConsent(c *gin.Context, status int, data gin.H) {
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	handlers.RenderHTML(c, status, handlers.RoutesPointer.OAuth.ConsentPageName, data)
+}
+
+// GetAuthorize checks the authorization request and asks the user to allow it.
+// Unknown clients and unregistered redirect URIs are shown as error, everything else is reported to the client.
+func (prop *oauthHandlerProps) GetAuthorize(c *gin.Context) {
+	client, err := prop.Database.GetOAuthClient(c.Query("client_id"))
+	if err != nil {
+		if err.Error() != utils.OAuthInvalidClient {
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		renderConsent(c, http.StatusBadRequest, gin.H{utils.ErrorOAuthHTML: utils.OAuthUnknownClient})
+		return
+	}
+
+	// Never redirect to an address the client did not register
+	redirectURI := c.Query("redirect_uri")
+	if !client.HasRedirectURI(redirectURI) {
+		renderConsent(c, http.StatusBadRequest, gin.H{utils.ErrorOAuthHTML: utils.OAuthUnknownRedirect})
+		return
+	}
+
+	state := c.Query("state")
+	fail := func(code string) {
+		redirectToClient(c, redirectURI, map[string]string{"error": code, "state": state})
+	}
+
+	if c.Query("response_type") != "code" {
+		fail(unsupportedResponseType)
+		return
+	}
+
+	// PKCE is required from every client, plain challenges are refused
+	challenge := c.Query("code_challenge")
+	if c.Query("code_challenge_method") != "S256" || len(challenge) != pkceChallengeLength {
+		fail(utils.OAuthInvalidRequest)
+		return
+	}
+
+	scope, err := utils.NormalizeOAuthScope(c.Query("scope"))
+	if err != nil {
+		fail(utils.OAuthInvalidScope)
+		return
+	}
+
+	principal, ok, err := prop.currentUser(c)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if !ok {
+		// Back to this request after the login
+		if err := handlers.SaveReturnPath(c, prop.Store, c.Request.URL.RequestURI()); err != nil {
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.MainLoginConfig.Path)
+		return
+	}
+
+	request := authorizeRequest{
+		ClientID:    client.ClientID,
+		RedirectURI: redirectURI,
+		Scope:       scope,
+		State:       state,
+		Challenge:   challenge,
+		UserID:      principal.ID,
+		Expires:     time.Now().Add(authorizeRequestTTL),
+	}
+	encoded, err := json.Marshal(request)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if err := handlers.SetSession(c, prop.Store, authorizeSessionKey, string(encoded)); err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	renderConsent(c, http.StatusOK, gin.H{
+		"Username":   principal.Username,
+		"ClientName": client.Name,
+		"Scopes":     utils.OAuthScopeDescriptions(scope),
+	})
+}
+
+// takeAuthorizeRequest returns the request shown on the consent page and removes it, so it is answered once
+func (prop *oauthHandlerProps) takeAuthorizeRequest(c *gin.Context) (authorizeRequest, bool) {
+	var request authorizeRequest
+
+	session, ok := handlers.GetSession(c, prop.Store)
+	if !ok {
+		return request, false
+	}
+
+	encoded, ok := session.Values[authorizeSessionKey].(string)
+	if !ok {
+		return request, false
+	}
+
+	delete(session.Values, authorizeSessionKey)
+	if err := sessions.Save(c.Request, c.Writer); err != nil {
+		return request, false
+	}
+
+	if err := json.Unmarshal([]byte(encoded), &request); err != nil {
+		return request, false
+	}
+
+	return request, time.Now().Before(request.Expires)
+}
+
+// PostAuthorize answers the consent page: "allow" issues an authorization code, anything else denies.
+func (prop *oauthHandlerProps) PostAuthorize(c *gin.Context) {
+	request, ok := prop.takeAuthorizeRequest(c)
+	if !ok {
+		renderConsent(c, http.StatusBadRequest, gin.H{utils.ErrorOAuthHTML: utils.OAuthRequestExpired})
+		return
+	}
+
+	principal, ok, err := prop.currentUser(c)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if !ok || principal.ID != request.UserID {
+		renderConsent(c, http.StatusBadRequest, gin.H{utils.ErrorOAuthHTML: utils.OAuthRequestExpired})
+		return
+	}
+
+	if c.PostForm("decision") != "allow" {
+		redirectToClient(c, request.RedirectURI, map[string]string{"error": accessDenied, "state": request.State})
+		return
+	}
+
+	// The client may have been deleted while the page was open
+	client, err := prop.Database.GetOAuthClient(request.ClientID)
+	if err != nil {
+		if err.Error() != utils.OAuthInvalidClient {
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		renderConsent(c, http.StatusBadRequest, gin.H{utils.ErrorOAuthHTML: utils.OAuthUnknownClient})
+		return
+	}
+
+	code, err := prop.Database.CreateAuthorizationCode(client, principal.ID, request.RedirectURI, request.Scope, request.Challenge, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	redirectToClient(c, request.RedirectURI, map[string]string{"code": code, "state": request.State})
+}
+
+// tokenError answers a token, introspection or revocation request with an OAuth error
+func tokenError(c *gin.Context, status int, code string) {
+	if status == http.StatusUnauthorized {
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(status, gin.H{"error": code})
+}
+
+// authenticateClient reads client credentials from HTTP Basic auth or the client_id and client_secret form fields.
+// Public clients send only client_id. false means an error was already sent.
+func (prop *oauthHandlerProps) authenticateClient(c *gin.Context) (utils.OAuthClient, bool) {
+	clientID, secret, basic := c.Request.BasicAuth()
+	if basic {
+		// Basic credentials are form encoded first (RFC 6749 section 2.3.1)
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID = c.PostForm("client_id")
+		secret = c.PostForm("client_secret")
+	}
+
+	client, err := prop.Database.GetOAuthClient(clientID)
+	if err != nil {
+		if err.Error() != utils.OAuthInvalidClient {
+			tokenError(c, http.StatusInternalServerError, "server_error")
+			return utils.OAuthClient{}, false
+		}
+		tokenError(c, http.StatusUnauthorized, utils.OAuthInvalidClient)
+		return utils.OAuthClient{}, false
+	}
+
+	if !client.Authenticate(secret) {
+		tokenError(c, http.StatusUnauthorized, utils.OAuthInvalidClient)
+		return utils.OAuthClient{}, false
+	}
+
+	return client, true
+}
+
+// PostToken issues tokens for the authorization_code and refresh_token grants.
+func (prop *oauthHandlerProps) PostToken(c *gin.Context) {
+	client, ok := prop.authenticateClient(c)
+	if !ok {
+		return
+	}
+
+	var (
+		response utils.OAuthTokenResponse
+		err      error
+	)
+	switch c.PostForm("grant_type") {
+	case "authorization_code":
+		response, err = prop.Database.ExchangeAuthorizationCode(
+			client.ClientID, c.PostForm("code"), c.PostForm("redirect_uri"), c.PostForm("code_verifier"),
+			config.Options.OAuthAccessTokenTTL, config.Options.OAuthRefreshTokenTTL,
+		)
+	case "refresh_token":
+		scope := c.PostForm("scope")
+		if scope != "" {
+			if scope, err = utils.NormalizeOAuthScope(scope); err != nil {
+				tokenError(c, http.StatusBadRequest, utils.OAuthInvalidScope)
+				return
+			}
+		}
+		response, err = prop.Database.RefreshOAuthToken(
+			client.ClientID, c.PostForm("refresh_token"), scope,
+			config.Options.OAuthAccessTokenTTL, config.Options.OAuthRefreshTokenTTL,
+		)
+	default:
+		tokenError(c, http.StatusBadRequest, unsupportedGrantType)
+		return
+	}
+
+	if err != nil {
+		switch err.Error() {
+		case utils.OAuthInvalidGrant, utils.OAuthInvalidScope:
+			tokenError(c, http.StatusBadRequest, err.Error())
+		default:
+			log.Printf("oauth token error: %v\n", err)
+			tokenError(c, http.StatusInternalServerError, "server_error")
+		}
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, response)
+}
+
+// PostIntrospect tells a confidential client, e.g. another service receiving tokens, whether token is active.
+func (prop *oauthHandlerProps) PostIntrospect(c *gin.Context) {
+	client, ok := prop.authenticateClient(c)
+	if !ok {
+		return
+	}
+
+	// Public clients run on user devices, they must not learn about other tokens
+	if !client.Confidential {
+		tokenError(c, http.StatusUnauthorized, utils.OAuthInvalidClient)
+		return
+	}
+
+	info, active, err := prop.Database.IntrospectOAuthToken(c.PostForm("token"))
+	if err != nil {
+		log.Printf("oauth introspection error: %v\n", err)
+		tokenError(c, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	if !active {
+		c.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+
+	tokenType := "refresh_token"
+	if info.IsAccessToken() {
+		tokenType = "access_token"
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"active":     true,
+		"scope":      info.Scope,
+		"client_id":  info.ClientID,
+		"username":   info.Username,
+		"sub":        info.UserID,
+		"token_type": tokenType,
+		"iat":        info.IssuedAt.Unix(),
+		"exp":        info.ExpiresAt.Unix(),
+	})
+}
+
+// PostRevoke revokes token of the calling client and every token issued together with it.
+func (prop *oauthHandlerProps) PostRevoke(c *gin.Context) {
+	client, ok := prop.authenticateClient(c)
+	if !ok {
+		return
+	}
+
+	if err := prop.Database.RevokeOAuthToken(client.ClientID, c.PostForm("token")); err != nil {
+		log.Printf("oauth revocation error: %v\n", err)
+		tokenError(c, http.StatusInternalServerError, "server_error")
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// renderApps shows the applications page of user, data holds messages of the current action
+func (prop *oauthHandlerProps) renderApps(c *gin.Context, status int, user *utils.Principal, data gin.H) {
+	clients, err := prop.Database.ListOAuthClients(user.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	grants, err := prop.Database.ListOAuthGrants(user.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	data["Username"] = user.Username
+	data["Clients"] = clients
+	data["Grants"] = grants
+	data["AuthorizeURL"] = config.Options.BaseURL + handlers.RoutesPointer.OAuth.Authorize
+	data["TokenURL"] = config.Options.BaseURL + handlers.RoutesPointer.OAuth.Token
+
+	handlers.RenderHTML(c, status, handlers.RoutesPointer.OAuth.Apps.HTMLPageName, data)
+}
+
+// GetApps renders the applications page.
+func (prop *oauthHandlerProps) GetApps(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	prop.renderApps(c, http.StatusOK, user, gin.H{})
+}
+
+// PostRegisterApp registers a client from name, redirect_uris (one per line) and client_type (confidential or public).
+func (prop *oauthHandlerProps) PostRegisterApp(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	uris := strings.Split(c.PostForm("redirect_uris"), "\n")
+	confidential := c.PostForm("client_type") != "public"
+
+	client, secret, err := prop.Database.RegisterOAuthClient(user.ID, c.PostForm("name"), uris, confidential, c.ClientIP())
+	if err != nil {
+		if clientError, ok := err.(*utils.OAuthClientError); ok {
+			prop.renderApps(c, http.StatusBadRequest, user, gin.H{utils.ErrorOAuthHTML: clientError.Message})
+			return
+		}
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// The secret exists only in this response
+	c.Header("Cache-Control", "no-store")
+	prop.renderApps(c, http.StatusOK, user, gin.H{"NewClient": client, "NewSecret": secret})
+}
+
+// PostDeleteApp removes a client registered by the user, its tokens stop working.
+func (prop *oauthHandlerProps) PostDeleteApp(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	if err := prop.Database.DeleteOAuthClient(user.ID, c.PostForm("client_id"), c.ClientIP()); err != nil {
+		if err.Error() == utils.OAuthInvalidClient {
+			prop.renderApps(c, http.StatusNotFound, user, gin.H{utils.ErrorOAuthHTML: utils.OAuthUnknownClient})
+			return
+		}
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	prop.renderApps(c, http.StatusOK, user, gin.H{utils.MessageHTML: utils.OAuthClientDeleted})
+}
+
+// PostRevokeApp revokes every token the user gave to a client.
+func (prop *oauthHandlerProps) PostRevokeApp(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	if err := prop.Database.RevokeOAuthGrants(user.ID, c.PostForm("client_id"), c.ClientIP()); err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	prop.renderApps(c, http.StatusOK, user, gin.H{utils.MessageHTML: utils.OAuthAccessRevoked})
+}
+
+// NewOAuthHandler creates a new instance of OAuthHandlers.
+func NewOAuthHandler(db *utils.DataBaseProps, store *sessions.CookieStore) OAuthHandlers {
+	return &oauthHandlerProps{
+		Database: db,
+		Store:    store,
+	}
+}
@@ -0,0 +1,127 @@
+package offline
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"todoweb/packages/config"
+	"todoweb/packages/handlers"
+	"todoweb/packages/hub"
+	"todoweb/packages/utils"
+)
+
+// Maximum amount of mutations accepted in one push
+const maxPushBatch = 100
+
+// pushRequest is body of the push endpoint
+type pushRequest struct {
+	Mutations []utils.SyncMutation `json:"mutations"`
+}
+
+// SyncHandlers defines the interface for offline sync handlers.
+type SyncHandlers interface {
+	Pull(c *gin.Context) // Returns changes after ?since=N.
+	Push(c *gin.Context) // Applies batch of client mutations.
+}
+
+// syncHandlerProps holds dependencies for sync handlers.
+type syncHandlerProps struct {
+	Database *utils.DataBaseProps  // Database connection properties.
+	Store    *sessions.CookieStore // Cookie store for session management.
+	Hub      *hub.Hub              // Hub notified about applied mutations.
+}
+
+// Pull returns upserts and tombstones written after the change sequence given in "since" (0 for everything).
+func (prop *syncHandlerProps) Pull(c *gin.Context) {
+	userInterface, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	since, err := strconv.ParseInt(c.DefaultQuery("since", "0"), 10, 64)
+	if err != nil || since < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since parameter"})
+		return
+	}
+
+	changes, err := prop.Database.GetChangesSince(userInterface.ID, since)
+	if err != nil {
+		log.Printf("sync pull error: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, changes)
+}
+
+// Push applies mutations in order, each in its own transaction, and returns a result per mutation.
+// Conflicting mutations are not applied, the client gets the server state and decides what to do.
+func (prop *syncHandlerProps) Push(c *gin.Context) {
+	userInterface, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return
+	}
+
+	var request pushRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	if len(request.Mutations) > maxPushBatch {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "too many mutations, maximum is " + strconv.Itoa(maxPushBatch)})
+		return
+	}
+
+	results := make([]utils.SyncResult, 0, len(request.Mutations))
+	for _, mutation := range request.Mutations {
+		result, err := prop.Database.ApplySyncMutation(userInterface.ID, mutation, config.Options.IdempotencyWindow)
+		if err != nil {
+			log.Printf("sync push error: %v\n", err)
+			result = utils.SyncResult{ClientID: mutation.ClientID, Status: utils.SyncStatusRejected, Error: "Internal Server Error"}
+		}
+
+		// Duplicates were published when they were applied first
+		if result.Status == utils.SyncStatusApplied {
+			prop.publish(userInterface.ID, mutation, result)
+		}
+
+		results = append(results, result)
+	}
+
+	seq, err := prop.Database.CurrentChangeSeq(userInterface.ID)
+	if err != nil {
+		log.Printf("sync push error: %v\n", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"seq": seq, "results": results})
+}
+
+// publish notifies open pages about applied mutation
+func (prop *syncHandlerProps) publish(userID string, mutation utils.SyncMutation, result utils.SyncResult) {
+	switch mutation.Op {
+	case utils.SyncOpCreate:
+		prop.Hub.TaskChanged(userID, utils.TaskEventCreate, utils.StrToInt(result.Task.TaskID), result.Task)
+	case utils.SyncOpUpdate:
+		prop.Hub.TaskChanged(userID, utils.TaskEventUpdate, mutation.TaskID, result.Task)
+	case utils.SyncOpDelete:
+		prop.Hub.TaskChanged(userID, utils.TaskEventDelete, mutation.TaskID, nil)
+	}
+}
+
+// NewSyncHandler creates a new instance of SyncHandlers.
+func NewSyncHandler(db *utils.DataBaseProps, store *sessions.CookieStore, eventHub *hub.Hub) SyncHandlers {
+	return &syncHandlerProps{
+		Database: db,       // Set the database property.
+		Store:    store,    // Set the session store property.
+		Hub:      eventHub, // Set the hub property.
+	}
+}
@@ -0,0 +1,459 @@
+package passkey
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/sessions"
+
+	"todoweb/packages/config"
+	"todoweb/packages/handlers"
+	"todoweb/packages/utils"
+)
+
+// Session keys holding ceremony data between begin and finish requests
+const (
+	registrationSessionKey = "passkeyRegistration"
+	loginSessionKey        = "passkeyLogin"
+)
+
+// PasskeyHandlers defines the interface for WebAuthn registration and login ceremonies.
+// Begin handlers answer with options for navigator.credentials, finish handlers read its JSON result.
+type PasskeyHandlers interface {
+	GetPasskeys(c *gin.Context)          // Renders registered passkeys.
+	PostRegisterBegin(c *gin.Context)    // Starts registration of a new passkey.
+	PostRegisterFinish(c *gin.Context)   // Stores the new passkey.
+	PostDelete(c *gin.Context)           // Removes a passkey.
+	PostSecondFactor(c *gin.Context)     // Turns passkey as second factor on or off.
+	PostLoginBegin(c *gin.Context)       // Starts passwordless login.
+	PostLoginFinish(c *gin.Context)      // Finishes passwordless login.
+	PostSecondStepBegin(c *gin.Context)  // Starts passkey check of a pending password login.
+	PostSecondStepFinish(c *gin.Context) // Finishes passkey check of a pending password login.
+}
+
+// loginStore finds the user of a discoverable passkey and saves its use, implemented by utils.DataBaseProps
+type loginStore interface {
+	FindPasskeyUserByHandle(handle []byte) (*utils.PasskeyUser, error)
+	UsePasskey(userID string, credential *webauthn.Credential) error
+}
+
+// passkeyHandlerProps holds dependencies for passkey handlers.
+type passkeyHandlerProps struct {
+	Database *utils.DataBaseProps  // Database connection properties.
+	Logins   loginStore            // Passkeys used to log in, the database outside of tests.
+	Store    *sessions.CookieStore // Cookie store for session management.
+	WebAuthn *webauthn.WebAuthn    // Relying party configuration.
+}
+
+// NewWebAuthn configures the relying party from the public address of the application, e.g. config.Options.BaseURL
+func NewWebAuthn(baseURL string) (*webauthn.WebAuthn, error) {
+	origin, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("base url error: %v", err)
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPID:          origin.Hostname(),
+		RPDisplayName: utils.TwoFactorIssuer,
+		RPOrigins:     []string{origin.Scheme + "://" + origin.Host},
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementPreferred, // Discoverable keys allow passwordless login.
+			UserVerification: protocol.VerificationPreferred,
+		},
+	})
+}
+
+// saveCeremony keeps ceremony data in the session as JSON, so library types need no gob registration
+func (prop *passkeyHandlerProps) saveCeremony(c *gin.Context, key string, data *webauthn.SessionData) error {
+	session, ok := handlers.GetSession(c, prop.Store)
+	if !ok {
+		return fmt.Errorf("session error")
+	}
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	session.Values[key] = string(encoded)
+	return sessions.Save(c.Request, c.Writer)
+}
+
+// takeCeremony returns ceremony data of key and removes it, so one challenge can be answered only once
+func (prop *passkeyHandlerProps) takeCeremony(c *gin.Context, key string) (webauthn.SessionData, bool) {
+	var data webauthn.SessionData
+
+	session, ok := handlers.GetSession(c, prop.Store)
+	if !ok {
+		return data, false
+	}
+
+	encoded, ok := session.Values[key].(string)
+	if !ok {
+		return data, false
+	}
+
+	delete(session.Values, key)
+	if err := sessions.Save(c.Request, c.Writer); err != nil {
+		return data, false
+	}
+
+	return data, json.Unmarshal([]byte(encoded), &data) == nil
+}
+
+// ceremonyError logs details of a failed ceremony, the client only gets a generic message
+func ceremonyError(c *gin.Context, err error) {
+	if protocolErr, ok := err.(*protocol.Error); ok {
+		log.Printf("webauthn error: %s %s\n", protocolErr.Details, protocolErr.DevInfo)
+	} else {
+		log.Printf("webauthn error: %v\n", err)
+	}
+
+	c.JSON(http.StatusUnauthorized, gin.H{"error": utils.PasskeyFailed})
+}
+
+// sessionFailed answers a login the session was not started for, refused accounts get the reason with 403
+func sessionFailed(c *gin.Context, err error) {
+	switch err.Error() {
+	case utils.AccountDisabled, utils.PasswordResetRequired:
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+	}
+}
+
+// sessionUser returns the logged in user or answers with 401
+func (prop *passkeyHandlerProps) sessionUser(c *gin.Context) (*utils.Principal, bool) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+	}
+
+	return user, ok
+}
+
+// renderPasskeys shows the passkey page of user, data holds messages of the current action
+func (prop *passkeyHandlerProps) renderPasskeys(c *gin.Context, status int, user *utils.Principal, data gin.H) {
+	passkeys, err := prop.Database.ListPasskeys(user.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	secondFactor, err := prop.Database.IsPasskeySecondFactor(user.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	data["Username"] = user.Username
+	data["Passkeys"] = passkeys
+	data["SecondFactor"] = secondFactor
+
+	handlers.RenderHTML(c, status, handlers.RoutesPointer.UserConfig.Passkeys.HTMLPageName, data)
+}
+
+// GetPasskeys renders the passkey page.
+func (prop *passkeyHandlerProps) GetPasskeys(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	prop.renderPasskeys(c, http.StatusOK, user, gin.H{})
+}
+
+// PostRegisterBegin answers with creation options, existing passkeys are excluded so one authenticator is not registered twice.
+func (prop *passkeyHandlerProps) PostRegisterBegin(c *gin.Context) {
+	user, ok := prop.sessionUser(c)
+	if !ok {
+		return
+	}
+
+	passkeyUser, err := prop.Database.GetPasskeyUser(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+
+	exclude := make([]protocol.CredentialDescriptor, 0, len(passkeyUser.Credentials))
+	for _, credential := range passkeyUser.Credentials {
+		exclude = append(exclude, credential.Descriptor())
+	}
+
+	options, data, err := prop.WebAuthn.BeginRegistration(passkeyUser, webauthn.WithExclusions(exclude))
+	if err != nil {
+		ceremonyError(c, err)
+		return
+	}
+
+	if err := prop.saveCeremony(c, registrationSessionKey, data); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, options)
+}
+
+// PostRegisterFinish checks the attestation and stores the passkey under the name given in the "name" query parameter.
+func (prop *passkeyHandlerProps) PostRegisterFinish(c *gin.Context) {
+	user, ok := prop.sessionUser(c)
+	if !ok {
+		return
+	}
+
+	data, ok := prop.takeCeremony(c, registrationSessionKey)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": utils.PasskeyFailed})
+		return
+	}
+
+	passkeyUser, err := prop.Database.GetPasskeyUser(user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+
+	credential, err := prop.WebAuthn.FinishRegistration(passkeyUser, data, c.Request)
+	if err != nil {
+		ceremonyError(c, err)
+		return
+	}
+
+	name, err := prop.Database.AddPasskey(user.ID, c.Query("name"), credential)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+
+	handlers.RecordSecurityEvent(c, prop.Database, user.ID, utils.AuditEventPasskeyAdded, name)
+
+	c.JSON(http.StatusCreated, gin.H{"status": "registered"})
+}
+
+// PostDelete removes the passkey with id from the form.
+func (prop *passkeyHandlerProps) PostDelete(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	id := utils.StrToInt(c.PostForm("id"))
+	name, err := prop.Database.DeletePasskey(user.ID, id)
+	if err != nil {
+		if err.Error() == fmt.Sprintf(utils.PasskeyNotFound, id) {
+			prop.renderPasskeys(c, http.StatusNotFound, user, gin.H{utils.ErrorTwoFactorHTML: err.Error()})
+			return
+		}
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.RecordSecurityEvent(c, prop.Database, user.ID, utils.AuditEventPasskeyRemoved, name)
+
+	c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.Passkeys.RedirectPath)
+}
+
+// PostSecondFactor turns passkey as second factor of password login on ("enabled=true") or off.
+func (prop *passkeyHandlerProps) PostSecondFactor(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	enabled := c.PostForm("enabled") == "true"
+	if err := prop.Database.SetPasskeySecondFactor(user.ID, enabled); err != nil {
+		if err.Error() == utils.PasskeyRequired {
+			prop.renderPasskeys(c, http.StatusBadRequest, user, gin.H{utils.ErrorTwoFactorHTML: err.Error()})
+			return
+		}
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	event := utils.AuditEventTwoFactorDisabled
+	if enabled {
+		event = utils.AuditEventTwoFactorEnabled
+	}
+	handlers.RecordSecurityEvent(c, prop.Database, user.ID, event, utils.AuthMethodPasskey)
+
+	c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.Passkeys.RedirectPath)
+}
+
+// finishAssertion saves the new signature counter, a counter that went back means a cloned key and fails the login
+func (prop *passkeyHandlerProps) finishAssertion(c *gin.Context, userID string, credential *webauthn.Credential) bool {
+	if credential.Authenticator.CloneWarning {
+		log.Printf("webauthn clone warning for user %s\n", userID)
+		handlers.RecordSecurityEvent(c, prop.Database, userID, utils.AuditEventLoginFailed, utils.AuthMethodPasskey+", clone warning")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": utils.PasskeyCloned})
+		return false
+	}
+
+	if err := prop.Logins.UsePasskey(userID, credential); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return false
+	}
+
+	return true
+}
+
+// PostLoginBegin answers with request options for any discoverable passkey of this site.
+// User verification is required, so the passkey alone replaces password and second factor.
+func (prop *passkeyHandlerProps) PostLoginBegin(c *gin.Context) {
+	options, data, err := prop.WebAuthn.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+	if err != nil {
+		ceremonyError(c, err)
+		return
+	}
+
+	if err := prop.saveCeremony(c, loginSessionKey, data); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, options)
+}
+
+// PostLoginFinish finds the user by the handle of the passkey, checks the assertion and creates the session.
+func (prop *passkeyHandlerProps) PostLoginFinish(c *gin.Context) {
+	data, ok := prop.takeCeremony(c, loginSessionKey)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": utils.PasskeyFailed})
+		return
+	}
+
+	var passkeyUser *utils.PasskeyUser
+	credential, err := prop.WebAuthn.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		found, err := prop.Logins.FindPasskeyUserByHandle(userHandle)
+		if err != nil {
+			return nil, err
+		}
+		passkeyUser = found
+		return found, nil
+	}, data, c.Request)
+	if err != nil {
+		// Unknown passkeys are logged without account
+		var userID string
+		if passkeyUser != nil {
+			userID = passkeyUser.ID
+		}
+		handlers.RecordSecurityEvent(c, prop.Database, userID, utils.AuditEventLoginFailed, utils.AuthMethodPasskey)
+		ceremonyError(c, err)
+		return
+	}
+
+	if !prop.finishAssertion(c, passkeyUser.ID, credential) {
+		return
+	}
+
+	if passkeyUser.NeedsEmailVerification() && config.Options.RequireEmailVerification {
+		c.JSON(http.StatusForbidden, gin.H{"error": utils.EmailNotVerified})
+		return
+	}
+
+	if err := handlers.StartUserSession(c, prop.Store, prop.Database, &passkeyUser.User, utils.AuthMethodPasskey); err != nil {
+		sessionFailed(c, err)
+		return
+	}
+
+	// passkeys.js adds the "Remember me" checkbox of the login page to the finish url
+	if c.Query(handlers.RoutesPointer.MainLoginConfig.ParseKeys.RememberParseKey) != "" {
+		if err := handlers.RememberUserSession(c, prop.Store, prop.Database); err != nil {
+			log.Printf("remember me error: %v\n", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"redirect": handlers.LoginRedirectPath(c, prop.Store)})
+}
+
+// PostSecondStepBegin answers with request options limited to passkeys of the pending login.
+func (prop *passkeyHandlerProps) PostSecondStepBegin(c *gin.Context) {
+	pending, ok := handlers.GetPendingLogin(c, prop.Store)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": utils.TwoFactorLoginExpired})
+		return
+	}
+
+	passkeyUser, err := prop.Database.GetPasskeyUser(pending.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+
+	options, data, err := prop.WebAuthn.BeginLogin(passkeyUser)
+	if err != nil {
+		ceremonyError(c, err)
+		return
+	}
+
+	if err := prop.saveCeremony(c, loginSessionKey, data); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, options)
+}
+
+// PostSecondStepFinish checks the assertion of the pending user and creates the session.
+func (prop *passkeyHandlerProps) PostSecondStepFinish(c *gin.Context) {
+	pending, ok := handlers.GetPendingLogin(c, prop.Store)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": utils.TwoFactorLoginExpired})
+		return
+	}
+
+	data, ok := prop.takeCeremony(c, loginSessionKey)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": utils.PasskeyFailed})
+		return
+	}
+
+	passkeyUser, err := prop.Database.GetPasskeyUser(pending.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return
+	}
+
+	credential, err := prop.WebAuthn.FinishLogin(passkeyUser, data, c.Request)
+	if err != nil {
+		handlers.RecordSecurityEvent(c, prop.Database, pending.UserID, utils.AuditEventLoginFailed, utils.AuthMethodPasskey)
+		ceremonyError(c, err)
+		return
+	}
+
+	if !prop.finishAssertion(c, passkeyUser.ID, credential) {
+		return
+	}
+
+	if err := handlers.StartUserSession(c, prop.Store, prop.Database, &passkeyUser.User, utils.AuthMethodPassword, utils.AuthMethodPasskey); err != nil {
+		sessionFailed(c, err)
+		return
+	}
+
+	if pending.Remember {
+		if err := handlers.RememberUserSession(c, prop.Store, prop.Database); err != nil {
+			log.Printf("remember me error: %v\n", err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"redirect": handlers.LoginRedirectPath(c, prop.Store)})
+}
+
+// NewPasskeyHandler creates a new instance of PasskeyHandlers.
+func NewPasskeyHandler(db *utils.DataBaseProps, store *sessions.CookieStore, webAuthn *webauthn.WebAuthn) PasskeyHandlers {
+	return &passkeyHandlerProps{
+		Database: db,
+		Logins:   db,
+		Store:    store,
+		WebAuthn: webAuthn,
+	}
+}
@@ -0,0 +1,659 @@
+package passkey
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/sessions"
+
+	"todoweb/packages/config"
+	"todoweb/packages/handlers"
+	"todoweb/packages/utils"
+)
+
+// Flags of authenticator data, see https://www.w3.org/TR/webauthn-2/#sctn-authenticator-data
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttested     = 0x40
+)
+
+// authenticator is a software passkey with one P-256 credential, it answers like navigator.credentials does
+type authenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte // Set by create, discoverable credentials return it on every assertion.
+	counter      uint32
+	verifyUser   bool // Sets the UV flag, false is a key that only checks presence.
+	origin       string
+}
+
+func newAuthenticator(t *testing.T) *authenticator {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	origin, _ := url.Parse(config.Options.BaseURL)
+	return &authenticator{
+		key:          key,
+		credentialID: utils.GenerateRandomKey(16),
+		verifyUser:   true,
+		origin:       origin.Scheme + "://" + origin.Host,
+	}
+}
+
+// authData builds authenticator data for rpID, the public key is attached on registration
+func (a *authenticator) authData(t *testing.T, rpID string, attested bool) []byte {
+	t.Helper()
+
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	flags := byte(flagUserPresent)
+	if a.verifyUser {
+		flags |= flagUserVerified
+	}
+	if attested {
+		flags |= flagAttested
+	}
+
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	data = binary.BigEndian.AppendUint32(data, a.counter)
+	if !attested {
+		return data
+	}
+
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  int64(webauthncose.P256),
+		XCoord: a.key.PublicKey.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.PublicKey.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatalf("encode public key: %v", err)
+	}
+
+	data = append(data, make([]byte, 16)...) // AAGUID of an unknown model
+	data = binary.BigEndian.AppendUint16(data, uint16(len(a.credentialID)))
+	data = append(data, a.credentialID...)
+	return append(data, publicKey...)
+}
+
+// clientData is the clientDataJSON the browser signs over
+func (a *authenticator) clientData(t *testing.T, ceremony string, challenge protocol.URLEncodedBase64) []byte {
+	t.Helper()
+
+	encoded, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge.String(),
+		"origin":    a.origin,
+	})
+	if err != nil {
+		t.Fatalf("encode client data: %v", err)
+	}
+	return encoded
+}
+
+// create answers creation options with a new credential and "none" attestation
+func (a *authenticator) create(t *testing.T, options *protocol.CredentialCreation) []byte {
+	t.Helper()
+
+	a.userHandle = options.Response.User.ID.(protocol.URLEncodedBase64)
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": a.authData(t, options.Response.RelyingParty.ID, true),
+	})
+	if err != nil {
+		t.Fatalf("encode attestation: %v", err)
+	}
+
+	return a.response(t, map[string]string{
+		"clientDataJSON":    encode(a.clientData(t, "webauthn.create", options.Response.Challenge)),
+		"attestationObject": encode(attestation),
+	})
+}
+
+// get answers request options with a signed assertion, the counter goes up by one
+func (a *authenticator) get(t *testing.T, options *protocol.CredentialAssertion) []byte {
+	t.Helper()
+
+	a.counter++
+	authData := a.authData(t, options.Response.RelyingPartyID, false)
+	clientData := a.clientData(t, "webauthn.get", options.Response.Challenge)
+
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("sign assertion: %v", err)
+	}
+
+	return a.response(t, map[string]string{
+		"clientDataJSON":    encode(clientData),
+		"authenticatorData": encode(authData),
+		"signature":         encode(signature),
+		"userHandle":        encode(a.userHandle),
+	})
+}
+
+// response wraps the authenticator response in a PublicKeyCredential as passkeys.js posts it
+func (a *authenticator) response(t *testing.T, response map[string]string) []byte {
+	t.Helper()
+
+	encoded, err := json.Marshal(map[string]interface{}{
+		"id":       encode(a.credentialID),
+		"rawId":    encode(a.credentialID),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatalf("encode credential: %v", err)
+	}
+	return encoded
+}
+
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// newProps returns handlers with a relying party of config.Options.BaseURL and no database
+func newProps(t *testing.T) *passkeyHandlerProps {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	gob.Register(&utils.Principal{})
+
+	webAuthn, err := NewWebAuthn(config.Options.BaseURL)
+	if err != nil {
+		t.Fatalf("relying party: %v", err)
+	}
+
+	return &passkeyHandlerProps{
+		Store:    sessions.NewCookieStore(utils.GenerateRandomKey(32)),
+		WebAuthn: webAuthn,
+	}
+}
+
+// browser keeps the session cookie between requests like the login page does
+type browser struct {
+	cookies []*http.Cookie
+}
+
+// do runs step on a request with body and the cookies of earlier responses
+func (b *browser) do(body []byte, step func(c *gin.Context)) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(recorder)
+	c.Request = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	for _, cookie := range b.cookies {
+		c.Request.AddCookie(cookie)
+	}
+
+	step(c)
+
+	// A step saving the session twice sends the cookie twice, the browser keeps the last one
+	if cookies := recorder.Result().Cookies(); len(cookies) > 0 {
+		b.cookies = cookies[len(cookies)-1:]
+	}
+	return recorder
+}
+
+// register runs a registration ceremony of user through the session and adds the credential to user
+func register(t *testing.T, prop *passkeyHandlerProps, key *authenticator, user *utils.PasskeyUser) {
+	t.Helper()
+
+	var (
+		client  browser
+		options *protocol.CredentialCreation
+	)
+	client.do(nil, func(c *gin.Context) {
+		var data *webauthn.SessionData
+		var err error
+		if options, data, err = prop.WebAuthn.BeginRegistration(user); err != nil {
+			t.Fatalf("begin registration: %v", err)
+		}
+		if err := prop.saveCeremony(c, registrationSessionKey, data); err != nil {
+			t.Fatalf("save ceremony: %v", err)
+		}
+	})
+
+	client.do(key.create(t, options), func(c *gin.Context) {
+		data, ok := prop.takeCeremony(c, registrationSessionKey)
+		if !ok {
+			t.Fatal("registration ceremony missing from session")
+		}
+		credential, err := prop.WebAuthn.FinishRegistration(user, data, c.Request)
+		if err != nil {
+			t.Fatalf("finish registration: %v", describe(err))
+		}
+		user.Credentials = append(user.Credentials, *credential)
+	})
+}
+
+// beginDiscoverable runs PostLoginBegin and returns the options it answered with
+func beginDiscoverable(t *testing.T, prop *passkeyHandlerProps, client *browser) *protocol.CredentialAssertion {
+	t.Helper()
+
+	recorder := client.do(nil, prop.PostLoginBegin)
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("PostLoginBegin status = %d: %s", recorder.Code, recorder.Body)
+	}
+
+	var options protocol.CredentialAssertion
+	if err := json.Unmarshal(recorder.Body.Bytes(), &options); err != nil {
+		t.Fatalf("decode options: %v", err)
+	}
+	return &options
+}
+
+// beginSecondStep starts the ceremony of PostSecondStepBegin for user, which loads user from the database
+func beginSecondStep(t *testing.T, prop *passkeyHandlerProps, client *browser, user *utils.PasskeyUser) *protocol.CredentialAssertion {
+	t.Helper()
+
+	var options *protocol.CredentialAssertion
+	client.do(nil, func(c *gin.Context) {
+		var data *webauthn.SessionData
+		var err error
+		if options, data, err = prop.WebAuthn.BeginLogin(user); err != nil {
+			t.Fatalf("begin login: %v", err)
+		}
+		if err := prop.saveCeremony(c, loginSessionKey, data); err != nil {
+			t.Fatalf("save ceremony: %v", err)
+		}
+	})
+	return options
+}
+
+// finishDiscoverable finishes like PostLoginFinish, users are found by handle among known
+func finishDiscoverable(t *testing.T, prop *passkeyHandlerProps, client *browser, body []byte, known ...*utils.PasskeyUser) (*webauthn.Credential, error) {
+	t.Helper()
+
+	var (
+		credential *webauthn.Credential
+		err        error
+	)
+	client.do(body, func(c *gin.Context) {
+		data, ok := prop.takeCeremony(c, loginSessionKey)
+		if !ok {
+			t.Fatal("login ceremony missing from session")
+		}
+		credential, err = prop.WebAuthn.FinishDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			for _, user := range known {
+				if bytes.Equal(user.Handle, userHandle) {
+					return user, nil
+				}
+			}
+			return nil, protocol.ErrBadRequest.WithDetails(utils.PasskeyUnknown)
+		}, data, c.Request)
+	})
+	return credential, err
+}
+
+// finishSecondStep finishes like PostSecondStepFinish for the pending user
+func finishSecondStep(t *testing.T, prop *passkeyHandlerProps, client *browser, body []byte, user *utils.PasskeyUser) (*webauthn.Credential, error) {
+	t.Helper()
+
+	var (
+		credential *webauthn.Credential
+		err        error
+	)
+	client.do(body, func(c *gin.Context) {
+		data, ok := prop.takeCeremony(c, loginSessionKey)
+		if !ok {
+			t.Fatal("login ceremony missing from session")
+		}
+		credential, err = prop.WebAuthn.FinishLogin(user, data, c.Request)
+	})
+	return credential, err
+}
+
+// describe adds the details of protocol errors, which the message alone leaves out
+func describe(err error) string {
+	if protocolErr, ok := err.(*protocol.Error); ok {
+		return protocolErr.Error() + ": " + protocolErr.Details + " " + protocolErr.DevInfo
+	}
+	return err.Error()
+}
+
+func newPasskeyUser(id string, username string) *utils.PasskeyUser {
+	return &utils.PasskeyUser{
+		User:   utils.User{ID: id, Username: username},
+		Handle: utils.GenerateRandomKey(32),
+	}
+}
+
+func TestRegistration(t *testing.T) {
+	prop := newProps(t)
+	key := newAuthenticator(t)
+	user := newPasskeyUser("1", "alice")
+
+	register(t, prop, key, user)
+
+	if len(user.Credentials) != 1 {
+		t.Fatalf("credentials = %d, want 1", len(user.Credentials))
+	}
+	credential := user.Credentials[0]
+	if !bytes.Equal(credential.ID, key.credentialID) {
+		t.Errorf("credential id = %x, want %x", credential.ID, key.credentialID)
+	}
+	if credential.AttestationType != "none" {
+		t.Errorf("attestation type = %q, want none", credential.AttestationType)
+	}
+	if !bytes.Equal(key.userHandle, user.Handle) {
+		t.Errorf("authenticator got user handle %x, want %x", key.userHandle, user.Handle)
+	}
+}
+
+func TestRegistrationRejectsOtherOrigin(t *testing.T) {
+	prop := newProps(t)
+	key := newAuthenticator(t)
+	key.origin = "https://evil.example.com"
+	user := newPasskeyUser("1", "alice")
+
+	var (
+		client  browser
+		options *protocol.CredentialCreation
+	)
+	client.do(nil, func(c *gin.Context) {
+		var data *webauthn.SessionData
+		var err error
+		if options, data, err = prop.WebAuthn.BeginRegistration(user); err != nil {
+			t.Fatalf("begin registration: %v", err)
+		}
+		prop.saveCeremony(c, registrationSessionKey, data)
+	})
+
+	client.do(key.create(t, options), func(c *gin.Context) {
+		data, _ := prop.takeCeremony(c, registrationSessionKey)
+		if _, err := prop.WebAuthn.FinishRegistration(user, data, c.Request); err == nil {
+			t.Error("registration from another origin was accepted")
+		}
+	})
+}
+
+func TestDiscoverableLogin(t *testing.T) {
+	prop := newProps(t)
+	key := newAuthenticator(t)
+	alice := newPasskeyUser("1", "alice")
+	bob := newPasskeyUser("2", "bob")
+	register(t, prop, key, alice)
+
+	var client browser
+	options := beginDiscoverable(t, prop, &client)
+	if options.Response.UserVerification != protocol.VerificationRequired {
+		t.Errorf("user verification = %q, want required", options.Response.UserVerification)
+	}
+	if len(options.Response.AllowedCredentials) != 0 {
+		t.Errorf("discoverable options list %d credentials", len(options.Response.AllowedCredentials))
+	}
+
+	credential, err := finishDiscoverable(t, prop, &client, key.get(t, options), bob, alice)
+	if err != nil {
+		t.Fatalf("finish login: %v", describe(err))
+	}
+	if !bytes.Equal(credential.ID, key.credentialID) {
+		t.Errorf("credential id = %x, want %x", credential.ID, key.credentialID)
+	}
+	if credential.Authenticator.SignCount != key.counter || credential.Authenticator.CloneWarning {
+		t.Errorf("sign count = %d clone warning = %v, want %d without warning", credential.Authenticator.SignCount, credential.Authenticator.CloneWarning, key.counter)
+	}
+
+	// The ceremony was taken, the returned cookie cannot finish another login
+	recorder := client.do(key.get(t, options), prop.PostLoginFinish)
+	if recorder.Code != http.StatusBadRequest {
+		t.Errorf("second PostLoginFinish status = %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+}
+
+// fakeLogins finds passkey users in memory instead of the database and counts saved uses
+type fakeLogins struct {
+	users []*utils.PasskeyUser
+	used  int
+}
+
+func (logins *fakeLogins) FindPasskeyUserByHandle(handle []byte) (*utils.PasskeyUser, error) {
+	for _, user := range logins.users {
+		if bytes.Equal(user.Handle, handle) {
+			return user, nil
+		}
+	}
+	return nil, protocol.ErrBadRequest.WithDetails(utils.PasskeyUnknown)
+}
+
+func (logins *fakeLogins) UsePasskey(userID string, credential *webauthn.Credential) error {
+	logins.used++
+	return nil
+}
+
+// sessionPrincipal returns the logged in user of the session kept by client
+func sessionPrincipal(client *browser, prop *passkeyHandlerProps) *utils.Principal {
+	var principal *utils.Principal
+	client.do(nil, func(c *gin.Context) {
+		principal, _ = handlers.GetUserFromSession(c, prop.Store)
+	})
+	return principal
+}
+
+func TestPostLoginFinish(t *testing.T) {
+	prop := newProps(t)
+	key := newAuthenticator(t)
+	user := newPasskeyUser("1", "alice")
+	register(t, prop, key, user)
+	logins := &fakeLogins{users: []*utils.PasskeyUser{user}}
+	prop.Logins = logins
+
+	var client browser
+	options := beginDiscoverable(t, prop, &client)
+	if recorder := client.do(key.get(t, options), prop.PostLoginFinish); recorder.Code != http.StatusOK {
+		t.Fatalf("PostLoginFinish status = %d, want %d: %s", recorder.Code, http.StatusOK, recorder.Body)
+	}
+	if logins.used != 1 {
+		t.Errorf("passkey use saved %d times, want 1", logins.used)
+	}
+	if principal := sessionPrincipal(&client, prop); principal == nil || principal.ID != "1" {
+		t.Errorf("logged in user = %v, want 1", principal)
+	}
+}
+
+func TestPostLoginFinishRefusesPasswordReset(t *testing.T) {
+	prop := newProps(t)
+	key := newAuthenticator(t)
+	user := newPasskeyUser("1", "alice")
+	user.PasswordResetRequired = true
+	register(t, prop, key, user)
+	prop.Logins = &fakeLogins{users: []*utils.PasskeyUser{user}}
+
+	// A passkey does not get around the new password an admin asked for
+	var client browser
+	options := beginDiscoverable(t, prop, &client)
+	recorder := client.do(key.get(t, options), prop.PostLoginFinish)
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("PostLoginFinish status = %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+
+	var answer struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &answer); err != nil || answer.Error != utils.PasswordResetRequired {
+		t.Errorf("PostLoginFinish answer = %s, want error %q", recorder.Body, utils.PasswordResetRequired)
+	}
+	if principal := sessionPrincipal(&client, prop); principal != nil {
+		t.Errorf("session has user %v", principal)
+	}
+}
+
+func TestDiscoverableLoginRequiresUserVerification(t *testing.T) {
+	prop := newProps(t)
+	key := newAuthenticator(t)
+	user := newPasskeyUser("1", "alice")
+	register(t, prop, key, user)
+
+	// A security key that only checks presence must not replace password and second factor
+	key.verifyUser = false
+
+	var client browser
+	options := beginDiscoverable(t, prop, &client)
+	if _, err := finishDiscoverable(t, prop, &client, key.get(t, options), user); err == nil {
+		t.Error("discoverable login without user verification was accepted")
+	}
+}
+
+func TestDiscoverableLoginUnknownHandle(t *testing.T) {
+	prop := newProps(t)
+	key := newAuthenticator(t)
+	user := newPasskeyUser("1", "alice")
+	register(t, prop, key, user)
+
+	var client browser
+	options := beginDiscoverable(t, prop, &client)
+	if _, err := finishDiscoverable(t, prop, &client, key.get(t, options), newPasskeyUser("2", "bob")); err == nil {
+		t.Error("login with a handle of no user was accepted")
+	}
+}
+
+func TestSecondStep(t *testing.T) {
+	prop := newProps(t)
+	key := newAuthenticator(t)
+	user := newPasskeyUser("1", "alice")
+	register(t, prop, key, user)
+
+	// The password was checked, presence of a registered key is enough as second factor
+	key.verifyUser = false
+
+	var client browser
+	options := beginSecondStep(t, prop, &client, user)
+	if len(options.Response.AllowedCredentials) != 1 || !bytes.Equal(options.Response.AllowedCredentials[0].CredentialID, key.credentialID) {
+		t.Errorf("allowed credentials = %v, want the registered passkey", options.Response.AllowedCredentials)
+	}
+
+	credential, err := finishSecondStep(t, prop, &client, key.get(t, options), user)
+	if err != nil {
+		t.Fatalf("finish second step: %v", describe(err))
+	}
+	if credential.Authenticator.SignCount != key.counter {
+		t.Errorf("sign count = %d, want %d", credential.Authenticator.SignCount, key.counter)
+	}
+}
+
+func TestSecondStepRejectsPasskeyOfOtherUser(t *testing.T) {
+	prop := newProps(t)
+	alice := newPasskeyUser("1", "alice")
+	bob := newPasskeyUser("2", "bob")
+	aliceKey := newAuthenticator(t)
+	bobKey := newAuthenticator(t)
+	register(t, prop, aliceKey, alice)
+	register(t, prop, bobKey, bob)
+
+	var client browser
+	options := beginSecondStep(t, prop, &client, alice)
+	if _, err := finishSecondStep(t, prop, &client, bobKey.get(t, options), alice); err == nil {
+		t.Error("second step accepted a passkey of another user")
+	}
+}
+
+func TestSecondStepCloneWarning(t *testing.T) {
+	prop := newProps(t)
+	key := newAuthenticator(t)
+	user := newPasskeyUser("1", "alice")
+	register(t, prop, key, user)
+
+	key.counter = 10
+	var client browser
+	options := beginSecondStep(t, prop, &client, user)
+	credential, err := finishSecondStep(t, prop, &client, key.get(t, options), user)
+	if err != nil {
+		t.Fatalf("finish second step: %v", describe(err))
+	}
+	user.Credentials[0] = *credential
+
+	// A copy of the key answers with an older counter, finishAssertion fails the login on the warning
+	key.counter = 5
+	options = beginSecondStep(t, prop, &client, user)
+	credential, err = finishSecondStep(t, prop, &client, key.get(t, options), user)
+	if err != nil {
+		t.Fatalf("finish second step: %v", describe(err))
+	}
+	if !credential.Authenticator.CloneWarning {
+		t.Error("counter going back gave no clone warning")
+	}
+}
+
+// Both logins keep their ceremony under loginSessionKey, one must not finish with the data of the other
+
+func TestSecondStepRejectsDiscoverableCeremony(t *testing.T) {
+	prop := newProps(t)
+	key := newAuthenticator(t)
+	user := newPasskeyUser("1", "alice")
+	register(t, prop, key, user)
+
+	// PostLoginBegin was called in the same browser before the password form was sent
+	var client browser
+	options := beginDiscoverable(t, prop, &client)
+	if _, err := finishSecondStep(t, prop, &client, key.get(t, options), user); err == nil {
+		t.Error("second step finished with a discoverable ceremony")
+	}
+}
+
+func TestDiscoverableLoginRejectsSecondStepCeremony(t *testing.T) {
+	prop := newProps(t)
+	key := newAuthenticator(t)
+	user := newPasskeyUser("1", "alice")
+	register(t, prop, key, user)
+
+	// The challenge of the second step is not bound to user verification, it must not log in alone
+	var client browser
+	options := beginSecondStep(t, prop, &client, user)
+	if _, err := finishDiscoverable(t, prop, &client, key.get(t, options), user); err == nil {
+		t.Error("discoverable login finished with a second step ceremony")
+	}
+}
+
+func TestLaterCeremonyReplacesEarlier(t *testing.T) {
+	prop := newProps(t)
+	key := newAuthenticator(t)
+	user := newPasskeyUser("1", "alice")
+	register(t, prop, key, user)
+
+	var client browser
+	discoverable := beginDiscoverable(t, prop, &client)
+	beginSecondStep(t, prop, &client, user)
+
+	// The discoverable challenge was overwritten, so its answer does not match the stored one
+	if _, err := finishSecondStep(t, prop, &client, key.get(t, discoverable), user); err == nil {
+		t.Error("answer to a replaced challenge was accepted")
+	}
+}
+
+func TestFinishWithoutCeremony(t *testing.T) {
+	prop := newProps(t)
+
+	var client browser
+	if recorder := client.do([]byte("{}"), prop.PostLoginFinish); recorder.Code != http.StatusBadRequest {
+		t.Errorf("PostLoginFinish status = %d, want %d", recorder.Code, http.StatusBadRequest)
+	}
+	if recorder := client.do([]byte("{}"), prop.PostSecondStepFinish); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("PostSecondStepFinish without pending login status = %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+}
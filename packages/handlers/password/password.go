@@ -0,0 +1,160 @@
+package password
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+
+	"todoweb/packages/config"
+	"todoweb/packages/handlers"
+	"todoweb/packages/mailer"
+	"todoweb/packages/utils"
+)
+
+// PasswordHandlers defines the interface for the forgotten password flow.
+type PasswordHandlers interface {
+	GetForgot(c *gin.Context)  // Renders the "forgot password" form.
+	PostForgot(c *gin.Context) // Sends the reset link.
+	GetReset(c *gin.Context)   // Renders the new password form for a token.
+	PostReset(c *gin.Context)  // Sets the new password.
+}
+
+// First lines of reset emails, telling why the link was sent
+const (
+	ResetReasonForgot = "someone asked to reset the password of your TodoWebApp account.\nIf it was not you, ignore this email."
+	ResetReasonAdmin  = "an administrator asked you to choose a new password for your TodoWebApp account.\nYour current password is not accepted until then."
+)
+
+// SendResetLink creates a reset token for user and emails the link in the background, reason is one of the ResetReason* texts.
+// Used by the "forgot password" form and by the admin console.
+func SendResetLink(database *utils.DataBaseProps, mail mailer.Mailer, user utils.User, reason string) error {
+	token, err := database.CreatePasswordResetToken(user.ID, config.Options.PasswordResetTTL)
+	if err != nil {
+		return err
+	}
+
+	subject, body := ResetMail(user, reason, token)
+
+	go func() {
+		if err := mail.Send(user.Email, subject, body); err != nil {
+			log.Printf("reset mail error: %v\n", err)
+		}
+	}()
+
+	return nil
+}
+
+// ResetMail returns subject and body of the email with the reset link of token, reason is one of the ResetReason* texts
+func ResetMail(user utils.User, reason string, token string) (string, string) {
+	link := config.Options.BaseURL + handlers.RoutesPointer.ResetPasswordConfig.Path + "?token=" + url.QueryEscape(token)
+	body := fmt.Sprintf(
+		"Hello %s,\n\n%s\n\nOpen the link below to choose a new password, it is valid for %s and can be used once:\n\n%s\n",
+		user.Username, reason, config.Options.PasswordResetTTL, link,
+	)
+
+	return "Password reset", body
+}
+
+// passwordHandlerProps holds dependencies for password handlers.
+type passwordHandlerProps struct {
+	Database *utils.DataBaseProps // Database connection properties.
+	Mailer   mailer.Mailer        // Sends the reset links.
+}
+
+// GetForgot renders the "forgot password" page.
+func (prop *passwordHandlerProps) GetForgot(c *gin.Context) {
+	handlers.RenderHTML(c, http.StatusOK, handlers.RoutesPointer.ForgotPasswordConfig.PageName, nil)
+}
+
+// PostForgot emails a reset link if the address belongs to a user.
+// The answer is the same whether the address exists or not, and the email is sent in the background,
+// so the page does not tell which addresses are registered.
+func (prop *passwordHandlerProps) PostForgot(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.ForgotPasswordConfig.Path)
+		return
+	}
+
+	email := utils.TrimSpace(c.PostForm(handlers.RoutesPointer.ForgotPasswordConfig.ParseKeys.EmailParseKey))
+
+	data := gin.H{utils.MessageHTML: utils.ResetLinkSent}
+
+	user, err := prop.Database.FetchUserByEmail(email)
+	if err != nil {
+		if err.Error() != fmt.Sprintf(utils.UserNotFound, email) {
+			log.Printf("forgot password lookup error: %v\n", err)
+		}
+		handlers.RenderHTML(c, http.StatusOK, handlers.RoutesPointer.ForgotPasswordConfig.PageName, data)
+		return
+	}
+
+	if err := SendResetLink(prop.Database, prop.Mailer, user, ResetReasonForgot); err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.RenderHTML(c, http.StatusOK, handlers.RoutesPointer.ForgotPasswordConfig.PageName, data)
+}
+
+// GetReset renders the new password form if the token is still valid.
+func (prop *passwordHandlerProps) GetReset(c *gin.Context) {
+	token := c.Query("token")
+
+	valid, err := prop.Database.IsPasswordResetTokenValid(token)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	data := gin.H{"Token": token}
+	if !valid {
+		data[utils.ErrorResetHTML] = utils.ResetTokenInvalid
+	}
+
+	handlers.RenderHTML(c, http.StatusOK, handlers.RoutesPointer.ResetPasswordConfig.PageName, data)
+}
+
+// PostReset validates the new password with the registration rules and stores it.
+func (prop *passwordHandlerProps) PostReset(c *gin.Context) {
+	if err := c.Request.ParseForm(); err != nil {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.ForgotPasswordConfig.Path)
+		return
+	}
+
+	keys := handlers.RoutesPointer.ResetPasswordConfig.ParseKeys
+	token := c.PostForm("token")
+	password := utils.TrimSpace(c.PostForm(keys.PasswordParseKey))
+	rePassword := utils.TrimSpace(c.PostForm(keys.RePasswordParseKey))
+
+	data := gin.H{"Token": token}
+
+	if err := utils.IsValidPassword(password, rePassword); err != nil {
+		utils.SetPasswordErrors(data, err)
+		handlers.RenderHTML(c, http.StatusOK, handlers.RoutesPointer.ResetPasswordConfig.PageName, data)
+		return
+	}
+
+	if err := prop.Database.ResetPasswordWithToken(token, password, c.ClientIP(), c.Request.UserAgent()); err != nil {
+		if err.Error() == utils.ResetTokenInvalid {
+			data[utils.ErrorResetHTML] = err.Error()
+			handlers.RenderHTML(c, http.StatusOK, handlers.RoutesPointer.ResetPasswordConfig.PageName, data)
+			return
+		}
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// Back to login, the new password can be used right away
+	c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.ResetPasswordConfig.RedirectPath)
+}
+
+// NewPasswordHandler creates a new instance of PasswordHandlers.
+func NewPasswordHandler(db *utils.DataBaseProps, mail mailer.Mailer) PasswordHandlers {
+	return &passwordHandlerProps{
+		Database: db,   // Set the database property.
+		Mailer:   mail, // Set the mailer property.
+	}
+}
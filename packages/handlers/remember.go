@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"todoweb/packages/config"
+	"todoweb/packages/utils"
+)
+
+// The session cookie stays short and sliding, a remembered login lives in a second cookie holding a token
+// that is checked against remember_tokens and replaced on every use, see utils.UseRememberToken.
+
+// setRememberCookie stores token in the remember me cookie, maxAge -1 removes the cookie.
+// It follows the options of the session cookie, so it is Secure whenever the session cookie is.
+func setRememberCookie(c *gin.Context, Store *sessions.CookieStore, token string, maxAge int) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     RoutesPointer.Cookie.RememberNaming,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   Store.Options.Secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// RememberUserSession keeps the login of the session after the session cookie expires, called after StartUserSession
+// when the user ticked "Remember me". The token gets the auth time and methods of the principal.
+func RememberUserSession(c *gin.Context, Store *sessions.CookieStore, Database *utils.DataBaseProps) error {
+	if config.Options.RememberMeTTL <= 0 {
+		return nil
+	}
+
+	_, principal, ok := GetSessionAndUser(c, Store)
+	if !ok {
+		return fmt.Errorf("no user in session")
+	}
+
+	token, err := Database.CreateRememberToken(principal, config.Options.RememberMeTTL, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		return err
+	}
+
+	setRememberCookie(c, Store, token, int(config.Options.RememberMeTTL.Seconds()))
+	return nil
+}
+
+// RestoreUserSession logs in the user of the remember me cookie when the session has no user, used by middleware.Auth.
+// The token is rotated and the principal keeps the auth time of the original login, with utils.AuthMethodRemember added.
+// No credentials were entered for the new session, so sensitive settings ask for the password first (sudo mode).
+// Refused tokens remove the cookie, database errors keep it for the next request.
+func RestoreUserSession(c *gin.Context, Store *sessions.CookieStore, Database *utils.DataBaseProps) (*sessions.Session, *utils.Principal, bool) {
+	token, err := c.Cookie(RoutesPointer.Cookie.RememberNaming)
+	if err != nil || token == "" || config.Options.RememberMeTTL <= 0 {
+		return nil, nil, false
+	}
+
+	login, newToken, err := Database.UseRememberToken(token, config.Options.RememberMeTTL, c.ClientIP(), c.Request.UserAgent())
+	if err != nil {
+		switch err.Error() {
+		case utils.RememberTokenReused:
+			log.Printf("reused remember me token from %s, sessions of its user were logged out\n", c.ClientIP())
+		case utils.RememberTokenInvalid:
+		default:
+			log.Printf("remember me error: %v\n", err)
+			return nil, nil, false
+		}
+		setRememberCookie(c, Store, "", -1)
+		return nil, nil, false
+	}
+
+	// The new token is sent even if the session can not be saved, the old one is used up
+	setRememberCookie(c, Store, newToken, int(config.Options.RememberMeTTL.Seconds()))
+
+	// A session cookie that can not be decoded (e.g. after a restart, the key is random) still gives a new empty session
+	session, _ := Store.Get(c.Request, RoutesPointer.Cookie.Naming)
+	if session == nil {
+		return nil, nil, false
+	}
+
+	principal := utils.NewPrincipal(login.User, append(login.AuthMethods, utils.AuthMethodRemember)...)
+	principal.AuthTime = login.AuthTime
+	principal.VerifiedAt = time.Time{}
+	session.Values[RoutesPointer.Cookie.UserInfoKey] = principal
+	if err := sessions.Save(c.Request, c.Writer); err != nil {
+		log.Printf("session save error: %v\n", err)
+		return nil, nil, false
+	}
+
+	RecordSecurityEvent(c, Database, principal.ID, utils.AuditEventLoginSucceeded, strings.Join(principal.AuthMethods, " "))
+
+	return session, principal, true
+}
+
+// ForgetUserSession revokes the remembered login of the browser and removes its cookie, used at logout
+func ForgetUserSession(c *gin.Context, Store *sessions.CookieStore, Database *utils.DataBaseProps) error {
+	token, err := c.Cookie(RoutesPointer.Cookie.RememberNaming)
+	if err != nil || token == "" {
+		return nil
+	}
+
+	setRememberCookie(c, Store, "", -1)
+	return Database.RevokeRememberToken(token)
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"html/template"
+
+	"github.com/gin-gonic/gin"
+
+	"todoweb/packages/config"
+)
+
+// RenderHTML renders page like c.HTML and adds the CSRF token of the request to data,
+// so every form can use {{ csrfField .CSRFToken }}. nil data is allowed.
+func RenderHTML(c *gin.Context, status int, page string, data gin.H) {
+	if data == nil {
+		data = gin.H{}
+	}
+
+	data[RoutesPointer.CSRF.TemplateKey] = c.GetString(RoutesPointer.CSRF.SessionKey)
+	c.HTML(status, page, data)
+}
+
+// CSRFField is the csrfField template function, it returns the hidden input carrying token
+func CSRFField(token string) template.HTML {
+	return template.HTML(`<input type="hidden" name="` + RoutesPointer.CSRF.FormField + `" value="` + template.HTMLEscapeString(token) + `">`)
+}
+
+// SSOName is the ssoName template function, it returns the name of the single sign-on provider or "" if none is set
+func SSOName() string {
+	if config.Options.OIDCIssuer == "" {
+		return ""
+	}
+
+	return config.Options.OIDCProviderName
+}
+
+// RememberMe is the rememberMe template function, it reports whether the login page offers the remember me checkbox
+func RememberMe() bool {
+	return config.Options.RememberMeTTL > 0
+}
@@ -1,6 +1,12 @@
 package handlers
 
 import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
 	"todoweb/packages/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/sessions"
@@ -9,23 +15,61 @@ import (
 // RoutesPointer holds the route configuration for the application.
 var RoutesPointer *config.RouteConfig = config.Routes
 
-// getUserFromSession retrieves the user information from the session.
-func GetUserFromSession(c *gin.Context, Store *sessions.CookieStore) (*utils.User, bool) {
+// Context key of a principal that did not come from the session, see SetRequestPrincipal
+const principalContextKey = "principal"
+
+// SetRequestPrincipal authenticates the current request as principal without a session,
+// used by APIAuth for OAuth bearer tokens. GetUserFromSession returns it for the rest of the request.
+func SetRequestPrincipal(c *gin.Context, principal *utils.Principal) {
+	c.Set(principalContextKey, principal)
+}
+
+// getUserFromSession retrieves the principal of the logged-in user from the session,
+// or the principal of a bearer token set by SetRequestPrincipal.
+func GetUserFromSession(c *gin.Context, Store *sessions.CookieStore) (*utils.Principal, bool) {
+	if principal, ok := c.Get(principalContextKey); ok {
+		return principal.(*utils.Principal), true
+	}
+
 	session, err := Store.Get(c.Request, RoutesPointer.Cookie.Naming)
 	if err != nil {
 		return nil, false // If session retrieval fails, return nil and false.
 	}
 
-	userInterface, ok := session.Values[RoutesPointer.Cookie.UserInfoKey].(*utils.User)
-	return userInterface, ok // Return the user info and whether it was successful.
+	return principalFromSession(c, session)
+}
+
+// principalFromSession reads the principal stored under UserInfoKey.
+// A principal past the idle timeout or the maximum session lifetime is not returned, the user has to log in again.
+// Cookies written before principals existed hold the whole utils.User including the password hash,
+// they are rewritten with a principal on first use, so the hash leaves the cookie.
+func principalFromSession(c *gin.Context, session *sessions.Session) (*utils.Principal, bool) {
+	switch value := session.Values[RoutesPointer.Cookie.UserInfoKey].(type) {
+	case *utils.Principal:
+		if value.Expired(config.Options.SessionIdleTimeout, config.Options.SessionMaxLifetime) {
+			return nil, false
+		}
+		return value, true
+	case *utils.User:
+		principal := utils.PrincipalFromLegacyUser(value)
+		session.Values[RoutesPointer.Cookie.UserInfoKey] = principal
+		if err := sessions.Save(c.Request, c.Writer); err != nil {
+			// Old cookie can not be replaced, it is not accepted either
+			delete(session.Values, RoutesPointer.Cookie.UserInfoKey)
+			return nil, false
+		}
+		return principal, true
+	default:
+		return nil, false
+	}
 }
 
 // GetSessionAndUser retrieves the session and user information from the provided request context.
 // It first attempts to retrieve the session using the provided CookieStore and session naming convention.
 // If the session retrieval fails, it returns nil for both the session and user, and false to indicate failure.
-// If successful, it extracts the user information from the session values using the UserInfoKey.
-// The function returns the session, the user information (if available), and a boolean indicating success.
-func GetSessionAndUser (c *gin.Context, Store *sessions.CookieStore) (*sessions.Session, *utils.User, bool) {
+// If successful, it extracts the principal from the session values using the UserInfoKey.
+// The function returns the session, the principal (if available), and a boolean indicating success.
+func GetSessionAndUser (c *gin.Context, Store *sessions.CookieStore) (*sessions.Session, *utils.Principal, bool) {
     // Retrieve the session from the request using the session name defined in the Routes configuration.
     session, err := Store.Get(c.Request, RoutesPointer.Cookie.Naming)
     if err != nil {
@@ -33,8 +77,8 @@ func GetSessionAndUser (c *gin.Context, Store *sessions.CookieStore) (*sessions.
         return nil, nil, false
     }
 
-    // Attempt to retrieve the user information from the session values using the predefined key.
-    userInterface, ok := session.Values[RoutesPointer.Cookie.UserInfoKey].(*utils.User)
+    // Attempt to retrieve the principal from the session values, old cookies are upgraded.
+    userInterface, ok := principalFromSession(c, session)
     
     // Return the session object, the user information, and a boolean indicating whether the retrieval was successful.
     return session, userInterface, ok
@@ -45,13 +89,14 @@ func GetSessionAndUser (c *gin.Context, Store *sessions.CookieStore) (*sessions.
 // - c: The Gin context, which contains the HTTP request and response.
 // - Store: The session cookie store used to retrieve and manage session data.
 // Returns:
-// - *sessions.Session: The session object if successfully retrieved.
-// - bool: A boolean indicating whether the session retrieval was successful (true) or if an error occurred (false).
+// - *sessions.Session: The session object, a new empty one if the cookie can not be decoded.
+// - bool: A boolean indicating whether a session was returned (true) or not (false).
 func GetSession(c *gin.Context, Store *sessions.CookieStore) (*sessions.Session, bool) {
 	// Retrieve the session from the request using the session name defined in the Routes configuration.
-	session, err := Store.Get(c.Request, RoutesPointer.Cookie.Naming)
-	if err != nil {
-		// If session retrieval fails, return nil for the session and false to indicate an error.
+	// A cookie that can not be decoded (e.g. after a restart, the key is random) still gives a new empty session,
+	// saving it replaces the cookie. Like RestoreUserSession the error is ignored, so the login pages keep working.
+	session, _ := Store.Get(c.Request, RoutesPointer.Cookie.Naming)
+	if session == nil {
 		return nil, false
 	}
 
@@ -68,18 +113,18 @@ func GetSession(c *gin.Context, Store *sessions.CookieStore) (*sessions.Session,
 // Returns:
 // - error: If an error occurs while retrieving or saving the session, it's returned, otherwise nil.
 func SetSession(c *gin.Context, Store *sessions.CookieStore, key string, value interface{}) error {
-	// Retrieve the session using the session name from the Routes configuration.
-	session, err := Store.Get(c.Request, RoutesPointer.Cookie.Naming)
-	if err != nil {
+	// Retrieve the session using the session name from the Routes configuration, see GetSession for undecodable cookies.
+	session, ok := GetSession(c, Store)
+	if !ok {
 		// Return an error if there was an issue retrieving the session.
-		return err
+		return fmt.Errorf("session error")
 	}
 
 	// Set the session value using the provided key and value.
 	session.Values[key] = value
 
 	// Save the session to persist the changes.
-	err = sessions.Save(c.Request, c.Writer)
+	err := sessions.Save(c.Request, c.Writer)
 	if err != nil {
 		// Return an error if saving the session fails.
 		return err
@@ -88,3 +133,171 @@ func SetSession(c *gin.Context, Store *sessions.CookieStore, key string, value i
 	// Return nil if no errors occurred.
 	return nil
 }
+
+// StartUserSession stores the principal of user in the session once every login step is done,
+// methods are the utils.AuthMethod* constants of the steps. The login is written to the security event log.
+// A pending login of the two-step flow is removed, so it can not be finished twice.
+// Disabled users and users who must choose a new password are refused for every login method, the error is
+// utils.AccountDisabled or utils.PasswordResetRequired and can be shown to the user.
+func StartUserSession(c *gin.Context, Store *sessions.CookieStore, Database *utils.DataBaseProps, user *utils.User, methods ...string) error {
+	if user.Disabled {
+		return fmt.Errorf(utils.AccountDisabled)
+	}
+
+	if user.PasswordResetRequired {
+		return fmt.Errorf(utils.PasswordResetRequired)
+	}
+
+	session, ok := GetSession(c, Store)
+	if !ok {
+		return fmt.Errorf("session error")
+	}
+
+	delete(session.Values, RoutesPointer.Cookie.PendingLoginKey)
+	session.Values[RoutesPointer.Cookie.UserInfoKey] = utils.NewPrincipal(*user, methods...)
+
+	if err := sessions.Save(c.Request, c.Writer); err != nil {
+		return err
+	}
+
+	RecordSecurityEvent(c, Database, user.ID, utils.AuditEventLoginSucceeded, strings.Join(methods, " "))
+	return nil
+}
+
+// RecordSecurityEvent writes event of userID with address and browser of the request to the security event log.
+// The request goes on when the log can not be written, the error is only printed.
+func RecordSecurityEvent(c *gin.Context, Database *utils.DataBaseProps, userID string, event string, detail string) {
+	if err := Database.RecordSecurityEvent(userID, event, detail, c.ClientIP(), c.Request.UserAgent()); err != nil {
+		log.Printf("security event error: %v\n", err)
+	}
+}
+
+// RefreshUserSession copies username and session version of user into the current principal,
+// used after the account was changed in this session. Session id and auth time stay the same.
+func RefreshUserSession(c *gin.Context, Store *sessions.CookieStore, user *utils.User) error {
+	_, principal, ok := GetSessionAndUser(c, Store)
+	if !ok {
+		return fmt.Errorf("no user in session")
+	}
+
+	// principal points into the session values, so saving writes the change
+	principal.Update(*user)
+
+	return sessions.Save(c.Request, c.Writer)
+}
+
+// ConfirmRecentAuth records that the user entered credentials again in the current session,
+// so sensitive settings can be changed for the next config.Settings.SudoModeTTL (sudo mode).
+func ConfirmRecentAuth(c *gin.Context, Store *sessions.CookieStore) error {
+	_, principal, ok := GetSessionAndUser(c, Store)
+	if !ok {
+		return fmt.Errorf("no user in session")
+	}
+
+	// principal points into the session values, so saving writes the change
+	principal.VerifiedAt = time.Now()
+
+	return sessions.Save(c.Request, c.Writer)
+}
+
+// CheckCurrentPassword checks password of user before an account change in a running session. A wrong password counts
+// as a failed login of the username and is written to the security event log, so a stolen session can not guess it
+// faster than the login form allows. The result is http.StatusOK without message when the password is right,
+// otherwise the status and message (utils.LoginLocked or utils.CurrentPasswordInvalid) to show.
+func CheckCurrentPassword(c *gin.Context, Database *utils.DataBaseProps, user *utils.User, password string) (int, string, error) {
+	userKey := utils.UserLoginKey(user.Username)
+	lockedUntil, err := Database.LoginLockedUntil(userKey)
+	if err != nil {
+		return http.StatusInternalServerError, "", err
+	}
+	if !lockedUntil.IsZero() {
+		return http.StatusTooManyRequests, utils.LoginLocked, nil
+	}
+
+	if !utils.ComparePassword(password, user.PasswordHash) {
+		limits := utils.LoginLimits{
+			MaxFailures: config.Options.LoginMaxFailures,
+			LockoutBase: config.Options.LoginLockoutBase,
+			LockoutMax:  config.Options.LoginLockoutMax,
+		}
+		if _, err := Database.RegisterLoginFailure(userKey, limits, user.ID, c.ClientIP()); err != nil {
+			return http.StatusInternalServerError, "", err
+		}
+		RecordSecurityEvent(c, Database, user.ID, utils.AuditEventLoginFailed, utils.AuthMethodPassword+", reauth")
+		return http.StatusForbidden, utils.CurrentPasswordInvalid, nil
+	}
+
+	if err := Database.ClearLoginFailures(userKey); err != nil {
+		return http.StatusInternalServerError, "", err
+	}
+
+	return http.StatusOK, "", nil
+}
+
+// GetPendingLogin returns the login waiting for its second step, an expired one is removed from the session.
+func GetPendingLogin(c *gin.Context, Store *sessions.CookieStore) (*utils.PendingLogin, bool) {
+	session, err := Store.Get(c.Request, RoutesPointer.Cookie.Naming)
+	if err != nil {
+		return nil, false
+	}
+
+	pending, ok := session.Values[RoutesPointer.Cookie.PendingLoginKey].(*utils.PendingLogin)
+	if !ok {
+		return nil, false
+	}
+
+	if pending.Expired() {
+		delete(session.Values, RoutesPointer.Cookie.PendingLoginKey)
+		sessions.Save(c.Request, c.Writer)
+		return nil, false
+	}
+
+	return pending, true
+}
+
+// Session key of the page a logged out user asked for, see SaveReturnPath
+const returnPathKey = "returnPath"
+
+// SaveReturnPath remembers path, so the user comes back to it after logging in (e.g. the OAuth consent page).
+// Only local paths are kept, so the login can not be used to redirect to other sites.
+func SaveReturnPath(c *gin.Context, Store *sessions.CookieStore, path string) error {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") || strings.HasPrefix(path, "/\\") {
+		return fmt.Errorf("return path is not local")
+	}
+
+	return SetSession(c, Store, returnPathKey, path)
+}
+
+// LoginRedirectPath returns the page to show after a finished login: a path saved by SaveReturnPath, removed
+// from the session so it is used once, or the task list.
+func LoginRedirectPath(c *gin.Context, Store *sessions.CookieStore) string {
+	session, err := Store.Get(c.Request, RoutesPointer.Cookie.Naming)
+	if err != nil {
+		return RoutesPointer.UserConfig.GetTask.Route
+	}
+
+	path, ok := session.Values[returnPathKey].(string)
+	if !ok {
+		return RoutesPointer.UserConfig.GetTask.Route
+	}
+
+	delete(session.Values, returnPathKey)
+	if err := sessions.Save(c.Request, c.Writer); err != nil {
+		return RoutesPointer.UserConfig.GetTask.Route
+	}
+
+	return path
+}
+
+// SessionStillValid reports whether principal may keep a long-lived connection (event stream, WebSocket) open.
+// Such connections are authorized once at connect, so they call it every utils.SessionRecheckInterval:
+// logout, a password change, "log out everywhere", disabling the account and the maximum lifetime end them.
+// The idle timeout is not checked, an open connection is activity.
+func SessionStillValid(Database *utils.DataBaseProps, principal *utils.Principal) (bool, error) {
+	maxLifetime := config.Options.SessionMaxLifetime
+	if maxLifetime > 0 && !principal.IssuedAt.IsZero() && time.Since(principal.IssuedAt) > maxLifetime {
+		return false, nil
+	}
+
+	return Database.SessionActive(principal.ID, principal.SessionID, principal.SessionVersion)
+}
@@ -0,0 +1,383 @@
+package settings
+
+import (
+	"archive/zip"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"todoweb/packages/config"
+	"todoweb/packages/handlers"
+	"todoweb/packages/handlers/sso"
+	"todoweb/packages/utils"
+)
+
+// SettingsHandlers defines the interface for the account settings page.
+type SettingsHandlers interface {
+	GetSettings(c *gin.Context)      // Renders the account settings page.
+	PostPassword(c *gin.Context)     // Changes the password and logs out other sessions.
+	PostUsername(c *gin.Context)     // Changes the username.
+	PostDelete(c *gin.Context)       // Schedules deletion of the account after the password is entered again.
+	PostCancelDelete(c *gin.Context) // Cancels a scheduled deletion.
+	GetExport(c *gin.Context)        // Sends every per-user record as ZIP of JSON files.
+	GetReauth(c *gin.Context)        // Asks for the password before a sensitive change, see middleware.RequireRecentAuth.
+	PostReauth(c *gin.Context)       // Checks the password and returns to the page that asked for it.
+	GetSecurity(c *gin.Context)      // Renders the recent security events of the account.
+}
+
+// Events shown on the security page, older ones are in the export
+const securityEventsShown = 50
+
+// settingsHandlerProps holds dependencies for settings handlers.
+type settingsHandlerProps struct {
+	Database *utils.DataBaseProps  // Database connection properties.
+	Store    *sessions.CookieStore // Cookie store for session management.
+}
+
+// renderSettings shows the settings page of principal, data holds messages of the current action
+func (prop *settingsHandlerProps) renderSettings(c *gin.Context, status int, principal *utils.Principal, data gin.H) {
+	// The session only has id and username, the rest of the account is read here
+	user, err := prop.Database.FetchUserByID(principal.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	scheduled, err := prop.Database.DeletionScheduledAt(user.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	linked, err := prop.Database.ListExternalIdentities(user.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	data["Username"] = user.Username
+	data["Email"] = user.Email
+	data["LinkedAccounts"] = linked
+	data["IsAdmin"] = user.IsAdmin()
+	data["CanInvite"] = user.IsAdmin() || config.Options.UserInvites
+	if !scheduled.IsZero() {
+		data["DeletionScheduled"] = fmt.Sprintf(utils.AccountDeletionScheduled, scheduled.Format("2006-01-02 15:04"))
+	}
+
+	handlers.RenderHTML(c, status, handlers.RoutesPointer.UserConfig.Settings.HTMLPageName, data)
+}
+
+// refreshSession copies the current database row into the principal of the session,
+// so the session carries the new username or session version.
+func (prop *settingsHandlerProps) refreshSession(c *gin.Context, principal *utils.Principal) error {
+	user, err := prop.Database.FetchUserByID(principal.ID)
+	if err != nil {
+		return err
+	}
+
+	return handlers.RefreshUserSession(c, prop.Store, &user)
+}
+
+// GetSettings renders the settings page.
+func (prop *settingsHandlerProps) GetSettings(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	// Single sign-on returns here after linking, see sso.GetCallback
+	data := gin.H{}
+	switch c.Query("sso") {
+	case sso.LinkedQuery:
+		data[utils.MessageHTML] = utils.SSOLinked
+	case sso.TakenQuery:
+		data[utils.ErrorSSOHTML] = utils.ExternalIdentityTaken
+	}
+
+	prop.renderSettings(c, http.StatusOK, user, data)
+}
+
+// PostPassword checks the current password and sets the new one.
+// Every other session of the user is logged out, the current one gets the new session version.
+func (prop *settingsHandlerProps) PostPassword(c *gin.Context) {
+	sessionUser, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	keys := handlers.RoutesPointer.Authentication.ParseKeys
+	current := c.PostForm(keys.CurrentPasswordParseKey)
+	password := c.PostForm(keys.PasswordParseKey)
+	rePassword := c.PostForm(keys.RePasswordParseKey)
+
+	// Password hash in the session may be outdated, so the user is read again
+	user, err := prop.Database.FetchUserByID(sessionUser.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// Wrong passwords count towards the login lockout, so a stolen session can not guess the current one
+	status, message, err := handlers.CheckCurrentPassword(c, prop.Database, &user, current)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if message != "" {
+		prop.renderSettings(c, status, sessionUser, gin.H{utils.ErrorPasswordHTML: message})
+		return
+	}
+
+	if err := utils.IsValidPassword(password, rePassword, user.Username, user.Email); err != nil {
+		data := gin.H{}
+		utils.SetPasswordErrors(data, err)
+		prop.renderSettings(c, http.StatusBadRequest, sessionUser, data)
+		return
+	}
+
+	if _, err := prop.Database.ChangePassword(user.ID, sessionUser.SessionID, password, c.ClientIP(), c.Request.UserAgent()); err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if err := prop.refreshSession(c, sessionUser); err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	prop.renderSettings(c, http.StatusOK, sessionUser, gin.H{utils.MessageHTML: utils.PasswordChanged})
+}
+
+// PostUsername renames the user if the new name is valid and not taken.
+func (prop *settingsHandlerProps) PostUsername(c *gin.Context) {
+	sessionUser, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	username := utils.TrimSpace(c.PostForm(handlers.RoutesPointer.Authentication.ParseKeys.UsernameParseKey))
+
+	if err := prop.Database.ChangeUsername(sessionUser.ID, username, c.ClientIP()); err != nil {
+		switch err.Error() {
+		case utils.UsernameEmpty, utils.UsernameContainsSpace, utils.UserAlreadyExistError:
+			prop.renderSettings(c, http.StatusBadRequest, sessionUser, gin.H{utils.ErrorUsernameHTML: err.Error()})
+		default:
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+		}
+		return
+	}
+
+	if err := prop.refreshSession(c, sessionUser); err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	prop.renderSettings(c, http.StatusOK, sessionUser, gin.H{utils.MessageHTML: utils.UsernameChanged})
+}
+
+// PostDelete schedules deletion of the account, the current password is required so a left open session is not enough.
+// The account keeps working during the grace period, PurgeDeletedAccounts removes it afterwards.
+func (prop *settingsHandlerProps) PostDelete(c *gin.Context) {
+	sessionUser, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	user, err := prop.Database.FetchUserByID(sessionUser.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	password := c.PostForm(handlers.RoutesPointer.Authentication.ParseKeys.PasswordParseKey)
+	status, message, err := handlers.CheckCurrentPassword(c, prop.Database, &user, password)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if message != "" {
+		prop.renderSettings(c, status, sessionUser, gin.H{utils.ErrorDeleteHTML: message})
+		return
+	}
+
+	if _, err := prop.Database.ScheduleAccountDeletion(user.ID, config.Options.AccountDeletionGrace, c.ClientIP()); err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.Settings.RedirectPath)
+}
+
+// PostCancelDelete keeps the account if its deletion was scheduled.
+func (prop *settingsHandlerProps) PostCancelDelete(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	if err := prop.Database.CancelAccountDeletion(user.ID, c.ClientIP()); err != nil {
+		if err.Error() == utils.AccountDeletionNotScheduled {
+			prop.renderSettings(c, http.StatusConflict, user, gin.H{utils.ErrorDeleteHTML: err.Error()})
+			return
+		}
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.Settings.RedirectPath)
+}
+
+// GetExport sends the personal data of the user as ZIP archive with one JSON file per record type.
+func (prop *settingsHandlerProps) GetExport(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	export, err := prop.Database.ExportAccount(user.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	files, err := export.Files()
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// Same order on every download
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	filename := fmt.Sprintf("todoweb-%s-%s.zip", user.Username, time.Now().Format("20060102"))
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Header("Cache-Control", "no-store")
+	c.Status(http.StatusOK)
+
+	archive := zip.NewWriter(c.Writer)
+	for _, name := range names {
+		entry, err := archive.Create(name)
+		if err == nil {
+			_, err = entry.Write(files[name])
+		}
+		if err != nil {
+			// Headers are already sent, the client gets a broken archive
+			log.Printf("export write error: %v\n", err)
+			return
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		log.Printf("export close error: %v\n", err)
+	}
+}
+
+// renderReauth shows the confirmation page, single sign-on is offered to users with a linked account
+func (prop *settingsHandlerProps) renderReauth(c *gin.Context, status int, principal *utils.Principal, data gin.H) {
+	linked, err := prop.Database.ListExternalIdentities(principal.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	data["Username"] = principal.Username
+	data["CanUseSSO"] = len(linked) > 0 && handlers.SSOName() != ""
+	handlers.RenderHTML(c, status, handlers.RoutesPointer.UserConfig.Reauth.HTMLPageName, data)
+}
+
+// GetReauth renders the confirmation page.
+func (prop *settingsHandlerProps) GetReauth(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	// Single sign-on returns here if the provider account belongs to someone else, see sso.GetCallback
+	data := gin.H{}
+	if c.Query("sso") == sso.ReauthFailedQuery {
+		data[utils.ErrorReauthHTML] = utils.ReauthSSOMismatch
+	}
+
+	prop.renderReauth(c, http.StatusOK, user, data)
+}
+
+// PostReauth confirms the session with the password of the user.
+// Wrong passwords count towards the login lock of the username, so the page can not be used to guess the password.
+func (prop *settingsHandlerProps) PostReauth(c *gin.Context) {
+	sessionUser, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	user, err := prop.Database.FetchUserByID(sessionUser.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	password := c.PostForm(handlers.RoutesPointer.Authentication.ParseKeys.PasswordParseKey)
+	status, message, err := handlers.CheckCurrentPassword(c, prop.Database, &user, password)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if message != "" {
+		prop.renderReauth(c, status, sessionUser, gin.H{utils.ErrorReauthHTML: message})
+		return
+	}
+
+	if err := handlers.ConfirmRecentAuth(c, prop.Store); err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.RecordSecurityEvent(c, prop.Database, user.ID, utils.AuditEventReauthenticated, utils.AuthMethodPassword)
+
+	c.Redirect(http.StatusSeeOther, handlers.LoginRedirectPath(c, prop.Store))
+}
+
+// GetSecurity renders the latest logins, failed logins and account changes of the user, newest first.
+func (prop *settingsHandlerProps) GetSecurity(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	events, _, err := prop.Database.ListSecurityEvents(utils.SecurityEventFilter{UserID: user.ID}, securityEventsShown, 0)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.RenderHTML(c, http.StatusOK, handlers.RoutesPointer.UserConfig.Security.HTMLPageName, gin.H{
+		"Username": user.Username,
+		"Entries":  events,
+	})
+}
+
+// NewSettingsHandler creates a new instance of SettingsHandlers.
+func NewSettingsHandler(db *utils.DataBaseProps, store *sessions.CookieStore) SettingsHandlers {
+	return &settingsHandlerProps{
+		Database: db,
+		Store:    store,
+	}
+}
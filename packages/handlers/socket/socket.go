@@ -0,0 +1,356 @@
+package socket
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"github.com/gorilla/websocket"
+
+	"todoweb/packages/handlers"
+	"todoweb/packages/hub"
+	"todoweb/packages/utils"
+)
+
+/*
+WebSocket protocol, every frame is a single JSON object (socketMessage).
+
+Client to server:
+  {"type": "subscribe", "id": "1"}                                     start receiving "event" messages
+  {"type": "create", "id": "2", "description": "Buy milk"}             create task
+  {"type": "update", "id": "3", "taskId": 7, "description": "...", "isCompleted": true}
+                                                                       change description and/or completion
+  {"type": "delete", "id": "4", "taskId": 7}                           delete task
+
+update and delete accept optional "taskVersion", the request fails if the task has another version.
+
+Server to client:
+  {"type": "ack", "id": "2", "version": 42, "task": {...}}             request with the same id succeeded
+  {"type": "error", "id": "3", "error": "Task 7 not found"}            request with the same id failed
+  {"type": "event", "version": 43, "event": {...}}                     change made by any client of the user
+
+"version" is the id of the newest task event of the user (see utils.LatestTaskEventID),
+so a client can tell which of the messages it has already seen.
+
+The session is checked again before every client message and every utils.SessionRecheckInterval.
+After logout, a password change or when the account is disabled the server closes the socket
+with code 1008 (policy violation) and reason "session ended".
+*/
+
+// Message types of the protocol
+const (
+	MessageSubscribe = "subscribe"
+	MessageCreate    = "create"
+	MessageUpdate    = "update"
+	MessageDelete    = "delete"
+	MessageAck       = "ack"
+	MessageError     = "error"
+	MessageEvent     = "event"
+)
+
+const (
+	writeWait      = 10 * time.Second    // Time allowed to write a message.
+	pongWait       = 60 * time.Second    // Time allowed to read the next pong.
+	pingPeriod     = (pongWait * 9) / 10 // Pings are sent before pong deadline passes.
+	maxMessageSize = 4096                // Maximum size of a client message in bytes.
+	outgoingBuffer = 32                  // Messages waiting to be written.
+)
+
+// socketMessage is a frame of the protocol, unused fields are omitted
+type socketMessage struct {
+	Type        string      `json:"type"`
+	ID          string      `json:"id,omitempty"`
+	TaskID      int         `json:"taskId,omitempty"`
+	TaskVersion int         `json:"taskVersion,omitempty"`
+	Description *string     `json:"description,omitempty"`
+	IsCompleted *bool       `json:"isCompleted,omitempty"`
+	Version     int64       `json:"version,omitempty"`
+	Task        *utils.Task `json:"task,omitempty"`
+	Event       *hub.Event  `json:"event,omitempty"`
+	Error       string      `json:"error,omitempty"`
+}
+
+// SocketHandlers defines the interface for WebSocket handlers.
+type SocketHandlers interface {
+	Connect(c *gin.Context) // Upgrades the request and serves the task sync protocol.
+}
+
+// socketHandlerProps holds dependencies for socket handlers.
+type socketHandlerProps struct {
+	Database *utils.DataBaseProps  // Database connection properties.
+	Store    *sessions.CookieStore // Cookie store for session management.
+	Hub      *hub.Hub              // Hub for publishing and receiving task changes.
+	Upgrader websocket.Upgrader    // Default CheckOrigin rejects cross-origin pages.
+}
+
+// connection is state of a single WebSocket client
+type connection struct {
+	prop     *socketHandlerProps
+	conn     *websocket.Conn
+	user     *utils.Principal
+	outgoing chan socketMessage
+	done     chan struct{}
+}
+
+// Close reason of sockets whose session ended
+const sessionEndedReason = "session ended"
+
+// Connect authenticates the user by session, upgrades the connection and serves it until it is closed.
+func (prop *socketHandlerProps) Connect(c *gin.Context) {
+	userInterface, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return // Nothing to upgrade for anonymous users.
+	}
+
+	conn, err := prop.Upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		log.Printf("websocket upgrade error: %v\n", err)
+		return // Upgrader has already written the error response.
+	}
+
+	client := &connection{
+		prop:     prop,
+		conn:     conn,
+		user:     userInterface,
+		outgoing: make(chan socketMessage, outgoingBuffer),
+		done:     make(chan struct{}),
+	}
+
+	go client.writeLoop()
+	client.readLoop()
+}
+
+// readLoop handles client messages until the connection fails, then stops the write loop
+func (client *connection) readLoop() {
+	defer close(client.done)
+
+	client.conn.SetReadLimit(maxMessageSize)
+	client.conn.SetReadDeadline(time.Now().Add(pongWait))
+	client.conn.SetPongHandler(func(string) error {
+		return client.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	var unsubscribe func()
+	defer func() {
+		if unsubscribe != nil {
+			unsubscribe()
+		}
+	}()
+
+	for {
+		var message socketMessage
+		if err := client.conn.ReadJSON(&message); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Printf("websocket read error: %v\n", err)
+			}
+			return
+		}
+
+		// The socket outlives the request that authorized it, so every message is authorized again
+		if !client.sessionValid() {
+			client.closeSessionEnded()
+			return
+		}
+
+		if message.Type == MessageSubscribe {
+			if unsubscribe == nil {
+				unsubscribe = client.subscribe()
+			}
+			client.ack(message.ID, nil)
+			continue
+		}
+
+		client.handle(message)
+	}
+}
+
+// sessionValid reports whether the session of the socket may still be used, see handlers.SessionStillValid.
+// Errors count as invalid, the client reconnects and is authorized again.
+func (client *connection) sessionValid() bool {
+	valid, err := handlers.SessionStillValid(client.prop.Database, client.user)
+	if err != nil {
+		log.Printf("websocket session check error: %v\n", err)
+	}
+
+	return valid
+}
+
+// closeSessionEnded tells the client that its session ended, the caller stops its loop afterwards.
+// WriteControl may be used next to the write loop.
+func (client *connection) closeSessionEnded() {
+	message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, sessionEndedReason)
+	client.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+}
+
+// subscribe forwards hub events of the user to the client until returned function is called
+func (client *connection) subscribe() func() {
+	events, unsubscribe := client.prop.Hub.Subscribe(client.user.ID)
+
+	go func() {
+		for event := range events {
+			event := event
+			version, _ := client.prop.Database.LatestTaskEventID(client.user.ID)
+			client.send(socketMessage{Type: MessageEvent, Version: version, Event: &event})
+		}
+	}()
+
+	return unsubscribe
+}
+
+// handle executes create, update and delete requests with the same store methods as HTTP handlers
+func (client *connection) handle(message socketMessage) {
+	userID := client.user.ID
+
+	switch message.Type {
+	case MessageCreate:
+		if message.Description == nil {
+			client.fail(message.ID, requestError("description is required"))
+			return
+		}
+
+		created, err := client.prop.Database.AddTask(userID, utils.TrimSpace(*message.Description))
+		if err != nil {
+			client.fail(message.ID, err)
+			return
+		}
+
+		client.prop.Hub.TaskChanged(userID, utils.TaskEventCreate, utils.StrToInt(created.TaskID), &created)
+		client.ack(message.ID, &created)
+
+	case MessageUpdate:
+		if message.Description == nil && message.IsCompleted == nil {
+			client.fail(message.ID, requestError("nothing to update"))
+			return
+		}
+
+		// Both fields change in one transaction, so a failed version check changes nothing
+		description := message.Description
+		if description != nil {
+			trimmed := utils.TrimSpace(*description)
+			description = &trimmed
+		}
+
+		updated, err := client.prop.Database.UpdateTaskFields(userID, message.TaskID, message.TaskVersion, description, message.IsCompleted)
+		if err != nil {
+			client.storeFailed(message, err)
+			return
+		}
+
+		if description != nil {
+			client.prop.Hub.TaskChanged(userID, utils.TaskEventUpdate, message.TaskID, &updated)
+		}
+		if message.IsCompleted != nil {
+			client.prop.Hub.TaskChanged(userID, utils.TaskEventComplete, message.TaskID, &updated)
+		}
+
+		client.ack(message.ID, &updated)
+
+	case MessageDelete:
+		if err := client.prop.Database.DeleteTask(userID, message.TaskID, message.TaskVersion); err != nil {
+			client.storeFailed(message, err)
+			return
+		}
+
+		client.prop.Hub.TaskChanged(userID, utils.TaskEventDelete, message.TaskID, nil)
+		client.ack(message.ID, nil)
+
+	default:
+		client.fail(message.ID, requestError(fmt.Sprintf("unknown message type %q", message.Type)))
+	}
+}
+
+// ack confirms request with current server version
+func (client *connection) ack(id string, task *utils.Task) {
+	version, err := client.prop.Database.LatestTaskEventID(client.user.ID)
+	if err != nil {
+		client.fail(id, err)
+		return
+	}
+
+	client.send(socketMessage{Type: MessageAck, ID: id, Version: version, Task: task})
+}
+
+// requestError is a mistake of the client, its text is sent back as is
+type requestError string
+
+func (err requestError) Error() string {
+	return string(err)
+}
+
+// fail reports error of request, internal errors are logged and not exposed to the client
+func (client *connection) fail(id string, err error) {
+	message := err.Error()
+
+	if _, ok := err.(requestError); !ok {
+		log.Printf("websocket request error: %v\n", err)
+		message = "Internal Server Error"
+	}
+
+	client.send(socketMessage{Type: MessageError, ID: id, Error: message})
+}
+
+// storeFailed reports error returned by store method, missing tasks and version conflicts are reported to the client
+func (client *connection) storeFailed(message socketMessage, err error) {
+	if err.Error() == fmt.Sprintf(utils.TaskNotFound, message.TaskID) || err.Error() == fmt.Sprintf(utils.TaskVersionMismatch, message.TaskID) {
+		err = requestError(err.Error())
+	}
+
+	client.fail(message.ID, err)
+}
+
+// send queues message for writing, dropping it if the connection is already closed
+func (client *connection) send(message socketMessage) {
+	select {
+	case client.outgoing <- message:
+	case <-client.done:
+	}
+}
+
+// writeLoop is the only goroutine writing messages to the connection, it also sends pings
+// and closes the connection when the session ended while the client is quiet
+func (client *connection) writeLoop() {
+	ticker := time.NewTicker(pingPeriod)
+	recheck := time.NewTicker(utils.SessionRecheckInterval)
+	defer func() {
+		ticker.Stop()
+		recheck.Stop()
+		client.conn.Close() // readLoop fails on the closed connection and stops
+	}()
+
+	for {
+		select {
+		case message := <-client.outgoing:
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := client.conn.WriteJSON(message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := client.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-recheck.C:
+			if !client.sessionValid() {
+				client.closeSessionEnded()
+				return
+			}
+		case <-client.done:
+			client.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			client.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+			return
+		}
+	}
+}
+
+// NewSocketHandler creates a new instance of SocketHandlers.
+func NewSocketHandler(db *utils.DataBaseProps, store *sessions.CookieStore, eventHub *hub.Hub) SocketHandlers {
+	return &socketHandlerProps{
+		Database: db,       // Set the database property.
+		Store:    store,    // Set the session store property.
+		Hub:      eventHub, // Set the hub property.
+	}
+}
@@ -0,0 +1,377 @@
+package sso
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+
+	"todoweb/packages/config"
+	"todoweb/packages/handlers"
+	"todoweb/packages/utils"
+)
+
+const (
+	// Session key holding state, nonce and PKCE verifier between the redirect to the provider and the callback
+	loginSessionKey = "oidcLogin"
+
+	// How long a started login can be finished
+	loginStateTTL = 10 * time.Minute
+
+	// Longest wait for discovery and the token endpoint
+	providerTimeout = 10 * time.Second
+
+	// Query values the settings page turns into messages after linking
+	LinkedQuery = "linked"
+	TakenQuery  = "taken"
+
+	// Query value the confirmation page shows as error, the provider account is not linked to the user
+	ReauthFailedQuery = "failed"
+)
+
+// SSOHandlers defines the interface for OpenID Connect single sign-on.
+type SSOHandlers interface {
+	GetStart(c *gin.Context)    // Redirects to the identity provider, "reauth" confirms the current session instead of linking.
+	GetCallback(c *gin.Context) // Logs in, or links the identity or confirms the session if a user is logged in already.
+}
+
+// Provider is the OpenID Connect provider set in app.env.
+// Discovery runs at the first login, not at start, so the application starts while the provider is unreachable.
+type Provider struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Name         string // Shown on the login button.
+
+	mutex    sync.Mutex
+	oauth    *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewProvider configures single sign-on from config.Options, nil if no issuer is set
+func NewProvider(options *config.Settings) *Provider {
+	if options.OIDCIssuer == "" {
+		return nil
+	}
+
+	redirectURL := options.OIDCRedirectURL
+	if redirectURL == "" {
+		redirectURL = options.BaseURL + handlers.RoutesPointer.SSO.RedirectPath
+	}
+
+	return &Provider{
+		Issuer:       options.OIDCIssuer,
+		ClientID:     options.OIDCClientID,
+		ClientSecret: options.OIDCClientSecret,
+		RedirectURL:  redirectURL,
+		Name:         options.OIDCProviderName,
+	}
+}
+
+// discover reads the provider metadata once, a failed attempt is repeated at the next login
+func (provider *Provider) discover(ctx context.Context) (*oauth2.Config, *oidc.IDTokenVerifier, error) {
+	provider.mutex.Lock()
+	defer provider.mutex.Unlock()
+
+	if provider.oauth != nil {
+		return provider.oauth, provider.verifier, nil
+	}
+
+	discovered, err := oidc.NewProvider(ctx, provider.Issuer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("oidc discovery error: %v", err)
+	}
+
+	provider.oauth = &oauth2.Config{
+		ClientID:     provider.ClientID,
+		ClientSecret: provider.ClientSecret,
+		RedirectURL:  provider.RedirectURL,
+		Endpoint:     discovered.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "email", "profile"},
+	}
+	provider.verifier = discovered.Verifier(&oidc.Config{ClientID: provider.ClientID})
+
+	return provider.oauth, provider.verifier, nil
+}
+
+// loginState is kept in the session while the user is at the provider
+type loginState struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"` // PKCE code verifier.
+	Expires  time.Time `json:"expires"`
+	Reauth   bool      `json:"reauth"` // Started from the confirmation page of a logged-in user.
+}
+
+// idTokenClaims are the claims read from the ID token besides issuer and subject
+type idTokenClaims struct {
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// identityStore finds, links and provisions the local users of provider identities, implemented by utils.DataBaseProps
+type identityStore interface {
+	LoginExternalIdentity(identity utils.ExternalIdentity, provision bool, ip string) (utils.User, error)
+	LinkExternalIdentity(userID string, identity utils.ExternalIdentity, ip string) error
+	ExternalIdentityUser(identity utils.ExternalIdentity) (string, error)
+}
+
+// ssoHandlerProps holds dependencies for single sign-on handlers.
+type ssoHandlerProps struct {
+	Database   *utils.DataBaseProps  // Database connection properties, used for security events.
+	Identities identityStore         // Linked identities, the database outside of tests.
+	Store      *sessions.CookieStore // Cookie store for session management.
+	Provider   *Provider             // Identity provider.
+	Provision  bool                  // Create accounts for unknown provider users.
+}
+
+// saveState keeps state in the session as JSON, like the passkey ceremonies
+func (prop *ssoHandlerProps) saveState(c *gin.Context, state loginState) error {
+	session, ok := handlers.GetSession(c, prop.Store)
+	if !ok {
+		return fmt.Errorf("session error")
+	}
+
+	encoded, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	session.Values[loginSessionKey] = string(encoded)
+	return sessions.Save(c.Request, c.Writer)
+}
+
+// takeState returns the started login and removes it, so one callback can be used only once
+func (prop *ssoHandlerProps) takeState(c *gin.Context) (loginState, bool) {
+	var state loginState
+
+	session, ok := handlers.GetSession(c, prop.Store)
+	if !ok {
+		return state, false
+	}
+
+	encoded, ok := session.Values[loginSessionKey].(string)
+	if !ok {
+		return state, false
+	}
+
+	delete(session.Values, loginSessionKey)
+	if err := sessions.Save(c.Request, c.Writer); err != nil {
+		return state, false
+	}
+
+	if err := json.Unmarshal([]byte(encoded), &state); err != nil {
+		return state, false
+	}
+
+	return state, time.Now().Before(state.Expires)
+}
+
+// loginFailed shows the login page with message
+func loginFailed(c *gin.Context, status int, message string) {
+	handlers.RenderHTML(c, status, handlers.RoutesPointer.MainLoginConfig.PageName, gin.H{utils.ErrorLoginHTML: message})
+}
+
+// GetStart sends the browser to the authorization endpoint with a fresh state, nonce and PKCE challenge.
+func (prop *ssoHandlerProps) GetStart(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), providerTimeout)
+	defer cancel()
+
+	oauth, _, err := prop.Provider.discover(ctx)
+	if err != nil {
+		log.Println(err)
+		loginFailed(c, http.StatusBadGateway, utils.SSOFailed)
+		return
+	}
+
+	state := loginState{
+		State:    utils.GenerateToken(32),
+		Nonce:    utils.GenerateToken(32),
+		Verifier: oauth2.GenerateVerifier(),
+		Expires:  time.Now().Add(loginStateTTL),
+		Reauth:   c.Query("reauth") != "",
+	}
+
+	// Linking adds a way to log in to the account, so like other sensitive settings it needs a recent confirmation
+	if principal, loggedIn := handlers.GetUserFromSession(c, prop.Store); loggedIn && !state.Reauth && !principal.RecentlyVerified(config.Options.SudoModeTTL) {
+		if err := handlers.SaveReturnPath(c, prop.Store, handlers.RoutesPointer.UserConfig.Settings.Route); err != nil {
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.Reauth.Route)
+		return
+	}
+	if err := prop.saveState(c, state); err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, oauth.AuthCodeURL(state.State, oidc.Nonce(state.Nonce), oauth2.S256ChallengeOption(state.Verifier)))
+}
+
+// GetCallback exchanges the code, verifies the ID token and its nonce, then logs in the linked user.
+// If a user is logged in already, the identity is linked to that user instead.
+func (prop *ssoHandlerProps) GetCallback(c *gin.Context) {
+	state, ok := prop.takeState(c)
+	if !ok || c.Query("state") != state.State {
+		loginFailed(c, http.StatusBadRequest, utils.SSOFailed)
+		return
+	}
+
+	// The user declined or the provider refused, e.g. error=access_denied
+	if providerError := c.Query("error"); providerError != "" {
+		log.Printf("oidc provider error: %s %s\n", providerError, c.Query("error_description"))
+		loginFailed(c, http.StatusUnauthorized, utils.SSOFailed)
+		return
+	}
+
+	identity, err := prop.verify(c, state)
+	if err != nil {
+		log.Println(err)
+		loginFailed(c, http.StatusUnauthorized, utils.SSOFailed)
+		return
+	}
+
+	if principal, loggedIn := handlers.GetUserFromSession(c, prop.Store); loggedIn {
+		if state.Reauth {
+			prop.reauth(c, principal, identity)
+			return
+		}
+		prop.link(c, principal, identity)
+		return
+	}
+
+	// New accounts follow the registration mode, there is no invite code at the provider
+	provision := prop.Provision && utils.CurrentRegistrationPolicy().AllowsProvisioning(identity.Email, identity.EmailVerified)
+
+	user, err := prop.Identities.LoginExternalIdentity(identity, provision, c.ClientIP())
+	if err != nil {
+		switch err.Error() {
+		case utils.ExternalIdentityUnknown, utils.ExternalIdentityTaken, utils.ExternalIdentityLinkRequired:
+			loginFailed(c, http.StatusForbidden, err.Error())
+		default:
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+		}
+		return
+	}
+
+	if user.NeedsEmailVerification() && config.Options.RequireEmailVerification {
+		loginFailed(c, http.StatusForbidden, utils.EmailNotVerified)
+		return
+	}
+
+	// The provider is responsible for its own second factor, local 2FA is not asked again. Accounts with 2FA only get
+	// here through an identity the user linked after a local login, LoginExternalIdentity does not link them by email.
+	if err := handlers.StartUserSession(c, prop.Store, prop.Database, &user, utils.AuthMethodOIDC); err != nil {
+		switch err.Error() {
+		case utils.AccountDisabled, utils.PasswordResetRequired:
+			loginFailed(c, http.StatusForbidden, err.Error())
+		default:
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+		}
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, handlers.LoginRedirectPath(c, prop.Store))
+}
+
+// verify redeems the authorization code with the PKCE verifier and checks signature, audience, expiry and nonce of the ID token
+func (prop *ssoHandlerProps) verify(c *gin.Context, state loginState) (utils.ExternalIdentity, error) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), providerTimeout)
+	defer cancel()
+
+	oauth, verifier, err := prop.Provider.discover(ctx)
+	if err != nil {
+		return utils.ExternalIdentity{}, err
+	}
+
+	token, err := oauth.Exchange(ctx, c.Query("code"), oauth2.VerifierOption(state.Verifier))
+	if err != nil {
+		return utils.ExternalIdentity{}, fmt.Errorf("oidc code exchange error: %v", err)
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return utils.ExternalIdentity{}, fmt.Errorf("oidc token response has no id_token")
+	}
+
+	idToken, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return utils.ExternalIdentity{}, fmt.Errorf("oidc id token error: %v", err)
+	}
+	if idToken.Nonce != state.Nonce {
+		return utils.ExternalIdentity{}, fmt.Errorf("oidc nonce mismatch")
+	}
+
+	var claims idTokenClaims
+	if err := idToken.Claims(&claims); err != nil {
+		return utils.ExternalIdentity{}, fmt.Errorf("oidc claims error: %v", err)
+	}
+
+	return utils.ExternalIdentity{
+		Issuer:            idToken.Issuer,
+		Subject:           idToken.Subject,
+		Email:             claims.Email,
+		EmailVerified:     claims.EmailVerified,
+		PreferredUsername: claims.PreferredUsername,
+	}, nil
+}
+
+// link connects identity to the logged-in user and returns to the settings page
+func (prop *ssoHandlerProps) link(c *gin.Context, principal *utils.Principal, identity utils.ExternalIdentity) {
+	result := LinkedQuery
+	if err := prop.Identities.LinkExternalIdentity(principal.ID, identity, c.ClientIP()); err != nil {
+		if err.Error() != utils.ExternalIdentityTaken {
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+		result = TakenQuery
+	}
+
+	c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.Settings.RedirectPath+"?sso="+result)
+}
+
+// reauth confirms the session of principal if identity is linked to the same user, then returns to the page that asked for it
+func (prop *ssoHandlerProps) reauth(c *gin.Context, principal *utils.Principal, identity utils.ExternalIdentity) {
+	owner, err := prop.Identities.ExternalIdentityUser(identity)
+	if err != nil && err.Error() != utils.ExternalIdentityUnknown {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	if owner != principal.ID {
+		handlers.RecordSecurityEvent(c, prop.Database, principal.ID, utils.AuditEventLoginFailed, utils.AuthMethodOIDC+", reauth")
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.Reauth.Route+"?sso="+ReauthFailedQuery)
+		return
+	}
+
+	if err := handlers.ConfirmRecentAuth(c, prop.Store); err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.RecordSecurityEvent(c, prop.Database, principal.ID, utils.AuditEventReauthenticated, utils.AuthMethodOIDC)
+
+	c.Redirect(http.StatusSeeOther, handlers.LoginRedirectPath(c, prop.Store))
+}
+
+// NewSSOHandler creates a new instance of SSOHandlers.
+func NewSSOHandler(db *utils.DataBaseProps, store *sessions.CookieStore, provider *Provider, provision bool) SSOHandlers {
+	return &ssoHandlerProps{
+		Database:   db,
+		Identities: db,
+		Store:      store,
+		Provider:   provider,
+		Provision:  provision,
+	}
+}
@@ -0,0 +1,751 @@
+package sso
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"todoweb/packages/handlers"
+	"todoweb/packages/utils"
+)
+
+const (
+	testClientID     = "todoweb"
+	testClientSecret = "client-secret"
+	testKeyID        = "test-key"
+)
+
+// authorization is a code issued by the mock provider, waiting to be redeemed at the token endpoint
+type authorization struct {
+	challenge   string // PKCE code_challenge, S256 of the verifier the client must send.
+	nonce       string
+	redirectURI string
+}
+
+// mockProvider is an OpenID Connect provider with discovery, authorization, token and JWKS endpoints.
+// Its users always consent, the ID token claims are set per test.
+type mockProvider struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey // Published in the JWKS.
+	signer *rsa.PrivateKey // Signs ID tokens, another key than key forges them.
+
+	mutex    sync.Mutex
+	codes    map[string]authorization
+	claims   map[string]interface{}       // Claims of the user logging in, besides iss, aud, exp, iat and nonce.
+	tamper   func(map[string]interface{}) // Changes the final claims, e.g. to a wrong audience.
+	redeemed int                          // Codes exchanged with a correct PKCE verifier.
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	provider := &mockProvider{
+		key:    key,
+		signer: key,
+		codes:  map[string]authorization{},
+		claims: map[string]interface{}{
+			"sub":                "provider-user-1",
+			"email":              "alice@example.com",
+			"email_verified":     true,
+			"preferred_username": "alice",
+		},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", provider.discovery)
+	mux.HandleFunc("/authorize", provider.authorize)
+	mux.HandleFunc("/token", provider.token)
+	mux.HandleFunc("/jwks", provider.jwks)
+	provider.server = httptest.NewServer(mux)
+	t.Cleanup(provider.server.Close)
+
+	return provider
+}
+
+func (provider *mockProvider) discovery(w http.ResponseWriter, r *http.Request) {
+	issuer := provider.server.URL
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/authorize",
+		"token_endpoint":                        issuer + "/token",
+		"jwks_uri":                              issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+// authorize issues a code for the request and sends the browser back, like a provider after the user consented
+func (provider *mockProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("response_type") != "code" || query.Get("client_id") != testClientID || query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" {
+		http.Error(w, "invalid authorization request", http.StatusBadRequest)
+		return
+	}
+
+	code := utils.GenerateToken(16)
+	provider.mutex.Lock()
+	provider.codes[code] = authorization{
+		challenge:   query.Get("code_challenge"),
+		nonce:       query.Get("nonce"),
+		redirectURI: query.Get("redirect_uri"),
+	}
+	provider.mutex.Unlock()
+
+	callback, _ := url.Parse(query.Get("redirect_uri"))
+	values := url.Values{"code": {code}, "state": {query.Get("state")}}
+	callback.RawQuery = values.Encode()
+	http.Redirect(w, r, callback.String(), http.StatusFound)
+}
+
+// token redeems a code once, the client has to authenticate and send the PKCE verifier of the challenge
+func (provider *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	tokenError := func(code string) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": code})
+	}
+
+	if err := r.ParseForm(); err != nil {
+		tokenError("invalid_request")
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if !ok {
+		clientID, clientSecret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	if clientID != testClientID || clientSecret != testClientSecret {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	provider.mutex.Lock()
+	code, found := provider.codes[r.PostForm.Get("code")]
+	delete(provider.codes, r.PostForm.Get("code"))
+	provider.mutex.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if r.PostForm.Get("grant_type") != "authorization_code" || !found || r.PostForm.Get("redirect_uri") != code.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+		tokenError("invalid_grant")
+		return
+	}
+
+	provider.mutex.Lock()
+	provider.redeemed++
+	claims := map[string]interface{}{
+		"iss":   provider.server.URL,
+		"aud":   testClientID,
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": code.nonce,
+	}
+	for name, value := range provider.claims {
+		claims[name] = value
+	}
+	if provider.tamper != nil {
+		provider.tamper(claims)
+	}
+	signer := provider.signer
+	provider.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": utils.GenerateToken(16),
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     signJWT(signer, claims),
+	})
+}
+
+func (provider *mockProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": testKeyID,
+			"n":   base64.RawURLEncoding.EncodeToString(provider.key.PublicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(provider.key.PublicKey.E)).Bytes()),
+		}},
+	})
+}
+
+// signJWT encodes claims as an RS256 JWT with the key id of the JWKS
+func signJWT(key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": testKeyID})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// loginCall is one call of LoginExternalIdentity
+type loginCall struct {
+	identity  utils.ExternalIdentity
+	provision bool
+}
+
+// fakeIdentities keeps users and linked identities in memory, following the rules of utils.LoginExternalIdentity
+type fakeIdentities struct {
+	mutex  sync.Mutex
+	users  map[string]utils.User // By id.
+	linked map[string]string     // User id by issuer and subject.
+	logins []loginCall
+}
+
+func newFakeIdentities(users ...utils.User) *fakeIdentities {
+	identities := &fakeIdentities{users: map[string]utils.User{}, linked: map[string]string{}}
+	for _, user := range users {
+		identities.users[user.ID] = user
+	}
+	return identities
+}
+
+func identityKey(identity utils.ExternalIdentity) string {
+	return identity.Issuer + " " + identity.Subject
+}
+
+func (identities *fakeIdentities) LoginExternalIdentity(identity utils.ExternalIdentity, provision bool, ip string) (utils.User, error) {
+	identities.mutex.Lock()
+	defer identities.mutex.Unlock()
+
+	identities.logins = append(identities.logins, loginCall{identity, provision})
+
+	if userID, ok := identities.linked[identityKey(identity)]; ok {
+		return identities.users[userID], nil
+	}
+
+	if identity.EmailVerified && identity.Email != "" {
+		for _, user := range identities.users {
+			if user.EmailVerified && strings.EqualFold(user.Email, identity.Email) {
+				if user.TwoFactorEnabled {
+					return utils.User{}, fmt.Errorf(utils.ExternalIdentityLinkRequired)
+				}
+				identities.linked[identityKey(identity)] = user.ID
+				return user, nil
+			}
+		}
+	}
+
+	if !provision {
+		return utils.User{}, fmt.Errorf(utils.ExternalIdentityUnknown)
+	}
+
+	user := utils.User{
+		ID:            fmt.Sprintf("%d", len(identities.users)+1),
+		Username:      identity.PreferredUsername,
+		Email:         identity.Email,
+		EmailVerified: identity.EmailVerified,
+	}
+	identities.users[user.ID] = user
+	identities.linked[identityKey(identity)] = user.ID
+	return user, nil
+}
+
+func (identities *fakeIdentities) LinkExternalIdentity(userID string, identity utils.ExternalIdentity, ip string) error {
+	identities.mutex.Lock()
+	defer identities.mutex.Unlock()
+
+	if linked, ok := identities.linked[identityKey(identity)]; ok && linked != userID {
+		return fmt.Errorf(utils.ExternalIdentityTaken)
+	}
+	identities.linked[identityKey(identity)] = userID
+	return nil
+}
+
+func (identities *fakeIdentities) ExternalIdentityUser(identity utils.ExternalIdentity) (string, error) {
+	identities.mutex.Lock()
+	defer identities.mutex.Unlock()
+
+	if userID, ok := identities.linked[identityKey(identity)]; ok {
+		return userID, nil
+	}
+	return "", fmt.Errorf(utils.ExternalIdentityUnknown)
+}
+
+// Routes of the test application besides start and callback
+const (
+	whoamiPath = "/whoami"     // Answers with the principal of the session as JSON, 401 without.
+	seedPath   = "/seed-login" // Logs in the user with the id in the "id" query parameter by password.
+)
+
+// testApp serves the single sign-on handlers with a browser that keeps cookies and does not follow redirects
+type testApp struct {
+	server     *httptest.Server
+	provider   *mockProvider
+	identities *fakeIdentities
+	props      *ssoHandlerProps
+	browser    *http.Client
+}
+
+func newTestApp(t *testing.T, identities *fakeIdentities) *testApp {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	gob.Register(&utils.Principal{})
+
+	app := &testApp{provider: newMockProvider(t), identities: identities}
+
+	router := gin.New()
+	router.SetFuncMap(template.FuncMap{
+		"csrfField":  handlers.CSRFField,
+		"ssoName":    handlers.SSOName,
+		"rememberMe": handlers.RememberMe,
+	})
+	router.LoadHTMLGlob("../../../templates/*.html")
+	app.server = httptest.NewServer(router)
+	t.Cleanup(app.server.Close)
+
+	app.props = &ssoHandlerProps{
+		Identities: identities,
+		Store:      sessions.NewCookieStore(utils.GenerateRandomKey(32)),
+		Provision:  true,
+		Provider: &Provider{
+			Issuer:       app.provider.server.URL,
+			ClientID:     testClientID,
+			ClientSecret: testClientSecret,
+			RedirectURL:  app.server.URL + handlers.RoutesPointer.SSO.RedirectPath,
+		},
+	}
+
+	router.GET(handlers.RoutesPointer.SSO.Path, app.props.GetStart)
+	router.GET(handlers.RoutesPointer.SSO.RedirectPath, app.props.GetCallback)
+	router.GET(whoamiPath, func(c *gin.Context) {
+		principal, ok := handlers.GetUserFromSession(c, app.props.Store)
+		if !ok {
+			c.Status(http.StatusUnauthorized)
+			return
+		}
+		c.JSON(http.StatusOK, principal)
+	})
+	router.GET(seedPath, func(c *gin.Context) {
+		user := identities.users[c.Query("id")]
+		if err := handlers.StartUserSession(c, app.props.Store, nil, &user, utils.AuthMethodPassword); err != nil {
+			c.Status(http.StatusInternalServerError)
+		}
+	})
+
+	app.browser = app.newBrowser(t)
+	return app
+}
+
+// newBrowser returns a client with its own cookies
+func (app *testApp) newBrowser(t *testing.T) *http.Client {
+	t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatalf("cookie jar: %v", err)
+	}
+	return &http.Client{
+		Jar:           jar,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+func get(t *testing.T, browser *http.Client, target string) *http.Response {
+	t.Helper()
+
+	response, err := browser.Get(target)
+	if err != nil {
+		t.Fatalf("GET %s: %v", target, err)
+	}
+	t.Cleanup(func() { response.Body.Close() })
+	return response
+}
+
+// authorize starts single sign-on in browser and returns the callback URL the provider sends it back to
+func (app *testApp) authorize(t *testing.T, browser *http.Client, query string) *url.URL {
+	t.Helper()
+
+	start := get(t, browser, app.server.URL+handlers.RoutesPointer.SSO.Path+query)
+	if start.StatusCode != http.StatusSeeOther {
+		t.Fatalf("start status = %d, want %d", start.StatusCode, http.StatusSeeOther)
+	}
+	location, _ := start.Location()
+	if !strings.HasPrefix(location.String(), app.provider.server.URL+"/authorize?") {
+		t.Fatalf("start redirected to %s, not to the provider", location)
+	}
+
+	consent := get(t, browser, location.String())
+	if consent.StatusCode != http.StatusFound {
+		body, _ := io.ReadAll(consent.Body)
+		t.Fatalf("authorize status = %d: %s", consent.StatusCode, body)
+	}
+	callback, _ := consent.Location()
+	return callback
+}
+
+// login runs the whole flow in the browser of app and returns the answer of the callback
+func (app *testApp) login(t *testing.T) *http.Response {
+	t.Helper()
+	return get(t, app.browser, app.authorize(t, app.browser, "").String())
+}
+
+// principal returns the user logged in by the session of browser, nil if none is
+func (app *testApp) principal(t *testing.T, browser *http.Client) *utils.Principal {
+	t.Helper()
+
+	response := get(t, browser, app.server.URL+whoamiPath)
+	if response.StatusCode != http.StatusOK {
+		return nil
+	}
+	var principal utils.Principal
+	if err := json.NewDecoder(response.Body).Decode(&principal); err != nil {
+		t.Fatalf("decode principal: %v", err)
+	}
+	return &principal
+}
+
+// expectRedirect fails unless response redirects to path
+func expectRedirect(t *testing.T, response *http.Response, path string) {
+	t.Helper()
+
+	location, err := response.Location()
+	if response.StatusCode != http.StatusSeeOther || err != nil || location.RequestURI() != path {
+		t.Errorf("response = %d to %v, want %d to %s", response.StatusCode, location, http.StatusSeeOther, path)
+	}
+}
+
+// expectFailure fails unless response is the login page with status and message, and no user is logged in
+func expectFailure(t *testing.T, app *testApp, response *http.Response, status int, message string) {
+	t.Helper()
+
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != status {
+		t.Errorf("status = %d, want %d", response.StatusCode, status)
+	}
+	if !strings.Contains(string(body), template.HTMLEscapeString(message)) {
+		t.Errorf("page does not show %q", message)
+	}
+	if principal := app.principal(t, app.browser); principal != nil {
+		t.Errorf("user %s was logged in", principal.ID)
+	}
+}
+
+func TestLoginLinkedIdentity(t *testing.T) {
+	identities := newFakeIdentities(utils.User{ID: "7", Username: "alice"})
+	app := newTestApp(t, identities)
+	identities.linked[app.provider.server.URL+" provider-user-1"] = "7"
+
+	start := get(t, app.browser, app.server.URL+handlers.RoutesPointer.SSO.Path)
+	location, _ := start.Location()
+	query := location.Query()
+	if query.Get("code_challenge_method") != "S256" || query.Get("code_challenge") == "" || query.Get("nonce") == "" || query.Get("state") == "" {
+		t.Errorf("authorization request lacks PKCE, nonce or state: %s", location.RawQuery)
+	}
+	if !strings.Contains(query.Get("scope"), "openid") {
+		t.Errorf("scope = %q, want openid", query.Get("scope"))
+	}
+
+	response := app.login(t)
+	expectRedirect(t, response, handlers.RoutesPointer.UserConfig.GetTask.Route)
+
+	principal := app.principal(t, app.browser)
+	if principal == nil || principal.ID != "7" {
+		t.Fatalf("logged in user = %v, want 7", principal)
+	}
+	if len(principal.AuthMethods) != 1 || principal.AuthMethods[0] != utils.AuthMethodOIDC {
+		t.Errorf("auth methods = %v, want [%s]", principal.AuthMethods, utils.AuthMethodOIDC)
+	}
+	if app.provider.redeemed != 1 {
+		t.Errorf("provider redeemed %d codes, want 1", app.provider.redeemed)
+	}
+
+	if len(identities.logins) != 1 {
+		t.Fatalf("LoginExternalIdentity called %d times, want 1", len(identities.logins))
+	}
+	want := utils.ExternalIdentity{
+		Issuer:            app.provider.server.URL,
+		Subject:           "provider-user-1",
+		Email:             "alice@example.com",
+		EmailVerified:     true,
+		PreferredUsername: "alice",
+	}
+	if identities.logins[0].identity != want {
+		t.Errorf("identity = %+v, want %+v", identities.logins[0].identity, want)
+	}
+}
+
+func TestCallbackReplay(t *testing.T) {
+	identities := newFakeIdentities(utils.User{ID: "7", Username: "alice"})
+	app := newTestApp(t, identities)
+	identities.linked[app.provider.server.URL+" provider-user-1"] = "7"
+
+	callback := app.authorize(t, app.browser, "")
+	expectRedirect(t, get(t, app.browser, callback.String()), handlers.RoutesPointer.UserConfig.GetTask.Route)
+
+	// The state was taken from the session, a second use of the callback is refused before the code is sent
+	attacker := app.newBrowser(t)
+	if response := get(t, attacker, callback.String()); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("replayed callback status = %d, want %d", response.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestCallbackStateMismatch(t *testing.T) {
+	identities := newFakeIdentities()
+	app := newTestApp(t, identities)
+
+	callback := app.authorize(t, app.browser, "")
+	query := callback.Query()
+	query.Set("state", "forged")
+	callback.RawQuery = query.Encode()
+
+	expectFailure(t, app, get(t, app.browser, callback.String()), http.StatusBadRequest, utils.SSOFailed)
+	if len(identities.logins) != 0 {
+		t.Error("identity was looked up after a state mismatch")
+	}
+}
+
+func TestCallbackProviderError(t *testing.T) {
+	app := newTestApp(t, newFakeIdentities())
+
+	callback := app.authorize(t, app.browser, "")
+	query := callback.Query()
+	query.Del("code")
+	query.Set("error", "access_denied")
+	callback.RawQuery = query.Encode()
+
+	expectFailure(t, app, get(t, app.browser, callback.String()), http.StatusUnauthorized, utils.SSOFailed)
+}
+
+func TestCallbackInjectedCodeFailsPKCE(t *testing.T) {
+	identities := newFakeIdentities(utils.User{ID: "7", Username: "alice"})
+	app := newTestApp(t, identities)
+	identities.linked[app.provider.server.URL+" provider-user-1"] = "7"
+
+	// The victim's code leaked, the attacker puts it into the callback of a login started in its own browser
+	victim := app.newBrowser(t)
+	stolen := app.authorize(t, victim, "").Query().Get("code")
+
+	attacker := app.browser
+	callback := app.authorize(t, attacker, "")
+	query := callback.Query()
+	query.Set("code", stolen)
+	callback.RawQuery = query.Encode()
+
+	expectFailure(t, app, get(t, attacker, callback.String()), http.StatusUnauthorized, utils.SSOFailed)
+	if app.provider.redeemed != 0 {
+		t.Errorf("provider redeemed %d codes, want 0", app.provider.redeemed)
+	}
+}
+
+func TestCallbackRejectsInvalidIDToken(t *testing.T) {
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	cases := map[string]func(*mockProvider){
+		"signature": func(provider *mockProvider) { provider.signer = otherKey },
+		"audience": func(provider *mockProvider) {
+			provider.tamper = func(claims map[string]interface{}) { claims["aud"] = "another-client" }
+		},
+		"nonce": func(provider *mockProvider) {
+			provider.tamper = func(claims map[string]interface{}) { claims["nonce"] = "replayed-nonce" }
+		},
+		"missing nonce": func(provider *mockProvider) {
+			provider.tamper = func(claims map[string]interface{}) { delete(claims, "nonce") }
+		},
+		"issuer": func(provider *mockProvider) {
+			provider.tamper = func(claims map[string]interface{}) { claims["iss"] = "https://evil.example.com" }
+		},
+		"expired": func(provider *mockProvider) {
+			provider.tamper = func(claims map[string]interface{}) { claims["exp"] = time.Now().Add(-time.Hour).Unix() }
+		},
+	}
+
+	for name, change := range cases {
+		t.Run(name, func(t *testing.T) {
+			identities := newFakeIdentities(utils.User{ID: "7", Username: "alice"})
+			app := newTestApp(t, identities)
+			identities.linked[app.provider.server.URL+" provider-user-1"] = "7"
+			change(app.provider)
+
+			expectFailure(t, app, app.login(t), http.StatusUnauthorized, utils.SSOFailed)
+			if len(identities.logins) != 0 {
+				t.Error("identity of an invalid ID token was looked up")
+			}
+		})
+	}
+}
+
+func TestLinkByVerifiedEmail(t *testing.T) {
+	identities := newFakeIdentities(utils.User{ID: "7", Username: "alice", Email: "Alice@example.com", EmailVerified: true})
+	app := newTestApp(t, identities)
+
+	expectRedirect(t, app.login(t), handlers.RoutesPointer.UserConfig.GetTask.Route)
+	if principal := app.principal(t, app.browser); principal == nil || principal.ID != "7" {
+		t.Fatalf("logged in user = %v, want 7", principal)
+	}
+	if identities.linked[app.provider.server.URL+" provider-user-1"] != "7" {
+		t.Error("identity was not linked to the user with the same verified email")
+	}
+}
+
+func TestNoLinkByEmailWithTwoFactor(t *testing.T) {
+	identities := newFakeIdentities(utils.User{ID: "7", Username: "alice", Email: "alice@example.com", EmailVerified: true, TwoFactorEnabled: true})
+	app := newTestApp(t, identities)
+
+	expectFailure(t, app, app.login(t), http.StatusForbidden, utils.ExternalIdentityLinkRequired)
+	if _, linked := identities.linked[app.provider.server.URL+" provider-user-1"]; linked {
+		t.Error("identity was linked to a user with 2FA")
+	}
+}
+
+func TestProvisioning(t *testing.T) {
+	t.Cleanup(func() { utils.SetRegistrationPolicy(utils.DefaultRegistrationPolicy) })
+
+	cases := []struct {
+		name      string
+		policy    utils.RegistrationPolicy
+		provision bool // Provision setting of the handler, OIDC_AUTO_PROVISION.
+		verified  bool // email_verified claim.
+		want      bool // Whether an account may be created.
+	}{
+		{"open", utils.RegistrationPolicy{Mode: utils.RegistrationOpen}, true, false, true},
+		{"off", utils.RegistrationPolicy{Mode: utils.RegistrationOpen}, false, true, false},
+		{"invite", utils.RegistrationPolicy{Mode: utils.RegistrationInvite}, true, true, false},
+		{"closed", utils.RegistrationPolicy{Mode: utils.RegistrationClosed}, true, true, false},
+		{"allowed domain", utils.RegistrationPolicy{Mode: utils.RegistrationDomains, AllowedDomains: []string{"example.com"}}, true, true, true},
+		{"unverified domain", utils.RegistrationPolicy{Mode: utils.RegistrationDomains, AllowedDomains: []string{"example.com"}}, true, false, false},
+		{"other domain", utils.RegistrationPolicy{Mode: utils.RegistrationDomains, AllowedDomains: []string{"example.org"}}, true, true, false},
+	}
+
+	for _, test := range cases {
+		t.Run(test.name, func(t *testing.T) {
+			if err := utils.SetRegistrationPolicy(test.policy); err != nil {
+				t.Fatalf("policy: %v", err)
+			}
+
+			identities := newFakeIdentities()
+			app := newTestApp(t, identities)
+			app.props.Provision = test.provision
+			app.provider.claims["email_verified"] = test.verified
+
+			response := app.login(t)
+			if len(identities.logins) != 1 || identities.logins[0].provision != test.want {
+				t.Fatalf("LoginExternalIdentity calls = %+v, want one with provision %v", identities.logins, test.want)
+			}
+
+			if !test.want {
+				expectFailure(t, app, response, http.StatusForbidden, utils.ExternalIdentityUnknown)
+				return
+			}
+
+			// Without a verified address the new account waits for verification when that is required
+			if !test.verified {
+				return
+			}
+			expectRedirect(t, response, handlers.RoutesPointer.UserConfig.GetTask.Route)
+			principal := app.principal(t, app.browser)
+			if principal == nil || principal.Username != "alice" {
+				t.Fatalf("logged in user = %v, want the provisioned alice", principal)
+			}
+			if identities.linked[app.provider.server.URL+" provider-user-1"] != principal.ID {
+				t.Error("provisioned user is not linked to the identity")
+			}
+		})
+	}
+}
+
+func TestLoginRefusesDisabledUser(t *testing.T) {
+	identities := newFakeIdentities(utils.User{ID: "7", Username: "alice", Disabled: true})
+	app := newTestApp(t, identities)
+	identities.linked[app.provider.server.URL+" provider-user-1"] = "7"
+
+	expectFailure(t, app, app.login(t), http.StatusForbidden, utils.AccountDisabled)
+}
+
+func TestLoginRefusesPasswordReset(t *testing.T) {
+	identities := newFakeIdentities(utils.User{ID: "7", Username: "alice", PasswordResetRequired: true})
+	app := newTestApp(t, identities)
+	identities.linked[app.provider.server.URL+" provider-user-1"] = "7"
+
+	expectFailure(t, app, app.login(t), http.StatusForbidden, utils.PasswordResetRequired)
+}
+
+func TestLinkFromSettings(t *testing.T) {
+	identities := newFakeIdentities(
+		utils.User{ID: "7", Username: "alice", TwoFactorEnabled: true},
+		utils.User{ID: "8", Username: "bob"},
+	)
+	app := newTestApp(t, identities)
+
+	// A user with 2FA logs in with the password and the second factor, then connects the provider
+	get(t, app.browser, app.server.URL+seedPath+"?id=7")
+	response := app.login(t)
+	expectRedirect(t, response, handlers.RoutesPointer.UserConfig.Settings.RedirectPath+"?sso="+LinkedQuery)
+	if identities.linked[app.provider.server.URL+" provider-user-1"] != "7" {
+		t.Fatal("identity was not linked to the logged-in user")
+	}
+	if len(identities.logins) != 0 {
+		t.Error("linking logged in through LoginExternalIdentity")
+	}
+
+	// From now on the identity logs in to alice
+	fresh := app.newBrowser(t)
+	expectRedirect(t, get(t, fresh, app.authorize(t, fresh, "").String()), handlers.RoutesPointer.UserConfig.GetTask.Route)
+	if principal := app.principal(t, fresh); principal == nil || principal.ID != "7" {
+		t.Errorf("logged in user = %v, want 7", principal)
+	}
+
+	// Another user can not take the identity over
+	other := app.newBrowser(t)
+	get(t, other, app.server.URL+seedPath+"?id=8")
+	expectRedirect(t, get(t, other, app.authorize(t, other, "").String()), handlers.RoutesPointer.UserConfig.Settings.RedirectPath+"?sso="+TakenQuery)
+	if identities.linked[app.provider.server.URL+" provider-user-1"] != "7" {
+		t.Error("identity moved to another user")
+	}
+}
+
+func TestReauth(t *testing.T) {
+	identities := newFakeIdentities(utils.User{ID: "7", Username: "alice"}, utils.User{ID: "8", Username: "bob"})
+	app := newTestApp(t, identities)
+	identities.linked[app.provider.server.URL+" provider-user-1"] = "7"
+
+	get(t, app.browser, app.server.URL+seedPath+"?id=7")
+	response := get(t, app.browser, app.authorize(t, app.browser, "?reauth=1").String())
+	expectRedirect(t, response, handlers.RoutesPointer.UserConfig.GetTask.Route)
+
+	// The identity of alice does not confirm the session of bob
+	other := app.newBrowser(t)
+	get(t, other, app.server.URL+seedPath+"?id=8")
+	response = get(t, other, app.authorize(t, other, "?reauth=1").String())
+	expectRedirect(t, response, handlers.RoutesPointer.UserConfig.Reauth.Route+"?sso="+ReauthFailedQuery)
+	if principal := app.principal(t, other); principal == nil || principal.ID != "8" {
+		t.Errorf("session of bob changed to %v", principal)
+	}
+}
@@ -0,0 +1,85 @@
+package stream
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+
+	"todoweb/packages/handlers"
+	"todoweb/packages/hub"
+	"todoweb/packages/utils"
+)
+
+// How often a comment is sent to keep the connection open through proxies
+const heartbeatInterval = 25 * time.Second
+
+// StreamHandlers defines the interface for real-time update handlers.
+type StreamHandlers interface {
+	GetEvents(c *gin.Context) // Streams task changes of the logged-in user as Server-Sent Events.
+}
+
+// streamHandlerProps holds dependencies for stream handlers.
+type streamHandlerProps struct {
+	Database *utils.DataBaseProps  // Checks that the session of an open stream is still valid.
+	Store    *sessions.CookieStore // Cookie store for session management.
+	Hub      *hub.Hub              // Hub the task handlers publish to.
+}
+
+// GetEvents keeps the connection open and writes every task change of the user as an SSE event.
+// Event name is the action (create, update, complete, delete), data is hub.Event as JSON.
+// The stream ends when the session does (logout, password change, disabled account), see handlers.SessionStillValid.
+// EventSource then reconnects and gets 401.
+func (prop *streamHandlerProps) GetEvents(c *gin.Context) {
+	userInterface, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return // EventSource does not follow redirects to HTML pages.
+	}
+
+	events, unsubscribe := prop.Hub.Subscribe(userInterface.ID)
+	defer unsubscribe()
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	recheck := time.NewTicker(utils.SessionRecheckInterval)
+	defer recheck.Stop()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // Disable buffering in nginx.
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false // Client went away.
+		case event, open := <-events:
+			if !open {
+				return false
+			}
+			c.SSEvent(event.Type, event)
+			return true
+		case <-heartbeat.C:
+			_, err := io.WriteString(w, ": ping\n\n")
+			return err == nil
+		case <-recheck.C:
+			valid, err := handlers.SessionStillValid(prop.Database, userInterface)
+			if err != nil {
+				log.Printf("stream session check error: %v\n", err)
+			}
+			return valid // Closed on errors too, the reconnect is authorized again.
+		}
+	})
+}
+
+// NewStreamHandler creates a new instance of StreamHandlers.
+func NewStreamHandler(db *utils.DataBaseProps, store *sessions.CookieStore, eventHub *hub.Hub) StreamHandlers {
+	return &streamHandlerProps{
+		Database: db,       // Set the database property.
+		Store:    store,    // Set the session store property.
+		Hub:      eventHub, // Set the hub property.
+	}
+}
@@ -4,9 +4,13 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/sessions"
 
+	"fmt"
 	"net/http"
+	"strconv"
+	"todoweb/packages/config"
 	"todoweb/packages/utils"
 	"todoweb/packages/handlers"
+	"todoweb/packages/hub"
 )
 
 /*
@@ -26,6 +30,8 @@ Tasks Table Structure:
 
 - created_at (timestamp without time zone, Not NULL, Default: CURRENT_TIMESTAMP)
   The timestamp when the task was created.
+
+Every change of a task is also appended to task_events (see utils/taskEvents.go).
 */
 
 // TaskHandlers interface defines the methods for task management.
@@ -33,12 +39,18 @@ type TaskHandlers interface {
 	CreateTask(c *gin.Context) // Handles task creation.
 	DeleteTask(c *gin.Context) // Handles task deletion.
 	GetTasks(c *gin.Context)    // Retrieves tasks for the logged-in user.
+	GetTask(c *gin.Context)     // Renders single task with its history.
+	UpdateTask(c *gin.Context)  // Handles task description change.
+	CompleteTask(c *gin.Context) // Handles marking task as completed or not completed.
+	GetActivity(c *gin.Context) // Returns activity feed of the logged-in user as JSON.
+	BulkTasks(c *gin.Context)   // Handles completing, reopening or deleting selected tasks.
 }
 
 // taskHandleProps struct holds dependencies for task handlers.
 type taskHandleProps struct {
 	Database *utils.DataBaseProps  // Database connection properties.
 	Store    *sessions.CookieStore     // Cookie store for session management.
+	Hub      *hub.Hub                  // Hub notified after every successful change.
 }
 
 // GetTasks retrieves tasks for the authenticated user and renders the task page.
@@ -49,19 +61,25 @@ func (prop *taskHandleProps) GetTasks(c *gin.Context) {
 		return // Redirect to login if user is not authenticated.
 	}
 
+	prop.renderTasks(c, userInterface, http.StatusOK, gin.H{})
+}
+
+// renderTasks renders the task page with the current tasks of the user, data is passed to the template as well.
+func (prop *taskHandleProps) renderTasks(c *gin.Context, userInterface *utils.Principal, status int, data gin.H) {
 	UserTasks, err := prop.Database.GetTasksFromDatabase(userInterface.ID)
 	if err != nil {
 		c.String(http.StatusInternalServerError, "Internal Server Error")
 		return // Handle error if task retrieval fails.
 	}
 
-	c.HTML(http.StatusOK, handlers.RoutesPointer.UserConfig.GetTask.HTMLPageName, gin.H{
-		"tasks": utils.ToDoPassStruct{
-			Tasks:  UserTasks,                       // Pass the retrieved tasks to the template.
-			UserID: utils.StrToInt(userInterface.ID), // Pass user ID for reference.
-		},
-		"Username": userInterface.Username, // Pass the username for display.
-	})
+	data["tasks"] = utils.ToDoPassStruct{
+		Tasks:  UserTasks,                       // Pass the retrieved tasks to the template.
+		UserID: utils.StrToInt(userInterface.ID), // Pass user ID for reference.
+	}
+	data["Username"] = userInterface.Username // Pass the username for display.
+	data["IdempotencyKey"] = utils.GenerateToken(16) // New key for every render, so double submits create one task.
+
+	handlers.RenderHTML(c, status, handlers.RoutesPointer.UserConfig.GetTask.HTMLPageName, data)
 }
 
 // CreateTask handles the creation of a new task.
@@ -78,13 +96,27 @@ func (prop *taskHandleProps) CreateTask(c *gin.Context) {
 	}
 
 	task := utils.TrimSpace(c.PostForm("taskTitle")) // Get and trim the task title.
+	key := utils.TrimSpace(c.PostForm("idempotencyKey")) // Hidden token of the form, empty for old pages.
 
 	// Add the task to the database and handle any errors.
-	if err := prop.Database.AddTask(userInterface.ID, task); err != nil {
+	created, replayed, err := prop.Database.AddTaskIdempotent(userInterface.ID, key, task, config.Options.IdempotencyWindow)
+	if err != nil {
+		if err.Error() == utils.IdempotencyKeyReused || err.Error() == fmt.Sprintf(utils.IdempotencyKeyTooLong, utils.IdempotencyKeyMaxLength) {
+			// An old page sent again with another title (e.g. after going back), the form gets a new key and keeps the title
+			prop.renderTasks(c, userInterface, http.StatusUnprocessableEntity, gin.H{
+				utils.ErrorTaskHTML: utils.TaskFormReused,
+				"Draft":             task,
+			})
+			return
+		}
 		c.String(http.StatusInternalServerError, "Failed to add task")
 		return // Handle error if task addition fails.
 	}
 
+	if !replayed {
+		prop.Hub.TaskChanged(userInterface.ID, utils.TaskEventCreate, utils.StrToInt(created.TaskID), &created) // Notify other open pages.
+	}
+
 	c.Redirect(http.StatusFound, handlers.RoutesPointer.UserConfig.DeleteTask.RedirectPath) // Redirect after successful creation.
 }
 
@@ -109,18 +141,219 @@ func (prop *taskHandleProps) DeleteTask(c *gin.Context) {
 	}
 
 	// Attempt to delete the task from the database and handle any errors.
-	if err := prop.Database.DeleteTask(userInterface.ID, taskID); err != nil {
+	if err := prop.Database.DeleteTask(userInterface.ID, taskID, 0); err != nil {
+		if err.Error() == fmt.Sprintf(utils.TaskNotFound, taskID) {
+			c.String(http.StatusNotFound, err.Error())
+			return // Task does not exist or belongs to another user.
+		}
 		c.String(http.StatusInternalServerError, "Failed to delete task")
 		return // Handle error if task deletion fails.
 	}
 
+	prop.Hub.TaskChanged(userInterface.ID, utils.TaskEventDelete, taskID, nil) // Notify other open pages.
+
 	c.Redirect(http.StatusFound, handlers.RoutesPointer.UserConfig.DeleteTask.RedirectPath) // Redirect after successful deletion.
 }
 
-// NewTaskHandler creates a new instance of TaskHandlers with the provided database and session store.
-func NewTaskHandler(db *utils.DataBaseProps, store *sessions.CookieStore) TaskHandlers {
+// GetTask renders the task detail page together with the task history.
+func (prop *taskHandleProps) GetTask(c *gin.Context) {
+	userInterface, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusUnauthorized, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return // Redirect to login if user is not authenticated.
+	}
+
+	taskID := utils.StrToInt(c.Param("id")) // Task ID is a part of the path.
+	if taskID == -1 {
+		c.String(http.StatusNotFound, "Task not found")
+		return // Handle error if task ID conversion fails.
+	}
+
+	prop.renderTask(c, userInterface, taskID, http.StatusOK, gin.H{})
+}
+
+// renderTask renders the task detail page with the current state of the task, data is passed to the template as well.
+func (prop *taskHandleProps) renderTask(c *gin.Context, userInterface *utils.Principal, taskID int, status int, data gin.H) {
+	task, err := prop.Database.GetTaskByID(userInterface.ID, taskID)
+	if err != nil {
+		if err.Error() == fmt.Sprintf(utils.TaskNotFound, taskID) {
+			c.String(http.StatusNotFound, err.Error())
+			return // Task does not exist or belongs to another user.
+		}
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return // Handle error if task retrieval fails.
+	}
+
+	events, err := prop.Database.GetTaskEvents(userInterface.ID, taskID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return // Handle error if history retrieval fails.
+	}
+
+	data["task"] = task                       // Task itself.
+	data["events"] = events                   // History of the task, oldest first.
+	data["Username"] = userInterface.Username // Pass the username for display.
+
+	c.Header("ETag", utils.TaskETag(task)) // Same tag as the JSON API.
+	handlers.RenderHTML(c, status, handlers.RoutesPointer.UserConfig.TaskDetail.HTMLPageName, data)
+}
+
+// UpdateTask handles changing the description of a task.
+func (prop *taskHandleProps) UpdateTask(c *gin.Context) {
+	userInterface, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusUnauthorized, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return // Redirect to login if user is not authenticated.
+	}
+
+	if err := c.Request.ParseForm(); err != nil {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.Route)
+		return // Handle error if form parsing fails.
+	}
+
+	taskID := utils.StrToInt(utils.TrimSpace(c.PostForm("TaskID"))) // Get and convert the task ID.
+	if taskID == -1 {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return // Handle error if task ID conversion fails.
+	}
+
+	description := utils.TrimSpace(c.PostForm("taskTitle")) // Get and trim the new task title.
+	version := utils.StrToInt(c.PostForm("version"))         // Version the form was rendered with.
+	if version == -1 {
+		version = 0 // Old forms without version are not checked.
+	}
+
+	updated, err := prop.Database.UpdateTask(userInterface.ID, taskID, version, description)
+	if err != nil {
+		if err.Error() == fmt.Sprintf(utils.TaskNotFound, taskID) {
+			c.String(http.StatusNotFound, err.Error())
+			return // Task does not exist or belongs to another user.
+		}
+		if err.Error() == fmt.Sprintf(utils.TaskVersionMismatch, taskID) {
+			prop.renderTask(c, userInterface, taskID, http.StatusConflict, gin.H{
+				utils.ErrorConflictHTML: err.Error(),   // Tell the user the task has changed meanwhile.
+				"Draft":                 description, // Keep what the user has typed.
+			})
+			return // Show the current task instead of overwriting it.
+		}
+		c.String(http.StatusInternalServerError, "Failed to update task")
+		return // Handle error if task update fails.
+	}
+
+	prop.Hub.TaskChanged(userInterface.ID, utils.TaskEventUpdate, taskID, &updated) // Notify other open pages.
+
+	c.Redirect(http.StatusFound, handlers.RoutesPointer.UserConfig.UpdateTask.RedirectPath+strconv.Itoa(taskID)) // Back to the task page.
+}
+
+// CompleteTask handles marking a task as completed or not completed.
+func (prop *taskHandleProps) CompleteTask(c *gin.Context) {
+	userInterface, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusUnauthorized, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return // Redirect to login if user is not authenticated.
+	}
+
+	if err := c.Request.ParseForm(); err != nil {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.Route)
+		return // Handle error if form parsing fails.
+	}
+
+	taskID := utils.StrToInt(utils.TrimSpace(c.PostForm("TaskID"))) // Get and convert the task ID.
+	if taskID == -1 {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return // Handle error if task ID conversion fails.
+	}
+
+	completed := c.PostForm("completed") == "true" // Desired state, anything else reopens the task.
+
+	updated, err := prop.Database.SetTaskCompleted(userInterface.ID, taskID, 0, completed)
+	if err != nil {
+		if err.Error() == fmt.Sprintf(utils.TaskNotFound, taskID) {
+			c.String(http.StatusNotFound, err.Error())
+			return // Task does not exist or belongs to another user.
+		}
+		c.String(http.StatusInternalServerError, "Failed to update task")
+		return // Handle error if task update fails.
+	}
+
+	prop.Hub.TaskChanged(userInterface.ID, utils.TaskEventComplete, taskID, &updated) // Notify other open pages.
+
+	c.Redirect(http.StatusFound, handlers.RoutesPointer.UserConfig.CompleteTask.RedirectPath) // Redirect after successful change.
+}
+
+// BulkTasks applies the chosen action to every selected task in a single transaction.
+func (prop *taskHandleProps) BulkTasks(c *gin.Context) {
+	userInterface, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusUnauthorized, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return // Redirect to login if user is not authenticated.
+	}
+
+	if err := c.Request.ParseForm(); err != nil {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.Route)
+		return // Handle error if form parsing fails.
+	}
+
+	action := utils.TrimSpace(c.PostForm("action")) // Pressed button.
+	if !utils.IsBulkAction(action) {
+		c.String(http.StatusBadRequest, fmt.Sprintf(utils.BulkUnknownAction, action))
+		return // Handle unknown action.
+	}
+
+	var taskIDs []int
+	for _, value := range c.PostFormArray("TaskID") { // Every checked checkbox.
+		if taskID := utils.StrToInt(utils.TrimSpace(value)); taskID != -1 {
+			taskIDs = append(taskIDs, taskID)
+		}
+	}
+
+	if len(taskIDs) > utils.BulkMaxTasks {
+		c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf(utils.BulkTooManyTasks, utils.BulkMaxTasks))
+		return // Handle too big selection.
+	}
+
+	results, err := prop.Database.BulkUpdateTasks(userInterface.ID, action, taskIDs)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to update tasks")
+		return // Nothing was changed, the transaction is rolled back.
+	}
+
+	prop.Hub.BulkChanged(userInterface.ID, action, results) // Notify other open pages.
+
+	c.Redirect(http.StatusFound, handlers.RoutesPointer.UserConfig.BulkTasks.RedirectPath) // Redirect after successful change.
+}
+
+// GetActivity returns the activity feed of the logged-in user, newest events first.
+// Optional query parameters: "before" (event id for paging) and "limit".
+func (prop *taskHandleProps) GetActivity(c *gin.Context) {
+	userInterface, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+		return // JSON endpoint, so no redirect.
+	}
+
+	beforeID, err := strconv.ParseInt(c.DefaultQuery("before", "0"), 10, 64)
+	if err != nil || beforeID < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid before parameter"})
+		return
+	}
+
+	limit := utils.StrToInt(c.DefaultQuery("limit", strconv.Itoa(utils.ActivityFeedLimit)))
+
+	events, err := prop.Database.GetUserActivity(userInterface.ID, beforeID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Internal Server Error"})
+		return // Handle error if feed retrieval fails.
+	}
+
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+// NewTaskHandler creates a new instance of TaskHandlers with the provided database, session store and hub.
+func NewTaskHandler(db *utils.DataBaseProps, store *sessions.CookieStore, eventHub *hub.Hub) TaskHandlers {
 	return &taskHandleProps{
 		Database: db,  // Set the database property.
 		Store:    store, // Set the session store property.
+		Hub:      eventHub, // Set the hub property.
 	}
 }
\ No newline at end of file
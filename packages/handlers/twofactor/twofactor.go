@@ -0,0 +1,277 @@
+package twofactor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image/png"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/sessions"
+	"github.com/pquerna/otp"
+
+	"todoweb/packages/handlers"
+	"todoweb/packages/utils"
+)
+
+// Size of the enrollment QR code in pixels
+const qrCodeSize = 200
+
+// TwoFactorHandlers defines the interface for TOTP enrollment and the second login step.
+type TwoFactorHandlers interface {
+	GetSettings(c *gin.Context)   // Renders 2FA status and the QR code of a pending setup.
+	PostSetup(c *gin.Context)     // Starts enrollment with a new secret.
+	PostConfirm(c *gin.Context)   // Enables 2FA after the first valid code and shows recovery codes.
+	PostDisable(c *gin.Context)   // Disables 2FA after the password is entered again.
+	GetLoginCode(c *gin.Context)  // Renders the second login step.
+	PostLoginCode(c *gin.Context) // Checks the code and finishes login.
+}
+
+// twoFactorHandlerProps holds dependencies for 2FA handlers.
+type twoFactorHandlerProps struct {
+	Database *utils.DataBaseProps  // Database connection properties.
+	Store    *sessions.CookieStore // Cookie store for session management.
+}
+
+// qrCodeURL renders the otpauth URL of key as PNG data URL.
+// The QR code is made on the server, so the secret is never sent to a third party.
+func qrCodeURL(key *otp.Key) (template.URL, error) {
+	image, err := key.Image(qrCodeSize, qrCodeSize)
+	if err != nil {
+		return "", fmt.Errorf("qr code error: %v", err)
+	}
+
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, image); err != nil {
+		return "", fmt.Errorf("qr code encode error: %v", err)
+	}
+
+	// html/template drops data URLs unless they are marked safe, the content is generated here
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buffer.Bytes())), nil
+}
+
+// renderSettings shows the settings page of user, data holds messages of the current action
+func (prop *twoFactorHandlerProps) renderSettings(c *gin.Context, status int, user *utils.Principal, data gin.H) {
+	state, err := prop.Database.GetTwoFactorState(user.ID, user.Username)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	data["Username"] = user.Username
+	data["Enabled"] = state.Enabled
+	data["RecoveryCodesLeft"] = state.RecoveryCodesLeft
+
+	if state.PendingKey != nil {
+		qrCode, err := qrCodeURL(state.PendingKey)
+		if err != nil {
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+			return
+		}
+
+		data["QRCode"] = qrCode
+		data["Secret"] = state.PendingKey.Secret() // For apps that can not scan codes.
+	}
+
+	handlers.RenderHTML(c, status, handlers.RoutesPointer.UserConfig.TwoFactor.HTMLPageName, data)
+}
+
+// GetSettings renders the 2FA settings page.
+func (prop *twoFactorHandlerProps) GetSettings(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	prop.renderSettings(c, http.StatusOK, user, gin.H{})
+}
+
+// PostSetup generates a new pending secret and shows its QR code.
+func (prop *twoFactorHandlerProps) PostSetup(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	if err := prop.Database.BeginTwoFactorSetup(user.ID, user.Username); err != nil {
+		if err.Error() == utils.TwoFactorAlreadyEnabled {
+			prop.renderSettings(c, http.StatusConflict, user, gin.H{utils.ErrorTwoFactorHTML: err.Error()})
+			return
+		}
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.TwoFactor.RedirectPath)
+}
+
+// PostConfirm enables 2FA if the entered code matches the pending secret.
+// Recovery codes are shown only in this response, the database keeps their hashes.
+func (prop *twoFactorHandlerProps) PostConfirm(c *gin.Context) {
+	user, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	code := c.PostForm(handlers.RoutesPointer.TwoFactorLoginConfig.ParseKeys.CodeParseKey)
+
+	codes, err := prop.Database.ConfirmTwoFactor(user.ID, code)
+	if err != nil {
+		switch err.Error() {
+		case utils.TwoFactorCodeInvalid, utils.TwoFactorNotPending, utils.TwoFactorAlreadyEnabled:
+			prop.renderSettings(c, http.StatusBadRequest, user, gin.H{utils.ErrorTwoFactorHTML: err.Error()})
+		default:
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+		}
+		return
+	}
+
+	handlers.RecordSecurityEvent(c, prop.Database, user.ID, utils.AuditEventTwoFactorEnabled, utils.AuthMethodTOTP)
+
+	prop.renderSettings(c, http.StatusOK, user, gin.H{"RecoveryCodes": codes})
+}
+
+// PostDisable turns 2FA off, the current password is required so a left open session is not enough.
+func (prop *twoFactorHandlerProps) PostDisable(c *gin.Context) {
+	sessionUser, ok := handlers.GetUserFromSession(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.GetTask.RedirectPath)
+		return
+	}
+
+	// Password hash in the session may be outdated, so the user is read again
+	user, err := prop.Database.FetchUserByID(sessionUser.ID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	// Wrong passwords count towards the login lockout like at the login form
+	password := c.PostForm(handlers.RoutesPointer.Authentication.ParseKeys.PasswordParseKey)
+	status, message, err := handlers.CheckCurrentPassword(c, prop.Database, &user, password)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+	if message != "" {
+		prop.renderSettings(c, status, sessionUser, gin.H{utils.ErrorTwoFactorHTML: message})
+		return
+	}
+
+	if err := prop.Database.DisableTwoFactor(user.ID); err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	handlers.RecordSecurityEvent(c, prop.Database, user.ID, utils.AuditEventTwoFactorDisabled, utils.AuthMethodTOTP)
+
+	c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.UserConfig.TwoFactor.RedirectPath)
+}
+
+// GetLoginCode renders the code form, without a pending login the user goes back to the password form.
+func (prop *twoFactorHandlerProps) GetLoginCode(c *gin.Context) {
+	pending, ok := handlers.GetPendingLogin(c, prop.Store)
+	if !ok {
+		c.Redirect(http.StatusSeeOther, handlers.RoutesPointer.TwoFactorLoginConfig.RedirectPath)
+		return
+	}
+
+	prop.renderLoginCode(c, http.StatusOK, pending, gin.H{})
+}
+
+// renderLoginCode shows the second step with the methods the pending user has, TOTP code and/or passkey
+func (prop *twoFactorHandlerProps) renderLoginCode(c *gin.Context, status int, pending *utils.PendingLogin, data gin.H) {
+	state, err := prop.Database.GetTwoFactorState(pending.UserID, "")
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	passkey, err := prop.Database.IsPasskeySecondFactor(pending.UserID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	data["CodeEnabled"] = state.Enabled
+	data["PasskeyEnabled"] = passkey
+
+	handlers.RenderHTML(c, status, handlers.RoutesPointer.TwoFactorLoginConfig.PageName, data)
+}
+
+// PostLoginCode checks TOTP or recovery code of the pending login and only then sets the user session.
+func (prop *twoFactorHandlerProps) PostLoginCode(c *gin.Context) {
+	pending, ok := handlers.GetPendingLogin(c, prop.Store)
+	if !ok {
+		handlers.RenderHTML(c, http.StatusUnauthorized, handlers.RoutesPointer.MainLoginConfig.PageName, gin.H{
+			utils.ErrorLoginHTML: utils.TwoFactorLoginExpired,
+		})
+		return
+	}
+
+	code := c.PostForm(handlers.RoutesPointer.TwoFactorLoginConfig.ParseKeys.CodeParseKey)
+
+	usedRecovery, err := prop.Database.VerifySecondFactor(pending.UserID, code)
+	if err != nil {
+		if err.Error() == utils.TwoFactorCodeInvalid || err.Error() == fmt.Sprintf(utils.TwoFactorTooManyAttempts, int(utils.TwoFactorLockTime.Minutes())) {
+			handlers.RecordSecurityEvent(c, prop.Database, pending.UserID, utils.AuditEventLoginFailed, utils.AuthMethodTOTP)
+			prop.renderLoginCode(c, http.StatusUnauthorized, pending, gin.H{
+				utils.ErrorTwoFactorHTML: err.Error(),
+			})
+			return
+		}
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	user, err := prop.Database.FetchUserByID(pending.UserID)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Internal Server Error")
+		return
+	}
+
+	method := utils.AuthMethodTOTP
+	if usedRecovery {
+		method = utils.AuthMethodRecoveryCode
+	}
+
+	// Replace the pending login with the real session, an account disabled or reset between the password and
+	// the code step is refused
+	if err := handlers.StartUserSession(c, prop.Store, prop.Database, &user, utils.AuthMethodPassword, method); err != nil {
+		switch err.Error() {
+		case utils.AccountDisabled, utils.PasswordResetRequired:
+			handlers.RenderHTML(c, http.StatusForbidden, handlers.RoutesPointer.MainLoginConfig.PageName, gin.H{utils.ErrorLoginHTML: err.Error()})
+		default:
+			c.String(http.StatusInternalServerError, "Internal Server Error")
+		}
+		return
+	}
+
+	if pending.Remember {
+		if err := handlers.RememberUserSession(c, prop.Store, prop.Database); err != nil {
+			log.Printf("remember me error: %v\n", err)
+		}
+	}
+
+	// A used recovery code means the authenticator may be lost, point the user to the settings page
+	if usedRecovery {
+		c.Redirect(http.StatusFound, handlers.RoutesPointer.UserConfig.TwoFactor.Route)
+		return
+	}
+
+	c.Redirect(http.StatusFound, handlers.LoginRedirectPath(c, prop.Store))
+}
+
+// NewTwoFactorHandler creates a new instance of TwoFactorHandlers.
+func NewTwoFactorHandler(db *utils.DataBaseProps, store *sessions.CookieStore) TwoFactorHandlers {
+	return &twoFactorHandlerProps{
+		Database: db,
+		Store:    store,
+	}
+}
@@ -0,0 +1,97 @@
+package hub
+
+import (
+	"sync"
+
+	"todoweb/packages/utils"
+)
+
+// Size of subscriber buffer, events for subscribers with full buffer are dropped
+const subscriberBuffer = 16
+
+// Event is a change of a task, published after the change is stored in the database.
+// Type is one of utils.TaskEvent* actions.
+type Event struct {
+	Type   string      `json:"type"`
+	TaskID int         `json:"taskId"`
+	Task   *utils.Task `json:"task,omitempty"` // nil for delete events
+}
+
+// Hub is an in-process publish/subscribe hub, subscribers are grouped by user ID.
+type Hub struct {
+	mutex       sync.RWMutex
+	subscribers map[string]map[chan Event]struct{}
+}
+
+// NewHub creates empty Hub
+func NewHub() *Hub {
+	return &Hub{
+		subscribers: make(map[string]map[chan Event]struct{}),
+	}
+}
+
+// Subscribe registers new subscriber for events of userID.
+// Returned function must be called to unsubscribe, it closes the channel.
+func (hub *Hub) Subscribe(userID string) (<-chan Event, func()) {
+	channel := make(chan Event, subscriberBuffer)
+
+	hub.mutex.Lock()
+	if hub.subscribers[userID] == nil {
+		hub.subscribers[userID] = make(map[chan Event]struct{})
+	}
+	hub.subscribers[userID][channel] = struct{}{}
+	hub.mutex.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			hub.mutex.Lock()
+			delete(hub.subscribers[userID], channel)
+			if len(hub.subscribers[userID]) == 0 {
+				delete(hub.subscribers, userID)
+			}
+			hub.mutex.Unlock()
+			close(channel)
+		})
+	}
+
+	return channel, unsubscribe
+}
+
+// Publish sends event to every subscriber of userID without blocking.
+// Slow subscribers miss the event, they are expected to reload the list.
+func (hub *Hub) Publish(userID string, event Event) {
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+
+	for channel := range hub.subscribers[userID] {
+		select {
+		case channel <- event:
+		default:
+		}
+	}
+}
+
+// TaskChanged is a shortcut for publishing change of task, pass nil task for deletion
+func (hub *Hub) TaskChanged(userID string, action string, taskID int, task *utils.Task) {
+	if hub == nil {
+		return
+	}
+
+	hub.Publish(userID, Event{Type: action, TaskID: taskID, Task: task})
+}
+
+// BulkChanged publishes every applied result of utils.BulkUpdateTasks
+func (hub *Hub) BulkChanged(userID string, action string, results []utils.BulkResult) {
+	for _, result := range results {
+		if result.Status != utils.BulkStatusApplied {
+			continue
+		}
+
+		if action == utils.BulkActionDelete {
+			hub.TaskChanged(userID, utils.TaskEventDelete, result.TaskID, nil)
+		} else {
+			hub.TaskChanged(userID, utils.TaskEventComplete, result.TaskID, result.Task)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Mailer sends plain text emails.
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPMailer sends emails through an SMTP server.
+// Without Username no authentication is used, which is what local SMTP sinks (MailHog, smtp4dev) expect.
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+// Send delivers the message, returning the SMTP error if the server rejects it
+func (mailer *SMTPMailer) Send(to, subject, body string) error {
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return fmt.Errorf("header injection attempt")
+	}
+
+	var auth smtp.Auth
+	if mailer.Username != "" {
+		auth = smtp.PlainAuth("", mailer.Username, mailer.Password, mailer.Host)
+	}
+
+	message := strings.Join([]string{
+		"From: " + mailer.From,
+		"To: " + to,
+		"Subject: " + subject,
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		body,
+	}, "\r\n")
+
+	return smtp.SendMail(net.JoinHostPort(mailer.Host, mailer.Port), auth, mailer.From, []string{to}, []byte(message))
+}
+
+// LogMailer only writes emails to the log, used for development.
+type LogMailer struct{}
+
+// Send logs the message and never fails
+func (LogMailer) Send(to, subject, body string) error {
+	log.Printf("mail to %s\nSubject: %s\n\n%s\n", to, subject, body)
+	return nil
+}
+
+// NewMailer returns SMTPMailer for driver "smtp" and LogMailer for anything else
+func NewMailer(driver, host, port, username, password, from string) Mailer {
+	if driver == "smtp" {
+		return &SMTPMailer{
+			Host:     host,
+			Port:     port,
+			Username: username,
+			Password: password,
+			From:     from,
+		}
+	}
+
+	return LogMailer{}
+}
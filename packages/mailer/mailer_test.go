@@ -0,0 +1,209 @@
+package mailer_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"todoweb/packages/handlers/password"
+	"todoweb/packages/mailer"
+	"todoweb/packages/utils"
+)
+
+// received is what the SMTP sink got from one client
+type received struct {
+	auth       string   // Decoded AUTH PLAIN response, empty without authentication.
+	mailFrom   string   // Address of MAIL FROM.
+	recipients []string // Addresses of RCPT TO.
+	data       string   // Message after DATA with dot-stuffing removed.
+}
+
+// startSink listens on a local port and serves one SMTP session, the result is sent on the channel.
+// AUTH PLAIN is offered only when withAuth is set, like a MailHog without authentication.
+func startSink(t *testing.T, withAuth bool) (string, string, <-chan received) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	result := make(chan received, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		var got received
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+		reply("220 localhost ESMTP sink")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+			command := strings.ToUpper(line)
+
+			switch {
+			case strings.HasPrefix(command, "EHLO"):
+				if withAuth {
+					reply("250-localhost")
+					reply("250 AUTH PLAIN")
+				} else {
+					reply("250 localhost")
+				}
+			case strings.HasPrefix(command, "AUTH PLAIN "):
+				decoded, _ := base64.StdEncoding.DecodeString(line[len("AUTH PLAIN "):])
+				got.auth = string(decoded)
+				reply("235 2.7.0 Authentication successful")
+			case strings.HasPrefix(command, "MAIL FROM:"):
+				got.mailFrom = strings.Trim(line[len("MAIL FROM:"):], "<> ")
+				reply("250 OK")
+			case strings.HasPrefix(command, "RCPT TO:"):
+				got.recipients = append(got.recipients, strings.Trim(line[len("RCPT TO:"):], "<> "))
+				reply("250 OK")
+			case command == "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				var data strings.Builder
+				for {
+					dataLine, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if dataLine == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(dataLine, "."))
+				}
+				got.data = data.String()
+				reply("250 OK queued")
+			case command == "QUIT":
+				reply("221 Bye")
+				result <- got
+				return
+			default:
+				reply("502 Command not implemented")
+			}
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(listener.Addr().String())
+	return host, port, result
+}
+
+// wait returns the session of the sink or fails the test
+func wait(t *testing.T, result <-chan received) received {
+	t.Helper()
+
+	select {
+	case got := <-result:
+		return got
+	case <-time.After(5 * time.Second):
+		t.Fatal("sink received no complete session")
+		return received{}
+	}
+}
+
+func TestSMTPMailerSendsResetLink(t *testing.T) {
+	host, port, result := startSink(t, false)
+
+	user := utils.User{Username: "alice", Email: "alice@example.com"}
+	token := "a+b/c=d"
+	subject, body := password.ResetMail(user, password.ResetReasonForgot, token)
+
+	sender := &mailer.SMTPMailer{Host: host, Port: port, From: "todoweb@localhost"}
+	if err := sender.Send(user.Email, subject, body); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	got := wait(t, result)
+
+	if got.auth != "" {
+		t.Errorf("authenticated without username: %q", got.auth)
+	}
+	if got.mailFrom != "todoweb@localhost" {
+		t.Errorf("MAIL FROM = %q, want todoweb@localhost", got.mailFrom)
+	}
+	if len(got.recipients) != 1 || got.recipients[0] != user.Email {
+		t.Errorf("RCPT TO = %v, want [%s]", got.recipients, user.Email)
+	}
+
+	message, err := mail.ReadMessage(strings.NewReader(got.data))
+	if err != nil {
+		t.Fatalf("parse message: %v", err)
+	}
+
+	headers := map[string]string{
+		"From":         "todoweb@localhost",
+		"To":           user.Email,
+		"Subject":      "Password reset",
+		"MIME-Version": "1.0",
+		"Content-Type": "text/plain; charset=UTF-8",
+	}
+	for name, want := range headers {
+		if value := message.Header.Get(name); value != want {
+			t.Errorf("header %s = %q, want %q", name, value, want)
+		}
+	}
+	if _, err := message.Header.Date(); err != nil {
+		t.Errorf("Date header: %v", err)
+	}
+
+	var received strings.Builder
+	scanner := bufio.NewScanner(message.Body)
+	for scanner.Scan() {
+		received.WriteString(scanner.Text() + "\n")
+	}
+	if received.String() != body {
+		t.Errorf("body = %q, want %q", received.String(), body)
+	}
+
+	// The token is escaped, so + / = survive as part of the query
+	link := "http://localhost:8080/reset?token=a%2Bb%2Fc%3Dd"
+	if !strings.Contains(received.String(), link+"\n") {
+		t.Errorf("body has no reset link %s:\n%s", link, received.String())
+	}
+}
+
+func TestSMTPMailerAuthenticates(t *testing.T) {
+	host, port, result := startSink(t, true)
+
+	sender := &mailer.SMTPMailer{Host: host, Port: port, Username: "user", Password: "secret", From: "todoweb@localhost"}
+	if err := sender.Send("bob@example.com", "Hello", ".starts with a dot\n"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	got := wait(t, result)
+
+	if got.auth != "\x00user\x00secret" {
+		t.Errorf("AUTH PLAIN = %q, want user and secret", got.auth)
+	}
+	if !strings.HasSuffix(got.data, "\r\n\r\n.starts with a dot\r\n") {
+		t.Errorf("dot-stuffed line not restored: %q", got.data)
+	}
+}
+
+func TestSMTPMailerRejectsHeaderInjection(t *testing.T) {
+	// No server runs on the port, the check happens before connecting
+	sender := &mailer.SMTPMailer{Host: "127.0.0.1", Port: "1", From: "todoweb@localhost"}
+
+	for _, to := range []string{"alice@example.com\r\nBcc: eve@example.com", "alice@example.com\n"} {
+		if err := sender.Send(to, "Password reset", "body"); err == nil || err.Error() != "header injection attempt" {
+			t.Errorf("Send(%q) error = %v, want header injection attempt", to, err)
+		}
+	}
+	if err := sender.Send("alice@example.com", "Reset\r\nBcc: eve@example.com", "body"); err == nil {
+		t.Error("subject with CRLF was sent")
+	}
+}
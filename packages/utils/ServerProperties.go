@@ -2,7 +2,6 @@ package utils
 
 import (
 	"fmt"
-	"regexp"
 	"strconv"
 	"strings"
 )
@@ -17,53 +16,124 @@ const (
     LatinError = "Password should contain at least one latin letter"
     DigitError = "Password should contain at least one digit"
     SpaceError = "Password should not contain space"
+    UppercaseError = "Password should contain at least one upper case letter"
+    LowercaseError = "Password should contain at least one lower case letter"
+    SymbolError = "Password should contain at least one symbol"
+    PasswordTooWeak = "Password is too easy to guess, use a longer or less common one"
+    PasswordBreached = "Password appeared in a data breach, choose another one"
+    ErrorPasswordListHTML = "PasswordErrors"
     PasswordNotMatch = "Passwords do not match"
     UserAlreadyExistError = "User already exists"
     UsernameContainsSpace = "Username should not contain space"
+    UsernameEmpty = "Username should not be empty"
+    CurrentPasswordInvalid = "Current password is not correct"
+    PasswordChanged = "Password changed, other sessions were logged out"
+    UsernameChanged = "Username changed"
+    AccountDeletionNotScheduled = "Account deletion was not requested"
+    AccountDeletionScheduled = "Your account and all tasks will be deleted on %s, you can cancel until then"
+    ErrorDeleteHTML = "DeleteError"
     ErrorPasswordHTML = "PasswordError"
     ErrorUsernameHTML = "UserExistError"
     ErrorLoginHTML = "LoginError"
+    ErrorConflictHTML = "ConflictError"
+    ErrorTaskHTML = "TaskError"
+    TaskFormReused = "This form was already sent with another task, the task was not added. Press Add again to add it"
     LoginError = "Incorrect username or password"
+    CSRFTokenInvalid = "Form has expired, reload the page and try again"
+    LoginLocked = "Too many failed logins, try again later"
     Form = "Form"
     ConvertError = "StrToInt error"
     GetTaskError = "Task parsing error"
     UserNotFound = "User %s not found"
+    TaskNotFound = "Task %d not found"
+    TaskVersionMismatch = "Task %d was changed by someone else"
+    IdempotencyKeyReused = "Idempotency key was already used for another request"
+    IdempotencyKeyTooLong = "Idempotency key must be at most %d characters"
+    BulkUnknownAction = "Unknown bulk action %q"
+    BulkTooManyTasks = "At most %d tasks can be changed at once"
+    ResetTokenInvalid = "Reset link is invalid or has expired"
+    ResetLinkSent = "If an account with this email exists, a reset link has been sent"
+    ErrorResetHTML = "ResetError"
+    EmailInvalid = "Email address is not valid"
+    EmailAlreadyExistError = "Email is already used by another account"
+    ErrorEmailHTML = "EmailError"
+    VerificationTokenInvalid = "Verification link is invalid or has expired"
+    EmailNotVerified = "Please verify your email address before logging in"
+    VerificationLinkSent = "If this account is waiting for verification, a new link has been sent"
+    MessageHTML = "Message"
+    TwoFactorCodeInvalid = "Authentication code is not valid"
+    TwoFactorTooManyAttempts = "Too many wrong codes, try again in %d minutes"
+    TwoFactorNotPending = "Two-factor setup was not started"
+    TwoFactorAlreadyEnabled = "Two-factor authentication is already enabled"
+    TwoFactorLoginExpired = "Login step expired, enter your password again"
+    ErrorTwoFactorHTML = "TwoFactorError"
+    PasskeyUnknown = "Passkey is not registered"
+    PasskeyNotFound = "Passkey %d not found"
+    PasskeyRequired = "Register a passkey first"
+    PasskeyFailed = "Passkey check failed"
+    PasskeyCloned = "Passkey was rejected because its counter went back, it may have been copied"
+    ExternalIdentityUnknown = "No account is linked to this sign-in, log in with your password and connect it in settings"
+    ExternalIdentityTaken = "This sign-in is already linked to another account"
+    ExternalIdentityLinkRequired = "Your account uses two-factor authentication, log in with your password and connect this sign-in in settings"
+    SSOFailed = "Single sign-on failed, try again"
+    SSOLinked = "Single sign-on account connected"
+    ErrorSSOHTML = "SSOError"
+    OAuthClientNameInvalid = "Application name must have 1 to %d characters"
+    OAuthRedirectURIInvalid = "Redirect URI %q must be an absolute https URL without fragment, http is allowed for localhost only"
+    OAuthRedirectURICount = "Enter 1 to %d redirect URIs"
+    OAuthClientDeleted = "Application deleted"
+    OAuthAccessRevoked = "Access revoked"
+    ErrorOAuthHTML = "OAuthError"
+    OAuthUnknownClient = "Unknown application"
+    OAuthUnknownRedirect = "The application sent a redirect address it did not register"
+    OAuthRequestExpired = "The authorization request has expired, start again from the application"
+    AccountDisabled = "This account is disabled, contact an administrator"
+    PasswordResetRequired = "An administrator asked you to choose a new password, use the link sent to your email or \"Forgot password\""
+    AdminForbidden = "Only administrators can open this page"
+    AdminSelfAction = "Use the settings page to change your own account"
+    AdminRoleInvalid = "Unknown role"
+    AdminUserDisabled = "%s is disabled and was logged out"
+    AdminUserEnabled = "%s is enabled"
+    AdminUserLoggedOut = "Every session of %s was logged out"
+    AdminPasswordResetSent = "%s has to choose a new password, a reset link was sent to their email"
+    AdminPasswordResetNoEmail = "%s has no email address to send a reset link to"
+    AdminRoleChanged = "%s is now %s"
+    AdminEventDateInvalid = "Dates have the form YYYY-MM-DD"
+    ErrorAdminHTML = "AdminError"
+    ErrorRegistrationHTML = "RegistrationError"
+    RegistrationClosedError = "Registration is closed"
+    RegistrationDomainError = "Only addresses at %s can register without an invite code"
+    InviteRequired = "An invite code is needed to register"
+    InviteInvalid = "Invite code is invalid, expired or used up"
+    InviteUsesInvalid = "Number of uses must be 1 to %d"
+    InviteTTLInvalid = "Validity must be 1 to %d days"
+    InviteNotFound = "Invite not found"
+    InviteRevoked = "Invite revoked"
+    InvitesForbidden = "Only administrators can create invites"
+    ErrorInviteHTML = "InviteError"
+    RememberTokenInvalid = "remember me token is invalid"
+    RememberTokenReused = "remember me token was used again, every session was logged out"
+    ReauthRequired = "Confirm it is you before changing this setting"
+    ReauthSSOMismatch = "That account is not linked to you, use a linked account or your password"
+    ErrorReauthHTML = "ReauthError"
 )
 
-// Checks if gained password valid, if it is unvalid return error
-func IsValidPassword (pword, repword string) (error) {
-    passwordByted := []byte(pword)
+// Checks if gained password valid against the current PasswordPolicy.
+// Every broken rule is returned at once in a *PasswordPolicyError, userInputs (username, email) make the strength check stricter.
+func IsValidPassword (pword, repword string, userInputs ...string) (error) {
+    violations := currentPolicy.Check(pword, userInputs...)
 
     if pword != repword {
-        return fmt.Errorf(PasswordNotMatch)
+        violations = append([]string{PasswordNotMatch}, violations...)
     }
 
-    if len(passwordByted) < MinLength {
-        return fmt.Errorf("Password length must be at least %d", MinLength)
-    } else if len(passwordByted) > MaxLength {
-        return fmt.Errorf("Password length must be at most %d", MaxLength)
-    }
-
-    if matched, err := regexp.Match(LatinRegexp, passwordByted); err != nil {
-        return fmt.Errorf(InternalErrorString)
-    } else if !matched {
-        return fmt.Errorf(LatinError)
-    }
-
-    if digitValid, err := regexp.Match(DigitsRegexp, passwordByted); err != nil {
-        return fmt.Errorf(InternalErrorString)
-    } else if !digitValid {
-        return fmt.Errorf(DigitError)
-    }
-
-    if ContainSpace(pword) {
-        return fmt.Errorf(SpaceError)
+    if len(violations) > 0 {
+        return &PasswordPolicyError{Violations: violations}
     }
 
     return nil
 }
 
-// Checks if gained username valid, if it is unvalid return error
 func IsValidUsername (uname string) (error) {
     if ContainSpace(uname) {
         return fmt.Errorf(UsernameContainsSpace)
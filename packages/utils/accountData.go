@@ -0,0 +1,373 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// users.deletion_scheduled_at (timestamp, nullable)
+//    - Set when the user asks to delete the account. After this time PurgeDeletedAccounts removes
+//      the user and every per-user row, until then the request can be cancelled.
+
+const (
+	usersDeletionScheduledColumn = "deletion_scheduled_at"
+)
+
+// Events stored in audit_log
+const (
+	AuditEventDeletionRequested = "account_deletion_requested"
+	AuditEventDeletionCancelled = "account_deletion_cancelled"
+	AuditEventAccountDeleted    = "account_deleted"
+)
+
+// userDataTables lists tables with a user_id column, their rows are exported and purged with the account.
+// audit_log is purged too, the deletion itself is recorded afterwards without a user id.
+var userDataTables = []struct {
+	Table  string
+	UserID string
+}{
+	{tasksTableName, tasksUserID},
+	{taskEventsTableName, taskEventsUserID},
+	{tombstonesTableName, tombstonesUserID},
+	{changeSeqTableName, changeSeqUserID},
+	{idempotencyTableName, idempotencyUserID},
+	{resetTokensTableName, resetTokensUserID},
+	{verificationTokensTableName, verificationTokensUserID},
+	{recoveryCodesTableName, recoveryCodesUserID},
+	{credentialsTableName, credentialsUserID},
+	{externalIdentitiesTableName, externalIdentitiesUserID},
+	{oauthClientsTableName, oauthClientsOwnerID},
+	{oauthCodesTableName, oauthCodesUserID},
+	{oauthTokensTableName, oauthTokensUserID},
+	{userSessionsTableName, userSessionsUserID},
+	{invitesTableName, invitesCreatedBy},
+	{rememberTokensTableName, rememberTokensUserID},
+	{auditTableName, auditUserID},
+}
+
+// DeletionScheduledAt returns when the account of user will be deleted, zero time if no deletion was requested
+func (database *DataBaseProps) DeletionScheduledAt(userID string) (time.Time, error) {
+	if database == nil || database.Connection == nil {
+		return time.Time{}, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1", usersDeletionScheduledColumn, tableUsersNaming, usersIDColumn)
+
+	var scheduled sql.NullTime
+	if err := database.Connection.QueryRow(query, userID).Scan(&scheduled); err != nil {
+		if err == sql.ErrNoRows {
+			return time.Time{}, fmt.Errorf(UserNotFound, userID)
+		}
+		return time.Time{}, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return scheduled.Time, nil
+}
+
+// ScheduleAccountDeletion marks the account of user for deletion after grace, returning the deletion time
+func (database *DataBaseProps) ScheduleAccountDeletion(userID string, grace time.Duration, ip string) (time.Time, error) {
+	scheduled := time.Now().Add(grace)
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		update := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s = $2", tableUsersNaming, usersDeletionScheduledColumn, usersIDColumn)
+		if _, err := tx.Exec(update, scheduled, userID); err != nil {
+			return fmt.Errorf("deletion schedule error: %v", err)
+		}
+
+		return recordAuditEvent(tx, userID, AuditEventDeletionRequested, fmt.Sprintf("deletion at %s", scheduled.Format(time.RFC3339)), ip)
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return scheduled, nil
+}
+
+// CancelAccountDeletion keeps the account of user, AccountDeletionNotScheduled is returned if nothing was scheduled
+func (database *DataBaseProps) CancelAccountDeletion(userID string, ip string) error {
+	return database.inTransaction(func(tx *sql.Tx) error {
+		update := fmt.Sprintf("UPDATE %s SET %s = NULL WHERE %s = $1 AND %s IS NOT NULL", tableUsersNaming, usersDeletionScheduledColumn, usersIDColumn, usersDeletionScheduledColumn)
+		result, err := tx.Exec(update, userID)
+		if err != nil {
+			return fmt.Errorf("deletion cancel error: %v", err)
+		}
+
+		if affected, err := result.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			return fmt.Errorf(AccountDeletionNotScheduled)
+		}
+
+		return recordAuditEvent(tx, userID, AuditEventDeletionCancelled, "", ip)
+	})
+}
+
+// PurgeDeletedAccounts hard deletes every account whose grace period ended before now, returning the number of deleted accounts.
+// Each account is removed in its own transaction, so one failure does not keep the others.
+func (database *DataBaseProps) PurgeDeletedAccounts(now time.Time) (int, error) {
+	if database == nil || database.Connection == nil {
+		return 0, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s <= $1", usersIDColumn, usersUsernameColumn, tableUsersNaming, usersDeletionScheduledColumn)
+	rows, err := database.Connection.Query(query, now)
+	if err != nil {
+		return 0, fmt.Errorf("row query error : %v", err)
+	}
+
+	type dueAccount struct{ ID, Username string }
+	var due []dueAccount
+	for rows.Next() {
+		var account dueAccount
+		if err := rows.Scan(&account.ID, &account.Username); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("row scan error: %v", err)
+		}
+		due = append(due, account)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("rows error: %v", err)
+	}
+
+	deleted := 0
+	for _, account := range due {
+		if err := database.purgeAccount(account.ID, account.Username, now); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// purgeAccount deletes user and all rows of userDataTables, the deletion is checked again under lock
+// so an account whose deletion was cancelled meanwhile is kept
+func (database *DataBaseProps) purgeAccount(userID string, username string, now time.Time) error {
+	return database.inTransaction(func(tx *sql.Tx) error {
+		lock := fmt.Sprintf("SELECT 1 FROM %s WHERE %s = $1 AND %s <= $2 FOR UPDATE", tableUsersNaming, usersIDColumn, usersDeletionScheduledColumn)
+		var due int
+		if err := tx.QueryRow(lock, userID, now).Scan(&due); err != nil {
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			return fmt.Errorf("row scan error: %v", err)
+		}
+
+		for _, data := range userDataTables {
+			query := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", data.Table, data.UserID)
+			if _, err := tx.Exec(query, userID); err != nil {
+				return fmt.Errorf("%s delete error: %v", data.Table, err)
+			}
+		}
+
+		attempts := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", loginAttemptsTableName, loginAttemptsKey)
+		if _, err := tx.Exec(attempts, UserLoginKey(username)); err != nil {
+			return fmt.Errorf("login attempts delete error: %v", err)
+		}
+
+		query := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", tableUsersNaming, usersIDColumn)
+		if _, err := tx.Exec(query, userID); err != nil {
+			return fmt.Errorf("user delete error: %v", err)
+		}
+
+		// No user id and no name, the entry only tells that an account was removed
+		return recordAuditEvent(tx, "", AuditEventAccountDeleted, fmt.Sprintf("account %s deleted", userID), "")
+	})
+}
+
+// ExportProfile is the profile part of the personal data export
+type ExportProfile struct {
+	ID                  string     `json:"id"`
+	Username            string     `json:"username"`
+	Email               string     `json:"email,omitempty"`
+	EmailVerified       bool       `json:"emailVerified"`
+	CreatedAt           time.Time  `json:"createdAt"`
+	Role                string     `json:"role"`
+	TwoFactorEnabled    bool       `json:"twoFactorEnabled"`
+	DeletionScheduledAt *time.Time `json:"deletionScheduledAt,omitempty"`
+}
+
+// ExportPasskey is a registered passkey without key material
+type ExportPasskey struct {
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+}
+
+// ExportAuditEntry is a security event of the user
+type ExportAuditEntry struct {
+	Event     string    `json:"event"`
+	Detail    string    `json:"detail"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// AccountExport holds every per-user record, one field per file of the export archive.
+// Password hash, TOTP secret, recovery codes and tokens are left out, they are credentials, not personal data.
+type AccountExport struct {
+	Profile        ExportProfile      `json:"profile"`
+	Tasks          []Task             `json:"tasks"`
+	TaskEvents     []TaskEvent        `json:"taskEvents"`
+	DeletedTasks   []Tombstone        `json:"deletedTasks"`
+	Passkeys       []ExportPasskey    `json:"passkeys"`
+	LinkedAccounts []LinkedIdentity   `json:"linkedAccounts"`
+	OAuthClients   []OAuthClient      `json:"oauthClients"`
+	AuthorizedApps []OAuthGrant       `json:"authorizedApps"`
+	Invites        []Invite           `json:"invites"`
+	SecurityEvents []ExportAuditEntry `json:"securityEvents"`
+}
+
+// Files returns the export as JSON documents keyed by file name
+func (export AccountExport) Files() (map[string][]byte, error) {
+	parts := map[string]any{
+		"profile.json":         export.Profile,
+		"tasks.json":           export.Tasks,
+		"task_history.json":    export.TaskEvents,
+		"deleted_tasks.json":   export.DeletedTasks,
+		"passkeys.json":        export.Passkeys,
+		"linked_accounts.json": export.LinkedAccounts,
+		"oauth_clients.json":   export.OAuthClients,
+		"authorized_apps.json": export.AuthorizedApps,
+		"invites.json":         export.Invites,
+		"security_events.json": export.SecurityEvents,
+	}
+
+	files := make(map[string][]byte, len(parts))
+	for name, part := range parts {
+		content, err := json.MarshalIndent(part, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("%s encode error: %v", name, err)
+		}
+		files[name] = content
+	}
+
+	return files, nil
+}
+
+// ExportAccount collects every per-user record of user
+func (database *DataBaseProps) ExportAccount(userID string) (AccountExport, error) {
+	if database == nil || database.Connection == nil {
+		return AccountExport{}, fmt.Errorf("database connection is nil")
+	}
+
+	var (
+		export    AccountExport
+		createdAt time.Time
+		email     sql.NullString
+		verified  sql.NullTime
+		scheduled sql.NullTime
+	)
+
+	profile := fmt.Sprintf(
+		"SELECT %s, %s, %s, %s, %s, %s, (%s IS NOT NULL OR %s), %s FROM %s WHERE %s = $1",
+		usersIDColumn, usersUsernameColumn, usersEmailColumn, usersEmailVerifiedAtColumn, usersCreationTimeColumn, usersRoleColumn,
+		usersTOTPSecretColumn, usersPasskey2FAColumn, usersDeletionScheduledColumn,
+		tableUsersNaming, usersIDColumn,
+	)
+	err := database.Connection.QueryRow(profile, userID).Scan(
+		&export.Profile.ID, &export.Profile.Username, &email, &verified, &createdAt, &export.Profile.Role,
+		&export.Profile.TwoFactorEnabled, &scheduled,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return AccountExport{}, fmt.Errorf(UserNotFound, userID)
+		}
+		return AccountExport{}, fmt.Errorf("row scan error: %v", err)
+	}
+	export.Profile.Email = email.String
+	export.Profile.EmailVerified = verified.Valid
+	export.Profile.CreatedAt = createdAt
+	if scheduled.Valid {
+		export.Profile.DeletionScheduledAt = &scheduled.Time
+	}
+
+	if export.Tasks, err = database.GetTasksFromDatabase(userID); err != nil {
+		return AccountExport{}, err
+	}
+
+	events := fmt.Sprintf("%s WHERE e.%s = $1 ORDER BY e.%s", taskEventsSelect(), taskEventsUserID, taskEventsID)
+	if export.TaskEvents, err = queryRows(database.Connection, events, scanTaskEvents, userID); err != nil {
+		return AccountExport{}, err
+	}
+
+	tombstones := fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s = $1 ORDER BY %s", tombstonesTaskID, tombstonesChangeSeq, tombstonesTableName, tombstonesUserID, tombstonesChangeSeq)
+	export.DeletedTasks, err = queryRows(database.Connection, tombstones, func(rows *sql.Rows) ([]Tombstone, error) {
+		result := []Tombstone{}
+		for rows.Next() {
+			var tombstone Tombstone
+			if err := rows.Scan(&tombstone.TaskID, &tombstone.Seq); err != nil {
+				return nil, fmt.Errorf("row scan error: %v", err)
+			}
+			result = append(result, tombstone)
+		}
+		return result, rows.Err()
+	}, userID)
+	if err != nil {
+		return AccountExport{}, err
+	}
+
+	passkeys, err := database.ListPasskeys(userID)
+	if err != nil {
+		return AccountExport{}, err
+	}
+	export.Passkeys = []ExportPasskey{}
+	for _, passkey := range passkeys {
+		entry := ExportPasskey{Name: passkey.Name, CreatedAt: passkey.CreatedAt}
+		if passkey.LastUsedAt.Valid {
+			entry.LastUsedAt = &passkey.LastUsedAt.Time
+		}
+		export.Passkeys = append(export.Passkeys, entry)
+	}
+
+	if export.LinkedAccounts, err = database.ListExternalIdentities(userID); err != nil {
+		return AccountExport{}, err
+	}
+
+	if export.OAuthClients, err = database.ListOAuthClients(userID); err != nil {
+		return AccountExport{}, err
+	}
+
+	if export.AuthorizedApps, err = database.ListOAuthGrants(userID); err != nil {
+		return AccountExport{}, err
+	}
+
+	if export.Invites, err = database.ListInvites(userID); err != nil {
+		return AccountExport{}, err
+	}
+
+	audit := fmt.Sprintf(
+		"SELECT %s, %s, %s, %s, %s FROM %s WHERE %s = $1 ORDER BY %s",
+		auditEvent, auditDetail, auditIP, auditUserAgent, auditCreatedAt, auditTableName, auditUserID, auditID,
+	)
+	export.SecurityEvents, err = queryRows(database.Connection, audit, func(rows *sql.Rows) ([]ExportAuditEntry, error) {
+		result := []ExportAuditEntry{}
+		for rows.Next() {
+			var entry ExportAuditEntry
+			if err := rows.Scan(&entry.Event, &entry.Detail, &entry.IP, &entry.UserAgent, &entry.CreatedAt); err != nil {
+				return nil, fmt.Errorf("row scan error: %v", err)
+			}
+			result = append(result, entry)
+		}
+		return result, rows.Err()
+	}, userID)
+	if err != nil {
+		return AccountExport{}, err
+	}
+
+	return export, nil
+}
+
+// queryRows runs query and hands the rows to scan, rows are closed afterwards
+func queryRows[T any](connection *sql.DB, query string, scan func(*sql.Rows) ([]T, error), args ...any) ([]T, error) {
+	rows, err := connection.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("row query error : %v", err)
+	}
+	defer rows.Close()
+
+	return scan(rows)
+}
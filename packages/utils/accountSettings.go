@@ -0,0 +1,149 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// users.session_version (int, not null, default 0)
+//    - Copied into the session at login. Changing the password increments it,
+//      so sessions made before the change no longer match and are logged out, see SessionVersion.
+
+const (
+	usersSessionVersionColumn = "session_version"
+
+	// Postgres error code of unique constraint violations
+	uniqueViolationCode = "23505"
+)
+
+// Events stored in audit_log
+const (
+	AuditEventPasswordChanged = "password_changed"
+	AuditEventUsernameChanged = "username_changed"
+)
+
+// SessionVersion returns the current session version of user, sessions holding another version are outdated
+func (database *DataBaseProps) SessionVersion(userID string) (int, error) {
+	if database == nil || database.Connection == nil {
+		return 0, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1", usersSessionVersionColumn, tableUsersNaming, usersIDColumn)
+
+	var version int
+	if err := database.Connection.QueryRow(query, userID).Scan(&version); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf(UserNotFound, userID)
+		}
+		return 0, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return version, nil
+}
+
+// setPasswordTx stores the hash of password and increments the session version, returning the new version.
+// Recorded sessions other than keepSessionID are forgotten, so their event streams and WebSockets close.
+// A password reset asked by an admin is done with it.
+func setPasswordTx(tx *sql.Tx, userID string, hashedPassword string, keepSessionID string) (int, error) {
+	update := fmt.Sprintf(
+		"UPDATE %[1]s SET %[2]s = $1, %[3]s = %[3]s + 1, %[5]s = FALSE WHERE %[4]s = $2 RETURNING %[3]s",
+		tableUsersNaming, usersPasswordHashColumn, usersSessionVersionColumn, usersIDColumn, usersPasswordResetRequiredColumn,
+	)
+
+	var version int
+	if err := tx.QueryRow(update, hashedPassword, userID).Scan(&version); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf(UserNotFound, userID)
+		}
+		return 0, fmt.Errorf("password update error: %v", err)
+	}
+
+	if err := endOtherUserSessionsTx(tx, userID, keepSessionID); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// ChangePassword sets a new password of user and logs out every session other than sessionID.
+// The caller checks the current password, the new session version is returned for the current session.
+func (database *DataBaseProps) ChangePassword(userID string, sessionID string, password string, ip string, userAgent string) (int, error) {
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = database.inTransaction(func(tx *sql.Tx) error {
+		version, err = setPasswordTx(tx, userID, hashedPassword, sessionID)
+		if err != nil {
+			return err
+		}
+
+		return recordSecurityEvent(tx, userID, AuditEventPasswordChanged, "", ip, userAgent)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+// RehashPassword replaces the stored hash of user with a hash of password made by the current hasher.
+// Only a hash still equal to oldHash is replaced, so a password changed meanwhile is kept. Sessions stay valid, the password is the same.
+func (database *DataBaseProps) RehashPassword(userID string, oldHash string, password string) error {
+	if database == nil || database.Connection == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	update := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s = $2 AND %s = $3", tableUsersNaming, usersPasswordHashColumn, usersIDColumn, usersPasswordHashColumn)
+	if _, err := database.Connection.Exec(update, hashedPassword, userID, oldHash); err != nil {
+		return fmt.Errorf("password rehash error: %v", err)
+	}
+
+	return nil
+}
+
+// ChangeUsername renames user, UserAlreadyExistError is returned if another user has the name
+func (database *DataBaseProps) ChangeUsername(userID string, username string, ip string) error {
+	if username == "" {
+		return fmt.Errorf(UsernameEmpty)
+	}
+
+	if err := IsValidUsername(username); err != nil {
+		return err
+	}
+
+	return database.inTransaction(func(tx *sql.Tx) error {
+		var previous string
+		current := fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1 FOR UPDATE", usersUsernameColumn, tableUsersNaming, usersIDColumn)
+		if err := tx.QueryRow(current, userID).Scan(&previous); err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf(UserNotFound, userID)
+			}
+			return fmt.Errorf("row scan error: %v", err)
+		}
+
+		if previous == username {
+			return nil
+		}
+
+		// The unique index decides when two users pick the same name at once
+		update := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s = $2", tableUsersNaming, usersUsernameColumn, usersIDColumn)
+		if _, err := tx.Exec(update, username, userID); err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolationCode {
+				return fmt.Errorf(UserAlreadyExistError)
+			}
+			return fmt.Errorf("username update error: %v", err)
+		}
+
+		return recordAuditEvent(tx, userID, AuditEventUsernameChanged, fmt.Sprintf("%s -> %s", previous, username), ip)
+	})
+}
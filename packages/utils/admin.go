@@ -0,0 +1,312 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// users.role (string, not null, default 'user')
+//    - One of the Role* constants. Admins open the /admin console.
+//
+// users.disabled_at (timestamp, nullable)
+//    - Set while an admin has disabled the account, no login method is accepted.
+//
+// users.password_reset_required (bool, not null, default false)
+//    - Set by an admin, the password is refused at login until it is changed through a reset link.
+
+const (
+	usersRoleColumn                  = "role"
+	usersDisabledAtColumn            = "disabled_at"
+	usersPasswordResetRequiredColumn = "password_reset_required"
+)
+
+// Roles of users
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Roles lists every role, in the order the console offers them
+var Roles = []string{RoleUser, RoleAdmin}
+
+// Events stored in audit_log, the detail names the admin
+const (
+	AuditEventAccountDisabled       = "account_disabled"
+	AuditEventAccountEnabled        = "account_enabled"
+	AuditEventForcedLogout          = "forced_logout"
+	AuditEventPasswordResetRequired = "password_reset_required"
+	AuditEventRoleChanged           = "role_changed"
+)
+
+// AdminUser is a row of the user list in the admin console
+type AdminUser struct {
+	ID                    string
+	Username              string
+	Email                 string
+	Role                  string
+	CreatedAt             time.Time
+	Disabled              bool
+	PasswordResetRequired bool
+	LastSeenAt            time.Time // Latest request of any session, zero if none is recorded.
+}
+
+// AdminStats are the numbers shown on top of the admin console
+type AdminStats struct {
+	Users          int
+	Admins         int
+	DisabledUsers  int
+	Tasks          int
+	ActiveSessions int // Sessions with a request after the "since" time given to GetAdminStats.
+}
+
+// ValidRole reports whether role is one of Roles
+func ValidRole(role string) bool {
+	for _, known := range Roles {
+		if role == known {
+			return true
+		}
+	}
+
+	return false
+}
+
+// escapeLike escapes the LIKE wildcards of text, so a search for "a_b" does not match "axb"
+func escapeLike(text string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(text)
+}
+
+// ListUsers returns users whose username or email contains search (case-insensitive, empty matches all),
+// ordered by id, with limit and offset for paging. The number of all matching users is returned too.
+func (database *DataBaseProps) ListUsers(search string, limit int, offset int) ([]AdminUser, int, error) {
+	if database == nil || database.Connection == nil {
+		return nil, 0, fmt.Errorf("database connection is nil")
+	}
+
+	pattern := "%" + escapeLike(strings.ToLower(search)) + "%"
+	filter := fmt.Sprintf("LOWER(u.%s) LIKE $1 OR LOWER(COALESCE(u.%s, '')) LIKE $1", usersUsernameColumn, usersEmailColumn)
+
+	var total int
+	count := fmt.Sprintf("SELECT COUNT(*) FROM %s u WHERE %s", tableUsersNaming, filter)
+	if err := database.Connection.QueryRow(count, pattern).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("row scan error: %v", err)
+	}
+
+	query := fmt.Sprintf(
+		`SELECT u.%s, u.%s, COALESCE(u.%s, ''), u.%s, u.%s, u.%s IS NOT NULL, u.%s,
+			(SELECT MAX(s.%s) FROM %s s WHERE s.%s = u.%s)
+		FROM %s u WHERE %s ORDER BY u.%s LIMIT $2 OFFSET $3`,
+		usersIDColumn, usersUsernameColumn, usersEmailColumn, usersRoleColumn, usersCreationTimeColumn,
+		usersDisabledAtColumn, usersPasswordResetRequiredColumn,
+		userSessionsLastSeen, userSessionsTableName, userSessionsUserID, usersIDColumn,
+		tableUsersNaming, filter, usersIDColumn,
+	)
+
+	users, err := queryRows(database.Connection, query, func(rows *sql.Rows) ([]AdminUser, error) {
+		result := []AdminUser{}
+		for rows.Next() {
+			var (
+				user     AdminUser
+				lastSeen sql.NullTime
+			)
+			if err := rows.Scan(
+				&user.ID, &user.Username, &user.Email, &user.Role, &user.CreatedAt,
+				&user.Disabled, &user.PasswordResetRequired, &lastSeen,
+			); err != nil {
+				return nil, fmt.Errorf("row scan error: %v", err)
+			}
+			user.LastSeenAt = lastSeen.Time
+			result = append(result, user)
+		}
+		return result, rows.Err()
+	}, pattern, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+// GetAdminStats counts users, tasks and the sessions used after since
+func (database *DataBaseProps) GetAdminStats(since time.Time) (AdminStats, error) {
+	if database == nil || database.Connection == nil {
+		return AdminStats{}, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf(
+		`SELECT
+			(SELECT COUNT(*) FROM %[1]s),
+			(SELECT COUNT(*) FROM %[1]s WHERE %[2]s = $1),
+			(SELECT COUNT(*) FROM %[1]s WHERE %[3]s IS NOT NULL),
+			(SELECT COUNT(*) FROM %[4]s),
+			(SELECT COUNT(*) FROM %[5]s WHERE %[6]s > $2)`,
+		tableUsersNaming, usersRoleColumn, usersDisabledAtColumn,
+		tasksTableName,
+		userSessionsTableName, userSessionsLastSeen,
+	)
+
+	var stats AdminStats
+	err := database.Connection.QueryRow(query, RoleAdmin, since).Scan(
+		&stats.Users, &stats.Admins, &stats.DisabledUsers, &stats.Tasks, &stats.ActiveSessions,
+	)
+	if err != nil {
+		return AdminStats{}, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return stats, nil
+}
+
+// UserRole returns the current role of user, read on every admin request so a removed role takes effect at once
+func (database *DataBaseProps) UserRole(userID string) (string, error) {
+	if database == nil || database.Connection == nil {
+		return "", fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1", usersRoleColumn, tableUsersNaming, usersIDColumn)
+
+	var role string
+	if err := database.Connection.QueryRow(query, userID).Scan(&role); err != nil {
+		if err == sql.ErrNoRows {
+			return "", fmt.Errorf(UserNotFound, userID)
+		}
+		return "", fmt.Errorf("row scan error: %v", err)
+	}
+
+	return role, nil
+}
+
+// GrantAdminRole makes the users named in usernames admins, used at start for ADMIN_USERS.
+// Unknown names are skipped, and the role is never taken away here. The number of promoted users is returned.
+func (database *DataBaseProps) GrantAdminRole(usernames []string) (int64, error) {
+	if database == nil || database.Connection == nil {
+		return 0, fmt.Errorf("database connection is nil")
+	}
+
+	var promoted int64
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		update := fmt.Sprintf(
+			"UPDATE %[1]s SET %[2]s = $1 WHERE %[3]s = $2 AND %[2]s <> $1 RETURNING %[4]s",
+			tableUsersNaming, usersRoleColumn, usersUsernameColumn, usersIDColumn,
+		)
+
+		for _, username := range usernames {
+			var userID string
+			err := tx.QueryRow(update, RoleAdmin, strings.TrimSpace(username)).Scan(&userID)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("role update error: %v", err)
+			}
+
+			if err := recordAuditEvent(tx, userID, AuditEventRoleChanged, RoleAdmin+" (ADMIN_USERS)", ""); err != nil {
+				return err
+			}
+			promoted++
+		}
+		return nil
+	})
+
+	return promoted, err
+}
+
+// SetUserRole gives user role, admin is the username of the admin doing it
+func (database *DataBaseProps) SetUserRole(userID string, role string, admin string, ip string) error {
+	if !ValidRole(role) {
+		return fmt.Errorf(AdminRoleInvalid)
+	}
+
+	return database.inTransaction(func(tx *sql.Tx) error {
+		update := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s = $2", tableUsersNaming, usersRoleColumn, usersIDColumn)
+		if err := execAffectingUser(tx, userID, update, role, userID); err != nil {
+			return err
+		}
+
+		return recordAuditEvent(tx, userID, AuditEventRoleChanged, fmt.Sprintf("%s by %s", role, admin), ip)
+	})
+}
+
+// SetUserDisabled disables or enables user. Disabling also logs out every session and OAuth token of the user.
+func (database *DataBaseProps) SetUserDisabled(userID string, disabled bool, admin string, ip string) error {
+	return database.inTransaction(func(tx *sql.Tx) error {
+		if !disabled {
+			update := fmt.Sprintf("UPDATE %s SET %s = NULL WHERE %s = $1", tableUsersNaming, usersDisabledAtColumn, usersIDColumn)
+			if err := execAffectingUser(tx, userID, update, userID); err != nil {
+				return err
+			}
+			return recordAuditEvent(tx, userID, AuditEventAccountEnabled, "by "+admin, ip)
+		}
+
+		update := fmt.Sprintf(
+			"UPDATE %[1]s SET %[2]s = COALESCE(%[2]s, $1), %[3]s = %[3]s + 1 WHERE %[4]s = $2",
+			tableUsersNaming, usersDisabledAtColumn, usersSessionVersionColumn, usersIDColumn,
+		)
+		if err := execAffectingUser(tx, userID, update, time.Now(), userID); err != nil {
+			return err
+		}
+		if err := endUserSessionsTx(tx, userID); err != nil {
+			return err
+		}
+
+		return recordAuditEvent(tx, userID, AuditEventAccountDisabled, "by "+admin, ip)
+	})
+}
+
+// ForceLogout increments the session version of user, so every session and OAuth token of the user stops working
+func (database *DataBaseProps) ForceLogout(userID string, admin string, ip string) error {
+	return database.inTransaction(func(tx *sql.Tx) error {
+		if err := bumpSessionVersionTx(tx, userID); err != nil {
+			return err
+		}
+
+		return recordAuditEvent(tx, userID, AuditEventForcedLogout, "by "+admin, ip)
+	})
+}
+
+// RequirePasswordReset logs user out and refuses the current password until a new one is set.
+// The caller sends the reset link, see password.SendResetLink.
+func (database *DataBaseProps) RequirePasswordReset(userID string, admin string, ip string) error {
+	return database.inTransaction(func(tx *sql.Tx) error {
+		update := fmt.Sprintf("UPDATE %s SET %s = TRUE WHERE %s = $1", tableUsersNaming, usersPasswordResetRequiredColumn, usersIDColumn)
+		if err := execAffectingUser(tx, userID, update, userID); err != nil {
+			return err
+		}
+		if err := bumpSessionVersionTx(tx, userID); err != nil {
+			return err
+		}
+
+		return recordAuditEvent(tx, userID, AuditEventPasswordResetRequired, "by "+admin, ip)
+	})
+}
+
+// bumpSessionVersionTx increments the session version of user and forgets the recorded sessions
+func bumpSessionVersionTx(tx *sql.Tx, userID string) error {
+	update := fmt.Sprintf(
+		"UPDATE %[1]s SET %[2]s = %[2]s + 1 WHERE %[3]s = $1",
+		tableUsersNaming, usersSessionVersionColumn, usersIDColumn,
+	)
+	if err := execAffectingUser(tx, userID, update, userID); err != nil {
+		return err
+	}
+
+	return endUserSessionsTx(tx, userID)
+}
+
+// execAffectingUser runs an update of the users row of userID, UserNotFound is returned if there is no such row
+func execAffectingUser(tx *sql.Tx, userID string, query string, args ...any) error {
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("user update error: %v", err)
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("user update error: %v", err)
+	}
+	if affected == 0 {
+		return fmt.Errorf(UserNotFound, userID)
+	}
+
+	return nil
+}
@@ -0,0 +1,208 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Table: audit_log
+//
+// Security event log: logins, account changes and admin actions. Users see their own entries
+// on the security page, admins search all of them, see ListSecurityEvents.
+//
+// Columns:
+// 1. id (bigint, primary key, auto-increment)
+//
+// 2. user_id (int, nullable)
+//    - Account the event is about, NULL when there is none (e.g. lockout of an unknown username or an address).
+//
+// 3. event (string, not null)
+//    - One of the AuditEvent* constants.
+//
+// 4. detail (string)
+//    - Free text shown to admins, never contains passwords or tokens.
+//
+// 5. ip (string)
+//    - Client address of the request that caused the event.
+//
+// 6. created_at (timestamp, default: current time)
+//
+// 7. user_agent (string)
+//    - Browser of the request, empty for events without one (background jobs, token endpoint).
+
+const (
+	auditTableName = "audit_log"
+	auditID        = "id"
+	auditUserID    = "user_id"
+	auditEvent     = "event"
+	auditDetail    = "detail"
+	auditIP        = "ip"
+	auditCreatedAt = "created_at"
+	auditUserAgent = "user_agent"
+)
+
+// Events stored in audit_log
+const (
+	AuditEventLockout         = "login_lockout"
+	AuditEventLoginSucceeded  = "login_succeeded"
+	AuditEventLoginFailed     = "login_failed"
+	AuditEventLogout          = "logout"
+	AuditEventReauthenticated = "reauthenticated"
+)
+
+// AuditEvents lists every event of audit_log for the filter of the admin page
+var AuditEvents = []string{
+	AuditEventAccountDeleted, AuditEventAccountDisabled, AuditEventAccountEnabled, AuditEventProvisioned,
+	AuditEventDeletionCancelled, AuditEventDeletionRequested, AuditEventIdentityLinked, AuditEventForcedLogout,
+	AuditEventInviteCreated, AuditEventInviteRedeemed, AuditEventInviteRevoked, AuditEventLockout,
+	AuditEventLoginFailed, AuditEventLoginSucceeded, AuditEventLogout, AuditEventOAuthClientDeleted,
+	AuditEventOAuthClientRegistered, AuditEventOAuthGrantCreated, AuditEventOAuthGrantRevoked, AuditEventOAuthTokenReuse,
+	AuditEventPasskeyAdded, AuditEventPasskeyRemoved, AuditEventPasswordChanged, AuditEventPasswordResetRequired,
+	AuditEventReauthenticated, AuditEventRememberTokenCreated, AuditEventRememberTokenReuse, AuditEventRoleChanged,
+	AuditEventTwoFactorDisabled, AuditEventTwoFactorEnabled, AuditEventUsernameChanged,
+}
+
+// SecurityEvent is one entry of audit_log
+type SecurityEvent struct {
+	ID        int64
+	UserID    string // Empty when the event is about no account.
+	Username  string // Current name of the account, empty when there is none.
+	Event     string // One of the AuditEvent* constants.
+	Detail    string
+	IP        string
+	UserAgent string
+	CreatedAt time.Time
+}
+
+// SecurityEventFilter selects entries of audit_log, empty fields match everything
+type SecurityEventFilter struct {
+	UserID   string    // Exact account id, used for the page of the user.
+	Username string    // Account name, case-insensitive.
+	Event    string    // One of the AuditEvent* constants.
+	IP       string    // Exact client address.
+	Since    time.Time // Entries at or after.
+	Until    time.Time // Entries before.
+}
+
+// recordAuditEvent appends an entry to audit_log without a user agent, empty userID is stored as NULL
+func recordAuditEvent(executor queryExecutor, userID string, event string, detail string, ip string) error {
+	return recordSecurityEvent(executor, userID, event, detail, ip, "")
+}
+
+// recordSecurityEvent appends an entry to audit_log, empty userID is stored as NULL
+func recordSecurityEvent(executor queryExecutor, userID string, event string, detail string, ip string, userAgent string) error {
+	var owner any
+	if userID != "" {
+		owner = userID
+	}
+
+	if len(userAgent) > userAgentMaxLength {
+		userAgent = userAgent[:userAgentMaxLength]
+	}
+
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s, %s, %s, %s, %s) VALUES ($1, $2, $3, $4, $5)",
+		auditTableName, auditUserID, auditEvent, auditDetail, auditIP, auditUserAgent,
+	)
+	if _, err := executor.Exec(query, owner, event, detail, ip, userAgent); err != nil {
+		return fmt.Errorf("audit insert error: %v", err)
+	}
+
+	return nil
+}
+
+// RecordSecurityEvent appends an entry to audit_log for events that change nothing else in the database,
+// such as logins and logouts. Empty userID is stored as NULL.
+func (database *DataBaseProps) RecordSecurityEvent(userID string, event string, detail string, ip string, userAgent string) error {
+	if database == nil || database.Connection == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+
+	return recordSecurityEvent(database.Connection, userID, event, detail, ip, userAgent)
+}
+
+// ListSecurityEvents returns one page of the entries matching filter, newest first, and how many match in total
+func (database *DataBaseProps) ListSecurityEvents(filter SecurityEventFilter, limit int, offset int) ([]SecurityEvent, int, error) {
+	if database == nil || database.Connection == nil {
+		return nil, 0, fmt.Errorf("database connection is nil")
+	}
+
+	// Every condition adds its argument, the placeholders follow the order
+	conditions := []string{"TRUE"}
+	args := []any{}
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.UserID != "" {
+		add("a."+auditUserID+" = $%d", filter.UserID)
+	}
+	if filter.Username != "" {
+		add("LOWER(u."+usersUsernameColumn+") = $%d", strings.ToLower(filter.Username))
+	}
+	if filter.Event != "" {
+		add("a."+auditEvent+" = $%d", filter.Event)
+	}
+	if filter.IP != "" {
+		add("a."+auditIP+" = $%d", filter.IP)
+	}
+	if !filter.Since.IsZero() {
+		add("a."+auditCreatedAt+" >= $%d", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		add("a."+auditCreatedAt+" < $%d", filter.Until)
+	}
+
+	from := fmt.Sprintf(
+		"FROM %s a LEFT JOIN %s u ON u.%s = a.%s WHERE %s",
+		auditTableName, tableUsersNaming, usersIDColumn, auditUserID, strings.Join(conditions, " AND "),
+	)
+
+	var total int
+	if err := database.Connection.QueryRow("SELECT COUNT(*) "+from, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("row scan error: %v", err)
+	}
+
+	query := fmt.Sprintf(
+		"SELECT a.%s, COALESCE(a.%s::TEXT, ''), COALESCE(u.%s, ''), a.%s, a.%s, a.%s, a.%s, a.%s %s ORDER BY a.%s DESC LIMIT $%d OFFSET $%d",
+		auditID, auditUserID, usersUsernameColumn, auditEvent, auditDetail, auditIP, auditUserAgent, auditCreatedAt,
+		from, auditID, len(args)+1, len(args)+2,
+	)
+
+	events, err := queryRows(database.Connection, query, func(rows *sql.Rows) ([]SecurityEvent, error) {
+		result := []SecurityEvent{}
+		for rows.Next() {
+			var event SecurityEvent
+			if err := rows.Scan(
+				&event.ID, &event.UserID, &event.Username, &event.Event, &event.Detail, &event.IP, &event.UserAgent, &event.CreatedAt,
+			); err != nil {
+				return nil, fmt.Errorf("row scan error: %v", err)
+			}
+			result = append(result, event)
+		}
+		return result, rows.Err()
+	}, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return events, total, nil
+}
+
+// PurgeSecurityEvents removes entries created before before, returning how many were removed
+func (database *DataBaseProps) PurgeSecurityEvents(before time.Time) (int64, error) {
+	if database == nil || database.Connection == nil {
+		return 0, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s < $1", auditTableName, auditCreatedAt)
+	result, err := database.Connection.Exec(query, before)
+	if err != nil {
+		return 0, fmt.Errorf("audit purge error: %v", err)
+	}
+
+	return result.RowsAffected()
+}
@@ -1,28 +1,30 @@
 package utils
 
-import "golang.org/x/crypto/bcrypt"
 import "crypto/rand"
+import "crypto/subtle"
+import "encoding/base64"
 import "log"
 
-// HashPassword hashes the given password using bcrypt and returns the hashed password as a string.
+// HashPassword hashes the given password with the current hasher (Argon2id by default, see passwordHasher.go)
+// and returns the hash together with its algorithm and parameters as a string.
 func HashPassword(password string) (string, error) {
-    hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-    if err != nil {
-        return "", err
-    }
-
-    return string(hashedPassword), nil
+    return currentHasher.Hash(password)
 }
 
-// Compares password with hash from database
+// Compares password with hash from database, hashes of legacy algorithms (bcrypt) are still accepted
 func ComparePassword (password, hash string) (bool) {
-    err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
-    return err == nil
+    hasher := hasherFor(hash)
+    if hasher == nil {
+        return false
+    }
+
+    return hasher.Verify(password, hash)
 }
 
-// Compares two hashes and returs true if they are the same
+// Compares two hashes and returs true if they are the same, in constant time, so the time of a wrong
+// client secret or PKCE verifier does not tell how much of it matched
 func CompareHash (hash1, hash2 string) (bool) {
-	return hash1 == hash2
+	return subtle.ConstantTimeCompare([]byte(hash1), []byte(hash2)) == 1
 }
 
 // GenerateRandomKey creates a random byte slice of the given size
@@ -32,4 +34,9 @@ func GenerateRandomKey(size int) []byte {
         log.Fatalf("Error generating random key: %v\n", err)
     }
     return key
-}
\ No newline at end of file
+}
+
+// GenerateToken returns random URL-safe string made of size random bytes
+func GenerateToken(size int) string {
+    return base64.RawURLEncoding.EncodeToString(GenerateRandomKey(size))
+}
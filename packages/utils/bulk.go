@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Actions of BulkUpdateTasks
+const (
+	BulkActionComplete = "complete"
+	BulkActionReopen   = "reopen"
+	BulkActionDelete   = "delete"
+
+	// Maximum amount of tasks in one bulk request
+	BulkMaxTasks = 500
+)
+
+// Statuses of BulkResult
+const (
+	BulkStatusApplied  = "applied"
+	BulkStatusNotFound = "not_found"
+)
+
+// BulkResult is outcome of bulk action for a single task id
+type BulkResult struct {
+	TaskID int    `json:"taskId"`
+	Status string `json:"status"`
+	Task   *Task  `json:"task,omitempty"` // state after the action, nil for deleted tasks
+}
+
+// IsBulkAction reports whether action is supported by BulkUpdateTasks
+func IsBulkAction(action string) bool {
+	return action == BulkActionComplete || action == BulkActionReopen || action == BulkActionDelete
+}
+
+// BulkUpdateTasks applies action to every task of taskIDs in a single transaction.
+// Ids that do not belong to userID are reported as not found and do not stop the others,
+// any database error rolls back the whole batch.
+func (database *DataBaseProps) BulkUpdateTasks(userID string, action string, taskIDs []int) ([]BulkResult, error) {
+	if !IsBulkAction(action) {
+		return nil, fmt.Errorf(BulkUnknownAction, action)
+	}
+
+	if len(taskIDs) > BulkMaxTasks {
+		return nil, fmt.Errorf(BulkTooManyTasks, BulkMaxTasks)
+	}
+
+	results := make([]BulkResult, 0, len(taskIDs))
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		seen := make(map[int]bool, len(taskIDs))
+
+		for _, taskID := range taskIDs {
+			if seen[taskID] {
+				continue // Same id twice would be "not found" on the second delete.
+			}
+			seen[taskID] = true
+
+			before, err := getTaskForUpdate(tx, userID, taskID)
+			if err != nil {
+				if err.Error() == fmt.Sprintf(TaskNotFound, taskID) {
+					results = append(results, BulkResult{TaskID: taskID, Status: BulkStatusNotFound})
+					continue
+				}
+				return err
+			}
+
+			switch action {
+			case BulkActionDelete:
+				if err := deleteTaskTx(tx, userID, before); err != nil {
+					return err
+				}
+				results = append(results, BulkResult{TaskID: taskID, Status: BulkStatusApplied})
+
+			default:
+				after, err := modifyTaskTx(tx, userID, before, TaskEventComplete, tasksIsCompleted, action == BulkActionComplete)
+				if err != nil {
+					return err
+				}
+				results = append(results, BulkResult{TaskID: taskID, Status: BulkStatusApplied, Task: &after})
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
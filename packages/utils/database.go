@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -17,14 +18,19 @@ const (
 	tasksIsCompleted = "is_completed"
 	tasksUserID = "user_id"
 	tasksID = "id"
+	tasksCreatedAt = "created_at"
+	tasksChangeSeq = "change_seq"
+	tasksVersion = "version"
 )
 
 
 // RegisterForm represents html form POST struct for checking and adding to database
 type RegisterForm struct {
 	Username string
+	Email string
 	Password string
 	Re_Password string
+	InviteCode string // Needed by the invite and domains registration modes, see registration.go
 }
 
 // DataBaseProps holds the properties needed to connect and manipulate the database
@@ -44,8 +50,12 @@ type AuthResult struct {
 }
 
 type Task struct {
-	Description string
-	TaskID string
+	Description string `json:"description"`
+	TaskID string `json:"taskId"`
+	IsCompleted bool `json:"isCompleted"`
+	CreatedAt time.Time `json:"createdAt"`
+	ChangeSeq int64 `json:"changeSeq"` // change sequence of the last write, see sync.go
+	Version int `json:"version"` // grows by one on every change, used for optimistic concurrency
 }
 
 type ToDoPassStruct struct {
@@ -54,11 +64,13 @@ type ToDoPassStruct struct {
 }
 
 // NewRegisterForm return FormStruct struct
-func NewRegisterForm (username, password, re_password string) *RegisterForm {
+func NewRegisterForm (username, email, password, re_password, inviteCode string) *RegisterForm {
 	return &RegisterForm{
 		Username: username,
+		Email: email,
 		Password: password,
 		Re_Password: re_password,
+		InviteCode: inviteCode,
 	}
 }
 
@@ -150,6 +162,36 @@ func (database *DataBaseProps) CheckUserNameAndPassword(Username string, Passwor
 }
 
 func (database *DataBaseProps) FetchUserByUsername (Username string) (User, error) {
+	user, err := database.fetchUserBy(usersUsernameColumn, Username)
+	if err == sql.ErrNoRows {
+		return User{}, fmt.Errorf(UserNotFound, Username)
+	}
+
+	return user, err
+}
+
+// FetchUserByEmail finds user by email address, the address is compared case-insensitively
+func (database *DataBaseProps) FetchUserByEmail (Email string) (User, error) {
+	user, err := database.fetchUserBy("LOWER("+usersEmailColumn+")", strings.ToLower(Email))
+	if err == sql.ErrNoRows {
+		return User{}, fmt.Errorf(UserNotFound, Email)
+	}
+
+	return user, err
+}
+
+// FetchUserByID finds user by id, used when only the id is known, e.g. second login step
+func (database *DataBaseProps) FetchUserByID (ID string) (User, error) {
+	user, err := database.fetchUserBy(usersIDColumn, ID)
+	if err == sql.ErrNoRows {
+		return User{}, fmt.Errorf(UserNotFound, ID)
+	}
+
+	return user, err
+}
+
+// fetchUserBy fetches single user by value of column, sql.ErrNoRows is returned as is
+func (database *DataBaseProps) fetchUserBy (column string, value any) (User, error) {
 	if database == nil || database.Connection == nil {
 		return User{}, fmt.Errorf("database connection is nil")
 	}
@@ -157,27 +199,41 @@ func (database *DataBaseProps) FetchUserByUsername (Username string) (User, erro
 	var (
 		user User = User{}
 		createTime time.Time
+		email sql.NullString
+		emailVerifiedAt sql.NullTime
 	)
 
 	scriptToFindUser := fmt.Sprintf(
-		"SELECT * FROM %s WHERE %s = $1 LIMIT 1",
+		"SELECT %s, %s, %s, %s, %s, %s, (%s IS NOT NULL OR %s), %s, %s, %s IS NOT NULL, %s FROM %s WHERE %s = $1 LIMIT 1",
+		usersIDColumn, usersUsernameColumn, usersPasswordHashColumn, usersCreationTimeColumn, usersEmailColumn, usersEmailVerifiedAtColumn,
+		usersTOTPSecretColumn, usersPasskey2FAColumn, usersSessionVersionColumn,
+		usersRoleColumn, usersDisabledAtColumn, usersPasswordResetRequiredColumn,
 		tableUsersNaming,
-		usersUsernameColumn,
+		column,
 	)
 
-	err := database.Connection.QueryRow(scriptToFindUser, Username).Scan(
+	err := database.Connection.QueryRow(scriptToFindUser, value).Scan(
 		&user.ID,
 		&user.Username,
 		&user.PasswordHash,
 		&createTime,
+		&email,
+		&emailVerifiedAt,
+		&user.TwoFactorEnabled,
+		&user.SessionVersion,
+		&user.Role,
+		&user.Disabled,
+		&user.PasswordResetRequired,
 	)
 	if err != nil {
         if err == sql.ErrNoRows {
-            return User{}, fmt.Errorf(UserNotFound, Username)
+            return User{}, err
         }
         return User{}, fmt.Errorf("failed to scan user: %v", err)
     }
 
+	user.Email = email.String
+	user.EmailVerified = emailVerifiedAt.Valid
 	user.creationTime = createTime.Format("2006-01-02 15:04:05")
 	
 	return user, nil
@@ -204,6 +260,13 @@ func (database *DataBaseProps) DoesUserExist (Username string) (bool, error) {
 }
 
 func (database *DataBaseProps) IsValidRegister (UserInput RegisterForm, data gin.H) error {
+	// Who may register at all is checked first, the other messages would only help guess taken names
+	if err := database.checkRegistration(UserInput); err != nil {
+		data[ErrorRegistrationHTML] = err.Error()
+		data[Form] = UserInput
+		return err
+	}
+
 	exists, err := database.DoesUserExist(UserInput.Username)
 	if err != nil {
 		return fmt.Errorf(InternalErrorString)
@@ -221,8 +284,25 @@ func (database *DataBaseProps) IsValidRegister (UserInput RegisterForm, data gin
 		return err
 	}
 
-	if err := IsValidPassword(UserInput.Password, UserInput.Re_Password); err != nil {
-		data[ErrorPasswordHTML] = err.Error()
+	if err := IsValidEmail(UserInput.Email); err != nil {
+		data[ErrorEmailHTML] = err.Error()
+		data[Form] = UserInput
+		return err
+	}
+
+	emailExists, err := database.DoesEmailExist(UserInput.Email)
+	if err != nil {
+		return fmt.Errorf(InternalErrorString)
+	}
+
+	if emailExists {
+		data[ErrorEmailHTML] = EmailAlreadyExistError
+		data[Form] = UserInput
+		return fmt.Errorf(EmailAlreadyExistError)
+	}
+
+	if err := IsValidPassword(UserInput.Password, UserInput.Re_Password, UserInput.Username, UserInput.Email); err != nil {
+		SetPasswordErrors(data, err)
 		data[Form] = UserInput
 		return err
 	}
@@ -230,24 +310,32 @@ func (database *DataBaseProps) IsValidRegister (UserInput RegisterForm, data gin
 	return nil
 }
 
-// CreateNewUser creates a new user in the database with the given username and password
-func (database *DataBaseProps) CreateNewUser (Username, Password string) error {
+// CreateNewUser creates a new user in the database with the given username, password and email, returning the new user ID
+func (database *DataBaseProps) CreateNewUser (Username, Password, Email string) (string, error) {
 	if database == nil || database.Connection == nil {
-		return fmt.Errorf("database connection is nil")
+		return "", fmt.Errorf("database connection is nil")
 	}
 
 	hashedPassword, err := HashPassword(Password)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	query := fmt.Sprintf("INSERT INTO %s (%s, %s) VALUES ($1, $2)", tableUsersNaming, usersUsernameColumn, usersPasswordHashColumn)
-	_, err = database.Connection.Exec(query, Username, hashedPassword)
+	return insertUser(database.Connection, Username, hashedPassword, Email)
+}
+
+// insertUser adds a user with an already hashed password and returns its id, empty Email is stored as NULL
+func insertUser(executor queryExecutor, Username, hashedPassword, Email string) (string, error) {
+	var email sql.NullString = sql.NullString{String: Email, Valid: Email != ""}
+
+	var userID string
+	query := fmt.Sprintf("INSERT INTO %s (%s, %s, %s) VALUES ($1, $2, $3) RETURNING %s", tableUsersNaming, usersUsernameColumn, usersPasswordHashColumn, usersEmailColumn, usersIDColumn)
+	err := executor.QueryRow(query, Username, hashedPassword, email).Scan(&userID)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return userID, nil
 }
 
 // Used for getting username || Used before implementing Cookies, can be used for debuggin
@@ -266,41 +354,113 @@ func (database *DataBaseProps) GetUsername (userID string) (string, error) {
 	return result, nil
 }
 
-// AddTask adds Task to database by userID
-func (database *DataBaseProps) AddTask (userID string, task string) error {
-	query := fmt.Sprintf(`INSERT INTO %s (%s, %s) VALUES ($1, $2)`, tasksTableName, tasksUserID, tasksDescription)
+// AddTask adds Task to database by userID, records create event and returns stored task
+func (database *DataBaseProps) AddTask (userID string, task string) (Task, error) {
+	var created Task
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		var err error
+		created, err = addTaskTx(tx, userID, task)
+		return err
+	})
+
+	return created, err
+}
+
+// inTransaction runs fn in a transaction, committing it when fn returns nil
+func (database *DataBaseProps) inTransaction(fn func(tx *sql.Tx) error) error {
+	if database == nil || database.Connection == nil {
+		return fmt.Errorf("database connection is nil")
+	}
 
-	_, err := database.Connection.Exec(query, userID, task)
+	tx, err := database.Connection.Begin()
 	if err != nil {
-		return fmt.Errorf("insert into error : %v", err)
+		return fmt.Errorf("begin transaction error : %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("commit error : %v", err)
 	}
 
 	return nil
 }
 
+// addTaskTx inserts task with the next change sequence of the user and records create event
+func addTaskTx(tx *sql.Tx, userID string, task string) (Task, error) {
+	seq, err := nextChangeSeq(tx, userID)
+	if err != nil {
+		return Task{}, err
+	}
+
+	query := fmt.Sprintf(
+		`INSERT INTO %s (%s, %s, %s) VALUES ($1, $2, $3) RETURNING %s`,
+		tasksTableName, tasksUserID, tasksDescription, tasksChangeSeq, taskColumns(),
+	)
+
+	created, err := scanTask(tx.QueryRow(query, userID, task, seq))
+	if err != nil {
+		return Task{}, fmt.Errorf("insert into error : %v", err)
+	}
+
+	if err := recordTaskEvent(tx, userID, TaskEventCreate, StrToInt(created.TaskID), userID, nil, &created); err != nil {
+		return Task{}, err
+	}
+
+	return created, nil
+}
+
+// scanTask scans row of taskColumns into Task
+func scanTask(row interface{ Scan(dest ...any) error }) (Task, error) {
+	var (
+		task        Task
+		isCompleted sql.NullBool
+	)
+
+	if err := row.Scan(&task.Description, &task.TaskID, &isCompleted, &task.CreatedAt, &task.ChangeSeq, &task.Version); err != nil {
+		return Task{}, err
+	}
+
+	task.IsCompleted = isCompleted.Bool
+	return task, nil
+}
+
+// taskColumns returns column list that scanTask expects
+func taskColumns() string {
+	return fmt.Sprintf("%s, %s, %s, %s, %s, %s", tasksDescription, tasksID, tasksIsCompleted, tasksCreatedAt, tasksChangeSeq, tasksVersion)
+}
+
 // Used for fetching Tasks of User by userID from database 
 func (database *DataBaseProps) GetTasksFromDatabase (userID string) ([]Task, error) {
 	if database == nil || database.Connection == nil {
 		return nil, fmt.Errorf("database connection is nil")
 	}
 
-	var query string = fmt.Sprintf("SELECT %s, %s FROM %s WHERE %s = $1", tasksDescription, tasksID, tasksTableName, tasksUserID)
+	var query string = fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1 ORDER BY %s", taskColumns(), tasksTableName, tasksUserID, tasksID)
 	rows, err := database.Connection.Query(query, userID)
 	if err != nil {
 		return nil, fmt.Errorf("row query error : %v", err)
 	}
 	defer rows.Close()
 
+	return scanTasks(rows)
+}
+
+// scanTasks reads all rows of taskColumns
+func scanTasks(rows *sql.Rows) ([]Task, error) {
 	var result []Task = []Task{}
 
 	for rows.Next() {
-		var description string
-		var id string
-		if err := rows.Scan(&description, &id); err != nil {
+		task, err := scanTask(rows)
+		if err != nil {
 			return nil, fmt.Errorf("row scan error: %v", err)
 		}
 
-		result = append(result, Task{TaskID: id, Description: description})
+		result = append(result, task)
 	}
 
 	if err := rows.Err(); err != nil {
@@ -310,17 +470,175 @@ func (database *DataBaseProps) GetTasksFromDatabase (userID string) ([]Task, err
 	return result, nil
 }
 
-// DeleteTask deletes task by id
-func (database *DataBaseProps) DeleteTask(userID string, taskID int) error {
+// getTaskForUpdate fetches task of userID and locks its row until the end of transaction
+func getTaskForUpdate(tx *sql.Tx, userID string, taskID int) (Task, error) {
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1 AND %s = $2 FOR UPDATE", taskColumns(), tasksTableName, tasksUserID, tasksID)
+
+	task, err := scanTask(tx.QueryRow(query, userID, taskID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Task{}, fmt.Errorf(TaskNotFound, taskID)
+		}
+		return Task{}, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return task, nil
+}
+
+// GetTaskByID fetches single task of userID
+func (database *DataBaseProps) GetTaskByID(userID string, taskID int) (Task, error) {
 	if database == nil || database.Connection == nil {
-		return fmt.Errorf("database connection is nil")
+		return Task{}, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1 AND %s = $2", taskColumns(), tasksTableName, tasksUserID, tasksID)
+
+	task, err := scanTask(database.Connection.QueryRow(query, userID, taskID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return Task{}, fmt.Errorf(TaskNotFound, taskID)
+		}
+		return Task{}, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return task, nil
+}
+
+// UpdateTask changes description of task and records update event.
+// expectedVersion is the version the caller has seen, 0 skips the check
+func (database *DataBaseProps) UpdateTask(userID string, taskID int, expectedVersion int, description string) (Task, error) {
+	return database.modifyTask(userID, taskID, expectedVersion, TaskEventUpdate, tasksDescription, description)
+}
+
+// SetTaskCompleted marks task as completed or not completed and records complete event.
+// expectedVersion is the version the caller has seen, 0 skips the check
+func (database *DataBaseProps) SetTaskCompleted(userID string, taskID int, expectedVersion int, completed bool) (Task, error) {
+	return database.modifyTask(userID, taskID, expectedVersion, TaskEventComplete, tasksIsCompleted, completed)
+}
+
+// UpdateTaskFields changes description and/or completion of task in one transaction with a single version check,
+// nil fields are kept. Each changed field records its own event (update, complete), like UpdateTask and SetTaskCompleted.
+// expectedVersion is the version the caller has seen, 0 skips the check
+func (database *DataBaseProps) UpdateTaskFields(userID string, taskID int, expectedVersion int, description *string, completed *bool) (Task, error) {
+	var after Task
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		var err error
+		after, err = getTaskForUpdate(tx, userID, taskID)
+		if err != nil {
+			return err
+		}
+
+		if err := checkTaskVersion(after, expectedVersion); err != nil {
+			return err
+		}
+
+		if description != nil {
+			after, err = modifyTaskTx(tx, userID, after, TaskEventUpdate, tasksDescription, *description)
+			if err != nil {
+				return err
+			}
+		}
+
+		if completed != nil {
+			after, err = modifyTaskTx(tx, userID, after, TaskEventComplete, tasksIsCompleted, *completed)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return after, err
+}
+
+// TaskETag returns strong entity tag of task, it changes together with task version
+func TaskETag(task Task) string {
+	return fmt.Sprintf(`"%s-%d"`, task.TaskID, task.Version)
+}
+
+// checkTaskVersion returns TaskVersionMismatch error if task is not at expectedVersion, 0 skips the check
+func checkTaskVersion(task Task, expectedVersion int) error {
+	if expectedVersion != 0 && task.Version != expectedVersion {
+		return fmt.Errorf(TaskVersionMismatch, StrToInt(task.TaskID))
+	}
+
+	return nil
+}
+
+// modifyTask sets single column of task inside transaction and records event with before and after state
+func (database *DataBaseProps) modifyTask(userID string, taskID int, expectedVersion int, action string, column string, value any) (Task, error) {
+	var after Task
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		before, err := getTaskForUpdate(tx, userID, taskID)
+		if err != nil {
+			return err
+		}
+
+		if err := checkTaskVersion(before, expectedVersion); err != nil {
+			return err
+		}
+
+		after, err = modifyTaskTx(tx, userID, before, action, column, value)
+		return err
+	})
+
+	return after, err
+}
+
+// modifyTaskTx sets single column of locked task, bumps its change sequence and records event
+func modifyTaskTx(tx *sql.Tx, userID string, before Task, action string, column string, value any) (Task, error) {
+	seq, err := nextChangeSeq(tx, userID)
+	if err != nil {
+		return Task{}, err
 	}
 
+	query := fmt.Sprintf(
+		"UPDATE %s SET %s = $1, %s = $2, %s = %s + 1 WHERE %s = $3 AND %s = $4 RETURNING %s",
+		tasksTableName, column, tasksChangeSeq, tasksVersion, tasksVersion, tasksUserID, tasksID, taskColumns(),
+	)
+	after, err := scanTask(tx.QueryRow(query, value, seq, userID, before.TaskID))
+	if err != nil {
+		return Task{}, fmt.Errorf("row update error: %v", err)
+	}
+
+	if err := recordTaskEvent(tx, userID, action, StrToInt(before.TaskID), userID, &before, &after); err != nil {
+		return Task{}, err
+	}
+
+	return after, nil
+}
+
+// DeleteTask deletes task by id and records delete event with the last state of task.
+// expectedVersion is the version the caller has seen, 0 skips the check
+func (database *DataBaseProps) DeleteTask(userID string, taskID int, expectedVersion int) error {
+	return database.inTransaction(func(tx *sql.Tx) error {
+		before, err := getTaskForUpdate(tx, userID, taskID)
+		if err != nil {
+			return err
+		}
+
+		if err := checkTaskVersion(before, expectedVersion); err != nil {
+			return err
+		}
+
+		return deleteTaskTx(tx, userID, before)
+	})
+}
+
+// deleteTaskTx deletes locked task, leaves a tombstone for sync clients and records delete event
+func deleteTaskTx(tx *sql.Tx, userID string, before Task) error {
 	query := fmt.Sprintf("DELETE FROM %s WHERE %s = $1 AND %s = $2", tasksTableName, tasksUserID, tasksID)
-	_, err := database.Connection.Exec(query, userID, taskID)
+	_, err := tx.Exec(query, userID, before.TaskID)
 	if err != nil {
 		return fmt.Errorf("row delete error: %v", err)
 	}
 
-	return nil
-}
\ No newline at end of file
+	if err := addTombstone(tx, userID, StrToInt(before.TaskID)); err != nil {
+		return err
+	}
+
+	return recordTaskEvent(tx, userID, TaskEventDelete, StrToInt(before.TaskID), userID, &before, nil)
+}
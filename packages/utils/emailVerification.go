@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Table: email_verification_tokens
+//
+// Same columns as password_reset_tokens (token_hash, user_id, expires_at, used_at).
+//
+// users.email_verified_at (timestamp, nullable) is set when the user opens the link.
+
+const (
+	verificationTokensTableName = "email_verification_tokens"
+	verificationTokensUserID    = "user_id"
+	usersEmailVerifiedAtColumn  = "email_verified_at"
+
+	// Rough shape of an address, the real check is the verification email itself
+	EmailRegexp    = `^[^@\s]+@[^@\s]+\.[^@\s]+$`
+	EmailMaxLength = 255
+)
+
+var emailPattern = regexp.MustCompile(EmailRegexp)
+
+// IsValidEmail checks shape and length of email address
+func IsValidEmail(email string) error {
+	if len(email) > EmailMaxLength || !emailPattern.MatchString(email) {
+		return fmt.Errorf(EmailInvalid)
+	}
+
+	return nil
+}
+
+// DoesEmailExist reports whether email is used by any user, compared case-insensitively
+func (database *DataBaseProps) DoesEmailExist(Email string) (bool, error) {
+	if database == nil || database.Connection == nil {
+		return false, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf("SELECT 1 FROM %s WHERE LOWER(%s) = $1 LIMIT 1", tableUsersNaming, usersEmailColumn)
+
+	var exists int
+	if err := database.Connection.QueryRow(query, strings.ToLower(Email)).Scan(&exists); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// CreateEmailVerificationToken issues a new single-use verification token for userID valid for ttl
+func (database *DataBaseProps) CreateEmailVerificationToken(userID string, ttl time.Duration) (string, error) {
+	return database.createUserToken(verificationTokensTableName, userID, ttl)
+}
+
+// VerifyEmailWithToken marks email of the token owner verified.
+// Invalid, used and expired tokens give VerificationTokenInvalid error.
+func (database *DataBaseProps) VerifyEmailWithToken(token string) error {
+	return database.inTransaction(func(tx *sql.Tx) error {
+		userID, err := useUserToken(tx, verificationTokensTableName, token)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf(VerificationTokenInvalid)
+			}
+			return err
+		}
+
+		update := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s = $2", tableUsersNaming, usersEmailVerifiedAtColumn, usersIDColumn)
+		if _, err := tx.Exec(update, time.Now(), userID); err != nil {
+			return fmt.Errorf("email verification update error: %v", err)
+		}
+
+		return nil
+	})
+}
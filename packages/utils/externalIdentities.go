@@ -0,0 +1,299 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Table: external_identities
+//
+// Columns:
+// 1. id (int, primary key, auto-increment)
+//
+// 2. user_id (int, not null)
+//    - Local account the identity logs in to.
+//
+// 3. issuer (string, not null)
+//    - OpenID Connect issuer URL of the identity provider.
+//
+// 4. subject (string, not null)
+//    - "sub" claim, unique per issuer. (issuer, subject) is unique.
+//
+// 5. email (string)
+//    - Address the provider reported at the last login, for display only.
+//
+// 6. created_at, last_login_at (timestamp)
+
+const (
+	externalIdentitiesTableName = "external_identities"
+	externalIdentitiesUserID    = "user_id"
+	externalIdentitiesIssuer    = "issuer"
+	externalIdentitiesSubject   = "subject"
+	externalIdentitiesEmail     = "email"
+	externalIdentitiesCreatedAt = "created_at"
+	externalIdentitiesLastLogin = "last_login_at"
+
+	// Tries of numbered usernames before a random suffix is used
+	provisionUsernameTries = 20
+)
+
+// Events stored in audit_log
+const (
+	AuditEventIdentityLinked = "external_identity_linked"
+	AuditEventProvisioned    = "account_provisioned"
+)
+
+// ExternalIdentity is a user as an identity provider reported it in a verified ID token
+type ExternalIdentity struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	PreferredUsername string
+}
+
+// LinkedIdentity is an identity provider account linked to a user, as shown in settings and the data export
+type LinkedIdentity struct {
+	Issuer      string    `json:"issuer"`
+	Email       string    `json:"email"`
+	CreatedAt   time.Time `json:"createdAt"`
+	LastLoginAt time.Time `json:"lastLoginAt"`
+}
+
+// ListExternalIdentities returns the identities linked to userID, oldest first
+func (database *DataBaseProps) ListExternalIdentities(userID string) ([]LinkedIdentity, error) {
+	if database == nil || database.Connection == nil {
+		return nil, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf(
+		"SELECT %s, COALESCE(%s, ''), %s, %s FROM %s WHERE %s = $1 ORDER BY %s",
+		externalIdentitiesIssuer, externalIdentitiesEmail, externalIdentitiesCreatedAt, externalIdentitiesLastLogin,
+		externalIdentitiesTableName, externalIdentitiesUserID, externalIdentitiesCreatedAt,
+	)
+
+	return queryRows(database.Connection, query, func(rows *sql.Rows) ([]LinkedIdentity, error) {
+		result := []LinkedIdentity{}
+		for rows.Next() {
+			var identity LinkedIdentity
+			if err := rows.Scan(&identity.Issuer, &identity.Email, &identity.CreatedAt, &identity.LastLoginAt); err != nil {
+				return nil, fmt.Errorf("row scan error: %v", err)
+			}
+			result = append(result, identity)
+		}
+		return result, rows.Err()
+	}, userID)
+}
+
+// findExternalIdentityUser returns id of the user linked to issuer and subject, sql.ErrNoRows if none is
+func findExternalIdentityUser(executor queryExecutor, issuer string, subject string) (string, error) {
+	query := fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s = $1 AND %s = $2",
+		externalIdentitiesUserID, externalIdentitiesTableName, externalIdentitiesIssuer, externalIdentitiesSubject,
+	)
+
+	var userID string
+	rows, err := executor.Query(query, issuer, subject)
+	if err != nil {
+		return "", fmt.Errorf("row query error : %v", err)
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return "", sql.ErrNoRows
+	}
+	if err := rows.Scan(&userID); err != nil {
+		return "", fmt.Errorf("row scan error: %v", err)
+	}
+
+	return userID, nil
+}
+
+// linkExternalIdentityTx links identity to userID, ExternalIdentityTaken is returned if another user has it
+func linkExternalIdentityTx(tx *sql.Tx, userID string, identity ExternalIdentity, ip string) error {
+	insert := fmt.Sprintf(
+		"INSERT INTO %s (%s, %s, %s, %s, %s) VALUES ($1, $2, $3, $4, $5)",
+		externalIdentitiesTableName, externalIdentitiesUserID, externalIdentitiesIssuer, externalIdentitiesSubject, externalIdentitiesEmail, externalIdentitiesLastLogin,
+	)
+	if _, err := tx.Exec(insert, userID, identity.Issuer, identity.Subject, identity.Email, time.Now()); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolationCode {
+			return fmt.Errorf(ExternalIdentityTaken)
+		}
+		return fmt.Errorf("external identity insert error: %v", err)
+	}
+
+	return recordAuditEvent(tx, userID, AuditEventIdentityLinked, identity.Issuer, ip)
+}
+
+// LinkExternalIdentity links identity to the logged-in user, used when a signed-in user connects the provider account
+func (database *DataBaseProps) LinkExternalIdentity(userID string, identity ExternalIdentity, ip string) error {
+	return database.inTransaction(func(tx *sql.Tx) error {
+		linked, err := findExternalIdentityUser(tx, identity.Issuer, identity.Subject)
+		if err == nil {
+			if linked == userID {
+				return nil
+			}
+			return fmt.Errorf(ExternalIdentityTaken)
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		return linkExternalIdentityTx(tx, userID, identity, ip)
+	})
+}
+
+// ExternalIdentityUser returns the id of the user identity is linked to, ExternalIdentityUnknown if it is not linked
+func (database *DataBaseProps) ExternalIdentityUser(identity ExternalIdentity) (string, error) {
+	if database == nil || database.Connection == nil {
+		return "", fmt.Errorf("database connection is nil")
+	}
+
+	userID, err := findExternalIdentityUser(database.Connection, identity.Issuer, identity.Subject)
+	if err == sql.ErrNoRows {
+		return "", fmt.Errorf(ExternalIdentityUnknown)
+	}
+
+	return userID, err
+}
+
+// LoginExternalIdentity returns the user identity logs in to.
+// An identity seen before logs in to its linked user. Otherwise a user whose verified email matches a verified
+// provider email is linked, and if none does and provision is true a new user is created (just-in-time provisioning).
+// A matching user with 2FA is not linked, the login would skip the second factor: ExternalIdentityLinkRequired is
+// returned and the user links the identity from settings after a local login.
+// ExternalIdentityUnknown is returned when nothing matches and provisioning is off.
+func (database *DataBaseProps) LoginExternalIdentity(identity ExternalIdentity, provision bool, ip string) (User, error) {
+	var userID string
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		linked, err := findExternalIdentityUser(tx, identity.Issuer, identity.Subject)
+		if err == nil {
+			userID = linked
+			update := fmt.Sprintf(
+				"UPDATE %s SET %s = $1, %s = $2 WHERE %s = $3 AND %s = $4",
+				externalIdentitiesTableName, externalIdentitiesEmail, externalIdentitiesLastLogin, externalIdentitiesIssuer, externalIdentitiesSubject,
+			)
+			if _, err := tx.Exec(update, identity.Email, time.Now(), identity.Issuer, identity.Subject); err != nil {
+				return fmt.Errorf("external identity update error: %v", err)
+			}
+			return nil
+		}
+		if err != sql.ErrNoRows {
+			return err
+		}
+
+		// Both sides have to vouch for the address, otherwise anyone could claim an account by its email
+		if identity.EmailVerified && identity.Email != "" {
+			query := fmt.Sprintf(
+				"SELECT %s, (%s IS NOT NULL OR %s) FROM %s WHERE LOWER(%s) = $1 AND %s IS NOT NULL",
+				usersIDColumn, usersTOTPSecretColumn, usersPasskey2FAColumn, tableUsersNaming, usersEmailColumn, usersEmailVerifiedAtColumn,
+			)
+			var twoFactor bool
+			err := tx.QueryRow(query, strings.ToLower(identity.Email)).Scan(&userID, &twoFactor)
+			if err == nil {
+				if twoFactor {
+					return fmt.Errorf(ExternalIdentityLinkRequired)
+				}
+				return linkExternalIdentityTx(tx, userID, identity, ip)
+			}
+			if err != sql.ErrNoRows {
+				return fmt.Errorf("row scan error: %v", err)
+			}
+		}
+
+		if !provision {
+			return fmt.Errorf(ExternalIdentityUnknown)
+		}
+
+		userID, err = provisionUserTx(tx, identity)
+		if err != nil {
+			return err
+		}
+
+		if err := recordAuditEvent(tx, userID, AuditEventProvisioned, identity.Issuer, ip); err != nil {
+			return err
+		}
+
+		return linkExternalIdentityTx(tx, userID, identity, ip)
+	})
+	if err != nil {
+		return User{}, err
+	}
+
+	return database.FetchUserByID(userID)
+}
+
+// provisionUserTx creates a user for identity and returns its id.
+// The password is random and never shown, the user logs in through the provider or sets one with "forgot password".
+func provisionUserTx(tx *sql.Tx, identity ExternalIdentity) (string, error) {
+	hashedPassword, err := HashPassword(GenerateToken(32))
+	if err != nil {
+		return "", err
+	}
+
+	// An address used by an unverified local account is left out instead of failing the login
+	var email sql.NullString
+	var verifiedAt sql.NullTime
+	if identity.Email != "" {
+		var taken int
+		query := fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE LOWER(%s) = $1", tableUsersNaming, usersEmailColumn)
+		if err := tx.QueryRow(query, strings.ToLower(identity.Email)).Scan(&taken); err != nil {
+			return "", fmt.Errorf("row scan error: %v", err)
+		}
+		if taken == 0 {
+			email = sql.NullString{String: identity.Email, Valid: true}
+			verifiedAt = sql.NullTime{Time: time.Now(), Valid: identity.EmailVerified}
+		}
+	}
+
+	base := provisionUsernameBase(identity)
+	insert := fmt.Sprintf(
+		"INSERT INTO %s (%s, %s, %s, %s) VALUES ($1, $2, $3, $4) ON CONFLICT (%s) DO NOTHING RETURNING %s",
+		tableUsersNaming, usersUsernameColumn, usersPasswordHashColumn, usersEmailColumn, usersEmailVerifiedAtColumn,
+		usersUsernameColumn, usersIDColumn,
+	)
+
+	for try := 1; try <= provisionUsernameTries+1; try++ {
+		username := base
+		switch {
+		case try > provisionUsernameTries:
+			username = fmt.Sprintf("%s-%s", base, GenerateToken(4))
+		case try > 1:
+			username = fmt.Sprintf("%s%d", base, try)
+		}
+
+		var userID string
+		err := tx.QueryRow(insert, username, hashedPassword, email, verifiedAt).Scan(&userID)
+		if err == nil {
+			return userID, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", fmt.Errorf("user insert error: %v", err)
+		}
+	}
+
+	return "", fmt.Errorf(UserAlreadyExistError)
+}
+
+// provisionUsernameBase picks the username wish of identity: preferred_username, else the local part of the email
+func provisionUsernameBase(identity ExternalIdentity) string {
+	base := identity.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+
+	base = strings.Join(strings.Fields(base), "") // Usernames have no spaces
+	if base == "" {
+		base = "user"
+	}
+	if len(base) > 64 {
+		base = base[:64]
+	}
+
+	return base
+}
@@ -0,0 +1,166 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Table: idempotency_keys
+//
+// Columns:
+// 1. user_id (int, not null), key (string, not null)
+//    - Primary key, keys are scoped per user.
+//
+// 2. request_hash (string, not null)
+//    - SHA-256 of the request, reusing a key for another request is an error.
+//
+// 3. status_code (int), response_body (jsonb)
+//    - Result of the first request, returned again on replay.
+//
+// 4. created_at (timestamp, default: current time)
+//    - Keys older than config.Options.IdempotencyWindow are forgotten.
+
+const (
+	idempotencyTableName    = "idempotency_keys"
+	idempotencyUserID       = "user_id"
+	idempotencyKey          = "key"
+	idempotencyRequestHash  = "request_hash"
+	idempotencyStatusCode   = "status_code"
+	idempotencyResponseBody = "response_body"
+	idempotencyCreatedAt    = "created_at"
+
+	// Maximum length of a key sent by client
+	IdempotencyKeyMaxLength = 255
+)
+
+// IdempotentResult is the stored outcome of the first request with a key
+type IdempotentResult struct {
+	StatusCode int
+	Body       json.RawMessage
+	Replayed   bool // true if the request was not executed again
+}
+
+// IdempotencyRequestHash fingerprints request parts, so a key can not be reused for another request
+func IdempotencyRequestHash(parts ...string) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// claimIdempotencyKey reserves key for the running transaction.
+// If the key was already used inside window, the stored result is returned instead.
+// Concurrent requests with the same key wait on the primary key until the first transaction ends.
+func claimIdempotencyKey(tx *sql.Tx, userID, key, requestHash string, window time.Duration) (*IdempotentResult, error) {
+	expire := fmt.Sprintf(
+		"DELETE FROM %s WHERE %s = $1 AND %s < now() - make_interval(secs => $2)",
+		idempotencyTableName, idempotencyUserID, idempotencyCreatedAt,
+	)
+	if _, err := tx.Exec(expire, userID, window.Seconds()); err != nil {
+		return nil, fmt.Errorf("idempotency expire error: %v", err)
+	}
+
+	claim := fmt.Sprintf(
+		"INSERT INTO %s (%s, %s, %s) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		idempotencyTableName, idempotencyUserID, idempotencyKey, idempotencyRequestHash,
+	)
+	inserted, err := tx.Exec(claim, userID, key, requestHash)
+	if err != nil {
+		return nil, fmt.Errorf("idempotency claim error: %v", err)
+	}
+
+	if rows, err := inserted.RowsAffected(); err != nil {
+		return nil, err
+	} else if rows == 1 {
+		return nil, nil // First request with this key.
+	}
+
+	var (
+		storedHash string
+		status     sql.NullInt64
+		body       []byte
+	)
+
+	lookup := fmt.Sprintf(
+		"SELECT %s, %s, %s FROM %s WHERE %s = $1 AND %s = $2",
+		idempotencyRequestHash, idempotencyStatusCode, idempotencyResponseBody, idempotencyTableName, idempotencyUserID, idempotencyKey,
+	)
+	if err := tx.QueryRow(lookup, userID, key).Scan(&storedHash, &status, &body); err != nil {
+		return nil, fmt.Errorf("idempotency lookup error: %v", err)
+	}
+
+	if storedHash != requestHash {
+		return nil, fmt.Errorf(IdempotencyKeyReused)
+	}
+
+	return &IdempotentResult{StatusCode: int(status.Int64), Body: body, Replayed: true}, nil
+}
+
+// storeIdempotencyResult saves outcome of the request that claimed key
+func storeIdempotencyResult(tx *sql.Tx, userID, key string, statusCode int, body any) error {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(
+		"UPDATE %s SET %s = $1, %s = $2 WHERE %s = $3 AND %s = $4",
+		idempotencyTableName, idempotencyStatusCode, idempotencyResponseBody, idempotencyUserID, idempotencyKey,
+	)
+	if _, err := tx.Exec(query, statusCode, string(encoded), userID, key); err != nil {
+		return fmt.Errorf("idempotency store error: %v", err)
+	}
+
+	return nil
+}
+
+// AddTaskIdempotent is AddTask guarded by an idempotency key.
+// Replaying a key inside window returns the task created by the first request without inserting again.
+// Empty key behaves exactly like AddTask.
+func (database *DataBaseProps) AddTaskIdempotent(userID, key, task string, window time.Duration) (Task, bool, error) {
+	if key == "" {
+		created, err := database.AddTask(userID, task)
+		return created, false, err
+	}
+
+	if len(key) > IdempotencyKeyMaxLength {
+		return Task{}, false, fmt.Errorf(IdempotencyKeyTooLong, IdempotencyKeyMaxLength)
+	}
+
+	var (
+		created  Task
+		replayed bool
+	)
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		stored, err := claimIdempotencyKey(tx, userID, key, IdempotencyRequestHash("create-task", task), window)
+		if err != nil {
+			return err
+		}
+
+		if stored != nil {
+			replayed = true
+			return json.Unmarshal(stored.Body, &created)
+		}
+
+		created, err = addTaskTx(tx, userID, task)
+		if err != nil {
+			return err
+		}
+
+		return storeIdempotencyResult(tx, userID, key, http.StatusCreated, created)
+	})
+	if err != nil {
+		return Task{}, false, err
+	}
+
+	return created, replayed, nil
+}
@@ -0,0 +1,219 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Table: invites
+//
+// Columns:
+// 1. id (int, primary key, auto-increment)
+//
+// 2. code_hash (string, unique)
+//    - SHA-256 of the invite code, the code itself is shown once when it is created.
+//
+// 3. created_by (int, not null)
+//    - User who created the invite.
+//
+// 4. max_uses, uses (int)
+//    - Accounts the code can create and accounts it created.
+//
+// 5. created_at, expires_at, revoked_at (timestamp)
+
+const (
+	invitesTableName = "invites"
+	invitesID        = "id"
+	invitesHash      = "code_hash"
+	invitesCreatedBy = "created_by"
+	invitesMaxUses   = "max_uses"
+	invitesUses      = "uses"
+	invitesCreatedAt = "created_at"
+	invitesExpiresAt = "expires_at"
+	invitesRevokedAt = "revoked_at"
+
+	// Size of invite codes in random bytes
+	inviteCodeSize = 12
+)
+
+// Events stored in audit_log
+const (
+	AuditEventInviteCreated  = "invite_created"
+	AuditEventInviteRevoked  = "invite_revoked"
+	AuditEventInviteRedeemed = "invite_redeemed"
+)
+
+// Invite is an invite code without the code, as listed on the invites page and in the data export
+type Invite struct {
+	ID        string     `json:"id"`
+	CreatedBy string     `json:"createdBy"` // Username of the creator.
+	MaxUses   int        `json:"maxUses"`
+	Uses      int        `json:"uses"`
+	CreatedAt time.Time  `json:"createdAt"`
+	ExpiresAt time.Time  `json:"expiresAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
+// Active reports whether the invite can still create an account
+func (invite Invite) Active() bool {
+	return invite.RevokedAt == nil && invite.Uses < invite.MaxUses && time.Now().Before(invite.ExpiresAt)
+}
+
+// InviteError is an invite form mistake, shown to the user as it is
+type InviteError struct {
+	Message string
+}
+
+func (inviteError *InviteError) Error() string {
+	return inviteError.Message
+}
+
+// CreateInvite creates an invite of userID that creates up to maxUses accounts within ttl, and returns it with its code.
+// The code is not stored, only its hash. Limits out of range give an *InviteError.
+func (database *DataBaseProps) CreateInvite(userID string, maxUses int, maxUsesLimit int, ttl time.Duration, ttlLimit time.Duration, ip string, userAgent string) (Invite, string, error) {
+	if maxUses < 1 || maxUses > maxUsesLimit {
+		return Invite{}, "", &InviteError{fmt.Sprintf(InviteUsesInvalid, maxUsesLimit)}
+	}
+	if ttl <= 0 || ttl > ttlLimit {
+		return Invite{}, "", &InviteError{fmt.Sprintf(InviteTTLInvalid, int(ttlLimit.Hours()/24))}
+	}
+
+	code := GenerateToken(inviteCodeSize)
+	invite := Invite{MaxUses: maxUses, CreatedAt: time.Now()}
+	invite.ExpiresAt = invite.CreatedAt.Add(ttl)
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		insert := fmt.Sprintf(
+			"INSERT INTO %s (%s, %s, %s, %s, %s) VALUES ($1, $2, $3, $4, $5) RETURNING %s",
+			invitesTableName, invitesHash, invitesCreatedBy, invitesMaxUses, invitesCreatedAt, invitesExpiresAt, invitesID,
+		)
+		if err := tx.QueryRow(insert, HashToken(code), userID, maxUses, invite.CreatedAt, invite.ExpiresAt).Scan(&invite.ID); err != nil {
+			return fmt.Errorf("invite insert error: %v", err)
+		}
+
+		return recordSecurityEvent(tx, userID, AuditEventInviteCreated, fmt.Sprintf("invite %s, %d uses", invite.ID, maxUses), ip, userAgent)
+	})
+	if err != nil {
+		return Invite{}, "", err
+	}
+
+	return invite, code, nil
+}
+
+// ListInvites returns the invites created by userID, or every invite if userID is empty (admins), newest first
+func (database *DataBaseProps) ListInvites(userID string) ([]Invite, error) {
+	if database == nil || database.Connection == nil {
+		return nil, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf(
+		`SELECT i.%s, u.%s, i.%s, i.%s, i.%s, i.%s, i.%s FROM %s i
+		JOIN %s u ON u.%s = i.%s
+		WHERE $1 = '' OR i.%s::text = $1
+		ORDER BY i.%s DESC`,
+		invitesID, usersUsernameColumn, invitesMaxUses, invitesUses, invitesCreatedAt, invitesExpiresAt, invitesRevokedAt, invitesTableName,
+		tableUsersNaming, usersIDColumn, invitesCreatedBy,
+		invitesCreatedBy,
+		invitesID,
+	)
+
+	return queryRows(database.Connection, query, func(rows *sql.Rows) ([]Invite, error) {
+		result := []Invite{}
+		for rows.Next() {
+			var (
+				invite  Invite
+				revoked sql.NullTime
+			)
+			if err := rows.Scan(&invite.ID, &invite.CreatedBy, &invite.MaxUses, &invite.Uses, &invite.CreatedAt, &invite.ExpiresAt, &revoked); err != nil {
+				return nil, fmt.Errorf("row scan error: %v", err)
+			}
+			if revoked.Valid {
+				invite.RevokedAt = &revoked.Time
+			}
+			result = append(result, invite)
+		}
+		return result, rows.Err()
+	}, userID)
+}
+
+// RevokeInvite stops inviteID from creating accounts, actorID is the user revoking it. A non-empty ownerID limits it
+// to invites of that user, admins pass an empty one. InviteNotFound is returned for unknown invites and invites of other users.
+func (database *DataBaseProps) RevokeInvite(inviteID string, ownerID string, actorID string, ip string) error {
+	return database.inTransaction(func(tx *sql.Tx) error {
+		update := fmt.Sprintf(
+			"UPDATE %[1]s SET %[2]s = COALESCE(%[2]s, $1) WHERE %[3]s::text = $2 AND ($3 = '' OR %[4]s::text = $3)",
+			invitesTableName, invitesRevokedAt, invitesID, invitesCreatedBy,
+		)
+		result, err := tx.Exec(update, time.Now(), inviteID, ownerID)
+		if err != nil {
+			return fmt.Errorf("invite update error: %v", err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("invite update error: %v", err)
+		}
+		if affected == 0 {
+			return fmt.Errorf(InviteNotFound)
+		}
+
+		return recordAuditEvent(tx, actorID, AuditEventInviteRevoked, "invite "+inviteID, ip)
+	})
+}
+
+// IsInviteValid reports whether code can create an account now, without using it up
+func (database *DataBaseProps) IsInviteValid(code string) (bool, error) {
+	if database == nil || database.Connection == nil {
+		return false, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf(
+		"SELECT COUNT(*) FROM %s WHERE %s = $1 AND %s IS NULL AND %s < %s AND %s > $2",
+		invitesTableName, invitesHash, invitesRevokedAt, invitesUses, invitesMaxUses, invitesExpiresAt,
+	)
+
+	var count int
+	if err := database.Connection.QueryRow(query, HashToken(code), time.Now()).Scan(&count); err != nil {
+		return false, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return count > 0, nil
+}
+
+// CreateNewUserWithInvite is CreateNewUser that uses up one use of the invite code in the same transaction,
+// so a code can not create more accounts than allowed even when forms are sent at once.
+// InviteInvalid is returned if the code is unknown, revoked, expired or used up.
+func (database *DataBaseProps) CreateNewUserWithInvite(Username, Password, Email, code, ip string) (string, error) {
+	hashedPassword, err := HashPassword(Password)
+	if err != nil {
+		return "", err
+	}
+
+	var userID string
+	err = database.inTransaction(func(tx *sql.Tx) error {
+		redeem := fmt.Sprintf(
+			"UPDATE %[1]s SET %[2]s = %[2]s + 1 WHERE %[3]s = $1 AND %[4]s IS NULL AND %[2]s < %[5]s AND %[6]s > $2 RETURNING %[7]s",
+			invitesTableName, invitesUses, invitesHash, invitesRevokedAt, invitesMaxUses, invitesExpiresAt, invitesID,
+		)
+
+		var inviteID string
+		if err := tx.QueryRow(redeem, HashToken(code), time.Now()).Scan(&inviteID); err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf(InviteInvalid)
+			}
+			return fmt.Errorf("invite update error: %v", err)
+		}
+
+		userID, err = insertUser(tx, Username, hashedPassword, Email)
+		if err != nil {
+			return err
+		}
+
+		return recordAuditEvent(tx, userID, AuditEventInviteRedeemed, "invite "+inviteID, ip)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return userID, nil
+}
@@ -0,0 +1,176 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Table: login_attempts
+//
+// Columns:
+// 1. key (string, primary key)
+//    - "user:<lowercase username>" or "ip:<address>", see UserLoginKey and IPLoginKey.
+//
+// 2. failures (int, not null)
+//    - Failed logins in a row, reset by a successful login or after LoginFailureWindow without failures.
+//
+// 3. last_failure_at (timestamp, not null)
+//
+// 4. locked_until (timestamp, nullable)
+//    - Logins of the key are refused until this time.
+
+const (
+	loginAttemptsTableName = "login_attempts"
+	loginAttemptsKey       = "key"
+	loginAttemptsFailures  = "failures"
+	loginAttemptsLastAt    = "last_failure_at"
+	loginAttemptsLockedAt  = "locked_until"
+
+	// Failures older than this are forgotten
+	LoginFailureWindow = 24 * time.Hour
+)
+
+// LoginLimits describes when a key gets locked and for how long.
+// The lock starts at LockoutBase once MaxFailures is reached and doubles with every further failure up to LockoutMax.
+type LoginLimits struct {
+	MaxFailures int
+	LockoutBase time.Duration
+	LockoutMax  time.Duration
+}
+
+// lockoutFor returns lock duration after failures, zero while failures are below the limit
+func (limits LoginLimits) lockoutFor(failures int) time.Duration {
+	if limits.MaxFailures <= 0 || failures < limits.MaxFailures {
+		return 0
+	}
+
+	lockout := limits.LockoutBase
+	for i := limits.MaxFailures; i < failures && lockout < limits.LockoutMax; i++ {
+		lockout *= 2
+	}
+
+	if lockout > limits.LockoutMax {
+		lockout = limits.LockoutMax
+	}
+
+	return lockout
+}
+
+// UserLoginKey is the login_attempts key of username, usernames are compared case-insensitively
+func UserLoginKey(username string) string {
+	return "user:" + strings.ToLower(username)
+}
+
+// IPLoginKey is the login_attempts key of a client address
+func IPLoginKey(ip string) string {
+	return "ip:" + ip
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// DummyPasswordHash returns a bcrypt hash of a random password.
+// Comparing against it for unknown usernames makes them take as long as wrong passwords.
+func DummyPasswordHash() string {
+	dummyHashOnce.Do(func() {
+		hash, err := HashPassword(GenerateToken(16))
+		if err != nil {
+			panic(fmt.Sprintf("dummy hash error: %v", err))
+		}
+		dummyHash = hash
+	})
+
+	return dummyHash
+}
+
+// LoginLockedUntil returns the latest lock of keys that is still active, zero time if none is locked
+func (database *DataBaseProps) LoginLockedUntil(keys ...string) (time.Time, error) {
+	if database == nil || database.Connection == nil {
+		return time.Time{}, fmt.Errorf("database connection is nil")
+	}
+
+	var (
+		latest time.Time
+		now    = time.Now()
+	)
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1 AND %s > $2", loginAttemptsLockedAt, loginAttemptsTableName, loginAttemptsKey, loginAttemptsLockedAt)
+	for _, key := range keys {
+		var lockedUntil time.Time
+		if err := database.Connection.QueryRow(query, key, now).Scan(&lockedUntil); err != nil {
+			if err == sql.ErrNoRows {
+				continue
+			}
+			return time.Time{}, fmt.Errorf("row scan error: %v", err)
+		}
+
+		if lockedUntil.After(latest) {
+			latest = lockedUntil
+		}
+	}
+
+	return latest, nil
+}
+
+// RegisterLoginFailure counts a failed login of key and locks it once limits are reached.
+// Every new lock is written to audit_log for userID (may be empty) and ip. The lock end is returned, zero if not locked.
+func (database *DataBaseProps) RegisterLoginFailure(key string, limits LoginLimits, userID string, ip string) (time.Time, error) {
+	var lockedUntil time.Time
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		var (
+			failures int
+			now      = time.Now()
+		)
+
+		upsert := fmt.Sprintf(
+			`INSERT INTO %[1]s (%[2]s, %[3]s, %[4]s) VALUES ($1, 1, $2)
+			ON CONFLICT (%[2]s) DO UPDATE SET
+				%[3]s = CASE WHEN %[1]s.%[4]s < $3 THEN 1 ELSE %[1]s.%[3]s + 1 END,
+				%[4]s = $2
+			RETURNING %[3]s`,
+			loginAttemptsTableName, loginAttemptsKey, loginAttemptsFailures, loginAttemptsLastAt,
+		)
+		if err := tx.QueryRow(upsert, key, now, now.Add(-LoginFailureWindow)).Scan(&failures); err != nil {
+			return fmt.Errorf("login attempt upsert error: %v", err)
+		}
+
+		lockout := limits.lockoutFor(failures)
+		if lockout == 0 {
+			return nil
+		}
+
+		lockedUntil = now.Add(lockout)
+		lock := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s = $2", loginAttemptsTableName, loginAttemptsLockedAt, loginAttemptsKey)
+		if _, err := tx.Exec(lock, lockedUntil, key); err != nil {
+			return fmt.Errorf("login lock update error: %v", err)
+		}
+
+		detail := fmt.Sprintf("%s locked for %s after %d failed logins", key, lockout, failures)
+		return recordAuditEvent(tx, userID, AuditEventLockout, detail, ip)
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return lockedUntil, nil
+}
+
+// ClearLoginFailures forgets failures and lock of key, called after a successful login
+func (database *DataBaseProps) ClearLoginFailures(key string) error {
+	if database == nil || database.Connection == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", loginAttemptsTableName, loginAttemptsKey)
+	if _, err := database.Connection.Exec(query, key); err != nil {
+		return fmt.Errorf("login attempts delete error: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,776 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Table: oauth_clients
+//
+// Columns:
+// 1. client_id (string, primary key)
+//
+// 2. secret_hash (string, nullable)
+//    - SHA-256 of the client secret, NULL for public clients (browser and mobile apps), which must use PKCE.
+//
+// 3. name (string, not null)
+//    - Shown on the consent page.
+//
+// 4. redirect_uris (string, not null)
+//    - Allowed redirect URIs, one per line, compared exactly.
+//
+// 5. owner_id (int, not null)
+//    - User who registered the client.
+//
+// 6. created_at (timestamp)
+
+// Table: oauth_codes
+//
+// Columns:
+// 1. code_hash (string, primary key)
+//
+// 2. grant_id (string, not null)
+//    - Random id shared by the code and every token issued from it.
+//
+// 3. client_id, user_id, redirect_uri, scope
+//
+// 4. code_challenge (string, not null)
+//    - PKCE S256 challenge of the authorization request.
+//
+// 5. expires_at, used_at (timestamp)
+//    - A code is used once, using it again revokes every token of its grant.
+
+// Table: oauth_tokens
+//
+// Columns:
+// 1. token_hash (string, primary key)
+//
+// 2. kind (string, not null)
+//    - "access" or "refresh".
+//
+// 3. grant_id, client_id, user_id, scope
+//
+// 4. session_version (int, not null)
+//    - users.session_version at issue time, tokens of an older version are inactive (password change, forced logout).
+//
+// 5. created_at, expires_at, revoked_at (timestamp)
+//    - Refresh tokens are rotated: the used one is revoked, presenting a revoked one revokes the whole grant.
+
+const (
+	oauthClientsTableName  = "oauth_clients"
+	oauthClientsID         = "client_id"
+	oauthClientsSecretHash = "secret_hash"
+	oauthClientsName       = "name"
+	oauthClientsRedirects  = "redirect_uris"
+	oauthClientsOwnerID    = "owner_id"
+	oauthClientsCreatedAt  = "created_at"
+
+	oauthCodesTableName = "oauth_codes"
+	oauthCodesHash      = "code_hash"
+	oauthCodesGrantID   = "grant_id"
+	oauthCodesClientID  = "client_id"
+	oauthCodesUserID    = "user_id"
+	oauthCodesRedirect  = "redirect_uri"
+	oauthCodesScope     = "scope"
+	oauthCodesChallenge = "code_challenge"
+	oauthCodesExpiresAt = "expires_at"
+	oauthCodesUsedAt    = "used_at"
+
+	oauthTokensTableName      = "oauth_tokens"
+	oauthTokensHash           = "token_hash"
+	oauthTokensKind           = "kind"
+	oauthTokensGrantID        = "grant_id"
+	oauthTokensClientID       = "client_id"
+	oauthTokensUserID         = "user_id"
+	oauthTokensScope          = "scope"
+	oauthTokensSessionVersion = "session_version"
+	oauthTokensCreatedAt      = "created_at"
+	oauthTokensExpiresAt      = "expires_at"
+	oauthTokensRevokedAt      = "revoked_at"
+
+	oauthTokenKindAccess  = "access"
+	oauthTokenKindRefresh = "refresh"
+
+	// Random bytes of client ids, secrets, codes and tokens
+	oauthClientIDSize = 16
+	oauthSecretSize   = 32
+
+	// How long an authorization code can be exchanged
+	oauthCodeTTL = time.Minute
+
+	// Limits of client registration
+	oauthClientNameMax   = 64
+	oauthRedirectURIsMax = 5
+)
+
+// Scopes of the JSON task API
+const (
+	ScopeTasksRead  = "tasks:read"
+	ScopeTasksWrite = "tasks:write"
+)
+
+// OAuthScopes describes every scope for the consent page, in the order they are shown
+var OAuthScopes = []struct {
+	Name        string
+	Description string
+}{
+	{ScopeTasksRead, "See your tasks and their history"},
+	{ScopeTasksWrite, "Create, change and delete your tasks"},
+}
+
+// OAuth error codes (RFC 6749 section 5.2), returned as error text and sent to clients as they are
+const (
+	OAuthInvalidRequest = "invalid_request"
+	OAuthInvalidClient  = "invalid_client"
+	OAuthInvalidGrant   = "invalid_grant"
+	OAuthInvalidScope   = "invalid_scope"
+)
+
+// Events stored in audit_log
+const (
+	AuditEventOAuthClientRegistered = "oauth_client_registered"
+	AuditEventOAuthClientDeleted    = "oauth_client_deleted"
+	AuditEventOAuthGrantCreated     = "oauth_grant_created"
+	AuditEventOAuthGrantRevoked     = "oauth_grant_revoked"
+	AuditEventOAuthTokenReuse       = "oauth_token_reuse"
+)
+
+// OAuthClient is an application registered to ask users for access
+type OAuthClient struct {
+	ClientID     string    `json:"clientId"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirectUris"`
+	Confidential bool      `json:"confidential"` // Has a secret, public clients have none.
+	OwnerID      string    `json:"-"`
+	CreatedAt    time.Time `json:"createdAt"`
+	secretHash   string
+}
+
+// HasRedirectURI reports whether uri is registered for client, only exact matches count
+func (client OAuthClient) HasRedirectURI(uri string) bool {
+	for _, registered := range client.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticate checks the secret sent by client, public clients must not send one
+func (client OAuthClient) Authenticate(secret string) bool {
+	if !client.Confidential {
+		return secret == ""
+	}
+
+	return CompareHash(HashToken(secret), client.secretHash)
+}
+
+// OAuthTokenResponse is the token endpoint answer (RFC 6749 section 5.1)
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// OAuthTokenInfo describes an active access or refresh token
+type OAuthTokenInfo struct {
+	Kind      string
+	ClientID  string
+	UserID    string
+	Username  string
+	Scope     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	// SessionVersion of the user when the token was issued, equal to the current one for active tokens
+	SessionVersion int
+}
+
+// IsAccessToken reports whether the token may be used at the API, refresh tokens may not
+func (info OAuthTokenInfo) IsAccessToken() bool {
+	return info.Kind == oauthTokenKindAccess
+}
+
+// HasScope reports whether the token was granted scope
+func (info OAuthTokenInfo) HasScope(scope string) bool {
+	for _, granted := range strings.Fields(info.Scope) {
+		if granted == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// OAuthGrant is an application a user allowed to access their account
+type OAuthGrant struct {
+	ClientID   string    `json:"clientId"`
+	ClientName string    `json:"clientName"`
+	Scope      string    `json:"scope"`
+	LastIssued time.Time `json:"lastIssued"`
+}
+
+// OAuthScopeDescriptions returns the consent page descriptions of the scopes in the space separated list
+func OAuthScopeDescriptions(scope string) []string {
+	info := OAuthTokenInfo{Scope: scope}
+
+	descriptions := []string{}
+	for _, known := range OAuthScopes {
+		if info.HasScope(known.Name) {
+			descriptions = append(descriptions, known.Description)
+		}
+	}
+
+	return descriptions
+}
+
+// OAuthClientError is a registration form mistake, shown to the user as it is
+type OAuthClientError struct {
+	Message string
+}
+
+func (clientError *OAuthClientError) Error() string {
+	return clientError.Message
+}
+
+// NormalizeOAuthScope checks that every scope of the space separated list is known and returns them
+// in the order of OAuthScopes without duplicates, OAuthInvalidScope is returned for unknown or empty lists
+func NormalizeOAuthScope(scope string) (string, error) {
+	requested := map[string]bool{}
+	for _, name := range strings.Fields(scope) {
+		requested[name] = true
+	}
+
+	normalized := []string{}
+	for _, known := range OAuthScopes {
+		if requested[known.Name] {
+			normalized = append(normalized, known.Name)
+			delete(requested, known.Name)
+		}
+	}
+
+	if len(requested) > 0 || len(normalized) == 0 {
+		return "", fmt.Errorf(OAuthInvalidScope)
+	}
+
+	return strings.Join(normalized, " "), nil
+}
+
+// ValidRedirectURI reports whether uri can be registered: absolute, without fragment,
+// and https unless it points to the local machine (native apps and development)
+func ValidRedirectURI(uri string) bool {
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Host == "" || parsed.Fragment != "" {
+		return false
+	}
+
+	switch parsed.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := parsed.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		return false
+	}
+}
+
+// pkceChallenge returns the S256 challenge of verifier
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// RegisterOAuthClient stores a new client of ownerID and returns it with its secret in plain form,
+// the secret is empty for public clients and is never shown again. Invalid input gives an *OAuthClientError.
+func (database *DataBaseProps) RegisterOAuthClient(ownerID string, name string, redirectURIs []string, confidential bool, ip string) (OAuthClient, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || len(name) > oauthClientNameMax {
+		return OAuthClient{}, "", &OAuthClientError{fmt.Sprintf(OAuthClientNameInvalid, oauthClientNameMax)}
+	}
+
+	uris := []string{}
+	for _, uri := range redirectURIs {
+		if uri = strings.TrimSpace(uri); uri == "" {
+			continue
+		}
+		if !ValidRedirectURI(uri) {
+			return OAuthClient{}, "", &OAuthClientError{fmt.Sprintf(OAuthRedirectURIInvalid, uri)}
+		}
+		uris = append(uris, uri)
+	}
+	if len(uris) == 0 || len(uris) > oauthRedirectURIsMax {
+		return OAuthClient{}, "", &OAuthClientError{fmt.Sprintf(OAuthRedirectURICount, oauthRedirectURIsMax)}
+	}
+
+	client := OAuthClient{
+		ClientID:     GenerateToken(oauthClientIDSize),
+		Name:         name,
+		RedirectURIs: uris,
+		Confidential: confidential,
+		OwnerID:      ownerID,
+		CreatedAt:    time.Now(),
+	}
+
+	var secret string
+	var secretHash sql.NullString
+	if confidential {
+		secret = GenerateToken(oauthSecretSize)
+		secretHash = sql.NullString{String: HashToken(secret), Valid: true}
+		client.secretHash = secretHash.String
+	}
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		insert := fmt.Sprintf(
+			"INSERT INTO %s (%s, %s, %s, %s, %s, %s) VALUES ($1, $2, $3, $4, $5, $6)",
+			oauthClientsTableName, oauthClientsID, oauthClientsSecretHash, oauthClientsName, oauthClientsRedirects, oauthClientsOwnerID, oauthClientsCreatedAt,
+		)
+		if _, err := tx.Exec(insert, client.ClientID, secretHash, client.Name, strings.Join(uris, "\n"), ownerID, client.CreatedAt); err != nil {
+			return fmt.Errorf("oauth client insert error: %v", err)
+		}
+
+		return recordAuditEvent(tx, ownerID, AuditEventOAuthClientRegistered, client.Name, ip)
+	})
+	if err != nil {
+		return OAuthClient{}, "", err
+	}
+
+	return client, secret, nil
+}
+
+// oauthClientColumns are read by scanOAuthClient
+func oauthClientColumns() string {
+	return fmt.Sprintf(
+		"%s, COALESCE(%s, ''), %s, %s, %s, %s",
+		oauthClientsID, oauthClientsSecretHash, oauthClientsName, oauthClientsRedirects, oauthClientsOwnerID, oauthClientsCreatedAt,
+	)
+}
+
+// scanOAuthClient reads a row of oauthClientColumns
+func scanOAuthClient(row interface{ Scan(dest ...any) error }) (OAuthClient, error) {
+	var client OAuthClient
+	var redirects string
+	if err := row.Scan(&client.ClientID, &client.secretHash, &client.Name, &redirects, &client.OwnerID, &client.CreatedAt); err != nil {
+		return OAuthClient{}, err
+	}
+
+	client.RedirectURIs = strings.Split(redirects, "\n")
+	client.Confidential = client.secretHash != ""
+	return client, nil
+}
+
+// GetOAuthClient returns the client with clientID, OAuthInvalidClient if there is none
+func (database *DataBaseProps) GetOAuthClient(clientID string) (OAuthClient, error) {
+	if database == nil || database.Connection == nil {
+		return OAuthClient{}, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1", oauthClientColumns(), oauthClientsTableName, oauthClientsID)
+	client, err := scanOAuthClient(database.Connection.QueryRow(query, clientID))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return OAuthClient{}, fmt.Errorf(OAuthInvalidClient)
+		}
+		return OAuthClient{}, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return client, nil
+}
+
+// ListOAuthClients returns the clients registered by ownerID, oldest first
+func (database *DataBaseProps) ListOAuthClients(ownerID string) ([]OAuthClient, error) {
+	if database == nil || database.Connection == nil {
+		return nil, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s = $1 ORDER BY %s",
+		oauthClientColumns(), oauthClientsTableName, oauthClientsOwnerID, oauthClientsCreatedAt,
+	)
+
+	return queryRows(database.Connection, query, func(rows *sql.Rows) ([]OAuthClient, error) {
+		result := []OAuthClient{}
+		for rows.Next() {
+			client, err := scanOAuthClient(rows)
+			if err != nil {
+				return nil, fmt.Errorf("row scan error: %v", err)
+			}
+			result = append(result, client)
+		}
+		return result, rows.Err()
+	}, ownerID)
+}
+
+// DeleteOAuthClient removes a client of ownerID together with its codes and tokens
+func (database *DataBaseProps) DeleteOAuthClient(ownerID string, clientID string, ip string) error {
+	return database.inTransaction(func(tx *sql.Tx) error {
+		var name string
+		remove := fmt.Sprintf(
+			"DELETE FROM %s WHERE %s = $1 AND %s = $2 RETURNING %s",
+			oauthClientsTableName, oauthClientsID, oauthClientsOwnerID, oauthClientsName,
+		)
+		if err := tx.QueryRow(remove, clientID, ownerID).Scan(&name); err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf(OAuthInvalidClient)
+			}
+			return fmt.Errorf("oauth client delete error: %v", err)
+		}
+
+		tables := []struct {
+			Table    string
+			ClientID string
+		}{
+			{oauthCodesTableName, oauthCodesClientID},
+			{oauthTokensTableName, oauthTokensClientID},
+		}
+		for _, table := range tables {
+			query := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", table.Table, table.ClientID)
+			if _, err := tx.Exec(query, clientID); err != nil {
+				return fmt.Errorf("%s delete error: %v", table.Table, err)
+			}
+		}
+
+		return recordAuditEvent(tx, ownerID, AuditEventOAuthClientDeleted, name, ip)
+	})
+}
+
+// CreateAuthorizationCode stores a code for the consent of userID to client and returns it in plain form.
+// challenge is the PKCE S256 challenge the token request has to answer.
+func (database *DataBaseProps) CreateAuthorizationCode(client OAuthClient, userID string, redirectURI string, scope string, challenge string, ip string, userAgent string) (string, error) {
+	code := GenerateToken(oauthSecretSize)
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		insert := fmt.Sprintf(
+			"INSERT INTO %s (%s, %s, %s, %s, %s, %s, %s, %s) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+			oauthCodesTableName, oauthCodesHash, oauthCodesGrantID, oauthCodesClientID, oauthCodesUserID,
+			oauthCodesRedirect, oauthCodesScope, oauthCodesChallenge, oauthCodesExpiresAt,
+		)
+		_, err := tx.Exec(insert, HashToken(code), GenerateToken(oauthClientIDSize), client.ClientID, userID, redirectURI, scope, challenge, time.Now().Add(oauthCodeTTL))
+		if err != nil {
+			return fmt.Errorf("oauth code insert error: %v", err)
+		}
+
+		return recordSecurityEvent(tx, userID, AuditEventOAuthGrantCreated, fmt.Sprintf("%s: %s", client.Name, scope), ip, userAgent)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return code, nil
+}
+
+// ExchangeAuthorizationCode redeems code for an access and a refresh token.
+// The code must belong to clientID, be unused and unexpired, redirectURI must match the authorization request
+// and verifier must answer its PKCE challenge, otherwise OAuthInvalidGrant is returned.
+// A code presented a second time revokes every token issued from it, it has probably been stolen.
+func (database *DataBaseProps) ExchangeAuthorizationCode(clientID string, code string, redirectURI string, verifier string, accessTTL time.Duration, refreshTTL time.Duration) (OAuthTokenResponse, error) {
+	var response OAuthTokenResponse
+	var reused bool
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		var (
+			grantID, codeClient, userID, codeRedirect, scope, challenge string
+			expiresAt                                                   time.Time
+			usedAt                                                      sql.NullTime
+		)
+
+		query := fmt.Sprintf(
+			"SELECT %s, %s, %s, %s, %s, %s, %s, %s FROM %s WHERE %s = $1 FOR UPDATE",
+			oauthCodesGrantID, oauthCodesClientID, oauthCodesUserID, oauthCodesRedirect, oauthCodesScope, oauthCodesChallenge,
+			oauthCodesExpiresAt, oauthCodesUsedAt, oauthCodesTableName, oauthCodesHash,
+		)
+		err := tx.QueryRow(query, HashToken(code)).Scan(&grantID, &codeClient, &userID, &codeRedirect, &scope, &challenge, &expiresAt, &usedAt)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf(OAuthInvalidGrant)
+			}
+			return fmt.Errorf("row scan error: %v", err)
+		}
+
+		if usedAt.Valid {
+			reused = true
+			if err := revokeOAuthGrantTx(tx, grantID); err != nil {
+				return err
+			}
+			return recordAuditEvent(tx, userID, AuditEventOAuthTokenReuse, "authorization code", "")
+		}
+
+		if codeClient != clientID || codeRedirect != redirectURI || time.Now().After(expiresAt) ||
+			!CompareHash(pkceChallenge(verifier), challenge) {
+			return fmt.Errorf(OAuthInvalidGrant)
+		}
+
+		update := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s = $2", oauthCodesTableName, oauthCodesUsedAt, oauthCodesHash)
+		if _, err := tx.Exec(update, time.Now(), HashToken(code)); err != nil {
+			return fmt.Errorf("oauth code update error: %v", err)
+		}
+
+		response, err = issueOAuthTokensTx(tx, grantID, clientID, userID, scope, accessTTL, refreshTTL)
+		return err
+	})
+	if err != nil {
+		return OAuthTokenResponse{}, err
+	}
+	if reused {
+		// The revocation is committed, the request itself still fails
+		return OAuthTokenResponse{}, fmt.Errorf(OAuthInvalidGrant)
+	}
+
+	return response, nil
+}
+
+// RefreshOAuthToken rotates refreshToken of clientID: it is revoked and a new access and refresh token are returned.
+// scope may narrow the granted scope, empty keeps it. A revoked refresh token presented again revokes its whole grant.
+func (database *DataBaseProps) RefreshOAuthToken(clientID string, refreshToken string, scope string, accessTTL time.Duration, refreshTTL time.Duration) (OAuthTokenResponse, error) {
+	var response OAuthTokenResponse
+	var reused bool
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		var (
+			grantID, tokenClient, userID, granted string
+			version                               int
+			expiresAt                             time.Time
+			revokedAt                             sql.NullTime
+		)
+
+		query := fmt.Sprintf(
+			"SELECT %s, %s, %s, %s, %s, %s, %s FROM %s WHERE %s = $1 AND %s = $2 FOR UPDATE",
+			oauthTokensGrantID, oauthTokensClientID, oauthTokensUserID, oauthTokensScope, oauthTokensSessionVersion,
+			oauthTokensExpiresAt, oauthTokensRevokedAt, oauthTokensTableName, oauthTokensHash, oauthTokensKind,
+		)
+		err := tx.QueryRow(query, HashToken(refreshToken), oauthTokenKindRefresh).Scan(&grantID, &tokenClient, &userID, &granted, &version, &expiresAt, &revokedAt)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf(OAuthInvalidGrant)
+			}
+			return fmt.Errorf("row scan error: %v", err)
+		}
+
+		if tokenClient != clientID {
+			return fmt.Errorf(OAuthInvalidGrant)
+		}
+
+		if revokedAt.Valid {
+			reused = true
+			if err := revokeOAuthGrantTx(tx, grantID); err != nil {
+				return err
+			}
+			return recordAuditEvent(tx, userID, AuditEventOAuthTokenReuse, "refresh token", "")
+		}
+
+		current, err := sessionVersionTx(tx, userID)
+		if err != nil {
+			return err
+		}
+		if time.Now().After(expiresAt) || current != version {
+			return fmt.Errorf(OAuthInvalidGrant)
+		}
+
+		if scope == "" {
+			scope = granted
+		} else if !scopeSubset(scope, granted) {
+			return fmt.Errorf(OAuthInvalidScope)
+		}
+
+		revoke := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s = $2", oauthTokensTableName, oauthTokensRevokedAt, oauthTokensHash)
+		if _, err := tx.Exec(revoke, time.Now(), HashToken(refreshToken)); err != nil {
+			return fmt.Errorf("oauth token update error: %v", err)
+		}
+
+		response, err = issueOAuthTokensTx(tx, grantID, clientID, userID, scope, accessTTL, refreshTTL)
+		return err
+	})
+	if err != nil {
+		return OAuthTokenResponse{}, err
+	}
+	if reused {
+		return OAuthTokenResponse{}, fmt.Errorf(OAuthInvalidGrant)
+	}
+
+	return response, nil
+}
+
+// scopeSubset reports whether every scope of requested is in granted
+func scopeSubset(requested string, granted string) bool {
+	info := OAuthTokenInfo{Scope: granted}
+	for _, scope := range strings.Fields(requested) {
+		if !info.HasScope(scope) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sessionVersionTx reads users.session_version of userID inside tx
+func sessionVersionTx(tx *sql.Tx, userID string) (int, error) {
+	var version int
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1", usersSessionVersionColumn, tableUsersNaming, usersIDColumn)
+	if err := tx.QueryRow(query, userID).Scan(&version); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, fmt.Errorf(OAuthInvalidGrant)
+		}
+		return 0, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return version, nil
+}
+
+// issueOAuthTokensTx stores a new access and refresh token of grantID
+func issueOAuthTokensTx(tx *sql.Tx, grantID string, clientID string, userID string, scope string, accessTTL time.Duration, refreshTTL time.Duration) (OAuthTokenResponse, error) {
+	version, err := sessionVersionTx(tx, userID)
+	if err != nil {
+		return OAuthTokenResponse{}, err
+	}
+
+	response := OAuthTokenResponse{
+		AccessToken:  GenerateToken(oauthSecretSize),
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTTL.Seconds()),
+		RefreshToken: GenerateToken(oauthSecretSize),
+		Scope:        scope,
+	}
+
+	insert := fmt.Sprintf(
+		"INSERT INTO %s (%s, %s, %s, %s, %s, %s, %s, %s, %s) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)",
+		oauthTokensTableName, oauthTokensHash, oauthTokensKind, oauthTokensGrantID, oauthTokensClientID, oauthTokensUserID,
+		oauthTokensScope, oauthTokensSessionVersion, oauthTokensCreatedAt, oauthTokensExpiresAt,
+	)
+
+	now := time.Now()
+	tokens := []struct {
+		token string
+		kind  string
+		ttl   time.Duration
+	}{
+		{response.AccessToken, oauthTokenKindAccess, accessTTL},
+		{response.RefreshToken, oauthTokenKindRefresh, refreshTTL},
+	}
+	for _, token := range tokens {
+		if _, err := tx.Exec(insert, HashToken(token.token), token.kind, grantID, clientID, userID, scope, version, now, now.Add(token.ttl)); err != nil {
+			return OAuthTokenResponse{}, fmt.Errorf("oauth token insert error: %v", err)
+		}
+	}
+
+	return response, nil
+}
+
+// revokeOAuthGrantTx revokes every open token of grantID
+func revokeOAuthGrantTx(tx *sql.Tx, grantID string) error {
+	revoke := fmt.Sprintf(
+		"UPDATE %s SET %s = $1 WHERE %s = $2 AND %s IS NULL",
+		oauthTokensTableName, oauthTokensRevokedAt, oauthTokensGrantID, oauthTokensRevokedAt,
+	)
+	if _, err := tx.Exec(revoke, time.Now(), grantID); err != nil {
+		return fmt.Errorf("oauth token revoke error: %v", err)
+	}
+
+	return nil
+}
+
+// IntrospectOAuthToken returns the token info of an active token.
+// Tokens that are unknown, expired, revoked, issued before the last password change, whose client was deleted or
+// whose user is disabled are not active, false is returned for them.
+func (database *DataBaseProps) IntrospectOAuthToken(token string) (OAuthTokenInfo, bool, error) {
+	if database == nil || database.Connection == nil {
+		return OAuthTokenInfo{}, false, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf(
+		`SELECT t.%s, t.%s, t.%s, u.%s, t.%s, t.%s, t.%s, t.%s FROM %s t
+		JOIN %s u ON u.%s = t.%s
+		JOIN %s c ON c.%s = t.%s
+		WHERE t.%s = $1 AND t.%s IS NULL AND t.%s > $2 AND t.%s = u.%s AND u.%s IS NULL`,
+		oauthTokensKind, oauthTokensClientID, oauthTokensUserID, usersUsernameColumn, oauthTokensScope,
+		oauthTokensCreatedAt, oauthTokensExpiresAt, oauthTokensSessionVersion, oauthTokensTableName,
+		tableUsersNaming, usersIDColumn, oauthTokensUserID,
+		oauthClientsTableName, oauthClientsID, oauthTokensClientID,
+		oauthTokensHash, oauthTokensRevokedAt, oauthTokensExpiresAt, oauthTokensSessionVersion, usersSessionVersionColumn,
+		usersDisabledAtColumn,
+	)
+
+	var info OAuthTokenInfo
+	err := database.Connection.QueryRow(query, HashToken(token), time.Now()).Scan(
+		&info.Kind, &info.ClientID, &info.UserID, &info.Username, &info.Scope, &info.IssuedAt, &info.ExpiresAt, &info.SessionVersion,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return OAuthTokenInfo{}, false, nil
+		}
+		return OAuthTokenInfo{}, false, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return info, true, nil
+}
+
+// RevokeOAuthToken revokes the grant of token if it belongs to clientID (RFC 7009).
+// Unknown tokens are not an error, the client can not tell them apart from revoked ones.
+func (database *DataBaseProps) RevokeOAuthToken(clientID string, token string) error {
+	return database.inTransaction(func(tx *sql.Tx) error {
+		var grantID string
+		query := fmt.Sprintf(
+			"SELECT %s FROM %s WHERE %s = $1 AND %s = $2",
+			oauthTokensGrantID, oauthTokensTableName, oauthTokensHash, oauthTokensClientID,
+		)
+		if err := tx.QueryRow(query, HashToken(token), clientID).Scan(&grantID); err != nil {
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			return fmt.Errorf("row scan error: %v", err)
+		}
+
+		return revokeOAuthGrantTx(tx, grantID)
+	})
+}
+
+// ListOAuthGrants returns the applications that hold an open refresh token of userID
+func (database *DataBaseProps) ListOAuthGrants(userID string) ([]OAuthGrant, error) {
+	if database == nil || database.Connection == nil {
+		return nil, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf(
+		`SELECT c.%s, c.%s, string_agg(DISTINCT t.%s, ' '), MAX(t.%s) FROM %s t
+		JOIN %s c ON c.%s = t.%s
+		WHERE t.%s = $1 AND t.%s = $2 AND t.%s IS NULL AND t.%s > $3
+		GROUP BY c.%s, c.%s ORDER BY c.%s`,
+		oauthClientsID, oauthClientsName, oauthTokensScope, oauthTokensCreatedAt, oauthTokensTableName,
+		oauthClientsTableName, oauthClientsID, oauthTokensClientID,
+		oauthTokensUserID, oauthTokensKind, oauthTokensRevokedAt, oauthTokensExpiresAt,
+		oauthClientsID, oauthClientsName, oauthClientsName,
+	)
+
+	return queryRows(database.Connection, query, func(rows *sql.Rows) ([]OAuthGrant, error) {
+		result := []OAuthGrant{}
+		for rows.Next() {
+			var grant OAuthGrant
+			if err := rows.Scan(&grant.ClientID, &grant.ClientName, &grant.Scope, &grant.LastIssued); err != nil {
+				return nil, fmt.Errorf("row scan error: %v", err)
+			}
+			result = append(result, grant)
+		}
+		return result, rows.Err()
+	}, userID, oauthTokenKindRefresh, time.Now())
+}
+
+// RevokeOAuthGrants revokes every token userID gave to clientID
+func (database *DataBaseProps) RevokeOAuthGrants(userID string, clientID string, ip string) error {
+	return database.inTransaction(func(tx *sql.Tx) error {
+		revoke := fmt.Sprintf(
+			"UPDATE %s SET %s = $1 WHERE %s = $2 AND %s = $3 AND %s IS NULL",
+			oauthTokensTableName, oauthTokensRevokedAt, oauthTokensUserID, oauthTokensClientID, oauthTokensRevokedAt,
+		)
+		if _, err := tx.Exec(revoke, time.Now(), userID, clientID); err != nil {
+			return fmt.Errorf("oauth token revoke error: %v", err)
+		}
+
+		return recordAuditEvent(tx, userID, AuditEventOAuthGrantRevoked, clientID, ip)
+	})
+}
@@ -0,0 +1,329 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Columns of users used by passkeys:
+//
+// 1. webauthn_handle (bytea, nullable, unique)
+//    - Random user handle given to authenticators, created with the first passkey. Not the id, so it tells nothing about the account.
+//
+// 2. passkey_2fa (boolean, default false)
+//    - If true, password login asks for a passkey (or TOTP code) before the session is created.
+//
+// Table: webauthn_credentials
+//
+// 1. id (int, primary key, auto-increment)
+// 2. user_id (int, not null)
+// 3. credential_id (bytea, not null, unique) - id chosen by the authenticator
+// 4. public_key (bytea, not null) - COSE encoded key used to check assertions
+// 5. attestation_type, transports (string) - transports are joined with commas
+// 6. aaguid (bytea), sign_count (bigint) - authenticator model and signature counter, see webauthn.Authenticator
+// 7. backup_eligible, backup_state (boolean)
+// 8. name (string) - label chosen by the user
+// 9. created_at (timestamp), last_used_at (timestamp, nullable)
+
+const (
+	usersWebAuthnHandleColumn = "webauthn_handle"
+	usersPasskey2FAColumn     = "passkey_2fa"
+
+	credentialsTableName       = "webauthn_credentials"
+	credentialsID              = "id"
+	credentialsUserID          = "user_id"
+	credentialsCredentialID    = "credential_id"
+	credentialsPublicKey       = "public_key"
+	credentialsAttestationType = "attestation_type"
+	credentialsTransports      = "transports"
+	credentialsAAGUID          = "aaguid"
+	credentialsSignCount       = "sign_count"
+	credentialsBackupEligible  = "backup_eligible"
+	credentialsBackupState     = "backup_state"
+	credentialsName            = "name"
+	credentialsCreatedAt       = "created_at"
+	credentialsLastUsedAt      = "last_used_at"
+
+	// Size of the random user handle, the specification allows up to 64 bytes
+	webAuthnHandleSize = 32
+
+	PasskeyNameMaxLength = 64
+)
+
+// Events stored in audit_log, the detail is the name of the passkey
+const (
+	AuditEventPasskeyAdded   = "passkey_added"
+	AuditEventPasskeyRemoved = "passkey_removed"
+)
+
+// Passkey is a registered credential as shown on the settings page
+type Passkey struct {
+	ID         int
+	Name       string
+	CreatedAt  time.Time
+	LastUsedAt sql.NullTime
+}
+
+// PasskeyUser is a user together with its credentials, implements webauthn.User
+type PasskeyUser struct {
+	User
+	Handle      []byte
+	Credentials []webauthn.Credential
+}
+
+func (user *PasskeyUser) WebAuthnID() []byte                         { return user.Handle }
+func (user *PasskeyUser) WebAuthnName() string                       { return user.Username }
+func (user *PasskeyUser) WebAuthnDisplayName() string                { return user.Username }
+func (user *PasskeyUser) WebAuthnIcon() string                       { return "" }
+func (user *PasskeyUser) WebAuthnCredentials() []webauthn.Credential { return user.Credentials }
+
+// loadCredentials returns every credential of userID in the form used by the webauthn library
+func (database *DataBaseProps) loadCredentials(userID string) ([]webauthn.Credential, error) {
+	query := fmt.Sprintf(
+		"SELECT %s, %s, %s, %s, %s, %s, %s, %s FROM %s WHERE %s = $1 ORDER BY %s",
+		credentialsCredentialID, credentialsPublicKey, credentialsAttestationType, credentialsTransports,
+		credentialsAAGUID, credentialsSignCount, credentialsBackupEligible, credentialsBackupState,
+		credentialsTableName, credentialsUserID, credentialsID,
+	)
+	rows, err := database.Connection.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("row query error : %v", err)
+	}
+	defer rows.Close()
+
+	var credentials []webauthn.Credential = []webauthn.Credential{}
+	for rows.Next() {
+		var (
+			credential webauthn.Credential
+			transports string
+			signCount  int64
+		)
+		if err := rows.Scan(
+			&credential.ID, &credential.PublicKey, &credential.AttestationType, &transports,
+			&credential.Authenticator.AAGUID, &signCount, &credential.Flags.BackupEligible, &credential.Flags.BackupState,
+		); err != nil {
+			return nil, fmt.Errorf("row scan error: %v", err)
+		}
+
+		credential.Authenticator.SignCount = uint32(signCount)
+		for _, transport := range strings.Split(transports, ",") {
+			if transport != "" {
+				credential.Transport = append(credential.Transport, protocol.AuthenticatorTransport(transport))
+			}
+		}
+		credentials = append(credentials, credential)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+
+	return credentials, nil
+}
+
+// GetPasskeyUser loads user with credentials, the user handle is created on first use
+func (database *DataBaseProps) GetPasskeyUser(userID string) (*PasskeyUser, error) {
+	user, err := database.FetchUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only set when missing, so concurrent requests agree on one handle
+	create := fmt.Sprintf(
+		"UPDATE %s SET %s = $1 WHERE %s = $2 AND %s IS NULL",
+		tableUsersNaming, usersWebAuthnHandleColumn, usersIDColumn, usersWebAuthnHandleColumn,
+	)
+	if _, err := database.Connection.Exec(create, GenerateRandomKey(webAuthnHandleSize), userID); err != nil {
+		return nil, fmt.Errorf("webauthn handle update error: %v", err)
+	}
+
+	passkeyUser := &PasskeyUser{User: user}
+
+	lookup := fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1", usersWebAuthnHandleColumn, tableUsersNaming, usersIDColumn)
+	if err := database.Connection.QueryRow(lookup, userID).Scan(&passkeyUser.Handle); err != nil {
+		return nil, fmt.Errorf("row scan error: %v", err)
+	}
+
+	if passkeyUser.Credentials, err = database.loadCredentials(userID); err != nil {
+		return nil, err
+	}
+
+	return passkeyUser, nil
+}
+
+// FindPasskeyUserByHandle loads the user a discoverable credential belongs to, unknown handles give PasskeyUnknown error
+func (database *DataBaseProps) FindPasskeyUserByHandle(handle []byte) (*PasskeyUser, error) {
+	if database == nil || database.Connection == nil {
+		return nil, fmt.Errorf("database connection is nil")
+	}
+
+	var userID string
+	lookup := fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1", usersIDColumn, tableUsersNaming, usersWebAuthnHandleColumn)
+	if err := database.Connection.QueryRow(lookup, handle).Scan(&userID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf(PasskeyUnknown)
+		}
+		return nil, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return database.GetPasskeyUser(userID)
+}
+
+// AddPasskey stores a credential created by a finished registration ceremony and returns the name it got
+func (database *DataBaseProps) AddPasskey(userID string, name string, credential *webauthn.Credential) (string, error) {
+	if database == nil || database.Connection == nil {
+		return "", fmt.Errorf("database connection is nil")
+	}
+
+	name = TrimSpace(name)
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > PasskeyNameMaxLength {
+		name = name[:PasskeyNameMaxLength]
+	}
+
+	transports := make([]string, 0, len(credential.Transport))
+	for _, transport := range credential.Transport {
+		transports = append(transports, string(transport))
+	}
+
+	insert := fmt.Sprintf(
+		"INSERT INTO %s (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+		credentialsTableName, credentialsUserID, credentialsCredentialID, credentialsPublicKey, credentialsAttestationType,
+		credentialsTransports, credentialsAAGUID, credentialsSignCount, credentialsBackupEligible, credentialsBackupState, credentialsName,
+	)
+	if _, err := database.Connection.Exec(
+		insert, userID, credential.ID, credential.PublicKey, credential.AttestationType, strings.Join(transports, ","),
+		credential.Authenticator.AAGUID, int64(credential.Authenticator.SignCount), credential.Flags.BackupEligible, credential.Flags.BackupState, name,
+	); err != nil {
+		return "", fmt.Errorf("credential insert error: %v", err)
+	}
+
+	return name, nil
+}
+
+// UsePasskey saves signature counter and backup state after a successful assertion
+func (database *DataBaseProps) UsePasskey(userID string, credential *webauthn.Credential) error {
+	if database == nil || database.Connection == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+
+	update := fmt.Sprintf(
+		"UPDATE %s SET %s = $1, %s = $2, %s = $3 WHERE %s = $4 AND %s = $5",
+		credentialsTableName, credentialsSignCount, credentialsBackupState, credentialsLastUsedAt, credentialsUserID, credentialsCredentialID,
+	)
+	if _, err := database.Connection.Exec(update, int64(credential.Authenticator.SignCount), credential.Flags.BackupState, time.Now(), userID, credential.ID); err != nil {
+		return fmt.Errorf("credential update error: %v", err)
+	}
+
+	return nil
+}
+
+// ListPasskeys returns passkeys of userID, oldest first
+func (database *DataBaseProps) ListPasskeys(userID string) ([]Passkey, error) {
+	if database == nil || database.Connection == nil {
+		return nil, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf(
+		"SELECT %s, %s, %s, %s FROM %s WHERE %s = $1 ORDER BY %s",
+		credentialsID, credentialsName, credentialsCreatedAt, credentialsLastUsedAt, credentialsTableName, credentialsUserID, credentialsID,
+	)
+	rows, err := database.Connection.Query(query, userID)
+	if err != nil {
+		return nil, fmt.Errorf("row query error : %v", err)
+	}
+	defer rows.Close()
+
+	var passkeys []Passkey = []Passkey{}
+	for rows.Next() {
+		var passkey Passkey
+		if err := rows.Scan(&passkey.ID, &passkey.Name, &passkey.CreatedAt, &passkey.LastUsedAt); err != nil {
+			return nil, fmt.Errorf("row scan error: %v", err)
+		}
+		passkeys = append(passkeys, passkey)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+
+	return passkeys, nil
+}
+
+// DeletePasskey removes passkey id of userID and returns its name, removing the last one also turns passkey second factor off
+func (database *DataBaseProps) DeletePasskey(userID string, id int) (string, error) {
+	var name string
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		remove := fmt.Sprintf(
+			"DELETE FROM %s WHERE %s = $1 AND %s = $2 RETURNING %s",
+			credentialsTableName, credentialsID, credentialsUserID, credentialsName,
+		)
+		if err := tx.QueryRow(remove, id, userID).Scan(&name); err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf(PasskeyNotFound, id)
+			}
+			return fmt.Errorf("credential delete error: %v", err)
+		}
+
+		disable := fmt.Sprintf(
+			"UPDATE %s SET %s = false WHERE %s = $1 AND NOT EXISTS (SELECT 1 FROM %s WHERE %s = $1)",
+			tableUsersNaming, usersPasskey2FAColumn, usersIDColumn, credentialsTableName, credentialsUserID,
+		)
+		if _, err := tx.Exec(disable, userID); err != nil {
+			return fmt.Errorf("passkey second factor update error: %v", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return name, nil
+}
+
+// IsPasskeySecondFactor reports whether password login of userID asks for a passkey
+func (database *DataBaseProps) IsPasskeySecondFactor(userID string) (bool, error) {
+	if database == nil || database.Connection == nil {
+		return false, fmt.Errorf("database connection is nil")
+	}
+
+	var enabled bool
+	query := fmt.Sprintf("SELECT %s FROM %s WHERE %s = $1", usersPasskey2FAColumn, tableUsersNaming, usersIDColumn)
+	if err := database.Connection.QueryRow(query, userID).Scan(&enabled); err != nil {
+		return false, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return enabled, nil
+}
+
+// SetPasskeySecondFactor turns passkey second factor on or off, turning it on needs at least one passkey
+func (database *DataBaseProps) SetPasskeySecondFactor(userID string, enabled bool) error {
+	if database == nil || database.Connection == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+
+	update := fmt.Sprintf(
+		"UPDATE %s SET %s = $1 WHERE %s = $2 AND (NOT $1 OR EXISTS (SELECT 1 FROM %s WHERE %s = $2))",
+		tableUsersNaming, usersPasskey2FAColumn, usersIDColumn, credentialsTableName, credentialsUserID,
+	)
+	result, err := database.Connection.Exec(update, enabled, userID)
+	if err != nil {
+		return fmt.Errorf("passkey second factor update error: %v", err)
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("rows affected error: %v", err)
+	} else if affected == 0 {
+		return fmt.Errorf(PasskeyRequired)
+	}
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PasswordHasher is one password hashing algorithm.
+// Stored hashes carry algorithm and parameters, so hashes of older algorithms or settings keep working
+// and are replaced by HashPassword output after the next successful login, see PasswordNeedsRehash.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Verify(password string, hash string) bool
+	Handles(hash string) bool   // Reports whether hash was made by this algorithm.
+	IsCurrent(hash string) bool // Reports whether hash was made with the parameters of this hasher.
+}
+
+// Argon2Params are the Argon2id cost parameters, Memory is in KiB
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+}
+
+const (
+	argon2Prefix  = "$argon2id$"
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// DefaultArgon2Params are used unless app.env sets others (64 MiB, 3 passes, 2 lanes)
+var DefaultArgon2Params = Argon2Params{Memory: 64 * 1024, Iterations: 3, Parallelism: 2}
+
+// argon2idHasher writes hashes in the PHC string format: $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+type argon2idHasher struct {
+	params Argon2Params
+}
+
+// NewArgon2idHasher returns a hasher making Argon2id hashes with params
+func NewArgon2idHasher(params Argon2Params) PasswordHasher {
+	return &argon2idHasher{params: params}
+}
+
+func (hasher *argon2idHasher) Hash(password string) (string, error) {
+	salt := GenerateRandomKey(argon2SaltLen)
+	key := argon2.IDKey([]byte(password), salt, hasher.params.Iterations, hasher.params.Memory, hasher.params.Parallelism, argon2KeyLen)
+
+	return fmt.Sprintf(
+		"%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2Prefix, argon2.Version, hasher.params.Memory, hasher.params.Iterations, hasher.params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// decodeArgon2 splits hash into its parameters, salt and key
+func decodeArgon2(hash string) (Argon2Params, []byte, []byte, error) {
+	var (
+		params  Argon2Params
+		version int
+	)
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, fmt.Errorf("not an argon2id hash")
+	}
+
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version")
+	}
+
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("argon2 parameters error: %v", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("argon2 salt error: %v", err)
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("argon2 key error: %v", err)
+	}
+
+	return params, salt, key, nil
+}
+
+func (hasher *argon2idHasher) Verify(password string, hash string) bool {
+	params, salt, key, err := decodeArgon2(hash)
+	if err != nil {
+		return false
+	}
+
+	// Parameters of the stored hash are used, not the current ones
+	candidate := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+	return subtle.ConstantTimeCompare(candidate, key) == 1
+}
+
+func (hasher *argon2idHasher) Handles(hash string) bool {
+	return strings.HasPrefix(hash, argon2Prefix)
+}
+
+func (hasher *argon2idHasher) IsCurrent(hash string) bool {
+	params, salt, key, err := decodeArgon2(hash)
+	return err == nil && params == hasher.params && len(salt) == argon2SaltLen && len(key) == argon2KeyLen
+}
+
+// bcryptHasher verifies hashes written before Argon2id was introduced
+type bcryptHasher struct {
+	cost int
+}
+
+func (hasher *bcryptHasher) Hash(password string) (string, error) {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), hasher.cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hashedPassword), nil
+}
+
+func (hasher *bcryptHasher) Verify(password string, hash string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (hasher *bcryptHasher) Handles(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
+
+func (hasher *bcryptHasher) IsCurrent(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err == nil && cost == hasher.cost
+}
+
+var (
+	// currentHasher makes every new hash, set by SetPasswordHasher
+	currentHasher PasswordHasher = NewArgon2idHasher(DefaultArgon2Params)
+
+	// legacyHashers only verify hashes of earlier algorithms
+	legacyHashers = []PasswordHasher{&bcryptHasher{cost: bcrypt.DefaultCost}}
+)
+
+// SetPasswordHasher changes the algorithm of new hashes, called once at start before any request
+func SetPasswordHasher(hasher PasswordHasher) {
+	currentHasher = hasher
+}
+
+// hasherFor returns the hasher that made hash, nil if no known algorithm did
+func hasherFor(hash string) PasswordHasher {
+	if currentHasher.Handles(hash) {
+		return currentHasher
+	}
+
+	for _, hasher := range legacyHashers {
+		if hasher.Handles(hash) {
+			return hasher
+		}
+	}
+
+	return nil
+}
+
+// PasswordNeedsRehash reports whether hash was made by another algorithm or with other parameters than HashPassword uses now
+func PasswordNeedsRehash(hash string) bool {
+	return !currentHasher.Handles(hash) || !currentHasher.IsCurrent(hash)
+}
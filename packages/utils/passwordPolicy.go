@@ -0,0 +1,265 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nbutton23/zxcvbn-go"
+)
+
+// PasswordPolicy describes which passwords are accepted, see IsValidPassword
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireLetter bool // At least one Latin letter.
+	RequireUpper  bool // At least one upper case letter.
+	RequireLower  bool // At least one lower case letter.
+	RequireDigit  bool
+	RequireSymbol bool // At least one character that is neither letter, digit nor space.
+	AllowSpaces   bool
+	MinStrength   int // zxcvbn score 0 (guessable in seconds) to 4 (very hard to guess), 0 turns the check off.
+
+	// Breached, if set, rejects passwords found in a list of leaked passwords
+	Breached *BreachedPasswordList
+}
+
+// DefaultPasswordPolicy keeps the rules passwords had before the policy became configurable
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:     MinLength,
+	MaxLength:     MaxLength,
+	RequireLetter: true,
+	RequireDigit:  true,
+	AllowSpaces:   false,
+}
+
+// currentPolicy is used by IsValidPassword, set by SetPasswordPolicy
+var currentPolicy = DefaultPasswordPolicy
+
+// SetPasswordPolicy changes the rules of new passwords, called once at start before any request
+func SetPasswordPolicy(policy PasswordPolicy) {
+	currentPolicy = policy
+}
+
+// PasswordPolicyError lists every rule a password breaks, so the form can show all of them at once
+type PasswordPolicyError struct {
+	Violations []string
+}
+
+func (policyError *PasswordPolicyError) Error() string {
+	return strings.Join(policyError.Violations, ". ")
+}
+
+// Check returns every rule of policy that password breaks, an empty list if it is accepted.
+// userInputs (username, email) are words zxcvbn treats as easy to guess.
+func (policy PasswordPolicy) Check(password string, userInputs ...string) []string {
+	violations := []string{}
+
+	if length := len(password); length < policy.MinLength {
+		violations = append(violations, fmt.Sprintf("Password length must be at least %d", policy.MinLength))
+	} else if policy.MaxLength > 0 && length > policy.MaxLength {
+		violations = append(violations, fmt.Sprintf("Password length must be at most %d", policy.MaxLength))
+	}
+
+	var hasLatin, hasUpper, hasLower, hasDigit, hasSymbol, hasSpace bool
+	for _, char := range password {
+		switch {
+		case unicode.IsSpace(char):
+			hasSpace = true
+		case unicode.IsDigit(char):
+			hasDigit = true
+		case unicode.IsLetter(char):
+			hasLatin = hasLatin || (char < unicode.MaxASCII)
+			hasUpper = hasUpper || unicode.IsUpper(char)
+			hasLower = hasLower || unicode.IsLower(char)
+		default:
+			hasSymbol = true
+		}
+	}
+
+	rules := []struct {
+		broken  bool
+		message string
+	}{
+		{policy.RequireLetter && !hasLatin, LatinError},
+		{policy.RequireUpper && !hasUpper, UppercaseError},
+		{policy.RequireLower && !hasLower, LowercaseError},
+		{policy.RequireDigit && !hasDigit, DigitError},
+		{policy.RequireSymbol && !hasSymbol, SymbolError},
+		{!policy.AllowSpaces && hasSpace, SpaceError},
+	}
+	for _, rule := range rules {
+		if rule.broken {
+			violations = append(violations, rule.message)
+		}
+	}
+
+	if policy.MinStrength > 0 && password != "" {
+		if score := zxcvbn.PasswordStrength(password, userInputs).Score; score < policy.MinStrength {
+			violations = append(violations, PasswordTooWeak)
+		}
+	}
+
+	if policy.Breached != nil && password != "" {
+		breached, err := policy.Breached.Contains(password)
+		if err != nil {
+			// The list is an extra check, a broken file must not block every registration
+			log.Printf("breached password list error: %v\n", err)
+		} else if breached {
+			violations = append(violations, PasswordBreached)
+		}
+	}
+
+	return violations
+}
+
+// Rules describes policy for the registration form
+func (policy PasswordPolicy) Rules() []string {
+	rules := []string{fmt.Sprintf("At least %d characters", policy.MinLength)}
+	if policy.MaxLength > 0 {
+		rules = append(rules, fmt.Sprintf("At most %d characters", policy.MaxLength))
+	}
+
+	optional := []struct {
+		enabled bool
+		rule    string
+	}{
+		{policy.RequireLetter, "At least one latin letter"},
+		{policy.RequireUpper, "At least one upper case letter"},
+		{policy.RequireLower, "At least one lower case letter"},
+		{policy.RequireDigit, "At least one number"},
+		{policy.RequireSymbol, "At least one symbol"},
+		{!policy.AllowSpaces, "No spaces"},
+		{policy.MinStrength > 0, "Not easy to guess"},
+		{policy.Breached != nil, "Not found in known data breaches"},
+	}
+	for _, entry := range optional {
+		if entry.enabled {
+			rules = append(rules, entry.rule)
+		}
+	}
+
+	return rules
+}
+
+// PasswordRules describes the current policy
+func PasswordRules() []string {
+	return currentPolicy.Rules()
+}
+
+// SetPasswordErrors puts err of IsValidPassword into data, rule violations as list under ErrorPasswordListHTML
+func SetPasswordErrors(data gin.H, err error) {
+	if policyError, ok := err.(*PasswordPolicyError); ok {
+		data[ErrorPasswordListHTML] = policyError.Violations
+		return
+	}
+
+	data[ErrorPasswordHTML] = err.Error()
+}
+
+// BreachedPasswordList looks passwords up in a local copy of a leaked password list.
+// The file has the format of the Pwned Passwords download ordered by hash: one "SHA1:COUNT" line per password,
+// upper case hex. Only the SHA-1 of the password is compared and the file is binary searched on disk,
+// so a list with hundreds of millions of entries does not have to fit in memory.
+type BreachedPasswordList struct {
+	path string
+	size int64
+}
+
+// Longest line read at once, hash (40) + ':' + count
+const breachedLineMax = 64
+
+// OpenBreachedPasswordList checks that the list at path can be read
+func OpenBreachedPasswordList(path string) (*BreachedPasswordList, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("breached password list error: %v", err)
+	}
+
+	return &BreachedPasswordList{path: path, size: info.Size()}, nil
+}
+
+// Contains reports whether the SHA-1 of password is in the list
+func (list *BreachedPasswordList) Contains(password string) (bool, error) {
+	sum := sha1.Sum([]byte(password))
+	target := []byte(strings.ToUpper(hex.EncodeToString(sum[:])))
+
+	file, err := os.Open(list.path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	// Binary search over byte offsets, each step looks at the first line starting at or after the middle
+	low, high := int64(0), list.size
+	for low < high {
+		middle := low + (high-low)/2
+
+		start, line, err := lineAt(file, middle)
+		if err != nil {
+			return false, err
+		}
+		if start >= high || line == nil {
+			high = middle
+			continue
+		}
+
+		hash := line
+		if colon := bytes.IndexByte(line, ':'); colon >= 0 {
+			hash = line[:colon]
+		}
+
+		switch bytes.Compare(bytes.ToUpper(bytes.TrimSpace(hash)), target) {
+		case 0:
+			return true, nil
+		case -1:
+			low = start + int64(len(line)) + 1
+		default:
+			high = middle
+		}
+	}
+
+	return false, nil
+}
+
+// lineAt returns the first line that starts at or after offset and its start, nil line at the end of the file
+func lineAt(file *os.File, offset int64) (int64, []byte, error) {
+	buffer := make([]byte, 2*breachedLineMax)
+
+	start := offset
+	if offset > 0 {
+		// The previous byte tells whether offset is already a line start
+		n, err := file.ReadAt(buffer, offset-1)
+		if err != nil && err != io.EOF {
+			return 0, nil, err
+		}
+
+		newline := bytes.IndexByte(buffer[:n], '\n')
+		if newline < 0 {
+			return offset, nil, nil
+		}
+		start = offset - 1 + int64(newline) + 1
+	}
+
+	n, err := file.ReadAt(buffer, start)
+	if err != nil && err != io.EOF {
+		return 0, nil, err
+	}
+	if n == 0 {
+		return start, nil, nil
+	}
+
+	line := buffer[:n]
+	if newline := bytes.IndexByte(line, '\n'); newline >= 0 {
+		line = line[:newline]
+	}
+
+	return start, bytes.TrimSuffix(line, []byte("\r")), nil
+}
@@ -0,0 +1,137 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Table: password_reset_tokens
+//
+// Columns:
+// 1. token_hash (string, primary key)
+//    - SHA-256 of the token sent by email, the token itself is never stored.
+//
+// 2. user_id (int, not null)
+//
+// 3. expires_at (timestamp, not null)
+//
+// 4. used_at (timestamp, nullable)
+//    - Set when the token is used or another token of the user is used, a used token is rejected.
+
+const (
+	resetTokensTableName = "password_reset_tokens"
+	resetTokensHash = "token_hash"
+	resetTokensUserID = "user_id"
+	resetTokensExpiresAt = "expires_at"
+	resetTokensUsedAt = "used_at"
+
+	// Amount of random bytes in a reset token
+	resetTokenSize = 32
+)
+
+// HashToken returns hex SHA-256 of token, tokens are stored only in this form
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreatePasswordResetToken issues a new single-use token for userID valid for ttl and returns it in plain form
+func (database *DataBaseProps) CreatePasswordResetToken(userID string, ttl time.Duration) (string, error) {
+	return database.createUserToken(resetTokensTableName, userID, ttl)
+}
+
+// createUserToken stores hash of a new random token in tokenTable and returns the token.
+// tokenTable must have the columns of password_reset_tokens.
+func (database *DataBaseProps) createUserToken(tokenTable string, userID string, ttl time.Duration) (string, error) {
+	if database == nil || database.Connection == nil {
+		return "", fmt.Errorf("database connection is nil")
+	}
+
+	token := GenerateToken(resetTokenSize)
+
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s, %s, %s) VALUES ($1, $2, $3)",
+		tokenTable, resetTokensHash, resetTokensUserID, resetTokensExpiresAt,
+	)
+	if _, err := database.Connection.Exec(query, HashToken(token), userID, time.Now().Add(ttl)); err != nil {
+		return "", fmt.Errorf("token insert error: %v", err)
+	}
+
+	return token, nil
+}
+
+// useUserToken locks open token of tokenTable and marks every open token of its owner used, returning the owner.
+// sql.ErrNoRows is returned for unknown, used and expired tokens.
+func useUserToken(tx *sql.Tx, tokenTable string, token string) (string, error) {
+	var userID string
+
+	lookup := fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s = $1 AND %s IS NULL AND %s > $2 FOR UPDATE",
+		resetTokensUserID, tokenTable, resetTokensHash, resetTokensUsedAt, resetTokensExpiresAt,
+	)
+	if err := tx.QueryRow(lookup, HashToken(token), time.Now()).Scan(&userID); err != nil {
+		if err == sql.ErrNoRows {
+			return "", err
+		}
+		return "", fmt.Errorf("row scan error: %v", err)
+	}
+
+	useAll := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s = $2 AND %s IS NULL", tokenTable, resetTokensUsedAt, resetTokensUserID, resetTokensUsedAt)
+	if _, err := tx.Exec(useAll, time.Now(), userID); err != nil {
+		return "", fmt.Errorf("token update error: %v", err)
+	}
+
+	return userID, nil
+}
+
+// IsPasswordResetTokenValid reports whether token exists, is not used and not expired
+func (database *DataBaseProps) IsPasswordResetTokenValid(token string) (bool, error) {
+	if database == nil || database.Connection == nil {
+		return false, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf(
+		"SELECT 1 FROM %s WHERE %s = $1 AND %s IS NULL AND %s > $2",
+		resetTokensTableName, resetTokensHash, resetTokensUsedAt, resetTokensExpiresAt,
+	)
+
+	var exists int
+	if err := database.Connection.QueryRow(query, HashToken(token), time.Now()).Scan(&exists); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return true, nil
+}
+
+// ResetPasswordWithToken sets new password of the token owner and uses up every open token of the user.
+// Invalid, used and expired tokens give ResetTokenInvalid error. The change is written to the security event log.
+// The password is hashed only after the token was found, so requests with made-up tokens cost no hash.
+func (database *DataBaseProps) ResetPasswordWithToken(token string, password string, ip string, userAgent string) error {
+	return database.inTransaction(func(tx *sql.Tx) error {
+		userID, err := useUserToken(tx, resetTokensTableName, token)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf(ResetTokenInvalid)
+			}
+			return err
+		}
+
+		hashedPassword, err := HashPassword(password)
+		if err != nil {
+			return err
+		}
+
+		// Sessions opened with the old password are logged out too, the reset link has no session to keep
+		if _, err := setPasswordTx(tx, userID, hashedPassword, ""); err != nil {
+			return err
+		}
+
+		return recordSecurityEvent(tx, userID, AuditEventPasswordChanged, "reset link", ip, userAgent)
+	})
+}
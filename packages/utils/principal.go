@@ -0,0 +1,99 @@
+package utils
+
+import "time"
+
+// Ways a session was authenticated, kept in Principal.AuthMethods in the order they were used
+const (
+	AuthMethodPassword     = "password"
+	AuthMethodTOTP         = "totp"
+	AuthMethodRecoveryCode = "recovery_code"
+	AuthMethodPasskey      = "passkey"
+	AuthMethodOIDC         = "oidc" // Single sign-on through the configured identity provider.
+	AuthMethodOAuth        = "oauth" // Bearer access token of an OAuth client, never stored in a session.
+)
+
+// Size of the session id in random bytes
+const sessionIDSize = 16
+
+// Principal is what the session cookie holds about the logged-in user.
+// It has no password hash, email or other account data, handlers read those from the database when needed.
+type Principal struct {
+	ID             string    // users.id
+	Username       string    // For display, updated when the username changes.
+	SessionID      string    // Random id of this login, stays the same while the session lives.
+	AuthTime       time.Time // When the login finished, zero for sessions upgraded from the old cookie format.
+	AuthMethods    []string  // AuthMethod* constants used for this login.
+	SessionVersion int       // users.session_version at login, see accountSettings.go.
+	LastSeen       time.Time // Last time the session was written to user_sessions, see userSessions.go.
+	IssuedAt       time.Time // When this session started, a session restored by remember me starts anew.
+	LastActive     time.Time // Last request of the session, for the idle timeout.
+	VerifiedAt     time.Time // Last time credentials were entered in this session, zero for restored sessions, see RecentlyVerified.
+}
+
+// NewPrincipal starts a new login of user authenticated with methods
+func NewPrincipal(user User, methods ...string) *Principal {
+	now := time.Now()
+	return &Principal{
+		ID:             user.ID,
+		Username:       user.Username,
+		SessionID:      GenerateToken(sessionIDSize),
+		AuthTime:       now,
+		AuthMethods:    methods,
+		SessionVersion: user.SessionVersion,
+		IssuedAt:       now,
+		LastActive:     now,
+		VerifiedAt:     now,
+	}
+}
+
+// PrincipalFromLegacyUser converts a session written before principals existed, when the cookie held the whole User.
+// Auth time and methods are unknown, so they stay empty.
+func PrincipalFromLegacyUser(user *User) *Principal {
+	return &Principal{
+		ID:             user.ID,
+		Username:       user.Username,
+		SessionID:      GenerateToken(sessionIDSize),
+		SessionVersion: user.SessionVersion,
+	}
+}
+
+// PrincipalFromOAuthToken is the principal of a request authenticated by an OAuth access token
+func PrincipalFromOAuthToken(info OAuthTokenInfo) *Principal {
+	return &Principal{
+		ID:             info.UserID,
+		Username:       info.Username,
+		AuthTime:       info.IssuedAt,
+		AuthMethods:    []string{AuthMethodOAuth},
+		SessionVersion: info.SessionVersion,
+	}
+}
+
+// Expired reports whether the session was unused for longer than idle or started more than maxLifetime ago,
+// a zero maxLifetime is no limit. Sessions started before these times were kept are counted from their next request, see Touch.
+func (principal *Principal) Expired(idle time.Duration, maxLifetime time.Duration) bool {
+	if !principal.LastActive.IsZero() && time.Since(principal.LastActive) > idle {
+		return true
+	}
+
+	return maxLifetime > 0 && !principal.IssuedAt.IsZero() && time.Since(principal.IssuedAt) > maxLifetime
+}
+
+// Touch records a request of the session, the caller saves the session
+func (principal *Principal) Touch() {
+	now := time.Now()
+	if principal.IssuedAt.IsZero() {
+		principal.IssuedAt = now
+	}
+	principal.LastActive = now
+}
+
+// RecentlyVerified reports whether credentials were entered in this session less than window ago (sudo mode)
+func (principal *Principal) RecentlyVerified(window time.Duration) bool {
+	return !principal.VerifiedAt.IsZero() && time.Since(principal.VerifiedAt) < window
+}
+
+// Update copies the fields of user that can change during a session
+func (principal *Principal) Update(user User) {
+	principal.Username = user.Username
+	principal.SessionVersion = user.SessionVersion
+}
@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Registration modes, set by REGISTRATION_MODE
+const (
+	RegistrationOpen    = "open"    // Anyone can register.
+	RegistrationInvite  = "invite"  // A valid invite code is needed.
+	RegistrationDomains = "domains" // Addresses of the allowed domains register freely, others need an invite code.
+	RegistrationClosed  = "closed"  // Nobody can register, invite codes included.
+)
+
+// RegistrationPolicy describes who can create an account, see IsValidRegister
+type RegistrationPolicy struct {
+	Mode           string
+	AllowedDomains []string // Lower case domains without "@", used in RegistrationDomains mode.
+}
+
+// DefaultRegistrationPolicy keeps registration open as it was before modes existed
+var DefaultRegistrationPolicy = RegistrationPolicy{Mode: RegistrationOpen}
+
+// currentRegistration is used by IsValidRegister, set by SetRegistrationPolicy
+var currentRegistration = DefaultRegistrationPolicy
+
+// SetRegistrationPolicy changes who can register, called once at start before any request.
+// An unknown mode, or the domains mode without domains, is an error.
+func SetRegistrationPolicy(policy RegistrationPolicy) error {
+	domains := []string{}
+	for _, domain := range policy.AllowedDomains {
+		if domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@")); domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	policy.AllowedDomains = domains
+
+	switch policy.Mode {
+	case RegistrationOpen, RegistrationInvite, RegistrationClosed:
+	case RegistrationDomains:
+		if len(policy.AllowedDomains) == 0 {
+			return fmt.Errorf("registration mode %q needs at least one allowed domain", policy.Mode)
+		}
+	default:
+		return fmt.Errorf("unknown registration mode %q", policy.Mode)
+	}
+
+	currentRegistration = policy
+	return nil
+}
+
+// CurrentRegistrationPolicy returns the policy set at start
+func CurrentRegistrationPolicy() RegistrationPolicy {
+	return currentRegistration
+}
+
+// Closed reports whether nobody can register
+func (policy RegistrationPolicy) Closed() bool {
+	return policy.Mode == RegistrationClosed
+}
+
+// UsesInvites reports whether an invite code can matter, so the form asks for one
+func (policy RegistrationPolicy) UsesInvites() bool {
+	return policy.Mode == RegistrationInvite || policy.Mode == RegistrationDomains
+}
+
+// DomainAllowed reports whether the domain of email is one of AllowedDomains
+func (policy RegistrationPolicy) DomainAllowed(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range policy.AllowedDomains {
+		if domain == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NeedsInvite reports whether registering with email takes an invite code. Invite codes are not used up when not needed.
+func (policy RegistrationPolicy) NeedsInvite(email string) bool {
+	switch policy.Mode {
+	case RegistrationInvite:
+		return true
+	case RegistrationDomains:
+		return !policy.DomainAllowed(email)
+	default:
+		return false
+	}
+}
+
+// AllowsProvisioning reports whether single sign-on may create an account for a provider user with email.
+// There is no invite code at the provider, so only open registration and verified addresses of allowed domains are accepted.
+func (policy RegistrationPolicy) AllowsProvisioning(email string, emailVerified bool) bool {
+	switch policy.Mode {
+	case RegistrationOpen:
+		return true
+	case RegistrationDomains:
+		return emailVerified && policy.DomainAllowed(email)
+	default:
+		return false
+	}
+}
+
+// checkRegistration returns why UserInput may not register under the current policy, nil if it may.
+// The invite code is only checked here, it is used up together with the insert of the user, see CreateNewUserWithInvite.
+func (database *DataBaseProps) checkRegistration(UserInput RegisterForm) error {
+	policy := currentRegistration
+
+	if policy.Closed() {
+		return fmt.Errorf(RegistrationClosedError)
+	}
+
+	if !policy.NeedsInvite(UserInput.Email) {
+		return nil
+	}
+
+	if UserInput.InviteCode == "" {
+		if policy.Mode == RegistrationDomains {
+			return fmt.Errorf(RegistrationDomainError, strings.Join(policy.AllowedDomains, ", "))
+		}
+		return fmt.Errorf(InviteRequired)
+	}
+
+	valid, err := database.IsInviteValid(UserInput.InviteCode)
+	if err != nil {
+		return fmt.Errorf(InternalErrorString)
+	}
+	if !valid {
+		return fmt.Errorf(InviteInvalid)
+	}
+
+	return nil
+}
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Table: remember_tokens
+//
+// Columns:
+// 1. token_hash (string, primary key)
+//    - SHA-256 of the token in the remember me cookie.
+//
+// 2. series_id (string, not null)
+//    - Random id shared by every token of one remembered login, each use of a token rotates it within the series.
+//
+// 3. user_id, session_version (int, not null)
+//    - Tokens of an older session version are refused (password change, logout everywhere).
+//
+// 4. auth_time (timestamp), auth_methods (string)
+//    - Login the series was created by, copied into every session the series restores.
+//
+// 5. ip, user_agent (string)
+//    - Client the token was issued to.
+//
+// 6. created_at, expires_at, used_at (timestamp)
+//    - used_at is set when the token is rotated. A used token presented again means the cookie was copied,
+//      every remembered login of the user is revoked and every session logged out, see UseRememberToken.
+
+const (
+	rememberTokensTableName      = "remember_tokens"
+	rememberTokensHash           = "token_hash"
+	rememberTokensSeriesID       = "series_id"
+	rememberTokensUserID         = "user_id"
+	rememberTokensSessionVersion = "session_version"
+	rememberTokensAuthTime       = "auth_time"
+	rememberTokensAuthMethods    = "auth_methods"
+	rememberTokensIP             = "ip"
+	rememberTokensUserAgent      = "user_agent"
+	rememberTokensCreatedAt      = "created_at"
+	rememberTokensExpiresAt      = "expires_at"
+	rememberTokensUsedAt         = "used_at"
+
+	// Random bytes of remember tokens and series ids
+	rememberTokenSize    = 32
+	rememberSeriesIDSize = 16
+
+	// A rotated token sent again this soon is a parallel request of the same browser, not a copied cookie.
+	// It is refused without revoking anything, the browser has the new token already.
+	rememberReuseGrace = time.Minute
+)
+
+// AuthMethodRemember marks sessions restored from a remember me cookie instead of a login
+const AuthMethodRemember = "remember_me"
+
+// Events stored in audit_log
+const (
+	AuditEventRememberTokenCreated = "remember_token_created"
+	AuditEventRememberTokenReuse   = "remember_token_reuse"
+)
+
+// RememberedLogin is the login a remember me token restores
+type RememberedLogin struct {
+	User        User
+	AuthTime    time.Time // When the user logged in with the credentials below.
+	AuthMethods []string  // AuthMethod* constants of that login.
+}
+
+// CreateRememberToken starts a remembered login of principal valid for ttl, and returns the token for the cookie.
+// Only the hash of the token is stored. Rotations of the token are not logged, only the start of the series.
+func (database *DataBaseProps) CreateRememberToken(principal *Principal, ttl time.Duration, ip string, userAgent string) (string, error) {
+	token := GenerateToken(rememberTokenSize)
+	seriesID := GenerateToken(rememberSeriesIDSize)
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		err := insertRememberToken(tx, token, seriesID, principal.ID, principal.SessionVersion,
+			principal.AuthTime, principal.AuthMethods, ttl, ip, userAgent)
+		if err != nil {
+			return err
+		}
+
+		return recordSecurityEvent(tx, principal.ID, AuditEventRememberTokenCreated, "series "+seriesID, ip, userAgent)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// insertRememberToken stores token as the current token of seriesID
+func insertRememberToken(executor queryExecutor, token string, seriesID string, userID string, version int, authTime time.Time, methods []string, ttl time.Duration, ip string, userAgent string) error {
+	if len(userAgent) > userAgentMaxLength {
+		userAgent = userAgent[:userAgentMaxLength]
+	}
+
+	insert := fmt.Sprintf(
+		"INSERT INTO %s (%s, %s, %s, %s, %s, %s, %s, %s, %s, %s) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)",
+		rememberTokensTableName, rememberTokensHash, rememberTokensSeriesID, rememberTokensUserID, rememberTokensSessionVersion,
+		rememberTokensAuthTime, rememberTokensAuthMethods, rememberTokensIP, rememberTokensUserAgent, rememberTokensCreatedAt, rememberTokensExpiresAt,
+	)
+
+	now := time.Now()
+	_, err := executor.Exec(insert, HashToken(token), seriesID, userID, version, authTime, strings.Join(methods, " "), ip, userAgent, now, now.Add(ttl))
+	if err != nil {
+		return fmt.Errorf("remember token insert error: %v", err)
+	}
+
+	return nil
+}
+
+// UseRememberToken rotates token: it is marked used and a new token of the same series, valid for ttl, is returned
+// with the login it restores.
+// Unknown, expired and outdated tokens and tokens of disabled users give RememberTokenInvalid.
+// A token that was rotated before rememberReuseGrace is theft: every remember token of the user is deleted,
+// the session version is incremented so every session is logged out, and RememberTokenReused is returned.
+func (database *DataBaseProps) UseRememberToken(token string, ttl time.Duration, ip string, userAgent string) (RememberedLogin, string, error) {
+	var (
+		login    RememberedLogin
+		newToken string
+		reused   bool
+	)
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		var (
+			seriesID, userID, methods string
+			version, current          int
+			disabled                  bool
+			expiresAt                 time.Time
+			usedAt                    sql.NullTime
+		)
+
+		query := fmt.Sprintf(
+			`SELECT r.%s, r.%s, r.%s, u.%s, u.%s IS NOT NULL, r.%s, r.%s, r.%s, r.%s FROM %s r
+			JOIN %s u ON u.%s = r.%s
+			WHERE r.%s = $1 FOR UPDATE OF r`,
+			rememberTokensSeriesID, rememberTokensUserID, rememberTokensSessionVersion, usersSessionVersionColumn, usersDisabledAtColumn,
+			rememberTokensAuthTime, rememberTokensAuthMethods, rememberTokensExpiresAt, rememberTokensUsedAt, rememberTokensTableName,
+			tableUsersNaming, usersIDColumn, rememberTokensUserID,
+			rememberTokensHash,
+		)
+		err := tx.QueryRow(query, HashToken(token)).Scan(&seriesID, &userID, &version, &current, &disabled, &login.AuthTime, &methods, &expiresAt, &usedAt)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf(RememberTokenInvalid)
+			}
+			return fmt.Errorf("row scan error: %v", err)
+		}
+
+		if usedAt.Valid {
+			if time.Since(usedAt.Time) < rememberReuseGrace {
+				return fmt.Errorf(RememberTokenInvalid)
+			}
+
+			reused = true
+			if err := deleteRememberTokensTx(tx, userID); err != nil {
+				return err
+			}
+			if err := bumpSessionVersionTx(tx, userID); err != nil {
+				return err
+			}
+			return recordSecurityEvent(tx, userID, AuditEventRememberTokenReuse, "series "+seriesID, ip, userAgent)
+		}
+
+		if disabled || version != current || time.Now().After(expiresAt) {
+			return fmt.Errorf(RememberTokenInvalid)
+		}
+
+		use := fmt.Sprintf("UPDATE %s SET %s = $1 WHERE %s = $2", rememberTokensTableName, rememberTokensUsedAt, rememberTokensHash)
+		if _, err := tx.Exec(use, time.Now(), HashToken(token)); err != nil {
+			return fmt.Errorf("remember token update error: %v", err)
+		}
+
+		// Read before commit, so the token is not rotated when the browser can not get the new one
+		login.User, err = database.FetchUserByID(userID)
+		if err != nil {
+			return err
+		}
+
+		login.AuthMethods = strings.Fields(methods)
+		newToken = GenerateToken(rememberTokenSize)
+		return insertRememberToken(tx, newToken, seriesID, userID, version, login.AuthTime, login.AuthMethods, ttl, ip, userAgent)
+	})
+	if err != nil {
+		return RememberedLogin{}, "", err
+	}
+	if reused {
+		return RememberedLogin{}, "", fmt.Errorf(RememberTokenReused)
+	}
+
+	return login, newToken, nil
+}
+
+// RevokeRememberToken deletes the series of token, used at logout. Unknown tokens are ignored.
+func (database *DataBaseProps) RevokeRememberToken(token string) error {
+	if database == nil || database.Connection == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf(
+		"DELETE FROM %[1]s WHERE %[2]s = (SELECT %[2]s FROM %[1]s WHERE %[3]s = $1)",
+		rememberTokensTableName, rememberTokensSeriesID, rememberTokensHash,
+	)
+	if _, err := database.Connection.Exec(query, HashToken(token)); err != nil {
+		return fmt.Errorf("remember token delete error: %v", err)
+	}
+
+	return nil
+}
+
+// deleteRememberTokensTx deletes every remember token of userID
+func deleteRememberTokensTx(executor queryExecutor, userID string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", rememberTokensTableName, rememberTokensUserID)
+	if _, err := executor.Exec(query, userID); err != nil {
+		return fmt.Errorf("remember token delete error: %v", err)
+	}
+
+	return nil
+}
+
+// PurgeRememberTokens removes tokens that expired before before, returning how many were removed.
+// Used tokens are kept until then, so a copied cookie is still recognized.
+func (database *DataBaseProps) PurgeRememberTokens(before time.Time) (int64, error) {
+	if database == nil || database.Connection == nil {
+		return 0, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s < $1", rememberTokensTableName, rememberTokensExpiresAt)
+	result, err := database.Connection.Exec(query, before)
+	if err != nil {
+		return 0, fmt.Errorf("remember token purge error: %v", err)
+	}
+
+	return result.RowsAffected()
+}
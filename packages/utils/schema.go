@@ -0,0 +1,257 @@
+package utils
+
+import "fmt"
+
+// schemaStatements holds every statement needed to bring the database up to date.
+// Statements must be idempotent (IF NOT EXISTS), because they are executed on every start.
+var schemaStatements = []string{
+	// users and tasks existed before the schema was managed by the application,
+	// they are kept here so a fresh database can be created from scratch.
+	`CREATE TABLE IF NOT EXISTS users (
+		id SERIAL PRIMARY KEY,
+		username VARCHAR(255) NOT NULL UNIQUE,
+		passwordhash VARCHAR(255) NOT NULL,
+		creation_time TIMESTAMP DEFAULT now()
+	)`,
+	`CREATE TABLE IF NOT EXISTS tasks (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		description VARCHAR(255) NOT NULL,
+		is_completed BOOLEAN DEFAULT false,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+
+	// task_events is the append-only activity history of tasks
+	`CREATE TABLE IF NOT EXISTS task_events (
+		id BIGSERIAL PRIMARY KEY,
+		task_id INTEGER NOT NULL,
+		user_id INTEGER NOT NULL,
+		actor_id INTEGER NOT NULL,
+		action VARCHAR(32) NOT NULL,
+		before_state JSONB,
+		after_state JSONB,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS task_events_task_id_idx ON task_events (task_id)`,
+	`CREATE INDEX IF NOT EXISTS task_events_user_id_idx ON task_events (user_id, id)`,
+
+	// change sequences and tombstones for offline sync
+	`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS change_seq BIGINT NOT NULL DEFAULT 0`,
+	`CREATE INDEX IF NOT EXISTS tasks_user_id_change_seq_idx ON tasks (user_id, change_seq)`,
+	`CREATE TABLE IF NOT EXISTS user_change_seq (
+		user_id INTEGER PRIMARY KEY,
+		last_seq BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS task_tombstones (
+		task_id INTEGER PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		change_seq BIGINT NOT NULL,
+		deleted_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS task_tombstones_user_id_idx ON task_tombstones (user_id, change_seq)`,
+
+	// optimistic concurrency
+	`ALTER TABLE tasks ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1`,
+
+	// idempotency keys of task creation
+	`CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id INTEGER NOT NULL,
+		key VARCHAR(255) NOT NULL,
+		request_hash CHAR(64) NOT NULL,
+		status_code INTEGER,
+		response_body JSONB,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, key)
+	)`,
+
+	// password reset
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email VARCHAR(255)`,
+	`CREATE UNIQUE INDEX IF NOT EXISTS users_email_idx ON users (LOWER(email))`,
+	`CREATE TABLE IF NOT EXISTS password_reset_tokens (
+		token_hash CHAR(64) PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS password_reset_tokens_user_id_idx ON password_reset_tokens (user_id)`,
+
+	// email verification
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP`,
+	`CREATE TABLE IF NOT EXISTS email_verification_tokens (
+		token_hash CHAR(64) PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS email_verification_tokens_user_id_idx ON email_verification_tokens (user_id)`,
+
+	// two-factor authentication
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_pending_secret VARCHAR(64)`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_failed_attempts INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_locked_until TIMESTAMP`,
+	`CREATE TABLE IF NOT EXISTS recovery_codes (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		code_hash CHAR(64) NOT NULL,
+		used_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS recovery_codes_user_id_idx ON recovery_codes (user_id)`,
+
+	// passkeys
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS webauthn_handle BYTEA UNIQUE`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS passkey_2fa BOOLEAN NOT NULL DEFAULT false`,
+	`CREATE TABLE IF NOT EXISTS webauthn_credentials (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		credential_id BYTEA NOT NULL UNIQUE,
+		public_key BYTEA NOT NULL,
+		attestation_type VARCHAR(32) NOT NULL DEFAULT '',
+		transports VARCHAR(255) NOT NULL DEFAULT '',
+		aaguid BYTEA,
+		sign_count BIGINT NOT NULL DEFAULT 0,
+		backup_eligible BOOLEAN NOT NULL DEFAULT false,
+		backup_state BOOLEAN NOT NULL DEFAULT false,
+		name VARCHAR(64) NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_used_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS webauthn_credentials_user_id_idx ON webauthn_credentials (user_id)`,
+
+	// brute-force protection
+	`CREATE TABLE IF NOT EXISTS login_attempts (
+		key VARCHAR(320) PRIMARY KEY,
+		failures INTEGER NOT NULL DEFAULT 0,
+		last_failure_at TIMESTAMP NOT NULL,
+		locked_until TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS audit_log (
+		id BIGSERIAL PRIMARY KEY,
+		user_id INTEGER,
+		event VARCHAR(64) NOT NULL,
+		detail TEXT NOT NULL DEFAULT '',
+		ip VARCHAR(64) NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_user_id_idx ON audit_log (user_id, id)`,
+
+	// account settings
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS session_version INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS deletion_scheduled_at TIMESTAMP`,
+
+	// single sign-on
+	`CREATE TABLE IF NOT EXISTS external_identities (
+		id SERIAL PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		issuer VARCHAR(255) NOT NULL,
+		subject VARCHAR(255) NOT NULL,
+		email VARCHAR(255),
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_login_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		UNIQUE (issuer, subject)
+	)`,
+	`CREATE INDEX IF NOT EXISTS external_identities_user_id_idx ON external_identities (user_id)`,
+
+	// OAuth authorization server
+	`CREATE TABLE IF NOT EXISTS oauth_clients (
+		client_id VARCHAR(64) PRIMARY KEY,
+		secret_hash CHAR(64),
+		name VARCHAR(64) NOT NULL,
+		redirect_uris TEXT NOT NULL,
+		owner_id INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS oauth_clients_owner_id_idx ON oauth_clients (owner_id)`,
+	`CREATE TABLE IF NOT EXISTS oauth_codes (
+		code_hash CHAR(64) PRIMARY KEY,
+		grant_id VARCHAR(64) NOT NULL,
+		client_id VARCHAR(64) NOT NULL,
+		user_id INTEGER NOT NULL,
+		redirect_uri TEXT NOT NULL,
+		scope VARCHAR(255) NOT NULL,
+		code_challenge VARCHAR(128) NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP
+	)`,
+	`CREATE TABLE IF NOT EXISTS oauth_tokens (
+		token_hash CHAR(64) PRIMARY KEY,
+		kind VARCHAR(16) NOT NULL,
+		grant_id VARCHAR(64) NOT NULL,
+		client_id VARCHAR(64) NOT NULL,
+		user_id INTEGER NOT NULL,
+		scope VARCHAR(255) NOT NULL,
+		session_version INTEGER NOT NULL,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS oauth_tokens_grant_id_idx ON oauth_tokens (grant_id)`,
+	`CREATE INDEX IF NOT EXISTS oauth_tokens_user_id_idx ON oauth_tokens (user_id, client_id)`,
+
+	// admin console
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS role VARCHAR(16) NOT NULL DEFAULT 'user'`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS disabled_at TIMESTAMP`,
+	`ALTER TABLE users ADD COLUMN IF NOT EXISTS password_reset_required BOOLEAN NOT NULL DEFAULT FALSE`,
+	`CREATE TABLE IF NOT EXISTS user_sessions (
+		session_id VARCHAR(64) PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		ip VARCHAR(64) NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		last_seen_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS user_sessions_user_id_idx ON user_sessions (user_id)`,
+	`CREATE INDEX IF NOT EXISTS user_sessions_last_seen_at_idx ON user_sessions (last_seen_at)`,
+
+	// registration invites
+	`CREATE TABLE IF NOT EXISTS invites (
+		id SERIAL PRIMARY KEY,
+		code_hash CHAR(64) NOT NULL UNIQUE,
+		created_by INTEGER NOT NULL,
+		max_uses INTEGER NOT NULL,
+		uses INTEGER NOT NULL DEFAULT 0,
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS invites_created_by_idx ON invites (created_by)`,
+
+	// remember me
+	`CREATE TABLE IF NOT EXISTS remember_tokens (
+		token_hash CHAR(64) PRIMARY KEY,
+		series_id VARCHAR(64) NOT NULL,
+		user_id INTEGER NOT NULL,
+		session_version INTEGER NOT NULL,
+		auth_time TIMESTAMP NOT NULL,
+		auth_methods TEXT NOT NULL DEFAULT '',
+		ip VARCHAR(64) NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP
+	)`,
+	`CREATE INDEX IF NOT EXISTS remember_tokens_series_id_idx ON remember_tokens (series_id)`,
+	`CREATE INDEX IF NOT EXISTS remember_tokens_user_id_idx ON remember_tokens (user_id)`,
+	`CREATE INDEX IF NOT EXISTS remember_tokens_expires_at_idx ON remember_tokens (expires_at)`,
+
+	// security event log
+	`ALTER TABLE audit_log ADD COLUMN IF NOT EXISTS user_agent TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS audit_log_created_at_idx ON audit_log (created_at)`,
+	`CREATE INDEX IF NOT EXISTS audit_log_event_idx ON audit_log (event, id)`,
+}
+
+// EnsureSchema creates missing tables, columns and indexes, returning the first failing statement error
+func (database *DataBaseProps) EnsureSchema() error {
+	if database == nil || database.Connection == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+
+	for _, statement := range schemaStatements {
+		if _, err := database.Connection.Exec(statement); err != nil {
+			return fmt.Errorf("schema statement error: %v", err)
+		}
+	}
+
+	return nil
+}
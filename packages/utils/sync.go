@@ -0,0 +1,344 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Table: user_change_seq
+//
+// Columns:
+// 1. user_id (int, primary key)
+// 2. last_seq (bigint, not null)
+//    - Last change sequence given to a task write of the user. Grows by one on every write.
+//
+// Table: task_tombstones
+//
+// Columns:
+// 1. task_id (int, primary key)
+// 2. user_id (int, not null)
+// 3. change_seq (bigint, not null)
+//    - Change sequence of the deletion, so clients can tell whether they have already seen it.
+// 4. deleted_at (timestamp, default: current time)
+//
+// Every task also stores change_seq of its last write (tasks.change_seq).
+
+const (
+	changeSeqTableName = "user_change_seq"
+	changeSeqUserID    = "user_id"
+	changeSeqLastSeq   = "last_seq"
+
+	tombstonesTableName = "task_tombstones"
+	tombstonesTaskID    = "task_id"
+	tombstonesUserID    = "user_id"
+	tombstonesChangeSeq = "change_seq"
+)
+
+// Operations of SyncMutation
+const (
+	SyncOpCreate = "create"
+	SyncOpUpdate = "update"
+	SyncOpDelete = "delete"
+)
+
+// Statuses of SyncResult
+const (
+	SyncStatusApplied   = "applied"
+	SyncStatusDuplicate = "duplicate" // Create already applied by an earlier push, Task is the task created then.
+	SyncStatusConflict  = "conflict"
+	SyncStatusRejected  = "rejected"
+)
+
+// Tombstone marks task deleted at change sequence Seq
+type Tombstone struct {
+	TaskID int   `json:"taskId"`
+	Seq    int64 `json:"seq"`
+}
+
+// SyncChanges is everything that changed after the sequence asked by client
+type SyncChanges struct {
+	Seq        int64       `json:"seq"` // pass as since on the next pull
+	Upserts    []Task      `json:"upserts"`
+	Tombstones []Tombstone `json:"tombstones"`
+}
+
+// SyncMutation is a change made by offline client.
+// BaseSeq is the change sequence of the task the client has edited, used for conflict detection.
+type SyncMutation struct {
+	ClientID    string  `json:"clientId"`
+	Op          string  `json:"op"`
+	TaskID      int     `json:"taskId,omitempty"`
+	BaseSeq     int64   `json:"baseSeq"`
+	Description *string `json:"description,omitempty"`
+	IsCompleted *bool   `json:"isCompleted,omitempty"`
+}
+
+// SyncResult is outcome of a single SyncMutation.
+// On conflict Task holds the current server state, or Deleted is set if the task is gone.
+type SyncResult struct {
+	ClientID string `json:"clientId"`
+	Status   string `json:"status"`
+	Task     *Task  `json:"task,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// nextChangeSeq increments and returns change sequence of userID, must be called inside the write transaction
+func nextChangeSeq(tx *sql.Tx, userID string) (int64, error) {
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s, %s) VALUES ($1, 1) ON CONFLICT (%s) DO UPDATE SET %s = %s.%s + 1 RETURNING %s",
+		changeSeqTableName, changeSeqUserID, changeSeqLastSeq, changeSeqUserID, changeSeqLastSeq, changeSeqTableName, changeSeqLastSeq, changeSeqLastSeq,
+	)
+
+	var seq int64
+	if err := tx.QueryRow(query, userID).Scan(&seq); err != nil {
+		return 0, fmt.Errorf("change sequence error: %v", err)
+	}
+
+	return seq, nil
+}
+
+// addTombstone remembers deletion of taskID with the next change sequence of userID
+func addTombstone(tx *sql.Tx, userID string, taskID int) error {
+	seq, err := nextChangeSeq(tx, userID)
+	if err != nil {
+		return err
+	}
+
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s, %s, %s) VALUES ($1, $2, $3) ON CONFLICT (%s) DO UPDATE SET %s = EXCLUDED.%s",
+		tombstonesTableName, tombstonesTaskID, tombstonesUserID, tombstonesChangeSeq, tombstonesTaskID, tombstonesChangeSeq, tombstonesChangeSeq,
+	)
+	if _, err := tx.Exec(query, taskID, userID, seq); err != nil {
+		return fmt.Errorf("tombstone insert error: %v", err)
+	}
+
+	return nil
+}
+
+// isTombstoned reports whether task of userID was deleted
+func isTombstoned(tx *sql.Tx, userID string, taskID int) (bool, error) {
+	query := fmt.Sprintf("SELECT 1 FROM %s WHERE %s = $1 AND %s = $2", tombstonesTableName, tombstonesUserID, tombstonesTaskID)
+
+	var exists int
+	if err := tx.QueryRow(query, userID, taskID).Scan(&exists); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return true, nil
+}
+
+// CurrentChangeSeq returns the last change sequence of userID, 0 if nothing was written yet
+func (database *DataBaseProps) CurrentChangeSeq(userID string) (int64, error) {
+	if database == nil || database.Connection == nil {
+		return 0, fmt.Errorf("database connection is nil")
+	}
+
+	var seq int64
+	if err := database.Connection.QueryRow(currentChangeSeqQuery(), userID).Scan(&seq); err != nil {
+		return 0, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return seq, nil
+}
+
+// currentChangeSeqQuery selects last change sequence of user given in $1
+func currentChangeSeqQuery() string {
+	return fmt.Sprintf("SELECT COALESCE(MAX(%s), 0) FROM %s WHERE %s = $1", changeSeqLastSeq, changeSeqTableName, changeSeqUserID)
+}
+
+// GetChangesSince returns tasks and tombstones of userID written after change sequence since.
+// Everything is read from one snapshot, so returned Seq matches returned rows.
+func (database *DataBaseProps) GetChangesSince(userID string, since int64) (SyncChanges, error) {
+	if database == nil || database.Connection == nil {
+		return SyncChanges{}, fmt.Errorf("database connection is nil")
+	}
+
+	tx, err := database.Connection.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return SyncChanges{}, fmt.Errorf("begin transaction error : %v", err)
+	}
+	defer tx.Rollback()
+
+	changes := SyncChanges{Tombstones: []Tombstone{}}
+
+	if err := tx.QueryRow(currentChangeSeqQuery(), userID).Scan(&changes.Seq); err != nil {
+		return SyncChanges{}, fmt.Errorf("row scan error: %v", err)
+	}
+
+	// Tasks written before sequences existed have change_seq 0, they are only returned on the first pull.
+	// $2 is cast, otherwise Postgres infers int4 from the literal 0 and sequences above 2^31 fail.
+	tasksQuery := fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s = $1 AND ($2::BIGINT = 0 OR %s > $2::BIGINT) ORDER BY %s",
+		taskColumns(), tasksTableName, tasksUserID, tasksChangeSeq, tasksChangeSeq,
+	)
+	rows, err := tx.Query(tasksQuery, userID, since)
+	if err != nil {
+		return SyncChanges{}, fmt.Errorf("row query error : %v", err)
+	}
+	changes.Upserts, err = scanTasks(rows)
+	rows.Close()
+	if err != nil {
+		return SyncChanges{}, err
+	}
+
+	tombstonesQuery := fmt.Sprintf(
+		"SELECT %s, %s FROM %s WHERE %s = $1 AND %s > $2 ORDER BY %s",
+		tombstonesTaskID, tombstonesChangeSeq, tombstonesTableName, tombstonesUserID, tombstonesChangeSeq, tombstonesChangeSeq,
+	)
+	rows, err = tx.Query(tombstonesQuery, userID, since)
+	if err != nil {
+		return SyncChanges{}, fmt.Errorf("row query error : %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var tombstone Tombstone
+		if err := rows.Scan(&tombstone.TaskID, &tombstone.Seq); err != nil {
+			return SyncChanges{}, fmt.Errorf("row scan error: %v", err)
+		}
+		changes.Tombstones = append(changes.Tombstones, tombstone)
+	}
+
+	if err := rows.Err(); err != nil {
+		return SyncChanges{}, fmt.Errorf("rows iteration error: %v", err)
+	}
+
+	return changes, nil
+}
+
+// ApplySyncMutation applies a single client mutation in its own transaction.
+// Update and delete are rejected as conflict when the task was written after BaseSeq.
+// Creates are deduplicated by ClientID for idempotencyWindow, a replayed create is reported as SyncStatusDuplicate.
+// Returned error is only set for server failures, client mistakes are reported in SyncResult.
+func (database *DataBaseProps) ApplySyncMutation(userID string, mutation SyncMutation, idempotencyWindow time.Duration) (SyncResult, error) {
+	result := SyncResult{ClientID: mutation.ClientID}
+
+	reject := func(message string) (SyncResult, error) {
+		result.Status = SyncStatusRejected
+		result.Error = message
+		return result, nil
+	}
+
+	switch mutation.Op {
+	case SyncOpCreate:
+		if mutation.Description == nil {
+			return reject("description is required")
+		}
+	case SyncOpUpdate:
+		if mutation.Description == nil && mutation.IsCompleted == nil {
+			return reject("nothing to update")
+		}
+	case SyncOpDelete:
+	default:
+		return reject(fmt.Sprintf("unknown operation %q", mutation.Op))
+	}
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		if mutation.Op == SyncOpCreate {
+			// Client id is used as idempotency key, so a push retried after a lost response creates nothing new
+			key := "sync:" + mutation.ClientID
+			requestHash := IdempotencyRequestHash("sync-create", *mutation.Description, fmt.Sprint(mutation.IsCompleted != nil && *mutation.IsCompleted))
+			if mutation.ClientID != "" && len(key) <= IdempotencyKeyMaxLength {
+				stored, err := claimIdempotencyKey(tx, userID, key, requestHash, idempotencyWindow)
+				if err != nil {
+					return err
+				}
+
+				if stored != nil {
+					var created Task
+					if err := json.Unmarshal(stored.Body, &created); err != nil {
+						return err
+					}
+
+					result.Status, result.Task = SyncStatusDuplicate, &created
+					return nil
+				}
+			}
+
+			created, err := addTaskTx(tx, userID, TrimSpace(*mutation.Description))
+			if err != nil {
+				return err
+			}
+
+			// Task could be completed offline before it was ever pushed
+			if mutation.IsCompleted != nil && *mutation.IsCompleted {
+				created, err = modifyTaskTx(tx, userID, created, TaskEventComplete, tasksIsCompleted, true)
+				if err != nil {
+					return err
+				}
+			}
+
+			if mutation.ClientID != "" && len(key) <= IdempotencyKeyMaxLength {
+				if err := storeIdempotencyResult(tx, userID, key, http.StatusCreated, created); err != nil {
+					return err
+				}
+			}
+
+			result.Status, result.Task = SyncStatusApplied, &created
+			return nil
+		}
+
+		current, err := getTaskForUpdate(tx, userID, mutation.TaskID)
+		if err != nil {
+			if err.Error() != fmt.Sprintf(TaskNotFound, mutation.TaskID) {
+				return err
+			}
+
+			deleted, err := isTombstoned(tx, userID, mutation.TaskID)
+			if err != nil {
+				return err
+			}
+
+			if deleted {
+				result.Status, result.Deleted = SyncStatusConflict, true
+			} else {
+				result.Status, result.Error = SyncStatusRejected, fmt.Sprintf(TaskNotFound, mutation.TaskID)
+			}
+			return nil
+		}
+
+		if current.ChangeSeq > mutation.BaseSeq {
+			result.Status, result.Task = SyncStatusConflict, &current
+			return nil
+		}
+
+		if mutation.Op == SyncOpDelete {
+			if err := deleteTaskTx(tx, userID, current); err != nil {
+				return err
+			}
+
+			result.Status = SyncStatusApplied
+			return nil
+		}
+
+		if mutation.Description != nil {
+			current, err = modifyTaskTx(tx, userID, current, TaskEventUpdate, tasksDescription, TrimSpace(*mutation.Description))
+			if err != nil {
+				return err
+			}
+		}
+
+		if mutation.IsCompleted != nil {
+			current, err = modifyTaskTx(tx, userID, current, TaskEventComplete, tasksIsCompleted, *mutation.IsCompleted)
+			if err != nil {
+				return err
+			}
+		}
+
+		result.Status, result.Task = SyncStatusApplied, &current
+		return nil
+	})
+	if err != nil {
+		return SyncResult{}, err
+	}
+
+	return result, nil
+}
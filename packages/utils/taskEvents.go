@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Table: task_events
+//
+// Columns:
+// 1. id (bigint, primary key, auto-increment)
+//    - Order of the events, never reused.
+//
+// 2. task_id (int, not null)
+//    - Task the event belongs to. Not a foreign key, so history survives task deletion.
+//
+// 3. user_id (int, not null)
+//    - Owner of the task.
+//
+// 4. actor_id (int, not null)
+//    - User who made the change.
+//
+// 5. action (string, not null)
+//    - One of TaskEventCreate, TaskEventUpdate, TaskEventComplete, TaskEventDelete.
+//
+// 6. before_state, after_state (jsonb)
+//    - Task snapshot before and after the change, NULL when there is no such state.
+//
+// 7. created_at (timestamp, default: current time)
+
+const (
+	taskEventsTableName = "task_events"
+	taskEventsID        = "id"
+	taskEventsTaskID    = "task_id"
+	taskEventsUserID    = "user_id"
+	taskEventsActorID   = "actor_id"
+	taskEventsAction    = "action"
+	taskEventsBefore    = "before_state"
+	taskEventsAfter     = "after_state"
+	taskEventsCreatedAt = "created_at"
+)
+
+// Actions stored in task_events
+const (
+	TaskEventCreate   = "create"
+	TaskEventUpdate   = "update"
+	TaskEventComplete = "complete"
+	TaskEventDelete   = "delete"
+)
+
+// Default amount of events returned by activity feed
+const ActivityFeedLimit = 50
+
+// TaskEvent is single row of task history
+type TaskEvent struct {
+	ID        int64           `json:"id"`
+	TaskID    int             `json:"taskId"`
+	ActorID   string          `json:"actorId"`
+	ActorName string          `json:"actorName"`
+	Action    string          `json:"action"`
+	Before    json.RawMessage `json:"before,omitempty"`
+	After     json.RawMessage `json:"after,omitempty"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+// queryExecutor is implemented by both *sql.DB and *sql.Tx, so helpers can run inside and outside transactions
+type queryExecutor interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// taskSnapshot marshals task for storing in before/after columns, nil task means no state
+func taskSnapshot(task *Task) (any, error) {
+	if task == nil {
+		return nil, nil
+	}
+
+	snapshot, err := json.Marshal(task)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(snapshot), nil
+}
+
+// recordTaskEvent appends event to task history, must be called in the same transaction as the change itself
+func recordTaskEvent(executor queryExecutor, actorID string, action string, taskID int, ownerID string, before, after *Task) error {
+	beforeState, err := taskSnapshot(before)
+	if err != nil {
+		return fmt.Errorf("task snapshot error: %v", err)
+	}
+
+	afterState, err := taskSnapshot(after)
+	if err != nil {
+		return fmt.Errorf("task snapshot error: %v", err)
+	}
+
+	query := fmt.Sprintf(
+		"INSERT INTO %s (%s, %s, %s, %s, %s, %s) VALUES ($1, $2, $3, $4, $5, $6)",
+		taskEventsTableName, taskEventsTaskID, taskEventsUserID, taskEventsActorID, taskEventsAction, taskEventsBefore, taskEventsAfter,
+	)
+	if _, err := executor.Exec(query, taskID, ownerID, actorID, action, beforeState, afterState); err != nil {
+		return fmt.Errorf("task event insert error: %v", err)
+	}
+
+	return nil
+}
+
+// scanTaskEvents reads rows of (id, task_id, actor_id, username, action, before, after, created_at)
+func scanTaskEvents(rows *sql.Rows) ([]TaskEvent, error) {
+	var result []TaskEvent = []TaskEvent{}
+
+	for rows.Next() {
+		var (
+			event  TaskEvent
+			before []byte
+			after  []byte
+		)
+		if err := rows.Scan(&event.ID, &event.TaskID, &event.ActorID, &event.ActorName, &event.Action, &before, &after, &event.CreatedAt); err != nil {
+			return nil, fmt.Errorf("row scan error: %v", err)
+		}
+
+		event.Before = before
+		event.After = after
+		result = append(result, event)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows iteration error: %v", err)
+	}
+
+	return result, nil
+}
+
+// taskEventsSelect returns SELECT part shared by history queries, actor name is joined from users
+func taskEventsSelect() string {
+	return fmt.Sprintf(
+		"SELECT e.%s, e.%s, e.%s, COALESCE(u.%s, ''), e.%s, e.%s, e.%s, e.%s FROM %s e LEFT JOIN %s u ON u.%s = e.%s",
+		taskEventsID, taskEventsTaskID, taskEventsActorID, usersUsernameColumn, taskEventsAction, taskEventsBefore, taskEventsAfter, taskEventsCreatedAt,
+		taskEventsTableName, tableUsersNaming, usersIDColumn, taskEventsActorID,
+	)
+}
+
+// GetTaskEvents returns history of a single task owned by userID, oldest first
+func (database *DataBaseProps) GetTaskEvents(userID string, taskID int) ([]TaskEvent, error) {
+	if database == nil || database.Connection == nil {
+		return nil, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf("%s WHERE e.%s = $1 AND e.%s = $2 ORDER BY e.%s", taskEventsSelect(), taskEventsUserID, taskEventsTaskID, taskEventsID)
+	rows, err := database.Connection.Query(query, userID, taskID)
+	if err != nil {
+		return nil, fmt.Errorf("row query error : %v", err)
+	}
+	defer rows.Close()
+
+	return scanTaskEvents(rows)
+}
+
+// GetUserActivity returns latest events on tasks of userID, newest first.
+// beforeID is used for paging, pass 0 to start from the newest event
+func (database *DataBaseProps) GetUserActivity(userID string, beforeID int64, limit int) ([]TaskEvent, error) {
+	if database == nil || database.Connection == nil {
+		return nil, fmt.Errorf("database connection is nil")
+	}
+
+	if limit <= 0 || limit > ActivityFeedLimit {
+		limit = ActivityFeedLimit
+	}
+
+	// $2 is cast, otherwise Postgres infers int4 from the literal 0 and ids above 2^31 fail
+	query := fmt.Sprintf(
+		"%s WHERE e.%s = $1 AND ($2::BIGINT = 0 OR e.%s < $2::BIGINT) ORDER BY e.%s DESC LIMIT $3",
+		taskEventsSelect(), taskEventsUserID, taskEventsID, taskEventsID,
+	)
+	rows, err := database.Connection.Query(query, userID, beforeID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("row query error : %v", err)
+	}
+	defer rows.Close()
+
+	return scanTaskEvents(rows)
+}
+
+// LatestTaskEventID returns id of the newest event on tasks of userID, used as server version of the task list
+func (database *DataBaseProps) LatestTaskEventID(userID string) (int64, error) {
+	if database == nil || database.Connection == nil {
+		return 0, fmt.Errorf("database connection is nil")
+	}
+
+	var version int64
+	query := fmt.Sprintf("SELECT COALESCE(MAX(%s), 0) FROM %s WHERE %s = $1", taskEventsID, taskEventsTableName, taskEventsUserID)
+	if err := database.Connection.QueryRow(query, userID).Scan(&version); err != nil {
+		return 0, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return version, nil
+}
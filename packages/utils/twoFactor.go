@@ -0,0 +1,392 @@
+package utils
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// Columns of users used by two-factor authentication:
+//
+// 1. totp_secret (string, nullable)
+//    - Base32 secret of confirmed 2FA, NULL means 2FA is off.
+//
+// 2. totp_pending_secret (string, nullable)
+//    - Secret shown on the enrollment page, moved to totp_secret once the user enters a valid code.
+//
+// 3. totp_last_step (bigint, default 0)
+//    - Time step of the last accepted code, so one code can not be used twice.
+//
+// 4. totp_failed_attempts (int, default 0), totp_locked_until (timestamp, nullable)
+//    - Wrong codes in a row, after TwoFactorMaxAttempts the second step is locked for TwoFactorLockTime.
+//
+// Table: recovery_codes
+//
+// 1. id (int, primary key, auto-increment)
+// 2. user_id (int, not null)
+// 3. code_hash (string, not null) - SHA-256 of the normalized code, see HashToken
+// 4. used_at (timestamp, nullable) - set when the code is used, a used code is rejected
+
+const (
+	usersTOTPSecretColumn         = "totp_secret"
+	usersTOTPPendingSecretColumn  = "totp_pending_secret"
+	usersTOTPLastStepColumn       = "totp_last_step"
+	usersTOTPFailedAttemptsColumn = "totp_failed_attempts"
+	usersTOTPLockedUntilColumn    = "totp_locked_until"
+
+	recoveryCodesTableName = "recovery_codes"
+	recoveryCodesUserID    = "user_id"
+	recoveryCodesHash      = "code_hash"
+	recoveryCodesUsedAt    = "used_at"
+
+	// Name shown in authenticator apps
+	TwoFactorIssuer = "TodoWebApp"
+
+	// Codes are valid for one step before and after the current one to allow clock drift
+	totpPeriod = 30
+	totpSkew   = 1
+
+	// Amount of recovery codes issued on enrollment and their length in characters
+	RecoveryCodeCount  = 10
+	recoveryCodeLength = 10
+
+	TwoFactorMaxAttempts = 5
+	TwoFactorLockTime    = 15 * time.Minute
+)
+
+// Events stored in audit_log, the detail names the second factor (totp or passkey)
+const (
+	AuditEventTwoFactorEnabled  = "two_factor_enabled"
+	AuditEventTwoFactorDisabled = "two_factor_disabled"
+)
+
+// recoveryEncoding gives lowercase codes without padding, easy to type
+var recoveryEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// TwoFactorState is shown on the settings page
+type TwoFactorState struct {
+	Enabled           bool
+	PendingKey        *otp.Key // Not nil while enrollment is waiting for confirmation.
+	RecoveryCodesLeft int
+}
+
+// newTOTPKey builds key of secret for account, used to show the QR code of a pending secret again
+func newTOTPKey(account string, secret string) (*otp.Key, error) {
+	label := url.PathEscape(TwoFactorIssuer + ":" + account)
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", TwoFactorIssuer)
+	query.Set("period", fmt.Sprint(totpPeriod))
+	query.Set("digits", "6")
+	query.Set("algorithm", "SHA1")
+
+	return otp.NewKeyFromURL("otpauth://totp/" + label + "?" + query.Encode())
+}
+
+// matchTOTP returns time step of the code if it is valid for secret at now and newer than lastStep, else 0
+func matchTOTP(secret string, code string, lastStep int64, now time.Time) int64 {
+	current := now.Unix() / totpPeriod
+
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totp.ValidateOpts{
+			Period:    totpPeriod,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return 0
+		}
+
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step
+		}
+	}
+
+	return 0
+}
+
+// normalizeRecoveryCode drops separators and case, so "ABCDE-FGHIJ" and "abcdefghij" are the same code
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+// newRecoveryCodes replaces recovery codes of userID with fresh ones and returns them in plain form
+func newRecoveryCodes(tx *sql.Tx, userID string) ([]string, error) {
+	remove := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", recoveryCodesTableName, recoveryCodesUserID)
+	if _, err := tx.Exec(remove, userID); err != nil {
+		return nil, fmt.Errorf("recovery codes delete error: %v", err)
+	}
+
+	insert := fmt.Sprintf("INSERT INTO %s (%s, %s) VALUES ($1, $2)", recoveryCodesTableName, recoveryCodesUserID, recoveryCodesHash)
+	codes := make([]string, 0, RecoveryCodeCount)
+
+	for i := 0; i < RecoveryCodeCount; i++ {
+		code := recoveryEncoding.EncodeToString(GenerateRandomKey(recoveryCodeLength))[:recoveryCodeLength]
+		if _, err := tx.Exec(insert, userID, HashToken(code)); err != nil {
+			return nil, fmt.Errorf("recovery code insert error: %v", err)
+		}
+		codes = append(codes, code[:recoveryCodeLength/2]+"-"+code[recoveryCodeLength/2:])
+	}
+
+	return codes, nil
+}
+
+// GetTwoFactorState returns 2FA status of userID, account is the name put into the QR code
+func (database *DataBaseProps) GetTwoFactorState(userID string, account string) (TwoFactorState, error) {
+	if database == nil || database.Connection == nil {
+		return TwoFactorState{}, fmt.Errorf("database connection is nil")
+	}
+
+	var (
+		state   TwoFactorState
+		pending sql.NullString
+	)
+
+	query := fmt.Sprintf(
+		"SELECT %s IS NOT NULL, %s, (SELECT COUNT(*) FROM %s WHERE %s = $1 AND %s IS NULL) FROM %s WHERE %s = $1",
+		usersTOTPSecretColumn, usersTOTPPendingSecretColumn,
+		recoveryCodesTableName, recoveryCodesUserID, recoveryCodesUsedAt,
+		tableUsersNaming, usersIDColumn,
+	)
+	if err := database.Connection.QueryRow(query, userID).Scan(&state.Enabled, &pending, &state.RecoveryCodesLeft); err != nil {
+		return TwoFactorState{}, fmt.Errorf("row scan error: %v", err)
+	}
+
+	if !state.Enabled && pending.Valid {
+		key, err := newTOTPKey(account, pending.String)
+		if err != nil {
+			return TwoFactorState{}, err
+		}
+		state.PendingKey = key
+	}
+
+	return state, nil
+}
+
+// BeginTwoFactorSetup stores a new pending secret for userID, replacing an unconfirmed one
+func (database *DataBaseProps) BeginTwoFactorSetup(userID string, account string) error {
+	if database == nil || database.Connection == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      TwoFactorIssuer,
+		AccountName: account,
+		Period:      totpPeriod,
+	})
+	if err != nil {
+		return fmt.Errorf("totp generate error: %v", err)
+	}
+
+	update := fmt.Sprintf(
+		"UPDATE %s SET %s = $1 WHERE %s = $2 AND %s IS NULL",
+		tableUsersNaming, usersTOTPPendingSecretColumn, usersIDColumn, usersTOTPSecretColumn,
+	)
+	result, err := database.Connection.Exec(update, key.Secret(), userID)
+	if err != nil {
+		return fmt.Errorf("totp setup error: %v", err)
+	}
+
+	if affected, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("rows affected error: %v", err)
+	} else if affected == 0 {
+		return fmt.Errorf(TwoFactorAlreadyEnabled)
+	}
+
+	return nil
+}
+
+// ConfirmTwoFactor enables 2FA if code matches the pending secret and returns new recovery codes.
+// Wrong codes give TwoFactorCodeInvalid error, missing setup gives TwoFactorNotPending.
+func (database *DataBaseProps) ConfirmTwoFactor(userID string, code string) ([]string, error) {
+	var codes []string
+
+	err := database.inTransaction(func(tx *sql.Tx) error {
+		var pending sql.NullString
+
+		lookup := fmt.Sprintf(
+			"SELECT %s FROM %s WHERE %s = $1 AND %s IS NULL FOR UPDATE",
+			usersTOTPPendingSecretColumn, tableUsersNaming, usersIDColumn, usersTOTPSecretColumn,
+		)
+		if err := tx.QueryRow(lookup, userID).Scan(&pending); err != nil {
+			if err == sql.ErrNoRows {
+				return fmt.Errorf(TwoFactorAlreadyEnabled)
+			}
+			return fmt.Errorf("row scan error: %v", err)
+		}
+
+		if !pending.Valid {
+			return fmt.Errorf(TwoFactorNotPending)
+		}
+
+		step := matchTOTP(pending.String, TrimSpace(code), 0, time.Now())
+		if step == 0 {
+			return fmt.Errorf(TwoFactorCodeInvalid)
+		}
+
+		enable := fmt.Sprintf(
+			"UPDATE %s SET %s = %s, %s = NULL, %s = $1, %s = 0, %s = NULL WHERE %s = $2",
+			tableUsersNaming, usersTOTPSecretColumn, usersTOTPPendingSecretColumn, usersTOTPPendingSecretColumn,
+			usersTOTPLastStepColumn, usersTOTPFailedAttemptsColumn, usersTOTPLockedUntilColumn, usersIDColumn,
+		)
+		if _, err := tx.Exec(enable, step, userID); err != nil {
+			return fmt.Errorf("totp enable error: %v", err)
+		}
+
+		var err error
+		codes, err = newRecoveryCodes(tx, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// VerifySecondFactor checks TOTP or recovery code of userID during login.
+// A recovery code is used up, usedRecovery tells the caller which kind matched.
+// Wrong codes give TwoFactorCodeInvalid, locked accounts give TwoFactorTooManyAttempts.
+func (database *DataBaseProps) VerifySecondFactor(userID string, code string) (usedRecovery bool, err error) {
+	// Wrong attempts are counted outside of the failed transaction, otherwise rollback would forget them
+	var failed bool
+
+	err = database.inTransaction(func(tx *sql.Tx) error {
+		var (
+			secret      sql.NullString
+			lastStep    int64
+			lockedUntil sql.NullTime
+			now         = time.Now()
+		)
+
+		lookup := fmt.Sprintf(
+			"SELECT %s, %s, %s FROM %s WHERE %s = $1 FOR UPDATE",
+			usersTOTPSecretColumn, usersTOTPLastStepColumn, usersTOTPLockedUntilColumn, tableUsersNaming, usersIDColumn,
+		)
+		if err := tx.QueryRow(lookup, userID).Scan(&secret, &lastStep, &lockedUntil); err != nil {
+			return fmt.Errorf("row scan error: %v", err)
+		}
+
+		if lockedUntil.Valid && lockedUntil.Time.After(now) {
+			return fmt.Errorf(TwoFactorTooManyAttempts, int(TwoFactorLockTime.Minutes()))
+		}
+
+		if !secret.Valid {
+			return fmt.Errorf(TwoFactorCodeInvalid)
+		}
+
+		code = TrimSpace(code)
+		if step := matchTOTP(secret.String, code, lastStep, now); step != 0 {
+			update := fmt.Sprintf(
+				"UPDATE %s SET %s = $1, %s = 0, %s = NULL WHERE %s = $2",
+				tableUsersNaming, usersTOTPLastStepColumn, usersTOTPFailedAttemptsColumn, usersTOTPLockedUntilColumn, usersIDColumn,
+			)
+			if _, err := tx.Exec(update, step, userID); err != nil {
+				return fmt.Errorf("totp step update error: %v", err)
+			}
+			return nil
+		}
+
+		useCode := fmt.Sprintf(
+			"UPDATE %s SET %s = $1 WHERE %s = $2 AND %s = $3 AND %s IS NULL",
+			recoveryCodesTableName, recoveryCodesUsedAt, recoveryCodesUserID, recoveryCodesHash, recoveryCodesUsedAt,
+		)
+		result, err := tx.Exec(useCode, now, userID, HashToken(normalizeRecoveryCode(code)))
+		if err != nil {
+			return fmt.Errorf("recovery code update error: %v", err)
+		}
+
+		if affected, err := result.RowsAffected(); err != nil {
+			return fmt.Errorf("rows affected error: %v", err)
+		} else if affected == 0 {
+			failed = true
+			return fmt.Errorf(TwoFactorCodeInvalid)
+		}
+
+		reset := fmt.Sprintf("UPDATE %s SET %s = 0, %s = NULL WHERE %s = $1", tableUsersNaming, usersTOTPFailedAttemptsColumn, usersTOTPLockedUntilColumn, usersIDColumn)
+		if _, err := tx.Exec(reset, userID); err != nil {
+			return fmt.Errorf("totp attempts update error: %v", err)
+		}
+
+		usedRecovery = true
+		return nil
+	})
+
+	if failed {
+		if countErr := database.countTwoFactorFailure(userID); countErr != nil {
+			return false, countErr
+		}
+	}
+
+	return usedRecovery, err
+}
+
+// countTwoFactorFailure adds a wrong attempt and locks the second step once TwoFactorMaxAttempts is reached
+func (database *DataBaseProps) countTwoFactorFailure(userID string) error {
+	update := fmt.Sprintf(
+		`UPDATE %[1]s SET
+			%[2]s = CASE WHEN %[2]s + 1 >= $1 THEN 0 ELSE %[2]s + 1 END,
+			%[3]s = CASE WHEN %[2]s + 1 >= $1 THEN $2::timestamp ELSE %[3]s END
+		WHERE %[4]s = $3`,
+		tableUsersNaming, usersTOTPFailedAttemptsColumn, usersTOTPLockedUntilColumn, usersIDColumn,
+	)
+	if _, err := database.Connection.Exec(update, TwoFactorMaxAttempts, time.Now().Add(TwoFactorLockTime), userID); err != nil {
+		return fmt.Errorf("totp attempts update error: %v", err)
+	}
+
+	return nil
+}
+
+// DisableTwoFactor turns 2FA off for userID and removes its recovery codes, password must be checked by the caller
+func (database *DataBaseProps) DisableTwoFactor(userID string) error {
+	return database.inTransaction(func(tx *sql.Tx) error {
+		update := fmt.Sprintf(
+			"UPDATE %s SET %s = NULL, %s = NULL, %s = 0, %s = 0, %s = NULL WHERE %s = $1",
+			tableUsersNaming, usersTOTPSecretColumn, usersTOTPPendingSecretColumn, usersTOTPLastStepColumn,
+			usersTOTPFailedAttemptsColumn, usersTOTPLockedUntilColumn, usersIDColumn,
+		)
+		if _, err := tx.Exec(update, userID); err != nil {
+			return fmt.Errorf("totp disable error: %v", err)
+		}
+
+		remove := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", recoveryCodesTableName, recoveryCodesUserID)
+		if _, err := tx.Exec(remove, userID); err != nil {
+			return fmt.Errorf("recovery codes delete error: %v", err)
+		}
+
+		return nil
+	})
+}
+
+// PendingLogin is kept in the session between the password step and the code step of login
+type PendingLogin struct {
+	UserID    string
+	ExpiresAt time.Time
+	Remember  bool // "Remember me" was ticked on the login form.
+}
+
+// How long the user has to enter the code after the password was accepted
+const PendingLoginTTL = 5 * time.Minute
+
+// NewPendingLogin starts the code step for userID, remember is kept for the session started after it
+func NewPendingLogin(userID string, remember bool) *PendingLogin {
+	return &PendingLogin{UserID: userID, ExpiresAt: time.Now().Add(PendingLoginTTL), Remember: remember}
+}
+
+// Expired reports whether the code step took too long and the password has to be entered again
+func (pending *PendingLogin) Expired() bool {
+	return time.Now().After(pending.ExpiresAt)
+}
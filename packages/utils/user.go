@@ -14,6 +14,27 @@ package utils
 //
 // 4. creation_time (time.Time, default: current time via now())
 //    - This column stores the timestamp when the account was created, with a default value of the current time.
+//
+// 5. email (string, nullable, unique)
+//    - Optional address used for password reset. Required for accounts registered after email verification was added.
+//
+// 6. email_verified_at (time.Time, nullable)
+//    - Set when the user opens the verification link.
+//
+// 7. totp_* columns
+//    - Two-factor authentication state, see twoFactor.go.
+//
+// 8. webauthn_handle, passkey_2fa
+//    - Passkey state, see passkeys.go.
+//
+// 9. session_version (int, not null, default 0)
+//    - Incremented on password change, see accountSettings.go.
+//
+// 10. deletion_scheduled_at (timestamp, nullable)
+//    - Account deletion after the grace period, see accountData.go.
+//
+// 11. role, disabled_at, password_reset_required
+//    - Set from the admin console, see admin.go.
 
 const (
 	tableUsersNaming = "users"
@@ -21,6 +42,7 @@ const (
 	usersUsernameColumn = "username"
 	usersPasswordHashColumn = "passwordhash"
 	usersCreationTimeColumn = "creation_time"
+	usersEmailColumn = "email"
 )
 
 // Used for gob register and cookies, creationTime field is not used, in future I want to use them in tasks displaying
@@ -28,5 +50,23 @@ type User struct {
 	Username string
 	PasswordHash string
 	ID string
+	Email string
+	EmailVerified bool
+	TwoFactorEnabled bool // TOTP or passkey is asked after the password
+	SessionVersion int // Sessions with an older version were opened before the last password change
+	Role string // RoleUser or RoleAdmin
+	Disabled bool // Disabled by an admin, every login is refused
+	PasswordResetRequired bool // An admin asked for a new password, the current one is refused at login
 	creationTime string
+}
+
+// IsAdmin reports whether user can open the admin console
+func (user User) IsAdmin() bool {
+	return user.Role == RoleAdmin
+}
+
+// NeedsEmailVerification reports whether user has an address that was not verified yet.
+// Accounts created before emails existed have no address and are never asked to verify.
+func (user User) NeedsEmailVerification() bool {
+	return user.Email != "" && !user.EmailVerified
 }
\ No newline at end of file
@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+// Table: user_sessions
+//
+// Columns:
+// 1. session_id (string, primary key)
+//    - Principal.SessionID of a logged-in browser session.
+//
+// 2. user_id (int, not null)
+//
+// 3. ip, user_agent (string)
+//    - Client of the last recorded request.
+//
+// 4. created_at, last_seen_at (timestamp)
+//    - last_seen_at is written at most once per UserSessionTouchInterval, see middleware.Auth.
+//
+// Sessions live in the cookie, so this table is only a record of them: a row is not needed to stay logged in,
+// and deleting it does not log anyone out (session_version does that). It is used to count active sessions,
+// and event streams and WebSockets, which stay open after the request that authorized them, close when the
+// row of their session is gone (see SessionActive).
+
+const (
+	userSessionsTableName = "user_sessions"
+	userSessionsID        = "session_id"
+	userSessionsUserID    = "user_id"
+	userSessionsIP        = "ip"
+	userSessionsUserAgent = "user_agent"
+	userSessionsLastSeen  = "last_seen_at"
+
+	// Longest user agent kept, browsers send a few hundred characters
+	userAgentMaxLength = 512
+)
+
+// How often a request of a session updates its row, so not every request writes to the database
+const UserSessionTouchInterval = time.Minute
+
+// How often long-lived connections check that their session is still valid, see SessionActive
+const SessionRecheckInterval = time.Minute
+
+// TouchUserSession records that sessionID of userID was used now from ip with userAgent
+func (database *DataBaseProps) TouchUserSession(sessionID string, userID string, ip string, userAgent string) error {
+	if database == nil || database.Connection == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+
+	if len(userAgent) > userAgentMaxLength {
+		userAgent = userAgent[:userAgentMaxLength]
+	}
+
+	query := fmt.Sprintf(
+		`INSERT INTO %[1]s (%[2]s, %[3]s, %[4]s, %[5]s, %[6]s) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (%[2]s) DO UPDATE SET %[4]s = EXCLUDED.%[4]s, %[5]s = EXCLUDED.%[5]s, %[6]s = EXCLUDED.%[6]s`,
+		userSessionsTableName, userSessionsID, userSessionsUserID, userSessionsIP, userSessionsUserAgent, userSessionsLastSeen,
+	)
+	if _, err := database.Connection.Exec(query, sessionID, userID, ip, userAgent, time.Now()); err != nil {
+		return fmt.Errorf("user session update error: %v", err)
+	}
+
+	return nil
+}
+
+// EndUserSession removes the row of sessionID, used at logout
+func (database *DataBaseProps) EndUserSession(sessionID string) error {
+	if database == nil || database.Connection == nil {
+		return fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", userSessionsTableName, userSessionsID)
+	if _, err := database.Connection.Exec(query, sessionID); err != nil {
+		return fmt.Errorf("user session delete error: %v", err)
+	}
+
+	return nil
+}
+
+// endUserSessionsTx removes every row of userID, used when the session version is incremented
+func endUserSessionsTx(executor queryExecutor, userID string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s = $1", userSessionsTableName, userSessionsUserID)
+	if _, err := executor.Exec(query, userID); err != nil {
+		return fmt.Errorf("user session delete error: %v", err)
+	}
+
+	return nil
+}
+
+// endOtherUserSessionsTx removes every row of userID except keepSessionID, used when the session version is
+// incremented for the current session too and the session goes on with the new version. An empty keepSessionID removes all.
+func endOtherUserSessionsTx(executor queryExecutor, userID string, keepSessionID string) error {
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s = $1 AND %s <> $2", userSessionsTableName, userSessionsUserID, userSessionsID)
+	if _, err := executor.Exec(query, userID, keepSessionID); err != nil {
+		return fmt.Errorf("user session delete error: %v", err)
+	}
+
+	return nil
+}
+
+// PurgeUserSessions removes rows not used since before, returning how many were removed
+func (database *DataBaseProps) PurgeUserSessions(before time.Time) (int64, error) {
+	if database == nil || database.Connection == nil {
+		return 0, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf("DELETE FROM %s WHERE %s < $1", userSessionsTableName, userSessionsLastSeen)
+	result, err := database.Connection.Exec(query, before)
+	if err != nil {
+		return 0, fmt.Errorf("user session purge error: %v", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// SessionActive reports whether sessionID of userID with session version may still be used:
+// the account exists and is not disabled, the version is current (no password change, no logout everywhere)
+// and the session was not ended by logout. middleware.Auth records the row before any handler runs.
+func (database *DataBaseProps) SessionActive(userID string, sessionID string, version int) (bool, error) {
+	if database == nil || database.Connection == nil {
+		return false, fmt.Errorf("database connection is nil")
+	}
+
+	query := fmt.Sprintf(
+		`SELECT COUNT(*) FROM %s u JOIN %s s ON s.%s = u.%s
+		WHERE u.%s = $1 AND s.%s = $2 AND u.%s = $3 AND u.%s IS NULL`,
+		tableUsersNaming, userSessionsTableName, userSessionsUserID, usersIDColumn,
+		usersIDColumn, userSessionsID, usersSessionVersionColumn, usersDisabledAtColumn,
+	)
+
+	var count int
+	if err := database.Connection.QueryRow(query, userID, sessionID, version).Scan(&count); err != nil {
+		return false, fmt.Errorf("row scan error: %v", err)
+	}
+
+	return count > 0, nil
+}
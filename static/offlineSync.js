@@ -0,0 +1,289 @@
+// Offline support for the task page.
+// Tasks are mirrored to IndexedDB and kept up to date with /api/v1/sync.
+// While offline, add/complete/delete forms are applied locally and queued in the outbox,
+// the outbox is pushed as soon as the browser is online again.
+(function() {
+    var DB_NAME = "todoweb";
+    var DB_VERSION = 1;
+    var SYNC_URL = "/api/v1/sync";
+    var dbPromise = null;
+    var syncing = false;
+
+    if ("serviceWorker" in navigator) {
+        navigator.serviceWorker.register("/sw.js");
+    }
+
+    if (!window.indexedDB) {
+        return;
+    }
+
+    // Stores: tasks (by taskId), outbox (queued mutations), meta (last seen change sequence)
+    function openDB() {
+        if (!dbPromise) {
+            dbPromise = new Promise(function(resolve, reject) {
+                var request = indexedDB.open(DB_NAME, DB_VERSION);
+                request.onupgradeneeded = function() {
+                    var db = request.result;
+                    db.createObjectStore("tasks", { keyPath: "taskId" });
+                    db.createObjectStore("outbox", { keyPath: "clientId" });
+                    db.createObjectStore("meta");
+                };
+                request.onsuccess = function() { resolve(request.result); };
+                request.onerror = function() { reject(request.error); };
+            });
+        }
+        return dbPromise;
+    }
+
+    // Runs fn(stores...) in one transaction, resolves when the transaction completes
+    function withStores(names, mode, fn) {
+        return openDB().then(function(db) {
+            return new Promise(function(resolve, reject) {
+                var tx = db.transaction(names, mode);
+                var result = fn.apply(null, names.map(function(name) { return tx.objectStore(name); }));
+                tx.oncomplete = function() { resolve(result); };
+                tx.onerror = function() { reject(tx.error); };
+            });
+        });
+    }
+
+    function getAll(store) {
+        return withStores([store], "readonly", function(s) {
+            var holder = {};
+            s.getAll().onsuccess = function(ev) { holder.value = ev.target.result; };
+            return holder;
+        }).then(function(holder) { return holder.value || []; });
+    }
+
+    function getSeq() {
+        return withStores(["meta"], "readonly", function(meta) {
+            var holder = {};
+            meta.get("seq").onsuccess = function(ev) { holder.value = ev.target.result; };
+            return holder;
+        }).then(function(holder) { return holder.value || 0; });
+    }
+
+    function clientId() {
+        return Date.now().toString(36) + "-" + Math.random().toString(36).slice(2);
+    }
+
+    function isLocal(taskId) {
+        return String(taskId).indexOf("local-") === 0;
+    }
+
+    // Pull changes after the last seen sequence and apply them to IndexedDB and the page
+    function pull() {
+        return getSeq().then(function(seq) {
+            return fetch(SYNC_URL + "?since=" + seq, { credentials: "same-origin" });
+        }).then(function(response) {
+            if (!response.ok) {
+                throw new Error("pull failed: " + response.status);
+            }
+            return response.json();
+        }).then(function(changes) {
+            return withStores(["tasks", "meta"], "readwrite", function(tasks, meta) {
+                changes.upserts.forEach(function(task) { tasks.put(task); });
+                changes.tombstones.forEach(function(tombstone) { tasks.delete(String(tombstone.taskId)); });
+                meta.put(changes.seq, "seq");
+            }).then(function() {
+                if (window.TaskList) {
+                    changes.upserts.forEach(window.TaskList.upsert);
+                    changes.tombstones.forEach(function(tombstone) { window.TaskList.remove(tombstone.taskId); });
+                }
+            });
+        });
+    }
+
+    // Push queued mutations, then replace local tasks with what the server stored
+    function push() {
+        return getAll("outbox").then(function(outbox) {
+            if (outbox.length === 0) {
+                return;
+            }
+
+            outbox.sort(function(a, b) { return a.queuedAt - b.queuedAt; });
+            var mutations = outbox.map(function(entry) { return entry.mutation; });
+
+            var csrfMeta = document.querySelector("meta[name=csrf-token]");
+
+            return fetch(SYNC_URL, {
+                method: "POST",
+                credentials: "same-origin",
+                headers: { "Content-Type": "application/json", "X-CSRF-Token": csrfMeta ? csrfMeta.content : "" },
+                body: JSON.stringify({ mutations: mutations })
+            }).then(function(response) {
+                if (!response.ok) {
+                    throw new Error("push failed: " + response.status);
+                }
+                return response.json();
+            }).then(function(body) {
+                var conflicts = 0;
+
+                return withStores(["tasks", "outbox"], "readwrite", function(tasks, queue) {
+                    body.results.forEach(function(result, index) {
+                        var entry = outbox[index];
+                        queue.delete(result.clientId);
+
+                        if (entry.localId) {
+                            tasks.delete(entry.localId);
+                            if (window.TaskList) {
+                                window.TaskList.remove(entry.localId);
+                            }
+                        }
+
+                        if (result.status === "conflict") {
+                            conflicts++;
+                        }
+
+                        // Server state wins on conflict as well
+                        if (result.task) {
+                            tasks.put(result.task);
+                            if (window.TaskList) {
+                                window.TaskList.upsert(result.task);
+                            }
+                        } else if (result.deleted || entry.mutation.op === "delete") {
+                            tasks.delete(String(entry.mutation.taskId));
+                            if (window.TaskList) {
+                                window.TaskList.remove(entry.mutation.taskId);
+                            }
+                        }
+                    });
+                }).then(function() {
+                    if (conflicts > 0) {
+                        alert(conflicts + " offline change(s) were discarded because the task was changed elsewhere.");
+                    }
+                });
+            });
+        });
+    }
+
+    function sync() {
+        if (syncing || !navigator.onLine) {
+            return Promise.resolve();
+        }
+        syncing = true;
+        return push().then(pull).catch(function(err) {
+            console.warn("sync error", err);
+        }).then(function() {
+            syncing = false;
+        });
+    }
+
+    // Queue mutation and apply it to the local copy.
+    // The outbox holds at most one entry per task (keyed by task), so several offline changes
+    // of the same task are folded into one mutation with the original baseSeq.
+    function queue(mutation, localTask) {
+        var key = isLocal(localTask.taskId) ? String(localTask.taskId) : "task-" + localTask.taskId;
+        mutation.clientId = key;
+
+        return withStores(["tasks", "outbox"], "readwrite", function(tasks, outbox) {
+            outbox.get(key).onsuccess = function(ev) {
+                var entry = ev.target.result;
+
+                if (!entry) {
+                    entry = { clientId: key, queuedAt: Date.now(), mutation: mutation };
+                    if (mutation.op === "create") {
+                        entry.localId = localTask.taskId;
+                    }
+                } else if (mutation.op === "delete") {
+                    if (entry.mutation.op === "create") {
+                        // Never reached the server, nothing to delete there
+                        outbox.delete(key);
+                        return;
+                    }
+                    entry.mutation = { clientId: key, op: "delete", taskId: entry.mutation.taskId, baseSeq: entry.mutation.baseSeq };
+                } else if (mutation.isCompleted !== undefined) {
+                    entry.mutation.isCompleted = mutation.isCompleted;
+                }
+
+                outbox.put(entry);
+            };
+
+            if (mutation.op === "delete") {
+                tasks.delete(String(localTask.taskId));
+            } else {
+                tasks.put(localTask);
+            }
+        }).then(function() {
+            if (!window.TaskList) {
+                return;
+            }
+            if (mutation.op === "delete") {
+                window.TaskList.remove(localTask.taskId);
+            } else {
+                window.TaskList.upsert(localTask);
+            }
+        });
+    }
+
+    function findLocalTask(taskId) {
+        return withStores(["tasks"], "readonly", function(tasks) {
+            var holder = {};
+            tasks.get(String(taskId)).onsuccess = function(ev) { holder.value = ev.target.result; };
+            return holder;
+        }).then(function(holder) { return holder.value; });
+    }
+
+    // Forms keep working normally online, offline they are turned into queued mutations
+    function onSubmit(ev) {
+        var form = ev.target;
+        var action = form.getAttribute("action");
+
+        if (action === "/user/logout") {
+            // Do not leave tasks of this user on the device
+            indexedDB.deleteDatabase(DB_NAME);
+            if (window.caches) {
+                caches.keys().then(function(keys) { keys.forEach(function(key) { caches.delete(key); }); });
+            }
+            return;
+        }
+
+        if (navigator.onLine) {
+            return;
+        }
+
+        var data = new FormData(form);
+
+        if (action === "/user/addTask") {
+            ev.preventDefault();
+            var description = (data.get("taskTitle") || "").trim();
+            var localTask = { taskId: "local-" + clientId(), description: description, isCompleted: false, changeSeq: 0 };
+            queue({ op: "create", description: description }, localTask);
+            form.reset();
+        } else if (action === "/user/completeTask" || action === "/user/deleteTask") {
+            ev.preventDefault();
+            var taskId = data.get("TaskID");
+            findLocalTask(taskId).then(function(task) {
+                if (!task) {
+                    return;
+                }
+                var mutation = { taskId: Number(taskId), baseSeq: task.changeSeq };
+                if (action === "/user/deleteTask") {
+                    mutation.op = "delete";
+                } else {
+                    mutation.op = "update";
+                    mutation.isCompleted = data.get("completed") === "true";
+                    task.isCompleted = mutation.isCompleted;
+                }
+                return queue(mutation, task);
+            });
+        }
+    }
+
+    document.addEventListener("DOMContentLoaded", function() {
+        document.addEventListener("submit", onSubmit, true);
+        window.addEventListener("online", sync);
+
+        if (navigator.onLine) {
+            sync();
+            return;
+        }
+
+        // Page came from the service worker cache, show the local copy instead
+        getAll("tasks").then(function(tasks) {
+            if (window.TaskList) {
+                window.TaskList.replaceAll(tasks);
+            }
+        });
+    });
+})();
@@ -0,0 +1,152 @@
+// Passkey ceremonies: fetch options from the server, call navigator.credentials and post the result back.
+// Binary fields travel as base64url strings, both in the options and in the result.
+(function () {
+    // base64url string to ArrayBuffer
+    function decode(value) {
+        var base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+        while (base64.length % 4) {
+            base64 += '=';
+        }
+        var binary = atob(base64);
+        var bytes = new Uint8Array(binary.length);
+        for (var i = 0; i < binary.length; i++) {
+            bytes[i] = binary.charCodeAt(i);
+        }
+        return bytes.buffer;
+    }
+
+    // ArrayBuffer to base64url string
+    function encode(buffer) {
+        if (!buffer) {
+            return undefined;
+        }
+        var bytes = new Uint8Array(buffer);
+        var binary = '';
+        for (var i = 0; i < bytes.length; i++) {
+            binary += String.fromCharCode(bytes[i]);
+        }
+        return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+    }
+
+    function decodeDescriptors(list) {
+        return (list || []).map(function (descriptor) {
+            return Object.assign({}, descriptor, { id: decode(descriptor.id) });
+        });
+    }
+
+    // csrfToken reads the token the page was rendered with, the server checks it on every POST
+    function csrfToken() {
+        var meta = document.querySelector('meta[name=csrf-token]');
+        return meta ? meta.content : '';
+    }
+
+    // postJSON sends body and rejects with the server error message
+    function postJSON(url, body) {
+        return fetch(url, {
+            method: 'POST',
+            credentials: 'same-origin',
+            headers: { 'Content-Type': 'application/json', 'X-CSRF-Token': csrfToken() },
+            body: body === undefined ? undefined : JSON.stringify(body)
+        }).then(function (response) {
+            return response.json().then(function (data) {
+                if (!response.ok) {
+                    // Sensitive changes ask for the password first, see middleware.RequireRecentAuth
+                    if (response.status === 403 && data.redirect) {
+                        window.location.href = data.redirect;
+                    }
+                    throw new Error(data.error || response.statusText);
+                }
+                return data;
+            });
+        });
+    }
+
+    // register creates a new passkey of the logged in user
+    function register(name) {
+        return postJSON('/user/passkeys/register/begin').then(function (options) {
+            var publicKey = options.publicKey;
+            publicKey.challenge = decode(publicKey.challenge);
+            publicKey.user.id = decode(publicKey.user.id);
+            publicKey.excludeCredentials = decodeDescriptors(publicKey.excludeCredentials);
+            return navigator.credentials.create({ publicKey: publicKey });
+        }).then(function (credential) {
+            return postJSON('/user/passkeys/register/finish?name=' + encodeURIComponent(name || ''), {
+                id: credential.id,
+                rawId: encode(credential.rawId),
+                type: credential.type,
+                response: {
+                    attestationObject: encode(credential.response.attestationObject),
+                    clientDataJSON: encode(credential.response.clientDataJSON),
+                    transports: credential.response.getTransports ? credential.response.getTransports() : []
+                }
+            });
+        });
+    }
+
+    // authenticate runs a login ceremony against begin/finish urls and follows the redirect of the answer
+    function authenticate(beginURL, finishURL) {
+        return postJSON(beginURL).then(function (options) {
+            var publicKey = options.publicKey;
+            publicKey.challenge = decode(publicKey.challenge);
+            publicKey.allowCredentials = decodeDescriptors(publicKey.allowCredentials);
+            return navigator.credentials.get({ publicKey: publicKey });
+        }).then(function (credential) {
+            return postJSON(finishURL, {
+                id: credential.id,
+                rawId: encode(credential.rawId),
+                type: credential.type,
+                response: {
+                    authenticatorData: encode(credential.response.authenticatorData),
+                    clientDataJSON: encode(credential.response.clientDataJSON),
+                    signature: encode(credential.response.signature),
+                    userHandle: encode(credential.response.userHandle)
+                }
+            });
+        }).then(function (data) {
+            window.location.href = data.redirect;
+        });
+    }
+
+    // showError puts message into the element with id passkeyError
+    function showError(error) {
+        var target = document.getElementById('passkeyError');
+        if (target) {
+            target.textContent = error.message;
+            target.hidden = false;
+        }
+    }
+
+    document.addEventListener('DOMContentLoaded', function () {
+        var supported = !!window.PublicKeyCredential;
+
+        document.querySelectorAll('[data-passkey]').forEach(function (button) {
+            if (!supported) {
+                button.disabled = true;
+                button.title = 'This browser does not support passkeys';
+                return;
+            }
+
+            button.addEventListener('click', function (event) {
+                event.preventDefault();
+
+                var action = button.getAttribute('data-passkey');
+                var result;
+                if (action === 'register') {
+                    var input = document.getElementById('passkeyName');
+                    result = register(input ? input.value : '').then(function () {
+                        window.location.reload();
+                    });
+                } else if (action === 'login') {
+                    var remember = document.getElementById('remember');
+                    result = authenticate('/login/passkey/begin', '/login/passkey/finish' + (remember && remember.checked ? '?remember=1' : ''));
+                } else if (action === 'second-step') {
+                    result = authenticate('/login/2fa/passkey/begin', '/login/2fa/passkey/finish');
+                }
+
+                if (result) {
+                    result.catch(showError);
+                }
+            });
+        });
+    });
+})();
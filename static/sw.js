@@ -0,0 +1,78 @@
+// Service worker keeping the task page and static files available offline.
+// Task data itself is kept in IndexedDB by offlineSync.js.
+var CACHE_NAME = "todoweb-v3";
+var PRECACHE = [
+    "/user/tasks",
+    "/static/todoStyle.css",
+    "/static/taskEvents.js",
+    "/static/offlineSync.js"
+];
+
+self.addEventListener("install", function(event) {
+    event.waitUntil(
+        caches.open(CACHE_NAME).then(function(cache) {
+            // The task page needs a session, so failing to cache it must not break the install
+            return Promise.all(PRECACHE.map(function(url) {
+                return cache.add(url).catch(function() {});
+            }));
+        }).then(function() {
+            return self.skipWaiting();
+        })
+    );
+});
+
+self.addEventListener("activate", function(event) {
+    event.waitUntil(
+        caches.keys().then(function(keys) {
+            return Promise.all(keys.filter(function(key) {
+                return key !== CACHE_NAME;
+            }).map(function(key) {
+                return caches.delete(key);
+            }));
+        }).then(function() {
+            return self.clients.claim();
+        })
+    );
+});
+
+self.addEventListener("fetch", function(event) {
+    var request = event.request;
+    var url = new URL(request.url);
+
+    if (request.method !== "GET" || url.origin !== self.location.origin) {
+        return;
+    }
+
+    // Static files: cache first
+    if (url.pathname.indexOf("/static/") === 0) {
+        event.respondWith(
+            caches.match(request).then(function(cached) {
+                return cached || fetch(request).then(function(response) {
+                    var copy = response.clone();
+                    caches.open(CACHE_NAME).then(function(cache) {
+                        cache.put(request, copy);
+                    });
+                    return response;
+                });
+            })
+        );
+        return;
+    }
+
+    // Task page: network first, the last good copy is used offline
+    if (url.pathname === "/user/tasks") {
+        event.respondWith(
+            fetch(request).then(function(response) {
+                if (response.ok && !response.redirected) {
+                    var copy = response.clone();
+                    caches.open(CACHE_NAME).then(function(cache) {
+                        cache.put("/user/tasks", copy);
+                    });
+                }
+                return response;
+            }).catch(function() {
+                return caches.match("/user/tasks");
+            })
+        );
+    }
+});
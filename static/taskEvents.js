@@ -0,0 +1,151 @@
+// Keeps the task list in sync with changes made in other tabs or by other clients.
+// The server sends Server-Sent Events from /user/events, see packages/handlers/stream.
+document.addEventListener("DOMContentLoaded", function() {
+    var list = document.getElementById("myUL");
+    var noTasks = document.getElementById("noTasks");
+    if (!list) {
+        return;
+    }
+
+    // Forms built here need the same CSRF token as the ones rendered by the server
+    var csrfMeta = document.querySelector("meta[name=csrf-token]");
+    var csrfToken = csrfMeta ? csrfMeta.content : "";
+
+    // Builds the same markup as the range in todoMain.html
+    function renderTask(task) {
+        var li = document.createElement("li");
+        li.dataset.taskId = task.taskId;
+
+        var completeForm = document.createElement("form");
+        completeForm.method = "POST";
+        completeForm.action = "/user/completeTask";
+        completeForm.className = "complete-form";
+        completeForm.appendChild(hiddenInput("TaskID", task.taskId));
+        completeForm.appendChild(hiddenInput("completed", ""));
+        completeForm.appendChild(hiddenInput("csrf_token", csrfToken));
+        var completeButton = document.createElement("button");
+        completeButton.type = "submit";
+        completeButton.className = "complete";
+        completeButton.setAttribute("aria-label", "Toggle task completion");
+        completeForm.appendChild(completeButton);
+
+        var link = document.createElement("a");
+        link.className = "task-link";
+        link.href = "/user/task/" + task.taskId;
+
+        var select = document.createElement("input");
+        select.type = "checkbox";
+        select.name = "TaskID";
+        select.value = task.taskId;
+        select.className = "select-task";
+        select.setAttribute("form", "bulkForm");
+        select.setAttribute("aria-label", "Select task");
+
+        var deleteForm = document.createElement("form");
+        deleteForm.method = "POST";
+        deleteForm.action = "/user/deleteTask";
+        deleteForm.appendChild(hiddenInput("TaskID", task.taskId));
+        deleteForm.appendChild(hiddenInput("csrf_token", csrfToken));
+        var deleteButton = document.createElement("button");
+        deleteButton.type = "submit";
+        deleteButton.className = "close";
+        deleteButton.setAttribute("aria-label", "Delete task");
+        deleteButton.textContent = " X";
+        deleteForm.appendChild(deleteButton);
+
+        li.appendChild(completeForm);
+        li.appendChild(link);
+        li.appendChild(select);
+        li.appendChild(deleteForm);
+        applyTask(li, task);
+        return li;
+    }
+
+    function hiddenInput(name, value) {
+        var input = document.createElement("input");
+        input.type = "hidden";
+        input.name = name;
+        input.value = value;
+        return input;
+    }
+
+    // Copies the state of the task into an existing list item
+    function applyTask(li, task) {
+        li.querySelector(".task-link").textContent = task.description;
+        li.classList.toggle("checked", task.isCompleted);
+        li.querySelector(".complete-form input[name=completed]").value = task.isCompleted ? "false" : "true";
+    }
+
+    function findTask(taskId) {
+        return list.querySelector('li[data-task-id="' + taskId + '"]');
+    }
+
+    function refreshEmptyMessage() {
+        if (noTasks) {
+            noTasks.hidden = list.children.length > 0;
+        }
+    }
+
+    // Used by offlineSync.js to patch the list from local data
+    window.TaskList = {
+        upsert: function(task) {
+            var li = findTask(task.taskId);
+            if (li) {
+                applyTask(li, task);
+            } else {
+                list.appendChild(renderTask(task));
+            }
+            refreshEmptyMessage();
+        },
+        remove: function(taskId) {
+            var li = findTask(taskId);
+            if (li) {
+                li.remove();
+            }
+            refreshEmptyMessage();
+        },
+        replaceAll: function(tasks) {
+            list.innerHTML = "";
+            tasks.forEach(function(task) {
+                list.appendChild(renderTask(task));
+            });
+            refreshEmptyMessage();
+        }
+    };
+
+    function onChange(ev) {
+        var data = JSON.parse(ev.data);
+        var li = findTask(data.taskId);
+
+        if (data.type === "delete") {
+            if (li) {
+                li.remove();
+            }
+        } else if (li) {
+            applyTask(li, data.task);
+        } else {
+            list.appendChild(renderTask(data.task));
+        }
+
+        refreshEmptyMessage();
+    }
+
+    // "Select all" of the bulk bar
+    var selectAll = document.getElementById("selectAll");
+    if (selectAll) {
+        selectAll.addEventListener("change", function() {
+            list.querySelectorAll(".select-task").forEach(function(box) {
+                box.checked = selectAll.checked;
+            });
+        });
+    }
+
+    if (!window.EventSource) {
+        return;
+    }
+
+    var source = new EventSource("/user/events");
+    ["create", "update", "complete", "delete"].forEach(function(type) {
+        source.addEventListener(type, onChange);
+    });
+});